@@ -1,61 +1,242 @@
 package rmq
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	requeueTickDuration   = 10 * time.Millisecond
+	recoveryAttempts      = 3                      // how often returning an unacked delivery gets tried
+	recoveryRetryDuration = 100 * time.Millisecond // how long to wait before trying again
+	cleanerLockTTL        = time.Minute            // how long the cleaner lock stays taken if the cleaner crashed
+)
+
+// CleanerConfig holds optional settings of a Cleaner
+type CleanerConfig struct {
+	// MaxRequeueRate limits how many unacked deliveries of dead connections
+	// get returned to ready per second, so downstreams aren't overwhelmed
+	// after a big consumer died. 0 means no limit.
+	MaxRequeueRate int
+	// TagFilter restricts the cleaner to connections opened with this tag,
+	// so for example each team can clean up after its own services. Other
+	// tags starting with it don't match. Cleaners still take turns, see
+	// Cleaner.Clean. Empty means all connections.
+	TagFilter string
+}
 
 type Cleaner struct {
 	connection Connection
+	config     CleanerConfig
 }
 
 func NewCleaner(connection Connection) *Cleaner {
 	return &Cleaner{connection: connection}
 }
 
-func (cleaner *Cleaner) Clean() error {
+// NewCleanerWithConfig is like NewCleaner, but with custom settings
+func NewCleanerWithConfig(connection Connection, config CleanerConfig) *Cleaner {
+	return &Cleaner{connection: connection, config: config}
+}
+
+// Clean returns the unacked deliveries of all dead connections back to ready
+// and removes those connections. Of connections which are still alive it only
+// returns the deliveries whose lease expired, see Queue.SetLeaseDuration. It
+// returns the number of returned deliveries. Only one cleaner runs at a time,
+// even across processes, so several processes can run a cleaner for
+// redundancy. The others return ErrCleanerRunning meanwhile.
+func (cleaner *Cleaner) Clean() (returned int, err error) {
 	cleanerConnection, ok := cleaner.connection.(*redisConnection)
 	if !ok {
-		return nil
+		return 0, nil
+	}
+
+	lock, err := acquireLock(cleanerConnection.redisClient, cleanerConnection.key(cleanerLockKey), cleanerLockTTL)
+	if err == ErrLockTaken {
+		return 0, ErrCleanerRunning
 	}
-	connectionNames := cleanerConnection.GetConnections()
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Release()
+
+	connectionNames, err := cleanerConnection.GetConnectionsE()
+	if err != nil {
+		return 0, err
+	}
+
+	var firstErr error
 	for _, connectionName := range connectionNames {
+		if cleaner.config.TagFilter != "" && connectionTag(connectionName) != cleaner.config.TagFilter {
+			continue
+		}
 		connection := cleanerConnection.hijackConnection(connectionName)
+		var connectionReturned int
 		if connection.Check() {
-			continue // skip active connections!
+			connectionReturned, err = returnExpiredLeases(connection) // keep the rest of active connections!
+		} else {
+			connectionReturned, err = cleanConnection(connection, cleaner.config)
 		}
-
-		if err := CleanConnection(connection); err != nil {
-			return err
+		returned += connectionReturned
+		if connectionReturned > 0 {
+			cleanerConnection.emit(Event{Type: DeliveriesReclaimed, Connection: connectionName, Count: connectionReturned})
+		}
+		if err != nil {
+			// the connection stays registered, so the next run tries again
+			atomic.AddInt64(&cleanerConnection.recoveryFailures, 1)
+			cleanerConnection.logger.Printf("rmq cleaner failed to clean connection %s: %s", connectionName, err)
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
 
-	return nil
+	return returned, firstErr
+}
+
+// connectionTag returns the tag the connection was opened with, its name
+// without the dash and random token
+func connectionTag(connectionName string) string {
+	if i := strings.LastIndex(connectionName, "-"); i >= 0 {
+		return connectionName[:i]
+	}
+	return connectionName
 }
 
 func CleanConnection(connection *redisConnection) error {
-	queueNames := connection.GetConsumingQueues()
+	_, err := cleanConnection(connection, CleanerConfig{})
+	return err
+}
+
+func cleanConnection(connection *redisConnection, config CleanerConfig) (returned int, err error) {
+	queueNames, err := connection.GetConsumingQueuesE()
+	if err != nil {
+		return 0, err
+	}
 	for _, queueName := range queueNames {
 		queue, ok := connection.OpenQueue(queueName).(*redisQueue)
 		if !ok {
-			return fmt.Errorf("rmq cleaner failed to open queue %s", queueName)
+			return returned, fmt.Errorf("rmq cleaner failed to open queue %s", queueName)
 		}
 
-		CleanQueue(queue)
+		queueReturned, err := cleanQueue(queue, config.MaxRequeueRate)
+		returned += queueReturned
+		if err != nil {
+			return returned, err
+		}
 	}
 
 	if !connection.Close() {
-		return fmt.Errorf("rmq cleaner failed to close connection %s", connection)
+		return returned, fmt.Errorf("rmq cleaner failed to close connection %s", connection)
 	}
 
 	if err := connection.CloseAllQueuesInConnection(); err != nil {
-		return fmt.Errorf("rmq cleaner failed to close all queues %s %s", connection, err)
+		return returned, fmt.Errorf("rmq cleaner failed to close all queues %s %s", connection, err)
 	}
 
-	// log.Printf("rmq cleaner cleaned connection %s", connection)
-	return nil
+	// log.Printf("rmq cleaner cleaned connection %s %d", connection, returned)
+	return returned, nil
+}
+
+// returnExpiredLeases returns the deliveries whose lease expired of all queues
+// the connection is consuming
+func returnExpiredLeases(connection *redisConnection) (returned int, err error) {
+	queueNames, err := connection.GetConsumingQueuesE()
+	if err != nil {
+		return 0, err
+	}
+	for _, queueName := range queueNames {
+		queueReturned, err := connection.openQueue(queueName).returnExpiredLeases()
+		returned += queueReturned
+		if err != nil {
+			return returned, err
+		}
+	}
+	return returned, nil
 }
 
 func CleanQueue(queue *redisQueue) {
-	returned := queue.ReturnAllUnacked()
+	if _, err := cleanQueue(queue, 0); err != nil {
+		queue.logger().Printf("rmq cleaner failed to clean queue %s: %s", queue, err)
+	}
+}
+
+// cleanQueue returns the unacked deliveries of the queue and closes it. If
+// returning fails the queue stays open, so the unacked list doesn't get
+// deleted with deliveries left in it.
+func cleanQueue(queue *redisQueue, maxRequeueRate int) (returned int, err error) {
+	returned, err = returnUnackedPaced(queue, maxRequeueRate)
+	if err != nil {
+		return returned, err
+	}
 	queue.CloseInConnection()
-	_ = returned
 	// log.Printf("rmq cleaner cleaned queue %s %d", queue, returned)
+	return returned, nil
+}
+
+// returnUnackedPaced is like ReturnAllUnacked, but returns at most rate
+// deliveries per second, rate 0 means no limit. Failing redis calls get
+// retried a few times before giving up.
+func returnUnackedPaced(queue *redisQueue, rate int) (returned int, err error) {
+	count, err := queue.redisClient.LLen(queue.unackedKey)
+	if err != nil {
+		return 0, fmt.Errorf("rmq cleaner failed to count unacked %s: %w", queue, err)
+	}
+	if rate <= 0 {
+		return returnUnacked(queue, count)
+	}
+
+	tickDuration := requeueTickDuration
+	perTick := rate * int(tickDuration) / int(time.Second)
+	if perTick < 1 {
+		perTick = 1
+		tickDuration = time.Second / time.Duration(rate)
+	}
+
+	ticker := time.NewTicker(tickDuration)
+	defer ticker.Stop()
+	for {
+		batchSize := perTick
+		if batchSize > count-returned {
+			batchSize = count - returned
+		}
+		batchReturned, err := returnUnacked(queue, batchSize)
+		returned += batchReturned
+		if err != nil || batchReturned < batchSize || returned == count {
+			return returned, err
+		}
+		<-ticker.C
+	}
+}
+
+// returnUnacked returns up to count of the oldest unacked deliveries to the
+// ready list. It returns fewer if the unacked list runs empty.
+func returnUnacked(queue *redisQueue, count int) (returned int, err error) {
+	for returned < count {
+		err := retryRecovery(func() error {
+			_, err := queue.redisClient.RPopLPush(queue.unackedKey, queue.readyKey)
+			return err
+		})
+		if err == ErrNotFound {
+			return returned, nil
+		}
+		if err != nil {
+			return returned, fmt.Errorf("rmq cleaner failed to return unacked %s: %w", queue, err)
+		}
+		returned++
+	}
+	return returned, nil
+}
+
+// retryRecovery calls fn up to recoveryAttempts times until it returns no
+// error or ErrNotFound, which retrying wouldn't change
+func retryRecovery(fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt < recoveryAttempts && err != nil && err != ErrNotFound; attempt++ {
+		time.Sleep(recoveryRetryDuration)
+		err = fn()
+	}
+	return err
 }
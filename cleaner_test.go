@@ -1,6 +1,9 @@
 package rmq
 
 import (
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -118,7 +121,9 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 
 	cleanerConn := OpenConnection("cleaner-conn", "tcp", "localhost:6379", 1)
 	cleaner := NewCleaner(cleanerConn)
-	c.Check(cleaner.Clean(), IsNil)
+	returned, err := cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 6)
 	c.Check(queue.ReadyCount(), Equals, 9) // 2 of 11 were acked above
 	c.Check(conn.GetOpenQueues(), HasLen, 2)
 
@@ -135,6 +140,239 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 	conn.StopHeartbeat()
 	time.Sleep(time.Millisecond)
 
-	c.Check(cleaner.Clean(), IsNil)
+	_, err = cleaner.Clean()
+	c.Check(err, IsNil)
+	cleanerConn.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestMaxRequeueRate(c *C) {
+	conn := OpenConnection("cleaner-rate-conn", "tcp", "localhost:6379", 1)
+	queue := conn.OpenQueue("cleaner-rate-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(conn.redisClient.SAdd(conn.queuesKey, "cleaner-rate-q"), IsNil)
+	for i := 0; i < 1000; i++ {
+		c.Check(conn.redisClient.LPush(queue.unackedKey, fmt.Sprintf("cleaner-rate-d%d", i)), IsNil)
+	}
+	conn.StopHeartbeat() // dies with 1000 unacked deliveries
+
+	cleanerConn := OpenConnection("cleaner-rate-cleaner", "tcp", "localhost:6379", 1)
+	cleaner := NewCleanerWithConfig(cleanerConn, CleanerConfig{MaxRequeueRate: 10000})
+	start := time.Now()
+	returned, err := cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1000)
+	c.Check(time.Since(start) >= 80*time.Millisecond, Equals, true) // 100 per 10ms
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 1000)
+
+	queue.PurgeReady()
+	cleanerConn.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestTagFilter(c *C) {
+	redisClient := NewTestRedisClient()
+	queues := map[string]*redisQueue{}
+	for _, tag := range []string{"cleaner-filter-a", "cleaner-filter-ab", "cleaner-filter-a-b"} {
+		conn, err := openConnectionWithRedisClient(tag, redisClient, ConnectionConfig{})
+		c.Assert(err, IsNil)
+		queue := conn.OpenQueue(tag + "-q").(*redisQueue)
+		c.Check(conn.redisClient.SAdd(conn.queuesKey, queue.name), IsNil)
+		c.Check(conn.redisClient.LPush(queue.unackedKey, tag+"-d1"), IsNil)
+		time.Sleep(10 * time.Millisecond) // let the first heartbeat pass
+		conn.StopHeartbeat()
+		queues[tag] = queue
+	}
+
+	cleanerConn, err := openConnectionWithRedisClient("cleaner-filter-cleaner", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	cleaner := NewCleanerWithConfig(cleanerConn, CleanerConfig{TagFilter: "cleaner-filter-a"})
+	returned, err := cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queues["cleaner-filter-a"].ReadyCount(), Equals, 1)
+	c.Check(queues["cleaner-filter-ab"].UnackedCount(), Equals, 1) // tags starting with the filter don't match
+	c.Check(queues["cleaner-filter-a-b"].UnackedCount(), Equals, 1)
+	c.Check(cleanerConn.GetConnections(), HasLen, 3)
+
+	// without filter all connections get cleaned
+	returned, err = NewCleaner(cleanerConn).Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	c.Check(queues["cleaner-filter-ab"].ReadyCount(), Equals, 1)
+	c.Check(queues["cleaner-filter-a-b"].ReadyCount(), Equals, 1)
+	c.Check(cleanerConn.GetConnections(), HasLen, 1)
+
+	cleanerConn.StopHeartbeat()
+}
+
+// failingRedisClient fails the given number of RPopLPush calls, -1 fails all
+type failingRedisClient struct {
+	*TestRedisClient
+	failures int32
+}
+
+func (client *failingRedisClient) RPopLPush(source, destination string) (string, error) {
+	if failures := atomic.LoadInt32(&client.failures); failures != 0 {
+		if failures > 0 {
+			atomic.AddInt32(&client.failures, -1)
+		}
+		return "", errors.New("connection refused")
+	}
+	return client.TestRedisClient.RPopLPush(source, destination)
+}
+
+func (suite *CleanerSuite) TestRecoveryFailures(c *C) {
+	redisClient := &failingRedisClient{TestRedisClient: NewTestRedisClient()}
+	conn, err := openConnectionWithRedisClient("cleaner-fail-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	queue := conn.OpenQueue("cleaner-fail-q").(*redisQueue)
+	c.Check(conn.redisClient.SAdd(conn.queuesKey, "cleaner-fail-q"), IsNil)
+	c.Check(conn.redisClient.LPush(queue.unackedKey, "cleaner-fail-d1", "cleaner-fail-d2"), IsNil)
+	time.Sleep(10 * time.Millisecond) // let the first heartbeat pass
+	conn.StopHeartbeat()
+
+	logger := &recordingLogger{}
+	cleanerConn, err := openConnectionWithRedisClient("cleaner-fail-cleaner", redisClient, ConnectionConfig{Logger: logger})
+	c.Assert(err, IsNil)
+	cleaner := NewCleaner(cleanerConn)
+
+	// unacked deliveries stay if redis keeps failing
+	atomic.StoreInt32(&redisClient.failures, -1)
+	returned, err := cleaner.Clean()
+	c.Check(err, NotNil)
+	c.Check(returned, Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(cleanerConn.GetConnections(), HasLen, 2)
+	c.Check(logger.Messages(), HasLen, 1)
+	c.Check(CollectStats([]string{"cleaner-fail-q"}, cleanerConn).RecoveryFailures, Equals, int64(1))
+
+	// short failures get retried
+	atomic.StoreInt32(&redisClient.failures, 2)
+	returned, err = cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(cleanerConn.GetConnections(), HasLen, 1)
+	c.Check(CollectStats([]string{"cleaner-fail-q"}, cleanerConn).RecoveryFailures, Equals, int64(1))
+
+	cleanerConn.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestCleanerLock(c *C) {
+	redisClient := NewTestRedisClient()
+	conn, err := openConnectionWithRedisClient("cleaner-lock-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	queue := conn.OpenQueue("cleaner-lock-q").(*redisQueue)
+	c.Check(conn.redisClient.SAdd(conn.queuesKey, "cleaner-lock-q"), IsNil)
+	c.Check(conn.redisClient.LPush(queue.unackedKey, "cleaner-lock-d1"), IsNil)
+	time.Sleep(10 * time.Millisecond) // let the first heartbeat pass
+	conn.StopHeartbeat()
+
+	cleanerConn, err := openConnectionWithRedisClient("cleaner-lock-cleaner", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	cleaner := NewCleaner(cleanerConn)
+
+	// another cleaner is running
+	lock, err := acquireLock(redisClient, cleanerLockKey, time.Minute)
+	c.Assert(err, IsNil)
+	returned, err := cleaner.Clean()
+	c.Check(err, Equals, ErrCleanerRunning)
+	c.Check(returned, Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	c.Check(lock.Release(), IsNil)
+	returned, err = cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	// the lock gets released after cleaning
+	returned, err = cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 0)
+
+	cleanerConn.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestLeases(c *C) {
+	redisClient := NewTestRedisClient()
+	conn, err := openConnectionWithRedisClient("cleaner-lease-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	queue := conn.OpenQueue("cleaner-lease-q").(*redisQueue)
+	queue.SetLeaseDuration(50 * time.Millisecond)
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("cleaner-lease-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("cleaner-lease-cons", consumer)
+
+	c.Check(queue.Publish("cleaner-lease-d1", "cleaner-lease-d2"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	queue.PauseConsuming() // don't fetch returned deliveries again
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	touched, expired := consumer.LastDeliveries[0], consumer.LastDeliveries[1]
+	c.Check(touched.Payload(), Equals, "cleaner-lease-d1")
+
+	cleanerConn, err := openConnectionWithRedisClient("cleaner-lease-cleaner", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	cleaner := NewCleaner(cleanerConn)
+
+	time.Sleep(30 * time.Millisecond)
+	c.Check(touched.Touch(), IsNil)
+	returned, err := cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 0) // no lease expired yet
+
+	time.Sleep(40 * time.Millisecond)
+	returned, err = cleaner.Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(expired.Touch(), Equals, ErrLeaseExpired)
+	c.Check(expired.Ack(), Equals, false)
+	c.Check(conn.Check(), Equals, true) // the connection is still alive
+
+	c.Check(touched.Ack(), Equals, true)
+	c.Check(touched.Touch(), Equals, ErrLeaseExpired) // released on ack
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	<-queue.StopConsuming()
+	conn.StopHeartbeat()
+	cleanerConn.StopHeartbeat()
+}
+
+func (suite *CleanerSuite) TestLeasesOfEqualPayloads(c *C) {
+	conn := OpenConnection("cleaner-lease-eq-conn", "tcp", "localhost:6379", 1)
+	queue := conn.OpenQueue("cleaner-lease-eq-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.SetLeaseDuration(50 * time.Millisecond)
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("cleaner-lease-eq-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("cleaner-lease-eq-cons", consumer)
+
+	c.Check(queue.Publish("cleaner-lease-eq-d", "cleaner-lease-eq-d"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	queue.PauseConsuming()
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+
+	// each delivery has a lease of its own
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[0].Touch(), Equals, ErrLeaseExpired)
+	c.Check(consumer.LastDeliveries[1].Touch(), IsNil)
+
+	cleanerConn := OpenConnection("cleaner-lease-eq-cleaner", "tcp", "localhost:6379", 1)
+	time.Sleep(60 * time.Millisecond)
+	returned, err := NewCleaner(cleanerConn).Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	<-queue.StopConsuming()
+	queue.PurgeReady()
+	conn.StopHeartbeat()
 	cleanerConn.StopHeartbeat()
 }
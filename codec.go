@@ -0,0 +1,138 @@
+package rmq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Codec encodes values to payloads and decodes them again, see Queue.SetCodec
+type Codec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte, value interface{}) error
+}
+
+// RawCodec is the default codec. It passes payloads through unchanged, so it
+// only encodes strings and byte slices and only decodes into pointers to them.
+type RawCodec struct{}
+
+func (RawCodec) Encode(value interface{}) ([]byte, error) {
+	switch value := value.(type) {
+	case string:
+		return []byte(value), nil
+	case []byte:
+		return value, nil
+	default:
+		return nil, fmt.Errorf("rmq raw codec can't encode %T", value)
+	}
+}
+
+func (RawCodec) Decode(data []byte, value interface{}) error {
+	switch value := value.(type) {
+	case *string:
+		*value = string(data)
+	case *[]byte:
+		*value = append([]byte(nil), data...)
+	default:
+		return fmt.Errorf("rmq raw codec can't decode into %T", value)
+	}
+	return nil
+}
+
+// JSONCodec encodes values as JSON
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec) Decode(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+// GobCodec encodes values with encoding/gob. Each payload carries its own type
+// information, so it's larger than with a gob stream.
+type GobCodec struct{}
+
+func (GobCodec) Encode(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// gzipCodec compresses the payloads of another codec
+type gzipCodec struct {
+	codec Codec
+}
+
+// NewGzipCodec returns a codec which compresses the payloads encoded by codec
+// with gzip, for example NewGzipCodec(JSONCodec{}) for large JSON payloads
+func NewGzipCodec(codec Codec) Codec {
+	return gzipCodec{codec: codec}
+}
+
+func (codec gzipCodec) Encode(value interface{}) ([]byte, error) {
+	data, err := codec.codec.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (codec gzipCodec) Decode(data []byte, value interface{}) error {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	data, err = ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return codec.codec.Decode(data, value)
+}
+
+// SetCodec sets the codec which PublishValue and Delivery.Decode use, the
+// default is RawCodec. Consumers of the queue need the same codec as its
+// producers.
+func (queue *redisQueue) SetCodec(codec Codec) {
+	queue.codec = codec
+}
+
+// PublishValue adds a delivery with the value encoded by the queue's codec,
+// see SetCodec. Returns an error like PublishE.
+func (queue *redisQueue) PublishValue(value interface{}) error {
+	data, err := queue.codec.Encode(value)
+	if err != nil {
+		return fmt.Errorf("rmq queue failed to encode %s: %w", queue, err)
+	}
+	return queue.PublishE(string(data))
+}
+
+// Decode decodes the payload into value with the codec of the consuming
+// queue, see Queue.SetCodec
+func (delivery *wrapDelivery) Decode(value interface{}) error {
+	if err := delivery.codec.Decode([]byte(delivery.payload), value); err != nil {
+		return fmt.Errorf("rmq delivery failed to decode %s: %w", delivery, err)
+	}
+	return nil
+}
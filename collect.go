@@ -0,0 +1,126 @@
+package rmq
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// collected is the state of queues and connections read by collect,
+// CollectStats and Overview build on it
+type collected struct {
+	queues      []collectedQueue
+	connections []collectedConnection
+}
+
+// collectedQueue holds the counts of a queue
+type collectedQueue struct {
+	name           string
+	readyCount     int // without deliveries with priorities
+	rejectedCount  int
+	priorityCounts map[int]int // ready counts by priority, nil without priorities
+}
+
+// collectedConnection holds the state of a connection
+type collectedConnection struct {
+	name     string
+	active   bool                               // whether the heartbeat is alive
+	queues   []string                           // the queues the connection is consuming, sorted
+	consumed map[string]*collectedConsumedQueue // by queue name, only for the queues which were read
+}
+
+// collectedConsumedQueue holds the counts of a queue on a connection
+type collectedConsumedQueue struct {
+	unackedCount int
+	consumers    []string
+}
+
+// collect reads the counts of the queues and the state of all connections in
+// three pipelined batches, so the number of round-trips doesn't grow with the
+// number of queues and connections. With allQueues it reads all registered
+// queues instead of queueNames and the counts of all queues the connections
+// consume, otherwise only those of queueNames. On redis errors it keeps
+// reading and returns the first error, the affected counts stay 0 then.
+func (connection *redisConnection) collect(queueNames []string, allQueues bool) (collected, error) {
+	var firstErr error
+	exec := func(pipeline Pipeline) {
+		if err := pipeline.Exec(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// the connections, and the queues if needed
+	var connectionNames []string
+	pipeline := connection.redisClient.Pipeline()
+	if allQueues {
+		pipeline.SMembers(connection.key(queuesKey), &queueNames)
+	}
+	pipeline.SMembers(connection.key(connectionsKey), &connectionNames)
+	exec(pipeline)
+
+	// queue counts and priorities, and heartbeats and consumed queues of the connections
+	queues := make([]collectedQueue, len(queueNames))
+	priorities := make([][]string, len(queueNames))
+	for i, name := range queueNames {
+		queues[i].name = name
+		pipeline.LLen(connection.queueKey(queueReadyTemplate, name), &queues[i].readyCount)
+		pipeline.LLen(connection.queueKey(queueRejectedTemplate, name), &queues[i].rejectedCount)
+		pipeline.SMembers(connection.queueKey(queuePrioritiesTemplate, name), &priorities[i])
+	}
+	connections := make([]collectedConnection, len(connectionNames))
+	ttls := make([]time.Duration, len(connectionNames))
+	for i, name := range connectionNames {
+		hijacked := connection.hijackConnection(name)
+		connections[i].name = name
+		pipeline.TTL(hijacked.heartbeatKey, &ttls[i])
+		pipeline.SMembers(hijacked.queuesKey, &connections[i].queues)
+	}
+	exec(pipeline)
+
+	// priority counts, and unacked deliveries and consumers of the consumed queues
+	priorityCounts := make([][]int, len(queueNames))
+	for i, name := range queueNames {
+		priorityCounts[i] = make([]int, len(priorities[i]))
+		for j, member := range priorities[i] {
+			if priority, err := strconv.Atoi(member); err != nil || priority <= 0 {
+				continue
+			}
+			priorityKey := strings.Replace(connection.queueKey(queuePriorityTemplate, name), phPriority, member, 1)
+			pipeline.LLen(priorityKey, &priorityCounts[i][j])
+		}
+	}
+	wanted := make(map[string]bool, len(queueNames))
+	for _, name := range queueNames {
+		wanted[name] = true
+	}
+	for i := range connections {
+		connections[i].active = ttls[i] > 0
+		sort.Strings(connections[i].queues)
+		connections[i].consumed = map[string]*collectedConsumedQueue{}
+		hijacked := connection.hijackConnection(connections[i].name)
+		for _, queueName := range connections[i].queues {
+			if !allQueues && !wanted[queueName] {
+				continue
+			}
+			queue := hijacked.openQueue(queueName)
+			consumed := &collectedConsumedQueue{consumers: []string{}}
+			pipeline.LLen(queue.unackedKey, &consumed.unackedCount)
+			pipeline.SMembers(queue.consumersKey, &consumed.consumers)
+			connections[i].consumed[queueName] = consumed
+		}
+	}
+	exec(pipeline)
+
+	for i := range queues {
+		for j, member := range priorities[i] {
+			if priority, err := strconv.Atoi(member); err == nil && priority > 0 {
+				if queues[i].priorityCounts == nil {
+					queues[i].priorityCounts = map[int]int{}
+				}
+				queues[i].priorityCounts[priority] = priorityCounts[i][j]
+			}
+		}
+	}
+	return collected{queues: queues, connections: connections}, firstErr
+}
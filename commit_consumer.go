@@ -0,0 +1,76 @@
+package rmq
+
+import "fmt"
+
+// removes each delivery (ARGV) from the unacked list (KEYS[1]) and only for
+// the removed ones deletes their counts from the hashes (KEYS[2..]), returns
+// 1 for each removed delivery and 0 for the others
+const ackManyScript = `
+local removed = {}
+for i, value in ipairs(ARGV) do
+	removed[i] = redis.call("LREM", KEYS[1], 1, value)
+	if removed[i] == 1 then
+		for j = 2, #KEYS do
+			redis.call("HDEL", KEYS[j], value)
+		end
+	end
+end
+return removed
+`
+
+// CommitConsumer is a consumer which doesn't ack deliveries one by one.
+// Instead it calls commit to ack all deliveries it got since the last commit
+// at once. Uncommitted deliveries stay unacked, so if the consumer crashes
+// the cleaner returns them to ready.
+type CommitConsumer interface {
+	Consume(delivery Delivery, commit CommitFunc)
+}
+
+type CommitConsumerFunc func(Delivery, CommitFunc)
+
+func (consumerFunc CommitConsumerFunc) Consume(delivery Delivery, commit CommitFunc) {
+	consumerFunc(delivery, commit)
+}
+
+// CommitFunc acks all deliveries passed to the consumer since the last commit
+// in a single redis call. Deliveries which were acked or rejected in between
+// are skipped.
+type CommitFunc func() error
+
+// committer keeps track of the uncommitted deliveries of a single consumer
+type committer struct {
+	queue       *redisQueue
+	uncommitted []*wrapDelivery
+}
+
+func (committer *committer) add(delivery *wrapDelivery) {
+	committer.uncommitted = append(committer.uncommitted, delivery)
+}
+
+func (committer *committer) commit() error {
+	if len(committer.uncommitted) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, len(committer.uncommitted))
+	for i, delivery := range committer.uncommitted {
+		values[i] = delivery.value
+	}
+
+	// all deliveries come from the same queue, so they share the count keys
+	keys := append([]string{committer.queue.unackedKey}, committer.uncommitted[0].countKeys()...)
+	result, err := runScript(committer.queue.redisClient, ackManyScript, keys, values...)
+	if err != nil {
+		return fmt.Errorf("rmq queue failed to commit deliveries %s %d: %w", committer.queue, len(values), err)
+	}
+
+	// the others were acked, rejected or pushed in between and released then
+	removed, _ := result.([]interface{})
+	for i, delivery := range committer.uncommitted {
+		if i < len(removed) && removed[i] == int64(1) {
+			delivery.release()
+		}
+	}
+	committer.uncommitted = committer.uncommitted[:0]
+	return nil
+}
@@ -3,82 +3,353 @@ package rmq
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/adjust/uniuri"
 	"github.com/go-redis/redis/v7"
 )
 
-const heartbeatDuration = time.Minute
+const (
+	defaultHeartbeatInterval = time.Second
+	defaultHeartbeatTTL      = time.Minute
+	pingTimeout              = time.Second // max time Ping waits for redis to answer
+)
+
+// ConnectionConfig holds settings for OpenConnectionWithConfig. Zero values
+// get replaced by the defaults.
+type ConnectionConfig struct {
+	// HeartbeatInterval is how often the heartbeat key gets refreshed,
+	// defaults to one second
+	HeartbeatInterval time.Duration
+	// HeartbeatTTL is how long the heartbeat key lives without being
+	// refreshed. The cleaner considers a connection dead after that time and
+	// returns its unacked deliveries. Defaults to one minute
+	HeartbeatTTL time.Duration
+	// Logger gets problems like failing heartbeats, defaults to the standard
+	// log package
+	Logger Logger
+	// DebugLogger gets verbose messages like heartbeat updates, off by
+	// default
+	DebugLogger Logger
+	// HeartbeatLogInterval is how often heartbeat updates get logged to the
+	// DebugLogger, independent of how often the heartbeat gets refreshed. It
+	// gets rounded to a multiple of HeartbeatInterval. Defaults to logging
+	// every update, negative values turn the log off
+	HeartbeatLogInterval time.Duration
+	// OnHeartbeatLost gets called after each failed heartbeat update with the
+	// number of consecutive failures, for example to fail a readiness probe.
+	// After a failure the next update waits twice as long as the one before,
+	// up to a third of HeartbeatTTL. It's called from the heartbeat goroutine,
+	// so it shouldn't block. Optional
+	OnHeartbeatLost func(consecutiveFailures int)
+	// OnHeartbeatRestored gets called once the heartbeat got updated again
+	// after failures. Optional
+	OnHeartbeatRestored func()
+	// Namespace gets prepended to all keys of the connection, so several
+	// applications can share a redis database without seeing each other's
+	// queues, connections or cleaner. Empty by default, which keeps the keys
+	// as they are
+	Namespace string
+}
+
+func (config ConnectionConfig) withDefaults() ConnectionConfig {
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if config.HeartbeatTTL == 0 {
+		config.HeartbeatTTL = defaultHeartbeatTTL
+	}
+	if config.Logger == nil {
+		config.Logger = stdLogger{}
+	}
+	if config.DebugLogger == nil {
+		config.DebugLogger = noopLogger{}
+	}
+	return config
+}
+
+// validate makes sure a connection gets at least a few heartbeats per TTL, so
+// a single slow heartbeat doesn't make it look dead
+func (config ConnectionConfig) validate() error {
+	if config.HeartbeatInterval < 0 || config.HeartbeatTTL < 0 {
+		return fmt.Errorf("rmq connection config has negative heartbeat durations %s %s", config.HeartbeatInterval, config.HeartbeatTTL)
+	}
+	if config.HeartbeatInterval*3 > config.HeartbeatTTL {
+		return fmt.Errorf("rmq connection config heartbeat interval %s must be at most a third of heartbeat ttl %s", config.HeartbeatInterval, config.HeartbeatTTL)
+	}
+	return nil
+}
+
+// heartbeatLogTicks returns after how many heartbeat updates one gets logged,
+// 0 for never
+func (config ConnectionConfig) heartbeatLogTicks() int {
+	if config.HeartbeatLogInterval < 0 {
+		return 0
+	}
+	ticks := int((config.HeartbeatLogInterval + config.HeartbeatInterval/2) / config.HeartbeatInterval)
+	if ticks < 1 {
+		return 1
+	}
+	return ticks
+}
 
 // Connection is an interface that can be used to test publishing
 type Connection interface {
 	OpenQueue(name string) Queue
+	OpenQueueWithPriorities(name string, priorities int) Queue
+	OpenTopic(name string) Topic
+	StartConsumingMulti(queues []Queue, prefetchLimit int, pollDuration time.Duration) (MultiQueue, error)
+	RegisterQueue(name string) bool
+	SetAutoRegisterQueues(enabled bool)
 	CollectStats(queueList []string) Stats
+	Overview() (Overview, error)
 	GetOpenQueues() []string
+	GetOpenQueuesE() ([]string, error)
+	DiscoverQueues() ([]string, error)
+	QueueExists(name string) (bool, error)
+	GetConsumingQueuesFor(connectionName string) ([]string, error)
+	OpenConnectionForInspection(name string) Connection
+	QueuesWithoutConsumers() ([]string, error)
+	ReturnUnackedOf(connectionName string) (returned int, err error)
+	Events() <-chan Event
+	DroppedEvents() int64
+	DeleteQueue(name string) error
+	ForceDeleteQueue(name string) error
+	AcquireLock(name string, ttl time.Duration) (Lock, error)
+	Verify() (VerifyReport, error)
+	Repair(report VerifyReport) (fixed int, err error)
+	Ping() error
+	StopAllConsuming() <-chan struct{}
 }
 
 // Connection is the entry point. Use a connection to access queues, consumers and deliveries
 // Each connection has a single heartbeat shared among all consumers
+// It's safe for concurrent use: all fields but the int32 flags and the
+// consuming queues are only set on creation
 type redisConnection struct {
-	Name             string
-	heartbeatKey     string // key to keep alive
-	queuesKey        string // key to list of queues consumed by this connection
-	redisClient      RedisClient
-	heartbeatStopped bool
+	Name                 string
+	namespace            string // prepended to all keys, empty for none
+	heartbeatKey         string // key to keep alive
+	queuesKey            string // key to list of queues consumed by this connection
+	redisClient          RedisClient
+	heartbeatInterval    time.Duration                 // how often to refresh the heartbeat key
+	heartbeatTTL         time.Duration                 // expiration of the heartbeat key
+	heartbeatLogTicks    int                           // log every that many heartbeat updates, 0 for never
+	onHeartbeatLost      func(consecutiveFailures int) // nil for none
+	onHeartbeatRestored  func()                        // nil for none
+	logger               Logger
+	debugLogger          Logger
+	heartbeatStopped     int32         // heartbeat status, 1 for stopped, 0 for running
+	stopHeartbeat        chan struct{} // closed to stop the heartbeat goroutine, nil without one
+	heartbeatDone        chan struct{} // closed once the heartbeat goroutine returned
+	skipQueueRegister    int32         // 1 if OpenQueue doesn't add queues to the set of open queues
+	inspectionOnly       bool          // true for OpenConnectionForInspection, which mustn't change the connection
+	recoveryFailures     int64         // how often a cleaner using this connection failed to return unacked deliveries
+	consumingMutex       sync.Mutex
+	consumingQueues      []*redisQueue      // queues which started consuming, see StopAllConsuming
+	consumingMultiQueues []*redisMultiQueue // multi queues which started consuming, see StopAllConsuming
+	events               chan Event         // see Events, nil for hijacked connections
+	droppedEvents        int64              // events dropped because events was full
 }
 
 // OpenConnectionWithRedisClient opens and returns a new connection
+// It panics if redis can't be reached, see OpenConnectionWithRedisClientE
 func OpenConnectionWithRedisClient(tag string, redisClient *redis.Client) *redisConnection {
-	return openConnectionWithRedisClient(tag, RedisWrapper{redisClient})
+	connection, err := openConnectionWithRedisClient(tag, RedisWrapper{redisClient}, ConnectionConfig{})
+	if err != nil {
+		log.Panic(err)
+	}
+	return connection
+}
+
+// OpenConnectionWithRedisClientE opens and returns a new connection
+// It returns an error instead of panicking if redis can't be reached, so
+// callers can retry later
+func OpenConnectionWithRedisClientE(tag string, redisClient *redis.Client) (Connection, error) {
+	connection, err := openConnectionWithRedisClient(tag, RedisWrapper{redisClient}, ConnectionConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return connection, nil
 }
 
 // OpenConnectionWithTestRedisClient opens and returns a new connection which
 // uses a test redis client internally. This is useful in integration tests.
 func OpenConnectionWithTestRedisClient(tag string) *redisConnection {
-	return openConnectionWithRedisClient(tag, NewTestRedisClient())
+	connection, err := openConnectionWithRedisClient(tag, NewTestRedisClient(), ConnectionConfig{})
+	if err != nil {
+		log.Panic(err)
+	}
+	return connection
+}
+
+// OpenConnectionWithConfig opens and returns a new connection with custom
+// heartbeat settings. Lower values than the defaults let the cleaner return
+// the unacked deliveries of dead consumers sooner.
+func OpenConnectionWithConfig(tag string, redisClient *redis.Client, config ConnectionConfig) (Connection, error) {
+	connection, err := openConnectionWithRedisClient(tag, RedisWrapper{redisClient}, config)
+	if err != nil {
+		return nil, err
+	}
+	return connection, nil
 }
 
-func openConnectionWithRedisClient(tag string, redisClient RedisClient) *redisConnection {
+func openConnectionWithRedisClient(tag string, redisClient RedisClient, config ConnectionConfig) (*redisConnection, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	// check first to fail with a clear error if redis can't be reached
+	if err := redisClient.Ping(); err != nil {
+		return nil, fmt.Errorf("rmq connection failed to connect %s: %w", tag, err)
+	}
+
 	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
 
 	connection := &redisConnection{
-		Name:         name,
-		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
-		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
-		redisClient:  redisClient,
+		Name:                name,
+		namespace:           config.Namespace,
+		heartbeatKey:        strings.Replace(namespaced(config.Namespace, connectionHeartbeatTemplate), phConnection, name, 1),
+		queuesKey:           strings.Replace(namespaced(config.Namespace, connectionQueuesTemplate), phConnection, name, 1),
+		redisClient:         redisClient,
+		heartbeatInterval:   config.HeartbeatInterval,
+		heartbeatTTL:        config.HeartbeatTTL,
+		heartbeatLogTicks:   config.heartbeatLogTicks(),
+		onHeartbeatLost:     config.OnHeartbeatLost,
+		onHeartbeatRestored: config.OnHeartbeatRestored,
+		logger:              config.Logger,
+		debugLogger:         config.DebugLogger,
+		stopHeartbeat:       make(chan struct{}),
+		heartbeatDone:       make(chan struct{}),
+		events:              make(chan Event, eventBufferSize),
 	}
 
-	if !connection.updateHeartbeat() { // checks the connection
-		log.Panicf("rmq connection failed to update heartbeat %s", connection)
+	if err := connection.updateHeartbeat(); err != nil { // checks the connection
+		return nil, fmt.Errorf("rmq connection failed to update heartbeat %s: %w", connection, err)
 	}
 
 	// add to connection set after setting heartbeat to avoid race with cleaner
-	redisClient.SAdd(connectionsKey, name)
+	if err := redisClient.SAdd(namespaced(config.Namespace, connectionsKey), name); err != nil {
+		return nil, fmt.Errorf("rmq connection failed to register %s: %w", connection, err)
+	}
 
+	connection.debugLogger.Printf("rmq connection connected %s", connection)
+	connection.emit(Event{Type: ConnectionOpened})
+	// only start the heartbeat once we know redis is reachable
 	go connection.heartbeat()
-	// log.Printf("rmq connection connected to %s %s:%s %d", name, network, address, db)
-	return connection
+	return connection, nil
 }
 
 // OpenConnection opens and returns a new connection
+// It panics if redis can't be reached, see OpenConnectionE
 func OpenConnection(tag, network, address string, db int) *redisConnection {
-	redisClient := redis.NewClient(&redis.Options{
+	return OpenConnectionWithRedisClient(tag, newRedisClient(network, address, db))
+}
+
+// OpenConnectionE opens and returns a new connection
+// It returns an error instead of panicking if redis can't be reached, so
+// callers can retry later
+func OpenConnectionE(tag, network, address string, db int) (Connection, error) {
+	return OpenConnectionWithRedisClientE(tag, newRedisClient(network, address, db))
+}
+
+// OpenConnectionFromURL opens and returns a new connection to the redis
+// server at the given URL like redis://:password@localhost:6379/1, rediss://
+// URLs connect via TLS. It returns an error if the URL is invalid or redis
+// can't be reached.
+func OpenConnectionFromURL(tag, url string) (Connection, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("rmq connection failed to parse url %s: %w", tag, err)
+	}
+	return OpenConnectionWithRedisClientE(tag, redis.NewClient(options))
+}
+
+// OpenConnectionWithSentinel opens and returns a new connection to the
+// current master of a redis sentinel setup, which keeps working after a
+// failover. It panics if redis can't be reached, to get an error instead pass
+// a redis.NewFailoverClient to OpenConnectionWithRedisClientE
+func OpenConnectionWithSentinel(tag, masterName string, sentinelAddrs []string, db int, password string) *redisConnection {
+	redisClient := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    masterName,
+		SentinelAddrs: sentinelAddrs,
+		DB:            db,
+		Password:      password,
+	})
+	return OpenConnectionWithRedisClient(tag, redisClient)
+}
+
+func newRedisClient(network, address string, db int) *redis.Client {
+	return redis.NewClient(&redis.Options{
 		Network: network,
 		Addr:    address,
 		DB:      db,
 	})
-	return OpenConnectionWithRedisClient(tag, redisClient)
 }
 
 // OpenQueue opens and returns the queue with a given name
+// and registers it in the set of open queues unless disabled
 func (connection *redisConnection) OpenQueue(name string) Queue {
-	connection.redisClient.SAdd(queuesKey, name)
-	queue := newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
+	if atomic.LoadInt32(&connection.skipQueueRegister) == int32(0) {
+		connection.RegisterQueue(name)
+	}
+	queue := newQueue(name, connection.Name, connection.namespace, connection.queuesKey, connection.redisClient)
+	queue.connection = connection
+	return queue
+}
+
+// OpenQueueWithPriorities is like OpenQueue, but the returned queue supports
+// priorities from 0 (the default) to priorities-1, see
+// Queue.PublishWithPriority. Use the same number of priorities for
+// publishers and consumers of a queue. Returned unacked deliveries go back to
+// priority 0. Like the queue the priorities get registered unless disabled,
+// so that stats find their ready deliveries.
+func (connection *redisConnection) OpenQueueWithPriorities(name string, priorities int) Queue {
+	queue := connection.OpenQueue(name).(*redisQueue)
+	register := atomic.LoadInt32(&connection.skipQueueRegister) == int32(0)
+	prioritiesKey := strings.Replace(connection.key(queuePrioritiesTemplate), phQueue, name, 1)
+	for priority := 1; priority < priorities; priority++ {
+		priorityKey := strings.Replace(connection.key(queuePriorityTemplate), phQueue, name, 1)
+		queue.priorityKeys = append(queue.priorityKeys, strings.Replace(priorityKey, phPriority, strconv.Itoa(priority), 1))
+		if !register {
+			continue
+		}
+		if err := connection.redisClient.SAdd(prioritiesKey, strconv.Itoa(priority)); err != nil {
+			connection.logger.Printf("rmq connection failed to register priority %s %s %d: %s", connection, name, priority, err)
+		}
+	}
 	return queue
 }
 
+// RegisterQueue adds the queue to the set of open queues, which OpenQueue does
+// by default
+func (connection *redisConnection) RegisterQueue(name string) bool {
+	if err := connection.redisClient.SAdd(connection.key(queuesKey), name); err != nil {
+		connection.logger.Printf("rmq connection failed to register queue %s %s: %s", connection, name, err)
+		return false
+	}
+	return true
+}
+
+// SetAutoRegisterQueues controls whether OpenQueue registers the queue in the
+// set of open queues, which is enabled by default. Disabling it saves a redis
+// call per OpenQueue for producers which open queues often. Then queues don't
+// show up in GetOpenQueues and stats until they get registered with
+// RegisterQueue, or by a consumer opening them.
+func (connection *redisConnection) SetAutoRegisterQueues(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&connection.skipQueueRegister, 0)
+	} else {
+		atomic.StoreInt32(&connection.skipQueueRegister, 1)
+	}
+}
+
 func (connection *redisConnection) CollectStats(queueList []string) Stats {
 	return CollectStats(queueList, connection)
 }
@@ -87,91 +358,523 @@ func (connection *redisConnection) String() string {
 	return connection.Name
 }
 
-// GetConnections returns a list of all open connections
+// GetConnections returns a list of all open connections, it logs redis errors
+// and returns no connections then, see GetConnectionsE
 func (connection *redisConnection) GetConnections() []string {
-	return connection.redisClient.SMembers(connectionsKey)
+	return connection.logMembersErr(connection.GetConnectionsE())
+}
+
+// GetConnectionsE is like GetConnections, but returns redis errors
+func (connection *redisConnection) GetConnectionsE() ([]string, error) {
+	return connection.members(connection.key(connectionsKey))
 }
 
 // Check retuns true if the connection is currently active in terms of heartbeat
 func (connection *redisConnection) Check() bool {
-	heartbeatKey := strings.Replace(connectionHeartbeatTemplate, phConnection, connection.Name, 1)
-	ttl, _ := connection.redisClient.TTL(heartbeatKey)
+	ttl, err := connection.redisClient.TTL(connection.heartbeatKey)
+	if err != nil {
+		connection.logger.Printf("rmq connection failed to check heartbeat %s: %s", connection, err)
+		return false
+	}
 	return ttl > 0
 }
 
+// Ping sends a PING to redis and returns an error if it fails, for example
+// for readiness probes. Unlike Check it tests whether redis can actually be
+// reached. It returns ErrPingTimeout if redis doesn't answer within
+// pingTimeout, so probes don't hang.
+func (connection *redisConnection) Ping() error {
+	result := make(chan error, 1) // buffered so a late answer doesn't block
+	go func() {
+		result <- connection.redisClient.Ping()
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("rmq connection failed to ping %s: %w", connection, err)
+		}
+		return nil
+	case <-time.After(pingTimeout):
+		return ErrPingTimeout
+	}
+}
+
 // StopHeartbeat stops the heartbeat of the connection
 // it does not remove it from the list of connections so it can later be found by the cleaner
 func (connection *redisConnection) StopHeartbeat() bool {
-	connection.heartbeatStopped = true
-	_, ok := connection.redisClient.Del(connection.heartbeatKey)
-	return ok
+	if connection.inspectionOnly {
+		connection.logger.Printf("rmq connection can't stop heartbeat %s: %s", connection, ErrInspectionOnly)
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&connection.heartbeatStopped, 0, 1) && connection.stopHeartbeat != nil {
+		close(connection.stopHeartbeat)
+	}
+	if connection.stopHeartbeat != nil {
+		// wait for a running update so it doesn't set the key again after Del
+		<-connection.heartbeatDone
+	}
+	if _, err := connection.redisClient.Del(connection.heartbeatKey); err != nil {
+		connection.logger.Printf("rmq connection failed to stop heartbeat %s: %s", connection, err)
+		return false
+	}
+	return true
+}
+
+// StopAllConsuming stops consuming on all queues of this connection which
+// started consuming, see Queue.StopConsuming. The returned channel gets closed
+// once all their consumers returned.
+func (connection *redisConnection) StopAllConsuming() <-chan struct{} {
+	connection.consumingMutex.Lock()
+	queues := connection.consumingQueues
+	multiQueues := connection.consumingMultiQueues
+	connection.consumingMutex.Unlock()
+
+	finishedChan := make(chan struct{})
+	go func() {
+		for _, queue := range queues {
+			<-queue.StopConsuming()
+		}
+		for _, multi := range multiQueues {
+			<-multi.StopConsuming()
+		}
+		close(finishedChan)
+	}()
+	return finishedChan
+}
+
+// addConsumingQueue remembers the queue for StopAllConsuming
+func (connection *redisConnection) addConsumingQueue(queue *redisQueue) {
+	connection.consumingMutex.Lock()
+	connection.consumingQueues = append(connection.consumingQueues, queue)
+	connection.consumingMutex.Unlock()
 }
 
+// Close shuts the connection down: it stops all consumers and waits for them
+// to return, stops the heartbeat and removes the connection from the list of
+// connections. Don't use the connection afterwards.
 func (connection *redisConnection) Close() bool {
-	_, ok := connection.redisClient.SRem(connectionsKey, connection.Name)
-	return ok
+	if connection.inspectionOnly {
+		connection.logger.Printf("rmq connection can't close %s: %s", connection, ErrInspectionOnly)
+		return false
+	}
+	<-connection.StopAllConsuming()
+	if !connection.StopHeartbeat() {
+		return false
+	}
+	if _, err := connection.redisClient.SRem(connection.key(connectionsKey), connection.Name); err != nil {
+		connection.logger.Printf("rmq connection failed to close %s: %s", connection, err)
+		return false
+	}
+	connection.emit(Event{Type: ConnectionClosed})
+	return true
 }
 
-// GetOpenQueues returns a list of all open queues
+// GetOpenQueues returns a list of all open queues, it logs redis errors and
+// returns no queues then, see GetOpenQueuesE
 func (connection *redisConnection) GetOpenQueues() []string {
-	return connection.redisClient.SMembers(queuesKey)
+	return connection.logMembersErr(connection.GetOpenQueuesE())
+}
+
+// GetOpenQueuesE is like GetOpenQueues, but returns redis errors
+func (connection *redisConnection) GetOpenQueuesE() ([]string, error) {
+	return connection.members(connection.key(queuesKey))
+}
+
+// QueueExists returns whether a queue with the given name was opened and
+// registered, see GetOpenQueues. Unlike OpenQueue it doesn't register it.
+func (connection *redisConnection) QueueExists(name string) (bool, error) {
+	exists, err := connection.redisClient.SIsMember(connection.key(queuesKey), name)
+	if err != nil {
+		return false, fmt.Errorf("rmq connection failed to check queue %s %s: %w", connection, name, err)
+	}
+	return exists, nil
+}
+
+// DiscoverQueues returns the open queues plus all queues which have a ready
+// list in redis, even if they were never registered as open queues
+func (connection *redisConnection) DiscoverQueues() ([]string, error) {
+	openQueues, err := connection.redisClient.SMembers(connection.key(queuesKey))
+	if err != nil {
+		return nil, fmt.Errorf("rmq connection failed to get open queues %s: %w", connection, err)
+	}
+
+	found := map[string]bool{}
+	for _, name := range openQueues {
+		found[name] = true
+	}
+
+	readyTemplate := connection.key(queueReadyTemplate)
+	readyKeys, err := scanKeys(connection.redisClient, keyPattern(readyTemplate))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range readyKeys {
+		if name, ok := parseQueueKey(readyTemplate, key); ok {
+			found[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// QueuesWithoutConsumers returns the open queues which have no consumers on a
+// connection that is still alive. Consumers of connections whose heartbeat
+// expired don't count, even if the cleaner didn't remove them yet.
+func (connection *redisConnection) QueuesWithoutConsumers() ([]string, error) {
+	openQueues, err := connection.GetOpenQueuesE()
+	if err != nil {
+		return nil, err
+	}
+	connectionNames, err := connection.GetConnectionsE()
+	if err != nil {
+		return nil, err
+	}
+
+	consumed := map[string]bool{}
+	for _, connectionName := range connectionNames {
+		hijacked := connection.hijackConnection(connectionName)
+		ttl, err := connection.redisClient.TTL(hijacked.heartbeatKey)
+		if err != nil {
+			return nil, fmt.Errorf("rmq connection failed to check heartbeat %s: %w", hijacked, err)
+		}
+		if ttl <= 0 {
+			continue // dead connection, its consumers don't consume anything
+		}
+
+		queueNames, err := hijacked.GetConsumingQueuesE()
+		if err != nil {
+			return nil, err
+		}
+		for _, queueName := range queueNames {
+			if consumed[queueName] {
+				continue
+			}
+			consumers, err := hijacked.members(hijacked.openQueue(queueName).consumersKey)
+			if err != nil {
+				return nil, err
+			}
+			consumed[queueName] = len(consumers) > 0
+		}
+	}
+
+	names := []string{}
+	for _, name := range openQueues {
+		if !consumed[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ReturnUnackedOf moves the unacked deliveries of all queues the given
+// connection is consuming back to their ready lists, removes their leases and
+// returns how many were returned. It doesn't check whether the connection is
+// still alive, so only use it for connections you know are dead. Otherwise
+// those deliveries get consumed twice. Returns an error if not all unacked
+// deliveries could be returned.
+func (connection *redisConnection) ReturnUnackedOf(connectionName string) (returned int, err error) {
+	hijacked := connection.hijackConnection(connectionName)
+	queueNames, err := hijacked.GetConsumingQueuesE()
+	if err != nil {
+		return 0, err
+	}
+	for _, queueName := range queueNames {
+		queue := hijacked.openQueue(queueName)
+		count, err := queue.redisClient.LLen(queue.unackedKey)
+		if err != nil {
+			return returned, fmt.Errorf("rmq connection failed to return unacked %s: %w", queue, err)
+		}
+		queueReturned := queue.ReturnUnacked(count)
+		returned += queueReturned
+		if queueReturned < count {
+			return returned, fmt.Errorf("rmq connection failed to return unacked %s: returned %d of %d", queue, queueReturned, count)
+		}
+		if _, err := queue.redisClient.Del(queue.leasesKey); err != nil {
+			return returned, fmt.Errorf("rmq connection failed to remove leases %s: %w", queue, err)
+		}
+	}
+
+	// log.Printf("rmq connection returned unacked deliveries %s %d", connectionName, returned)
+	return returned, nil
+}
+
+// DeleteQueue deletes the queue with all its deliveries, including the unacked
+// ones of all connections, and all its keys. It returns ErrQueueHasConsumers
+// without deleting anything if connections which are still alive consume the
+// queue, see ForceDeleteQueue.
+func (connection *redisConnection) DeleteQueue(name string) error {
+	consumersKeys, err := connection.connectionQueueKeys(connectionQueueConsumersTemplate, name)
+	if err != nil {
+		return err
+	}
+	for connectionName, consumersKey := range consumersKeys {
+		consumers, err := connection.redisClient.SMembers(consumersKey)
+		if err != nil {
+			return fmt.Errorf("rmq connection failed to get consumers %s %s: %w", connectionName, name, err)
+		}
+		if len(consumers) > 0 && connection.hijackConnection(connectionName).Check() {
+			return ErrQueueHasConsumers
+		}
+	}
+	return connection.ForceDeleteQueue(name)
+}
+
+// ForceDeleteQueue deletes the queue like DeleteQueue, even if it's still
+// being consumed
+func (connection *redisConnection) ForceDeleteQueue(name string) error {
+	queue := connection.openQueue(name)
+	keys := []string{
+		queue.readyKey,
+		queue.rejectedKey,
+		queue.errorsKey,
+		strings.Replace(connection.key(queueAttemptsTemplate), phQueue, name, 1),
+		strings.Replace(connection.key(queueRejectsTemplate), phQueue, name, 1),
+		strings.Replace(connection.key(queuePrioritiesTemplate), phQueue, name, 1),
+	}
+	for _, template := range []string{queuePriorityTemplate, queueSlotTemplate, queuePurgingTemplate, queueDedupTemplate, queueReplyTemplate} {
+		scanned, err := scanKeys(connection.redisClient, keyPattern(strings.Replace(connection.key(template), phQueue, name, 1)))
+		if err != nil {
+			return err
+		}
+		keys = append(keys, scanned...)
+	}
+	for _, template := range []string{connectionQueueUnackedTemplate, connectionQueueConsumersTemplate} {
+		connectionKeys, err := connection.connectionQueueKeys(template, name)
+		if err != nil {
+			return err
+		}
+		for _, key := range connectionKeys {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		if _, err := connection.redisClient.Del(key); err != nil {
+			return fmt.Errorf("rmq connection failed to delete queue key %s %s: %w", name, key, err)
+		}
+	}
+
+	queuesKeys, err := scanKeys(connection.redisClient, keyPattern(connection.key(connectionQueuesTemplate)))
+	if err != nil {
+		return err
+	}
+	for _, key := range append(queuesKeys, connection.key(queuesKey)) {
+		if _, err := connection.redisClient.SRem(key, name); err != nil {
+			return fmt.Errorf("rmq connection failed to unregister queue %s %s: %w", name, key, err)
+		}
+	}
+
+	// log.Printf("rmq connection deleted queue %s %d", name, len(keys))
+	return nil
+}
+
+// connectionQueueKeys returns the keys built from the template of all
+// connections for the given queue by connection name
+func (connection *redisConnection) connectionQueueKeys(template, queueName string) (map[string]string, error) {
+	template = connection.key(template)
+	scanned, err := scanKeys(connection.redisClient, keyPattern(strings.Replace(template, phQueue, queueName, 1)))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]string{}
+	for _, key := range scanned {
+		if connectionName, name, ok := parseConnectionQueueKey(template, key); ok && name == queueName {
+			keys[connectionName] = key
+		}
+	}
+	return keys, nil
 }
 
 // CloseAllQueues closes all queues by removing them from the global list
 func (connection *redisConnection) CloseAllQueues() int {
-	count, _ := connection.redisClient.Del(queuesKey)
+	count, err := connection.redisClient.Del(connection.key(queuesKey))
+	if err != nil {
+		connection.logger.Printf("rmq connection failed to close all queues %s: %s", connection, err)
+	}
 	return count
 }
 
 // CloseAllQueuesInConnection closes all queues in the associated connection by removing all related keys
 func (connection *redisConnection) CloseAllQueuesInConnection() error {
-	connection.redisClient.Del(connection.queuesKey)
+	if connection.inspectionOnly {
+		return ErrInspectionOnly
+	}
+	if _, err := connection.redisClient.Del(connection.queuesKey); err != nil {
+		return err
+	}
 	// debug(fmt.Sprintf("connection closed all queues %s %d", connection, connection.queuesKey)) // COMMENTOUT
 	return nil
 }
 
-// GetConsumingQueues returns a list of all queues consumed by this connection
+// GetConsumingQueues returns a list of all queues consumed by this
+// connection, it logs redis errors and returns no queues then, see
+// GetConsumingQueuesE
 func (connection *redisConnection) GetConsumingQueues() []string {
-	return connection.redisClient.SMembers(connection.queuesKey)
+	return connection.logMembersErr(connection.GetConsumingQueuesE())
+}
+
+// GetConsumingQueuesE is like GetConsumingQueues, but returns redis errors
+func (connection *redisConnection) GetConsumingQueuesE() ([]string, error) {
+	return connection.members(connection.queuesKey)
+}
+
+// GetConsumingQueuesFor returns the queues consumed by the connection with the
+// given name, which may belong to another process. Returns ErrNoConnection if
+// no such connection is registered, see GetConnections.
+func (connection *redisConnection) GetConsumingQueuesFor(connectionName string) ([]string, error) {
+	registered, err := connection.redisClient.SIsMember(connection.key(connectionsKey), connectionName)
+	if err != nil {
+		return nil, fmt.Errorf("rmq connection failed to check connection %s %s: %w", connection, connectionName, err)
+	}
+	if !registered {
+		return nil, ErrNoConnection
+	}
+	return connection.hijackConnection(connectionName).GetConsumingQueuesE()
 }
 
-// heartbeat keeps the heartbeat key alive
+// members returns the members of the set at key
+func (connection *redisConnection) members(key string) ([]string, error) {
+	members, err := connection.redisClient.SMembers(key)
+	if err != nil {
+		return nil, fmt.Errorf("rmq connection failed to get members %s %s: %w", connection, key, err)
+	}
+	return members, nil
+}
+
+// logMembersErr logs the error of members and returns no members then
+func (connection *redisConnection) logMembersErr(members []string, err error) []string {
+	if err != nil {
+		connection.logger.Printf("%s", err)
+		return []string{}
+	}
+	return members
+}
+
+// heartbeat keeps the heartbeat key alive until the heartbeat gets stopped,
+// the first update happens on opening the connection. Updates get logged
+// every heartbeatLogTicks ticks, failures always. After failures it backs
+// off, see heartbeatWait.
 func (connection *redisConnection) heartbeat() {
-	for {
-		if !connection.updateHeartbeat() {
-			// log.Printf("rmq connection failed to update heartbeat %s", connection)
+	timer := time.NewTimer(connection.heartbeatInterval)
+	defer timer.Stop()
+	defer close(connection.heartbeatDone)
+
+	failures := 0 // consecutive failed updates
+	for ticks := 1; ; ticks++ {
+		select {
+		case <-connection.stopHeartbeat:
+			connection.debugLogger.Printf("rmq connection stopped heartbeat %s", connection)
+			return
+		case <-timer.C:
 		}
 
-		time.Sleep(time.Second)
+		if err := connection.updateHeartbeat(); err != nil {
+			failures++
+			connection.logger.Printf("rmq connection failed to update heartbeat %s %d: %s", connection, failures, err)
+			connection.emit(Event{Type: HeartbeatLost, Count: failures})
+			if connection.onHeartbeatLost != nil {
+				connection.onHeartbeatLost(failures)
+			}
+		} else {
+			if failures > 0 {
+				connection.logger.Printf("rmq connection restored heartbeat %s %d", connection, failures)
+				failures = 0
+				connection.emit(Event{Type: HeartbeatRestored})
+				if connection.onHeartbeatRestored != nil {
+					connection.onHeartbeatRestored()
+				}
+			}
+			if connection.heartbeatLogTicks > 0 && ticks%connection.heartbeatLogTicks == 0 {
+				connection.debugLogger.Printf("rmq connection updated heartbeat %s", connection)
+			}
+			connection.refreshSlots()
+		}
+		timer.Reset(connection.heartbeatWait(failures))
+	}
+}
+
+// heartbeatWait returns how long to wait for the next heartbeat update after
+// that many consecutive failures. The interval doubles with each failure up to
+// a third of the TTL, so an update still happens before the key would expire
+// once redis is back.
+func (connection *redisConnection) heartbeatWait(failures int) time.Duration {
+	wait := connection.heartbeatInterval
+	maxWait := connection.heartbeatTTL / 3
+	for i := 0; i < failures && wait < maxWait; i++ {
+		wait *= 2
+	}
+	if wait > maxWait {
+		return maxWait
+	}
+	return wait
+}
+
+// refreshSlots keeps the global concurrency slots of deliveries in flight
+// from expiring, see Queue.SetGlobalConcurrency
+func (connection *redisConnection) refreshSlots() {
+	connection.consumingMutex.Lock()
+	queues := connection.consumingQueues
+	connection.consumingMutex.Unlock()
 
-		if connection.heartbeatStopped {
-			// log.Printf("rmq connection stopped heartbeat %s", connection)
-			return
+	for _, queue := range queues {
+		if err := queue.heldSlots.refresh(connection.redisClient); err != nil {
+			connection.logger.Printf("rmq connection failed to refresh slots %s %s: %s", connection, queue, err)
 		}
 	}
 }
 
-func (connection *redisConnection) updateHeartbeat() bool {
-	ok := connection.redisClient.Set(connection.heartbeatKey, "1", heartbeatDuration)
-	return ok
+func (connection *redisConnection) updateHeartbeat() error {
+	return connection.redisClient.Set(connection.heartbeatKey, "1", connection.heartbeatTTL)
+}
+
+// OpenConnectionForInspection returns a handle of the connection with the
+// given name, which may belong to another process, for example to build admin
+// tools. Queues opened with it see the unacked deliveries and consumers of
+// that connection and don't get registered. It doesn't start a heartbeat, so
+// it doesn't keep a dead connection alive, and it doesn't emit events. It
+// refuses to consume, to stop the heartbeat or to close the connection, those
+// return ErrInspectionOnly or false. Unknown names give empty results, see
+// GetConnections.
+func (connection *redisConnection) OpenConnectionForInspection(name string) Connection {
+	inspected := connection.hijackConnection(name)
+	inspected.skipQueueRegister = 1
+	inspected.inspectionOnly = true
+	return inspected
 }
 
 // hijackConnection reopens an existing connection for inspection purposes without starting a heartbeat
 func (connection *redisConnection) hijackConnection(name string) *redisConnection {
 	return &redisConnection{
 		Name:         name,
-		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
-		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
+		namespace:    connection.namespace,
+		heartbeatKey: strings.Replace(connection.key(connectionHeartbeatTemplate), phConnection, name, 1),
+		queuesKey:    strings.Replace(connection.key(connectionQueuesTemplate), phConnection, name, 1),
 		redisClient:  connection.redisClient,
+		logger:       connection.logger,
+		debugLogger:  connection.debugLogger,
 	}
 }
 
+// key returns the key or key template in the namespace of the connection
+func (connection *redisConnection) key(template string) string {
+	return namespaced(connection.namespace, template)
+}
+
 // openQueue opens a queue without adding it to the set of queues
 func (connection *redisConnection) openQueue(name string) *redisQueue {
-	return newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
+	return newQueue(name, connection.Name, connection.namespace, connection.queuesKey, connection.redisClient)
 }
 
 // flushDb flushes the redis database to reset everything, used in tests
 func (connection *redisConnection) flushDb() {
-	connection.redisClient.FlushDb()
+	if err := connection.redisClient.FlushDb(); err != nil {
+		connection.logger.Printf("rmq connection failed to flush db %s: %s", connection, err)
+	}
 }
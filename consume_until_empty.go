@@ -0,0 +1,73 @@
+package rmq
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const untilEmptyPollDuration = 10 * time.Millisecond
+
+// ConsumeUntilEmpty consumes the named queue until it's empty and no new
+// deliveries arrived for the grace period, then returns the number of
+// consumed deliveries. It opens and closes its own connection, which makes
+// it handy for scripts. Deliveries get acked if fn returns nil and rejected
+// otherwise.
+func ConsumeUntilEmpty(client *redis.Client, queueName string, grace time.Duration, fn func(Delivery) error) (processed int, err error) {
+	connection, err := openConnectionWithRedisClient("consume-until-empty", RedisWrapper{client}, ConnectionConfig{})
+	if err != nil {
+		return 0, fmt.Errorf("rmq failed to consume until empty %s: %w", queueName, err)
+	}
+	defer func() {
+		connection.StopHeartbeat()
+		connection.CloseAllQueuesInConnection()
+		connection.Close()
+	}()
+
+	// open it with the registered priorities to consume those deliveries too
+	priorities, err := connection.redisClient.SMembers(connection.queueKey(queuePrioritiesTemplate, queueName))
+	if err != nil {
+		return 0, fmt.Errorf("rmq failed to consume until empty %s: %w", queueName, err)
+	}
+	maxPriority := 0
+	for _, member := range priorities {
+		if priority, err := strconv.Atoi(member); err == nil && priority > maxPriority {
+			maxPriority = priority
+		}
+	}
+	queue := connection.OpenQueueWithPriorities(queueName, maxPriority+1).(*redisQueue)
+	// let the cleaner find our unacked deliveries
+	if err := connection.redisClient.SAdd(connection.queuesKey, queueName); err != nil {
+		return 0, fmt.Errorf("rmq failed to consume until empty %s: %w", queueName, err)
+	}
+
+	lastDelivery := time.Now()
+	for {
+		value, err := queue.fetch()
+		if err != nil && err != ErrNotFound {
+			return processed, fmt.Errorf("rmq failed to consume until empty %s: %w", queueName, err)
+		}
+		if err == ErrNotFound {
+			if time.Since(lastDelivery) >= grace {
+				return processed, nil
+			}
+			time.Sleep(untilEmptyPollDuration)
+			continue
+		}
+
+		lastDelivery = time.Now()
+		delivery, ok := queue.prepareDelivery(value, slot{})
+		if !ok {
+			continue // expired
+		}
+		if err := fn(delivery); err != nil {
+			// log.Printf("rmq failed to consume %s %s", delivery, err)
+			delivery.RejectWithError(err)
+		} else {
+			delivery.Ack()
+		}
+		processed++
+	}
+}
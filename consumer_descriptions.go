@@ -0,0 +1,32 @@
+package rmq
+
+import "sync"
+
+// consumerDescriptions holds the descriptions of consumers added with
+// AddConsumerWithDescription by consumer name. They only live in this
+// process, so stats collected elsewhere won't show them. They get removed
+// with the consumer or once its queue stopped consuming, which includes
+// closing the connection.
+var consumerDescriptions = struct {
+	sync.RWMutex
+	byName map[string]string
+}{byName: map[string]string{}}
+
+func setConsumerDescription(name, description string) {
+	consumerDescriptions.Lock()
+	defer consumerDescriptions.Unlock()
+	consumerDescriptions.byName[name] = description
+}
+
+func removeConsumerDescription(name string) {
+	consumerDescriptions.Lock()
+	defer consumerDescriptions.Unlock()
+	delete(consumerDescriptions.byName, name)
+}
+
+func getConsumerDescription(name string) (description string, ok bool) {
+	consumerDescriptions.RLock()
+	defer consumerDescriptions.RUnlock()
+	description, ok = consumerDescriptions.byName[name]
+	return description, ok
+}
@@ -2,6 +2,15 @@ package rmq
 
 type Deliveries []Delivery
 
+// Payloads returns the payloads of all deliveries in order
+func (deliveries Deliveries) Payloads() []string {
+	payloads := make([]string, len(deliveries))
+	for i, delivery := range deliveries {
+		payloads[i] = delivery.Payload()
+	}
+	return payloads
+}
+
 func (deliveries Deliveries) Ack() int {
 	failedCount := 0
 	for _, delivery := range deliveries {
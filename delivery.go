@@ -1,31 +1,122 @@
 package rmq
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// removes the delivery (ARGV[1]) from the unacked list (KEYS[1]) and only if
+// it was there deletes its counts from the hashes (KEYS[2..])
+const ackScript = `
+local count = redis.call("LREM", KEYS[1], 1, ARGV[1])
+if count == 1 then
+	for i = 2, #KEYS do
+		redis.call("HDEL", KEYS[i], ARGV[1])
+	end
+end
+return count
+`
+
+// removes the delivery (ARGV[1]) from the unacked list (KEYS[1]) and only if
+// it was there pushes the payload (ARGV[2]) to the ready list (KEYS[2]) and
+// deletes the delivery's counts from the hashes (KEYS[3..])
+const ackAndPublishScript = `
+if redis.call("LREM", KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call("LPUSH", KEYS[2], ARGV[2])
+for i = 3, #KEYS do
+	redis.call("HDEL", KEYS[i], ARGV[1])
+end
+return 1
+`
+
+// removes the delivery (ARGV[1]) from the unacked list (KEYS[1]) and only if
+// it was there pushes it back to the ready list (KEYS[2]) with the push
+// command ARGV[2], RPUSH for the tail (right) or LPUSH for the head (left)
+const requeueScript = `
+if redis.call("LREM", KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call(ARGV[2], KEYS[2], ARGV[1])
+return 1
+`
+
+// pushes the reply (ARGV[1]) to the reply list (KEYS[1]) which expires after
+// ARGV[2] milliseconds, so it doesn't stay if the requester gave up
+const replyScript = `
+redis.call("LPUSH", KEYS[1], ARGV[1])
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+`
+
 type Delivery interface {
 	Payload() string
+	PayloadBytes() []byte
+	TraceID() string
+	Headers() map[string]string
+	Decode(value interface{}) error
+	Expired() bool
+	Context() context.Context
+	Consumer() string
+	Connection() string
+	Attempts() (int, error)
+	RejectCount() int
 	Ack() bool
 	Reject() bool
+	RejectWithError(err error) bool
+	Nack(requeue bool) bool
+	RequeueFront() bool
+	RequeueBack() bool
 	Push() bool
+	Reply(payload string) error
+	AckAndPublish(nextQueue Queue, payload string) error
+	Touch() error
 }
 
 type wrapDelivery struct {
-	payload     string
-	unackedKey  string
-	rejectedKey string
-	pushKey     string
-	redisClient RedisClient
+	value        string // as stored in redis, possibly wrapped in an envelope
+	payload      string
+	headers      map[string]string
+	readyKey     string
+	unackedKey   string
+	rejectedKey  string
+	pushKey      string
+	redisClient  RedisClient
+	slot         slot   // global concurrency slot, released once the delivery leaves the unacked list
+	leasesKey    string // key to sorted set of lease deadlines, empty without lease
+	leaseMember  string // of this delivery in the sorted set of leases
+	leaseTTL     time.Duration
+	attemptsKey  string // key to hash of fetch attempts, empty if not tracked
+	attempts     int
+	rejectsKey   string // key to hash of rejections, empty if not tracked
+	maxRejects   int
+	retriesKey   string          // key to hash of retries, empty without retry policy
+	errorsKey    string          // key to list of deliveries rejected with an error, empty to not record them
+	namespace    string          // of the consuming queue, for the keys of other queues
+	ctx          context.Context // of the consuming queue, nil for background
+	consumeOrder ConsumeOrder    // of the consuming queue, decides which end of the ready list is the front
+	codec        Codec           // of the consuming queue, see Decode
+	connection   string          // name of the connection which fetched the delivery
+	logger       Logger          // of the connection which fetched the delivery
+	consumer     string          // name of the consumer which took the delivery, empty until then
 }
 
-func newDelivery(payload, unackedKey, rejectedKey, pushKey string, redisClient RedisClient) *wrapDelivery {
+func newDelivery(value, readyKey, unackedKey, rejectedKey, pushKey string, redisClient RedisClient) *wrapDelivery {
+	payload, headers := decodeEnvelope(value)
 	return &wrapDelivery{
+		value:       value,
 		payload:     payload,
+		headers:     headers,
+		readyKey:    readyKey,
 		unackedKey:  unackedKey,
 		rejectedKey: rejectedKey,
 		pushKey:     pushKey,
 		redisClient: redisClient,
+		codec:       RawCodec{},
+		logger:      stdLogger{},
 	}
 }
 
@@ -37,34 +128,299 @@ func (delivery *wrapDelivery) Payload() string {
 	return delivery.payload
 }
 
+// PayloadBytes returns the payload as published with PublishBytes, it doesn't
+// need to be valid UTF-8
+func (delivery *wrapDelivery) PayloadBytes() []byte {
+	return []byte(delivery.payload)
+}
+
+// Context returns the context passed to StartConsumingWithContext, which is
+// done once the queue stopped consuming because of it
+func (delivery *wrapDelivery) Context() context.Context {
+	if delivery.ctx == nil {
+		return context.Background()
+	}
+	return delivery.ctx
+}
+
+// Consumer returns the name of the consumer which took the delivery, as
+// returned by Queue.AddConsumer and its variants
+func (delivery *wrapDelivery) Consumer() string {
+	return delivery.consumer
+}
+
+// Connection returns the name of the connection which fetched the delivery
+func (delivery *wrapDelivery) Connection() string {
+	return delivery.connection
+}
+
+// TraceID returns the trace ID the delivery was published with or an empty
+// string if it was published without one
+func (delivery *wrapDelivery) TraceID() string {
+	return delivery.headers[traceIDHeader]
+}
+
+// Headers returns a copy of the headers the delivery was published with, see
+// Queue.PublishWithHeaders(). It's nil for deliveries without headers.
+func (delivery *wrapDelivery) Headers() map[string]string {
+	var headers map[string]string
+	for key, value := range delivery.headers {
+		if strings.HasPrefix(key, reservedHeaderPrefix) {
+			continue
+		}
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers[key] = value
+	}
+	return headers
+}
+
+// Expired returns whether the delivery was published with a TTL which has
+// passed, see Queue.PublishWithTTL()
+func (delivery *wrapDelivery) Expired() bool {
+	expiresAt, err := strconv.ParseInt(delivery.headers[expiresAtHeader], 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().UnixNano()/int64(time.Millisecond) >= expiresAt
+}
+
+// Attempts returns how often the delivery was fetched including this time,
+// which requires the queue to track attempts, see Queue.SetAttemptTracking()
+func (delivery *wrapDelivery) Attempts() (int, error) {
+	if delivery.attemptsKey == "" {
+		return 0, fmt.Errorf("rmq delivery attempts aren't tracked %s", delivery)
+	}
+	return delivery.attempts, nil
+}
+
+// RejectCount returns how often the delivery was rejected before, which
+// requires the queue to count rejections, see Queue.SetMaxRejects()
+func (delivery *wrapDelivery) RejectCount() int {
+	if delivery.rejectsKey == "" {
+		return 0
+	}
+	value, _ := delivery.redisClient.HGet(delivery.rejectsKey, delivery.value)
+	count, _ := strconv.Atoi(value)
+	return count
+}
+
 func (delivery *wrapDelivery) Ack() bool {
 	// debug(fmt.Sprintf("delivery ack %s", delivery)) // COMMENTOUT
 
-	count, ok := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.payload)
-	return ok && count == 1
+	// forget the counts in the same step, so they can't outlive the delivery
+	keys := append([]string{delivery.unackedKey}, delivery.countKeys()...)
+	result, err := runScript(delivery.redisClient, ackScript, keys, delivery.value)
+	delivery.release()
+	if count, _ := result.(int64); err != nil || count != 1 {
+		return false
+	}
+	return true
+}
+
+// Touch extends the lease of the delivery by the lease duration of the queue,
+// so the cleaner doesn't return it to ready while a slow consumer is still
+// working on it, see Queue.SetLeaseDuration(). Returns ErrLeaseExpired if the
+// delivery has no lease anymore, because it expired and the delivery may have
+// been returned already, or because the delivery was acked or rejected.
+// Returns ErrNoLease if the queue doesn't lease deliveries.
+func (delivery *wrapDelivery) Touch() error {
+	if delivery.leasesKey == "" {
+		return ErrNoLease
+	}
+	result, err := runScript(delivery.redisClient, leaseScript, []string{delivery.leasesKey}, delivery.leaseMember, int64(delivery.leaseTTL/time.Millisecond), int64(1))
+	if err != nil {
+		return fmt.Errorf("rmq delivery failed to touch %s: %w", delivery, err)
+	}
+	if count, _ := result.(int64); count != 1 {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+// AckAndPublish acks the delivery and publishes the payload to the next queue
+// in one atomic step, so either both happen or none of them. Returns an error
+// if the delivery wasn't unacked anymore, then nothing gets published, and
+// ErrMessageTooLarge if the payload exceeds the max message size of the next
+// queue.
+func (delivery *wrapDelivery) AckAndPublish(nextQueue Queue, payload string) error {
+	next, ok := nextQueue.(*redisQueue)
+	if !ok {
+		return fmt.Errorf("rmq delivery can't publish to queue %s %s", delivery, nextQueue)
+	}
+	if next.tooLarge(payload) {
+		return ErrMessageTooLarge
+	}
+
+	keys := append([]string{delivery.unackedKey, next.readyKey}, delivery.countKeys()...)
+	result, err := runScript(delivery.redisClient, ackAndPublishScript, keys, delivery.value, payload)
+	if err != nil {
+		return fmt.Errorf("rmq delivery failed to ack and publish %s %s: %w", delivery, next.name, err)
+	}
+	if count, _ := result.(int64); count != 1 {
+		return fmt.Errorf("rmq delivery failed to ack and publish %s %s", delivery, next.name)
+	}
+	delivery.release()
+	return nil
 }
 
 func (delivery *wrapDelivery) Reject() bool {
+	if delivery.rejectsKey != "" {
+		rejects, _ := delivery.redisClient.HIncrBy(delivery.rejectsKey, delivery.value, 1)
+		if int(rejects) > delivery.maxRejects && delivery.pushKey != "" {
+			// debug(fmt.Sprintf("delivery rejected too often %s", delivery)) // COMMENTOUT
+			return delivery.Push()
+		}
+	}
 	return delivery.move(delivery.rejectedKey)
 }
 
+// Nack rejects the delivery like Reject if requeue is false. With requeue it
+// moves the delivery back to the front of the ready list like RequeueFront.
+// Use it for failures which might go away when retrying.
+func (delivery *wrapDelivery) Nack(requeue bool) bool {
+	if !requeue {
+		return delivery.Reject()
+	}
+	return delivery.RequeueFront()
+}
+
+// RequeueFront moves the delivery from the unacked list back to the front of
+// the ready list in one atomic step, so it gets consumed next, ahead of all
+// other ready deliveries
+func (delivery *wrapDelivery) RequeueFront() bool {
+	return delivery.requeue(true)
+}
+
+// RequeueBack moves the delivery from the unacked list back to the back of the
+// ready list in one atomic step, like a freshly published delivery. All other
+// ready deliveries get consumed before it, so a delivery which keeps failing
+// doesn't hold up the others.
+func (delivery *wrapDelivery) RequeueBack() bool {
+	return delivery.requeue(false)
+}
+
+// requeue pushes the delivery to the end of the ready list which gets consumed
+// next with front, or to the other end without. FIFO queues consume from the
+// tail (right), LIFO queues from the head (left).
+func (delivery *wrapDelivery) requeue(front bool) bool {
+	command := "LPUSH"
+	if front == (delivery.consumeOrder == FIFO) {
+		command = "RPUSH"
+	}
+	result, err := runScript(delivery.redisClient, requeueScript, []string{delivery.unackedKey, delivery.readyKey}, delivery.value, command)
+	if count, _ := result.(int64); err != nil || count != 1 {
+		return false
+	}
+	delivery.release()
+
+	// debug(fmt.Sprintf("delivery requeued %s", delivery)) // COMMENTOUT
+	return true
+}
+
+// RejectWithError rejects the delivery like Reject and records the error so
+// that it can be looked up with Queue.RejectedErrors()
+func (delivery *wrapDelivery) RejectWithError(err error) bool {
+	if !delivery.Reject() {
+		return false
+	}
+	if err != nil && delivery.errorsKey != "" {
+		recordRejectedError(delivery.redisClient, delivery.errorsKey, delivery.payload, err)
+	}
+	return true
+}
+
 func (delivery *wrapDelivery) Push() bool {
 	if delivery.pushKey != "" {
-		return delivery.move(delivery.pushKey)
+		if ok := delivery.move(delivery.pushKey); !ok {
+			return false
+		}
+		delivery.forgetCounts() // done with this queue
+		return true
 	} else {
 		return delivery.move(delivery.rejectedKey)
 	}
 }
 
+// Reply publishes the payload to the reply list of a delivery published by
+// Queue.Request, so that the waiting request receives it
+func (delivery *wrapDelivery) Reply(payload string) error {
+	replyQueue, ok := delivery.headers[replyQueueHeader]
+	if !ok {
+		return fmt.Errorf("rmq delivery has no reply queue %s", delivery)
+	}
+	ttl, err := strconv.ParseInt(delivery.headers[replyTTLHeader], 10, 64)
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("rmq delivery has no reply ttl %s", delivery)
+	}
+
+	key := replyKey(delivery.namespace, replyQueue, delivery.headers[correlationIDHeader])
+	if _, err := runScript(delivery.redisClient, replyScript, []string{key}, payload, ttl); err != nil {
+		return fmt.Errorf("rmq delivery failed to reply %s %s: %w", delivery, replyQueue, err)
+	}
+	return nil
+}
+
 func (delivery *wrapDelivery) move(key string) bool {
-	if ok := delivery.redisClient.LPush(key, delivery.payload); !ok {
+	if err := delivery.redisClient.LPush(key, delivery.value); err != nil {
 		return false
 	}
 
-	if _, ok := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.payload); !ok {
+	if _, err := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.value); err != nil {
 		return false
 	}
+	delivery.release()
 
 	// debug(fmt.Sprintf("delivery rejected %s", delivery)) // COMMENTOUT
 	return true
 }
+
+// rejectUnacked rejects the delivery only if it's still unacked, so it can't
+// end up in the rejected list after it was acked or rejected already
+func (delivery *wrapDelivery) rejectUnacked() bool {
+	result, err := runScript(delivery.redisClient, ackAndPublishScript, []string{delivery.unackedKey, delivery.rejectedKey}, delivery.value, delivery.value)
+	if count, _ := result.(int64); err != nil || count != 1 {
+		return false
+	}
+	delivery.release()
+	return true
+}
+
+// release frees the global concurrency slot and the lease of the delivery
+// once it left the unacked list
+func (delivery *wrapDelivery) release() {
+	delivery.slot.release(delivery.redisClient)
+	delivery.slot = slot{}
+	if err := delivery.releaseLease(); err != nil {
+		delivery.logger.Printf("rmq delivery failed to release lease %s: %s", delivery, err)
+	}
+}
+
+// countKeys returns the keys of the hashes counting attempts and rejections of
+// the delivery, if tracked
+func (delivery *wrapDelivery) countKeys() []string {
+	keys := []string{}
+	if delivery.attemptsKey != "" {
+		keys = append(keys, delivery.attemptsKey)
+	}
+	if delivery.rejectsKey != "" {
+		keys = append(keys, delivery.rejectsKey)
+	}
+	if delivery.retriesKey != "" {
+		keys = append(keys, delivery.retriesKey)
+	}
+	return keys
+}
+
+func (delivery *wrapDelivery) forgetCounts() {
+	if delivery.attemptsKey != "" {
+		delivery.redisClient.HDel(delivery.attemptsKey, delivery.value)
+	}
+	if delivery.rejectsKey != "" {
+		delivery.redisClient.HDel(delivery.rejectsKey, delivery.value)
+	}
+	if delivery.retriesKey != "" {
+		delivery.redisClient.HDel(delivery.retriesKey, delivery.value)
+	}
+}
@@ -0,0 +1,54 @@
+package rmq
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// reserved header keys, Delivery.Headers() leaves out all keys with this prefix
+const (
+	reservedHeaderPrefix = "rmq-"
+
+	traceIDHeader       = "rmq-trace-id"
+	correlationIDHeader = "rmq-correlation-id"
+	replyQueueHeader    = "rmq-reply-queue"
+	replyTTLHeader      = "rmq-reply-ttl"  // milliseconds
+	expiresAtHeader     = "rmq-expires-at" // unix time in milliseconds
+)
+
+const envelopePrefix = `{"h":`
+
+// envelope wraps a payload together with its headers. Deliveries without
+// headers are stored as bare payloads to stay compatible with older clients.
+type envelope struct {
+	Headers map[string]string `json:"h"`
+	Payload *string           `json:"p"`
+}
+
+// encodeEnvelope returns the value to store in redis for the given payload
+// and headers
+func encodeEnvelope(payload string, headers map[string]string) string {
+	if len(headers) == 0 {
+		return payload
+	}
+
+	bytes, err := json.Marshal(envelope{Headers: headers, Payload: &payload})
+	if err != nil { // can't happen for string maps
+		return payload
+	}
+	return string(bytes)
+}
+
+// decodeEnvelope returns the payload and headers of a value stored in redis.
+// Values which are not an envelope are returned as bare payloads.
+func decodeEnvelope(value string) (payload string, headers map[string]string) {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return value, nil
+	}
+
+	var decoded envelope
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil || decoded.Payload == nil {
+		return value, nil
+	}
+	return *decoded.Payload, decoded.Headers
+}
@@ -0,0 +1,21 @@
+package rmq
+
+import "errors"
+
+var (
+	ErrAlreadyConsuming  = errors.New("rmq queue is already consuming")
+	ErrRequestTimeout    = errors.New("rmq request timed out")
+	ErrQueueHasConsumers = errors.New("rmq queue has active consumers")
+	ErrConsumerTagTaken  = errors.New("rmq consumer tag is already registered")
+	ErrNotFound          = errors.New("rmq redis key not found")
+	ErrCleanerRunning    = errors.New("rmq cleaner is already running")
+	ErrLockTaken         = errors.New("rmq lock is held already")
+	ErrLockLost          = errors.New("rmq lock expired or was taken over before it was released")
+	ErrPingTimeout       = errors.New("rmq redis didn't answer ping in time")
+	ErrNoScript          = errors.New("rmq redis script not loaded")
+	ErrLeaseExpired      = errors.New("rmq delivery lease expired")
+	ErrNoLease           = errors.New("rmq delivery has no lease, see Queue.SetLeaseDuration")
+	ErrMessageTooLarge   = errors.New("rmq payload exceeds the queue's max message size")
+	ErrNoConnection      = errors.New("rmq connection is not registered")
+	ErrInspectionOnly    = errors.New("rmq connection was opened for inspection only")
+)
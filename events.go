@@ -0,0 +1,64 @@
+package rmq
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const eventBufferSize = 1000 // events which wait for the reader before new ones get dropped
+
+//go:generate stringer -type=EventType
+
+type EventType int
+
+const (
+	ConnectionOpened    EventType = iota // the connection registered itself
+	ConnectionClosed                     // the connection removed itself, see Close
+	ConsumerAdded                        // a consumer was added to a queue of the connection
+	ConsumerRemoved                      // a consumer was removed, see Queue.RemoveConsumer
+	HeartbeatLost                        // updating the heartbeat failed, Count is the number of consecutive failures
+	HeartbeatRestored                    // the heartbeat got updated again after failures
+	DeliveriesReclaimed                  // a cleaner using the connection returned Count unacked deliveries of Connection
+)
+
+// Event is something that happened on a connection, see Connection.Events
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	Connection string // name of the connection the event is about
+	Queue      string // for consumer events, empty otherwise
+	Consumer   string // name of the consumer for consumer events, empty otherwise
+	Count      int    // for HeartbeatLost and DeliveriesReclaimed, 0 otherwise
+}
+
+// Events returns the channel of events of this connection, like consumers
+// being added or the heartbeat failing, for example to feed a monitoring UI.
+// The channel is buffered and events get dropped while it's full, so a slow
+// reader never blocks consuming. See DroppedEvents.
+func (connection *redisConnection) Events() <-chan Event {
+	return connection.events
+}
+
+// DroppedEvents returns how many events got dropped because the events
+// channel was full
+func (connection *redisConnection) DroppedEvents() int64 {
+	return atomic.LoadInt64(&connection.droppedEvents)
+}
+
+// emit sends the event without blocking. Connections which were hijacked or
+// created internally have no events channel, then it does nothing.
+func (connection *redisConnection) emit(event Event) {
+	if connection == nil || connection.events == nil {
+		return
+	}
+	event.Time = time.Now()
+	if event.Connection == "" {
+		event.Connection = connection.Name
+	}
+
+	select {
+	case connection.events <- event:
+	default:
+		atomic.AddInt64(&connection.droppedEvents, 1)
+	}
+}
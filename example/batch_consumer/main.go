@@ -14,11 +14,15 @@ func main() {
 
 	queue := connection.OpenQueue("things")
 	queue.StartConsuming(unackedLimit, 500*time.Millisecond)
-	queue.AddBatchConsumer("things", 111, NewBatchConsumer("things"))
+	if _, err := queue.AddBatchConsumer("things", 111, NewBatchConsumer("things")); err != nil {
+		log.Fatal(err)
+	}
 
 	queue = connection.OpenQueue("balls")
 	queue.StartConsuming(unackedLimit, 500*time.Millisecond)
-	queue.AddBatchConsumer("balls", 111, NewBatchConsumer("balls"))
+	if _, err := queue.AddBatchConsumer("balls", 111, NewBatchConsumer("balls")); err != nil {
+		log.Fatal(err)
+	}
 
 	select {}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"time"
 
 	"github.com/adjust/rmq/v2"
@@ -11,6 +12,14 @@ func main() {
 	cleaner := rmq.NewCleaner(connection)
 
 	for _ = range time.Tick(time.Second) {
-		cleaner.Clean()
+		returned, err := cleaner.Clean()
+		if err == rmq.ErrCleanerRunning {
+			continue // another process is cleaning
+		}
+		if err != nil {
+			log.Printf("failed to clean: %s", err)
+			continue
+		}
+		log.Printf("cleaned %d", returned)
 	}
 }
@@ -20,7 +20,9 @@ func main() {
 	queue.StartConsuming(unackedLimit, 500*time.Millisecond)
 	for i := 0; i < numConsumers; i++ {
 		name := fmt.Sprintf("consumer %d", i)
-		queue.AddConsumer(name, NewConsumer(i))
+		if _, err := queue.AddConsumer(name, NewConsumer(i)); err != nil {
+			log.Fatal(err)
+		}
 	}
 	select {}
 }
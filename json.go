@@ -0,0 +1,42 @@
+package rmq
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PublishJSON adds a delivery with the JSON encoded value to the queue.
+// Returns an error if the value can't be encoded or published, see
+// Queue.PublishE.
+func PublishJSON(queue Queue, value interface{}) error {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("rmq queue failed to encode json %s: %w", queue, err)
+	}
+	if err := queue.PublishE(string(bytes)); err != nil {
+		return fmt.Errorf("rmq queue failed to publish json %s: %w", queue, err)
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes the JSON payload of the delivery into value, which
+// must be a pointer like for json.Unmarshal. The delivery doesn't get acked
+// or rejected.
+func UnmarshalJSON(delivery Delivery, value interface{}) error {
+	if err := json.Unmarshal([]byte(delivery.Payload()), value); err != nil {
+		return fmt.Errorf("rmq delivery failed to decode json %s: %w", delivery, err)
+	}
+	return nil
+}
+
+// UnmarshalJSONOrReject is like UnmarshalJSON but rejects the delivery with
+// the decoding error if the payload isn't valid, see
+// Delivery.RejectWithError. So malformed deliveries end up in the rejected
+// list instead of being retried. The consumer should just return on error.
+func UnmarshalJSONOrReject(delivery Delivery, value interface{}) error {
+	err := UnmarshalJSON(delivery, value)
+	if err != nil {
+		delivery.RejectWithError(err)
+	}
+	return err
+}
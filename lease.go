@@ -0,0 +1,91 @@
+package rmq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
+
+const leaseIDLength = 16 // random part of lease members, see leaseMember
+
+// sets the lease (ARGV[1]) in the sorted set of leases (KEYS[1]) to expire
+// after ARGV[2] milliseconds. The deadline is based on the redis clock, so
+// consumers and cleaners don't need to agree on the time. With ARGV[3] = 1
+// only if the lease exists already, so leases of returned deliveries don't
+// come back. Returns 1 if the lease was set.
+const leaseScript = `
+if ARGV[3] == "1" and not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[2]), ARGV[1])
+return 1
+`
+
+// removes the lease (ARGV[1]) from the sorted set of leases (KEYS[1])
+const releaseLeaseScript = `
+return redis.call("ZREM", KEYS[1], ARGV[1])
+`
+
+// moves the deliveries whose lease (KEYS[1]) expired by the redis clock from
+// the unacked list (KEYS[2]) to the ready list (KEYS[3]) and removes their
+// leases, returns the number of returned deliveries. Lease members consist of
+// the lease ID (of length ARGV[1]), a colon and the delivery. Leases of
+// deliveries which aren't unacked anymore just get removed.
+const returnExpiredLeasesScript = `
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local count = 0
+for _, member in ipairs(redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", now)) do
+	redis.call("ZREM", KEYS[1], member)
+	local value = string.sub(member, tonumber(ARGV[1]) + 2)
+	if redis.call("LREM", KEYS[2], 1, value) == 1 then
+		redis.call("LPUSH", KEYS[3], value)
+		count = count + 1
+	end
+end
+return count
+`
+
+// leaseMember returns a new member of the sorted set of leases for the value,
+// deliveries with equal payloads get leases of their own
+func leaseMember(value string) string {
+	return uniuri.NewLen(leaseIDLength) + ":" + value
+}
+
+// lease sets the lease of a delivery which was just fetched
+func (queue *redisQueue) lease(delivery *wrapDelivery) error {
+	member := leaseMember(delivery.value)
+	_, err := runScript(queue.redisClient, leaseScript, []string{queue.leasesKey}, member, int64(queue.leaseDuration/time.Millisecond), int64(0))
+	if err != nil {
+		return err
+	}
+	delivery.leasesKey = queue.leasesKey
+	delivery.leaseMember = member
+	delivery.leaseTTL = queue.leaseDuration
+	return nil
+}
+
+// returnExpiredLeases returns the unacked deliveries of this connection whose
+// lease expired back to ready, see SetLeaseDuration
+func (queue *redisQueue) returnExpiredLeases() (returned int, err error) {
+	keys := []string{queue.leasesKey, queue.unackedKey, queue.readyKey}
+	result, err := runScript(queue.redisClient, returnExpiredLeasesScript, keys, int64(leaseIDLength))
+	if err != nil {
+		return 0, fmt.Errorf("rmq cleaner failed to return expired leases %s: %w", queue, err)
+	}
+	count, _ := result.(int64)
+	return int(count), nil
+}
+
+// releaseLease removes the lease of a delivery which left the unacked list.
+// If it fails the lease stays until the cleaner removes it once it expired.
+func (delivery *wrapDelivery) releaseLease() error {
+	if delivery.leasesKey == "" {
+		return nil
+	}
+	_, err := runScript(delivery.redisClient, releaseLeaseScript, []string{delivery.leasesKey}, delivery.leaseMember)
+	return err
+}
@@ -0,0 +1,117 @@
+package rmq
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
+
+// extends the expiry of the lock (KEYS[1]) to ARGV[2] milliseconds only if
+// it's still held by the token (ARGV[1]), returns 1 if so and 0 otherwise
+const refreshLockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`
+
+// Lock is a distributed lock, see Connection.AcquireLock
+type Lock interface {
+	// Release stops refreshing the lock and deletes it if it's still held.
+	// Returns ErrLockLost if it expired or was taken over before.
+	Release() error
+}
+
+// redisLock is a lock held by setting its key to a random token, it gets
+// refreshed until it's released
+type redisLock struct {
+	key         string
+	token       string
+	ttl         time.Duration
+	redisClient RedisClient
+	stop        chan struct{}
+	stopped     chan struct{}
+	releaseOnce sync.Once
+	err         error
+}
+
+// AcquireLock takes the lock with the given name, which is held by at most
+// one caller at a time across all connections. Returns ErrLockTaken if it's
+// held already. The lock gets refreshed in the background until it's
+// released, so it only expires after ttl if the process holding it died.
+func (connection *redisConnection) AcquireLock(name string, ttl time.Duration) (Lock, error) {
+	key := strings.Replace(connection.key(lockTemplate), phLock, name, 1)
+	return acquireLock(connection.redisClient, key, ttl)
+}
+
+func acquireLock(redisClient RedisClient, key string, ttl time.Duration) (*redisLock, error) {
+	if ttl < 3*time.Millisecond {
+		return nil, fmt.Errorf("rmq lock ttl must be at least 3 milliseconds %s %s", key, ttl)
+	}
+
+	token := uniuri.NewLen(16)
+	result, err := runScript(redisClient, acquireSlotScript, []string{key}, token, int64(ttl/time.Millisecond))
+	if err != nil {
+		return nil, fmt.Errorf("rmq lock failed to acquire %s: %w", key, err)
+	}
+	if acquired, _ := result.(int64); acquired != 1 {
+		return nil, ErrLockTaken
+	}
+
+	lock := &redisLock{
+		key:         key,
+		token:       token,
+		ttl:         ttl,
+		redisClient: redisClient,
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go lock.refresh()
+	return lock, nil
+}
+
+// refresh extends the lock's expiry every third of its ttl until it's
+// released or lost
+func (lock *redisLock) refresh() {
+	defer close(lock.stopped)
+
+	ticker := time.NewTicker(lock.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+		}
+
+		result, err := runScript(lock.redisClient, refreshLockScript, []string{lock.key}, lock.token, int64(lock.ttl/time.Millisecond))
+		if err != nil {
+			// log.Printf("rmq lock failed to refresh %s: %s", lock.key, err)
+			continue // try again before it expires
+		}
+		if refreshed, _ := result.(int64); refreshed != 1 {
+			// log.Printf("rmq lock lost %s", lock.key)
+			return
+		}
+	}
+}
+
+func (lock *redisLock) Release() error {
+	lock.releaseOnce.Do(func() {
+		close(lock.stop)
+		<-lock.stopped
+
+		result, err := runScript(lock.redisClient, releaseSlotScript, []string{lock.key}, lock.token)
+		if err != nil {
+			lock.err = fmt.Errorf("rmq lock failed to release %s: %w", lock.key, err)
+			return
+		}
+		if released, _ := result.(int64); released != 1 {
+			lock.err = ErrLockLost
+		}
+	})
+	return lock.err
+}
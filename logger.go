@@ -0,0 +1,21 @@
+package rmq
+
+import "log"
+
+// Logger is used by connections to report problems like failing heartbeats.
+// It's satisfied by *log.Logger and most structured loggers.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// stdLogger logs using the standard log package, the default Logger
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// noopLogger discards all messages, the default debug Logger
+type noopLogger struct{}
+
+func (noopLogger) Printf(format string, args ...interface{}) {}
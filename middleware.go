@@ -0,0 +1,63 @@
+package rmq
+
+import (
+	"time"
+)
+
+// Middleware wraps a consumer to add behavior around its Consume calls, like
+// metrics or logging, see Queue.Use
+type Middleware func(Consumer) Consumer
+
+// Use adds middlewares which wrap all consumers added to this queue value
+// afterwards with AddConsumer and its variants for single deliveries. The first
+// middleware is the outermost one, so it sees the delivery first. Batch and
+// commit consumers don't get wrapped.
+func (queue *redisQueue) Use(middlewares ...Middleware) {
+	queue.consumersMutex.Lock()
+	defer queue.consumersMutex.Unlock()
+	queue.middlewares = append(queue.middlewares, middlewares...)
+}
+
+// withMiddlewares wraps the consumer in the middlewares added so far
+func (queue *redisQueue) withMiddlewares(consumer Consumer) Consumer {
+	queue.consumersMutex.Lock()
+	defer queue.consumersMutex.Unlock()
+	for i := len(queue.middlewares) - 1; i >= 0; i-- {
+		consumer = queue.middlewares[i](consumer)
+	}
+	return consumer
+}
+
+// TimingMiddleware calls observe with each delivery and how long the consumer
+// took to consume it, for example to record it in a histogram
+func TimingMiddleware(observe func(delivery Delivery, duration time.Duration)) Middleware {
+	return func(consumer Consumer) Consumer {
+		return ConsumerFunc(func(delivery Delivery) {
+			start := time.Now()
+			defer func() { observe(delivery, time.Since(start)) }()
+			consumer.Consume(delivery)
+		})
+	}
+}
+
+// RecoverMiddleware recovers panics of the consumer like the queue does, see
+// Queue.SetPanicHandler, but with a handler for just the wrapped consumers.
+// The delivery gets rejected unless it was acked or rejected already, then it
+// gets passed to the handler.
+func RecoverMiddleware(handler PanicHandler) Middleware {
+	return func(consumer Consumer) Consumer {
+		return ConsumerFunc(func(delivery Delivery) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				if wrapped, ok := delivery.(*wrapDelivery); ok {
+					wrapped.rejectUnacked()
+				}
+				handler(delivery, recovered)
+			}()
+			consumer.Consume(delivery)
+		})
+	}
+}
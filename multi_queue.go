@@ -0,0 +1,189 @@
+package rmq
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MultiConsumer consumes deliveries of several queues, see
+// Connection.StartConsumingMulti
+type MultiConsumer interface {
+	Consume(queueName string, delivery Delivery)
+}
+
+type MultiConsumerFunc func(queueName string, delivery Delivery)
+
+func (consumerFunc MultiConsumerFunc) Consume(queueName string, delivery Delivery) {
+	consumerFunc(queueName, delivery)
+}
+
+// MultiQueue consumes several queues with a single poller, see
+// Connection.StartConsumingMulti
+type MultiQueue interface {
+	AddMultiConsumer(tag string, consumer MultiConsumer) (string, error)
+	StopConsuming() <-chan struct{}
+}
+
+// multiDelivery is a delivery fetched by a multi queue with the queue it was
+// fetched from
+type multiDelivery struct {
+	queue    *redisQueue
+	delivery Delivery
+}
+
+type redisMultiQueue struct {
+	queues           []*redisQueue
+	deliveryChan     chan multiDelivery
+	prefetchLimit    int64
+	prefetchedCount  int64 // fetched deliveries which no consumer took yet
+	pollDuration     time.Duration
+	next             int   // index of the queue to fetch from next, only used by consume()
+	consumingStopped int32 // 1 for stopped, 0 for consuming
+	stopWg           sync.WaitGroup
+}
+
+// StartConsumingMulti starts consuming the given queues with a single poller,
+// which saves goroutines and redis round-trips for many queues with little
+// traffic. The poller fetches one delivery of each queue in turn until
+// prefetchLimit deliveries are fetched, and sleeps for pollDuration once none
+// of the queues has ready deliveries. Add consumers to the returned multi
+// queue, they get deliveries of all queues. Priorities, consume order, leases,
+// attempt tracking and propagators of the queues apply, settings of the
+// queue's own consuming like global concurrency, dispatch timeouts and idle
+// callbacks don't. The queues must not be consuming already.
+func (connection *redisConnection) StartConsumingMulti(queues []Queue, prefetchLimit int, pollDuration time.Duration) (MultiQueue, error) {
+	if len(queues) == 0 {
+		return nil, fmt.Errorf("rmq connection needs queues to start consuming multi %s", connection)
+	}
+	if connection.inspectionOnly {
+		return nil, ErrInspectionOnly
+	}
+	if err := connection.redisClient.Ping(); err != nil {
+		return nil, fmt.Errorf("rmq connection failed to start consuming multi %s: %w", connection, err)
+	}
+
+	redisQueues := make([]*redisQueue, 0, len(queues))
+	for _, queue := range queues {
+		redisQueue, ok := queue.(*redisQueue)
+		if !ok {
+			return nil, fmt.Errorf("rmq connection can't consume queue %s %s", connection, queue)
+		}
+		if redisQueue.deliveryChan != nil {
+			return nil, ErrAlreadyConsuming
+		}
+		redisQueues = append(redisQueues, redisQueue)
+	}
+	for _, queue := range redisQueues {
+		// add queue to list of queues consumed on this connection
+		if err := connection.redisClient.SAdd(queue.queuesKey, queue.name); err != nil {
+			return nil, fmt.Errorf("rmq connection failed to start consuming multi %s %s: %w", connection, queue, err)
+		}
+	}
+
+	multi := &redisMultiQueue{
+		queues:        redisQueues,
+		deliveryChan:  make(chan multiDelivery, prefetchLimit),
+		prefetchLimit: int64(prefetchLimit),
+		pollDuration:  pollDuration,
+	}
+	connection.consumingMutex.Lock()
+	connection.consumingMultiQueues = append(connection.consumingMultiQueues, multi)
+	connection.consumingMutex.Unlock()
+	go multi.consume()
+	return multi, nil
+}
+
+// consume fetches deliveries until consuming stops
+func (multi *redisMultiQueue) consume() {
+	for atomic.LoadInt32(&multi.consumingStopped) == 0 {
+		if !multi.consumeRound() {
+			time.Sleep(multi.pollDuration)
+		}
+	}
+	close(multi.deliveryChan)
+}
+
+// consumeRound tries to fetch a delivery of each queue, starting after the
+// queue it fetched from last. Returns false if it didn't fetch any or the
+// prefetch limit is reached.
+func (multi *redisMultiQueue) consumeRound() bool {
+	fetched := false
+	for range multi.queues {
+		if atomic.LoadInt32(&multi.consumingStopped) == 1 {
+			return true
+		}
+		if atomic.LoadInt64(&multi.prefetchedCount) >= multi.prefetchLimit {
+			return false
+		}
+
+		queue := multi.queues[multi.next]
+		multi.next = (multi.next + 1) % len(multi.queues)
+		value, err := queue.fetch()
+		if err != nil {
+			if err != ErrNotFound {
+				queue.logger().Printf("rmq multi queue failed to fetch delivery %s: %s", queue, err)
+			}
+			continue
+		}
+		delivery, ok := queue.prepareDelivery(value, slot{})
+		if !ok {
+			continue
+		}
+
+		atomic.AddInt64(&multi.prefetchedCount, 1) // the buffer has room for it
+		multi.deliveryChan <- multiDelivery{queue: queue, delivery: delivery}
+		fetched = true
+	}
+	return fetched
+}
+
+// AddMultiConsumer adds a consumer which gets deliveries of all queues
+// together with the name of their queue. It shows up as consumer of each
+// queue. Returns ErrConsumerTagTaken like Queue.AddConsumer if one of the
+// queues has a consumer with the same tag, then it's added to none of them.
+func (multi *redisMultiQueue) AddMultiConsumer(tag string, consumer MultiConsumer) (string, error) {
+	name := consumerName(tag)
+	for i, queue := range multi.queues {
+		if err := queue.registerConsumer(tag, name); err != nil {
+			for _, added := range multi.queues[:i] {
+				added.redisClient.SRem(added.consumersKey, name)
+			}
+			return "", err
+		}
+	}
+	for _, queue := range multi.queues {
+		queue.connection.emit(Event{Type: ConsumerAdded, Queue: queue.name, Consumer: name})
+	}
+
+	multi.stopWg.Add(1)
+	go multi.consumerConsume(consumer, name)
+	return name, nil
+}
+
+func (multi *redisMultiQueue) consumerConsume(consumer MultiConsumer, name string) {
+	defer multi.stopWg.Done()
+	for fetched := range multi.deliveryChan {
+		atomic.AddInt64(&multi.prefetchedCount, -1)
+		assignConsumer(name, fetched.delivery)
+		multi.consumeDelivery(consumer, fetched)
+	}
+}
+
+func (multi *redisMultiQueue) consumeDelivery(consumer MultiConsumer, fetched multiDelivery) {
+	defer fetched.queue.recoverConsumer(fetched.delivery)
+	consumer.Consume(fetched.queue.name, fetched.delivery)
+}
+
+// StopConsuming stops fetching deliveries of all queues. The returned channel
+// gets closed once the consumers consumed the fetched deliveries and returned.
+func (multi *redisMultiQueue) StopConsuming() <-chan struct{} {
+	finishedChan := make(chan struct{})
+	atomic.StoreInt32(&multi.consumingStopped, 1)
+	go func() {
+		multi.stopWg.Wait()
+		close(finishedChan)
+	}()
+	return finishedChan
+}
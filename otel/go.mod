@@ -0,0 +1,20 @@
+module github.com/adjust/rmq/v2/otel
+
+go 1.20
+
+require (
+	github.com/adjust/gocheck v0.0.0-20131111155431-fbc315b36e0e
+	github.com/adjust/rmq/v2 v2.0.0
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+)
+
+require (
+	github.com/adjust/uniuri v0.0.0-20130923163420-498743145e60 // indirect
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/go-redis/redis/v7 v7.2.0 // indirect
+	go.opentelemetry.io/otel/metric v1.24.0 // indirect
+)
+
+replace github.com/adjust/rmq/v2 => ../
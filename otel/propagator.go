@@ -0,0 +1,48 @@
+// Package otel propagates OpenTelemetry span contexts through rmq deliveries.
+// It's a separate module so that rmq itself doesn't depend on OpenTelemetry.
+package otel
+
+import (
+	"context"
+
+	"github.com/adjust/rmq/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/adjust/rmq/v2/otel"
+
+type propagator struct {
+	textMapPropagator propagation.TextMapPropagator
+	tracer            trace.Tracer
+}
+
+// NewPropagator returns a propagator for Queue.SetPropagator which injects
+// the current span context into published deliveries using the given
+// propagator, like propagation.TraceContext{} for W3C trace context.
+// For consumed deliveries it starts a consumer span as child of the
+// publishing span with the global tracer provider. The span ends right away,
+// it only marks when the delivery got received. Spans started from
+// Delivery.Context() become its children.
+func NewPropagator(textMapPropagator propagation.TextMapPropagator) rmq.Propagator {
+	return propagator{
+		textMapPropagator: textMapPropagator,
+		tracer:            otel.Tracer(instrumentationName),
+	}
+}
+
+func (propagator propagator) Inject(ctx context.Context, headers map[string]string) {
+	propagator.textMapPropagator.Inject(ctx, propagation.MapCarrier(headers))
+}
+
+func (propagator propagator) Extract(ctx context.Context, headers map[string]string) context.Context {
+	ctx = propagator.textMapPropagator.Extract(ctx, propagation.MapCarrier(headers))
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+
+	ctx, span := propagator.tracer.Start(ctx, "rmq receive", trace.WithSpanKind(trace.SpanKindConsumer))
+	span.End()
+	return ctx
+}
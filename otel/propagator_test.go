@@ -0,0 +1,48 @@
+package otel
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/adjust/gocheck"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestPropagatorSuite(t *testing.T) {
+	TestingSuiteT(&PropagatorSuite{}, t)
+}
+
+type PropagatorSuite struct{}
+
+func (suite *PropagatorSuite) TestRoundTrip(c *C) {
+	propagator := NewPropagator(propagation.TraceContext{})
+	publishSpanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+		SpanID:     trace.SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), publishSpanContext)
+
+	headers := map[string]string{}
+	propagator.Inject(ctx, headers)
+	c.Check(headers["traceparent"], Equals, "00-0102030405060708090a0b0c0d0e0f10-0102030405060708-01")
+
+	// without tracer provider the receive span carries the publishing span context
+	extracted := trace.SpanContextFromContext(propagator.Extract(context.Background(), headers))
+	c.Check(extracted.IsValid(), Equals, true)
+	c.Check(extracted.TraceID(), Equals, publishSpanContext.TraceID())
+	c.Check(extracted.SpanID(), Equals, publishSpanContext.SpanID())
+	c.Check(extracted.IsSampled(), Equals, true)
+}
+
+func (suite *PropagatorSuite) TestWithoutSpan(c *C) {
+	propagator := NewPropagator(propagation.TraceContext{})
+
+	headers := map[string]string{}
+	propagator.Inject(context.Background(), headers)
+	c.Check(headers, HasLen, 0)
+
+	ctx := propagator.Extract(context.Background(), headers)
+	c.Check(trace.SpanContextFromContext(ctx).IsValid(), Equals, false)
+}
@@ -0,0 +1,76 @@
+package rmq
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Overview is a snapshot of all queues and connections, see
+// Connection.Overview
+type Overview struct {
+	Queues      map[string]QueueOverview      // by queue name
+	Connections map[string]ConnectionOverview // by connection name
+	CollectedAt time.Time
+}
+
+// QueueOverview holds the counts of a queue summed up over all connections
+type QueueOverview struct {
+	ReadyCount    int // including deliveries with priorities
+	RejectedCount int
+	UnackedCount  int
+	ConsumerCount int
+}
+
+// ConnectionOverview holds the state of a connection
+type ConnectionOverview struct {
+	Active bool     // whether the heartbeat is alive, see Connection.Check
+	Queues []string // the queues the connection is consuming, sorted
+}
+
+// Overview returns the counts of all queues and the state of all connections,
+// for example for dashboards. Unlike CollectStats it doesn't need the queue
+// names and it returns redis errors. It reads everything in three pipelined
+// batches, so it stays fast with many queues and connections. The counts
+// aren't read atomically, deliveries moving between lists meanwhile may be
+// missed or counted twice.
+func (connection *redisConnection) Overview() (Overview, error) {
+	overview := Overview{
+		Queues:      map[string]QueueOverview{},
+		Connections: map[string]ConnectionOverview{},
+		CollectedAt: time.Now(),
+	}
+
+	collected, err := connection.collect(nil, true)
+	if err != nil {
+		return Overview{}, fmt.Errorf("rmq connection failed to collect overview %s: %w", connection, err)
+	}
+
+	for _, queue := range collected.queues {
+		queueOverview := QueueOverview{ReadyCount: queue.readyCount, RejectedCount: queue.rejectedCount}
+		for _, count := range queue.priorityCounts {
+			queueOverview.ReadyCount += count
+		}
+		overview.Queues[queue.name] = queueOverview
+	}
+	for _, state := range collected.connections {
+		overview.Connections[state.name] = ConnectionOverview{
+			Active: state.active,
+			Queues: state.queues,
+		}
+		for _, queueName := range state.queues {
+			consumed := state.consumed[queueName]
+			queue := overview.Queues[queueName] // also counts queues which aren't registered (anymore)
+			queue.UnackedCount += consumed.unackedCount
+			queue.ConsumerCount += len(consumed.consumers)
+			overview.Queues[queueName] = queue
+		}
+	}
+	return overview, nil
+}
+
+// queueKey returns the key of the queue by the template in the namespace of
+// the connection
+func (connection *redisConnection) queueKey(template, queueName string) string {
+	return strings.Replace(connection.key(template), phQueue, queueName, 1)
+}
@@ -0,0 +1,64 @@
+// Package prometheus exports rmq queue stats as prometheus metrics. It's a
+// separate module so that rmq itself doesn't depend on the prometheus client.
+package prometheus
+
+import (
+	"github.com/adjust/rmq/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	readyDesc       = newQueueDesc("ready", "Number of ready deliveries")
+	rejectedDesc    = newQueueDesc("rejected", "Number of rejected deliveries")
+	unackedDesc     = newQueueDesc("unacked", "Number of unacked deliveries of all connections")
+	connectionsDesc = newQueueDesc("connections", "Number of connections consuming the queue")
+	consumersDesc   = newQueueDesc("consumers", "Number of consumers of all connections")
+)
+
+func newQueueDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName("rmq", "queue", name), help, []string{"queue"}, nil)
+}
+
+type collector struct {
+	connection rmq.Connection
+	queues     []string
+}
+
+// NewCollector returns a collector which exports gauges for the given queues
+// labeled by queue name. The stats get collected from redis on each scrape,
+// so there's no background polling. Pass nil queues to export all open
+// queues.
+func NewCollector(connection rmq.Connection, queues []string) prometheus.Collector {
+	return &collector{
+		connection: connection,
+		queues:     queues,
+	}
+}
+
+func (collector *collector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- readyDesc
+	descs <- rejectedDesc
+	descs <- unackedDesc
+	descs <- connectionsDesc
+	descs <- consumersDesc
+}
+
+func (collector *collector) Collect(metrics chan<- prometheus.Metric) {
+	queues := collector.queues
+	if queues == nil {
+		queues = collector.connection.GetOpenQueues()
+	}
+
+	stats := collector.connection.CollectStats(queues)
+	for queueName, queueStat := range stats.QueueStats {
+		metrics <- gauge(readyDesc, queueStat.ReadyCount, queueName)
+		metrics <- gauge(rejectedDesc, queueStat.RejectedCount, queueName)
+		metrics <- gauge(unackedDesc, queueStat.UnackedCount(), queueName)
+		metrics <- gauge(connectionsDesc, queueStat.ConnectionCount(), queueName)
+		metrics <- gauge(consumersDesc, queueStat.ConsumerCount(), queueName)
+	}
+}
+
+func gauge(desc *prometheus.Desc, value int, queueName string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value), queueName)
+}
@@ -0,0 +1,50 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/adjust/gocheck"
+	"github.com/adjust/rmq/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollectorSuite(t *testing.T) {
+	TestingSuiteT(&CollectorSuite{}, t)
+}
+
+type CollectorSuite struct{}
+
+func (suite *CollectorSuite) TestCollector(c *C) {
+	connection := rmq.OpenConnectionWithTestRedisClient("collector-conn")
+	queue := connection.OpenQueue("collector-q")
+	c.Check(queue.Publish("collector-d1", "collector-d2"), Equals, true)
+
+	registry := prometheus.NewPedanticRegistry()
+	c.Assert(registry.Register(NewCollector(connection, []string{"collector-q"})), IsNil)
+
+	expected := `
+# HELP rmq_queue_connections Number of connections consuming the queue
+# TYPE rmq_queue_connections gauge
+rmq_queue_connections{queue="collector-q"} 0
+# HELP rmq_queue_consumers Number of consumers of all connections
+# TYPE rmq_queue_consumers gauge
+rmq_queue_consumers{queue="collector-q"} 0
+# HELP rmq_queue_ready Number of ready deliveries
+# TYPE rmq_queue_ready gauge
+rmq_queue_ready{queue="collector-q"} 2
+# HELP rmq_queue_rejected Number of rejected deliveries
+# TYPE rmq_queue_rejected gauge
+rmq_queue_rejected{queue="collector-q"} 0
+# HELP rmq_queue_unacked Number of unacked deliveries of all connections
+# TYPE rmq_queue_unacked gauge
+rmq_queue_unacked{queue="collector-q"} 0
+`
+	c.Check(testutil.GatherAndCompare(registry, strings.NewReader(expected)), IsNil)
+
+	// all open queues without a list of queues
+	c.Check(testutil.CollectAndCount(NewCollector(connection, nil), "rmq_queue_ready"), Equals, 1)
+
+	connection.StopHeartbeat()
+}
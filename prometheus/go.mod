@@ -0,0 +1,13 @@
+module github.com/adjust/rmq/v2/prometheus
+
+go 1.13
+
+require (
+	github.com/adjust/gocheck v0.0.0-20131111155431-fbc315b36e0e
+	github.com/adjust/rmq/v2 v2.0.0
+	github.com/prometheus/client_golang v1.12.2
+	golang.org/x/sys v0.7.0 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
+)
+
+replace github.com/adjust/rmq/v2 => ../
@@ -0,0 +1,14 @@
+package rmq
+
+import "context"
+
+// Propagator carries context values like trace contexts from publishers to
+// consumers by storing them in delivery headers, see Queue.SetPropagator().
+// The otel module provides one for OpenTelemetry.
+type Propagator interface {
+	// Inject adds the values of ctx to the headers of a delivery to publish
+	Inject(ctx context.Context, headers map[string]string)
+	// Extract returns a copy of ctx with the values found in the headers of
+	// a consumed delivery, it must not modify the headers
+	Extract(ctx context.Context, headers map[string]string) context.Context
+}
@@ -1,8 +1,9 @@
 package rmq
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,84 +18,332 @@ const (
 	connectionQueuesTemplate         = "rmq::connection::{connection}::queues"                      // Set of queues consumers of {connection} are consuming
 	connectionQueueConsumersTemplate = "rmq::connection::{connection}::queue::[{queue}]::consumers" // Set of all consumers from {connection} consuming from {queue}
 	connectionQueueUnackedTemplate   = "rmq::connection::{connection}::queue::[{queue}]::unacked"   // List of deliveries consumers of {connection} are currently consuming
-
-	queuesKey             = "rmq::queues"                     // Set of all open queues
-	queueReadyTemplate    = "rmq::queue::[{queue}]::ready"    // List of deliveries in that {queue} (right is first and oldest, left is last and youngest)
-	queueRejectedTemplate = "rmq::queue::[{queue}]::rejected" // List of rejected deliveries from that {queue}
+	connectionQueueLeasesTemplate    = "rmq::connection::{connection}::queue::[{queue}]::leases"    // Sorted set of unacked deliveries of {connection} by lease deadline, see Queue.SetLeaseDuration
+
+	cleanerLockKey = "rmq::cleaner::lock" // Token of the cleaner which is currently running, expires if it crashed
+	lockTemplate   = "rmq::lock::{lock}"  // Token of the holder of the lock {lock} acquired with Connection.AcquireLock
+
+	topicQueuesTemplate = "rmq::topic::{topic}::queues" // Set of queues bound to {topic}, see Connection.OpenTopic
+
+	queuesKey               = "rmq::queues"                              // Set of all open queues
+	queueReadyTemplate      = "rmq::queue::[{queue}]::ready"             // List of deliveries in that {queue} (right is first and oldest, left is last and youngest)
+	queueRejectedTemplate   = "rmq::queue::[{queue}]::rejected"          // List of rejected deliveries from that {queue}
+	queuePriorityTemplate   = "rmq::queue::[{queue}]::ready::{priority}" // List of deliveries in that {queue} with {priority} above 0, which get consumed first
+	queuePrioritiesTemplate = "rmq::queue::[{queue}]::priorities"        // Set of priorities above 0 {queue} was opened with, see Connection.OpenQueueWithPriorities
+	queueSlotTemplate       = "rmq::queue::[{queue}]::slot::{slot}"      // Token of the consumer holding that global concurrency {slot} of {queue}
+	queueAttemptsTemplate   = "rmq::queue::[{queue}]::attempts"          // Hash of how often each delivery of {queue} was fetched
+	queueRejectsTemplate    = "rmq::queue::[{queue}]::rejects"           // Hash of how often each delivery of {queue} was rejected
+	queueRetryTemplate      = "rmq::queue::[{queue}]::retry"             // Sorted set of rejected deliveries of {queue} by when they get retried, see Queue.SetRetryPolicy
+	queueRetriesTemplate    = "rmq::queue::[{queue}]::retries"           // Hash of how often each delivery of {queue} was retried
+	queueErrorsTemplate     = "rmq::queue::[{queue}]::rejected::errors"  // List of the latest deliveries of {queue} rejected with an error (left is youngest)
+	queuePurgingTemplate    = "rmq::queue::[{queue}]::purging::{token}"  // List of deliveries of {queue} which are being purged
+	queueDedupTemplate      = "rmq::queue::[{queue}]::dedup::{dedup}"    // Marker of a delivery published to {queue} with that {dedup} key, expires after the dedup window
+	queueReplyTemplate      = "rmq::queue::[{queue}]::reply::{token}"    // List holding the reply to the request {token} of reply queue {queue}, expires after the request timeout
 
 	phConnection = "{connection}" // connection name
 	phQueue      = "{queue}"      // queue name
 	phConsumer   = "{consumer}"   // consumer name (consisting of tag and token)
+	phSlot       = "{slot}"       // global concurrency slot number
+	phToken      = "{token}"      // random token
+	phPriority   = "{priority}"   // delivery priority
+	phDedup      = "{dedup}"      // dedup key of a delivery
+	phLock       = "{lock}"       // lock name
+	phTopic      = "{topic}"      // topic name
 
 	defaultBatchTimeout = time.Second
+	consumerTokenLength = 6 // random part of consumer names
 	purgeBatchSize      = 100
+	emptyPollDuration   = 10 * time.Millisecond
+)
+
+// ConsumeOrder defines from which end of the ready list deliveries get
+// consumed. Publish always adds new deliveries to the head (left) of the list.
+type ConsumeOrder int
+
+const (
+	FIFO ConsumeOrder = iota // consume oldest first, from the tail (right), the default
+	LIFO                     // consume youngest first, from the head (left)
 )
 
+// renames the list (KEYS[1]) to KEYS[2] and returns its length, 0 if it
+// doesn't exist. Purging the renamed list doesn't race with publishers and
+// consumers of the original one
+const renameListScript = `
+local count = redis.call("LLEN", KEYS[1])
+if count > 0 then
+	redis.call("RENAME", KEYS[1], KEYS[2])
+end
+return count
+`
+
+// removes the last ARGV[1] deliveries from the list (KEYS[1]) being purged and
+// deletes their counts from the hashes (KEYS[2..])
+const purgeBatchScript = `
+local batchSize = tonumber(ARGV[1])
+for _, value in ipairs(redis.call("LRANGE", KEYS[1], -batchSize, -1)) do
+	for i = 2, #KEYS do
+		redis.call("HDEL", KEYS[i], value)
+	end
+end
+return redis.call("LTRIM", KEYS[1], 0, -1 - batchSize)
+`
+
+// sets the dedup marker (KEYS[1]) with an expiry in milliseconds (ARGV[1]) and
+// only if it wasn't set yet publishes the payload (ARGV[2]) to the ready list
+// (KEYS[2]), returns 1 if published and 0 if it was a duplicate
+const publishUniqueScript = `
+if not redis.call("SET", KEYS[1], 1, "NX", "PX", ARGV[1]) then
+	return 0
+end
+redis.call("LPUSH", KEYS[2], ARGV[2])
+return 1
+`
+
+// publishes the payload (ARGV[2]) to the ready list (KEYS[1]) only if it
+// holds less than ARGV[1] deliveries, returns 1 if published and 0 if it was
+// full
+const publishWithBackpressureScript = `
+if redis.call("LLEN", KEYS[1]) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("LPUSH", KEYS[1], ARGV[2])
+return 1
+`
+
+// adds the consumer (ARGV[1]) to the consumers set (KEYS[1]) unless there's
+// a consumer with the same tag already. Consumer names consist of the tag (of
+// length ARGV[2]), a dash and a token of the same length for all consumers.
+// Returns 1 if the consumer was added.
+const addUniqueConsumerScript = `
+local length = string.len(ARGV[1])
+local prefix = string.sub(ARGV[1], 1, tonumber(ARGV[2]) + 1)
+for _, name in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	if string.len(name) == length and string.sub(name, 1, string.len(prefix)) == prefix then
+		return 0
+	end
+end
+redis.call("SADD", KEYS[1], ARGV[1])
+return 1
+`
+
+// moves the head (left) of the ready list (KEYS[1]) to the unacked list
+// (KEYS[2]) and returns it, which RPOPLPUSH can only do for the tail
+const lpopLPushScript = `
+local value = redis.call("LPOP", KEYS[1])
+if value then
+	redis.call("LPUSH", KEYS[2], value)
+end
+return value
+`
+
+// PanicHandler gets called with each delivery whose consumer panicked and the
+// recovered value, after the delivery got rejected
+type PanicHandler func(delivery Delivery, recovered interface{})
+
+// ConsumerPollConfig defines how long the queue sleeps when it finds no
+// deliveries to consume. It sleeps MinInterval after the first empty poll and
+// doubles the sleep after each further one up to MaxInterval, until it finds
+// deliveries again.
+type ConsumerPollConfig struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
 type Queue interface {
 	Publish(payload ...string) bool
+	PublishE(payload ...string) error
 	PublishBytes(payload ...[]byte) bool
+	PublishBatch(payloads []string) (int, error)
+	PublishWithTrace(payload, traceID string) bool
+	PublishWithHeaders(payload string, headers map[string]string) bool
+	PublishWithContext(ctx context.Context, payload string) bool
+	PublishUnique(dedupKey, payload string, window time.Duration) (bool, error)
+	PublishWithBackpressure(payload string, maxReady int) (bool, error)
+	PublishWithTTL(payload string, ttl time.Duration) bool
+	PublishWithPriority(payload string, priority int) bool
+	Request(payload, replyQueue string, timeout time.Duration) (string, error)
 	SetPushQueue(pushQueue Queue)
-	StartConsuming(prefetchLimit int, pollDuration time.Duration) bool
+	SetDispatchTimeout(timeout time.Duration)
+	SetReturnBufferedOnStop(enabled bool)
+	SetGlobalConcurrency(n int)
+	SetPrefetchLimit(prefetchLimit int)
+	SetAttemptTracking(enabled bool)
+	SetMaxRejects(maxRejects int)
+	SetRetryPolicy(policy RetryPolicy) error
+	SetConsumeOrder(order ConsumeOrder)
+	SetIdleCallback(idleDuration time.Duration, onIdle func())
+	SetPanicHandler(handler PanicHandler)
+	SetPropagator(propagator Propagator)
+	SetLeaseDuration(duration time.Duration)
+	SetMaxMessageBytes(maxBytes int)
+	SetCodec(codec Codec)
+	PublishValue(value interface{}) error
+	Use(middlewares ...Middleware)
+	StartConsuming(prefetchLimit int, pollDuration time.Duration) error
+	StartConsumingWithContext(ctx context.Context, prefetchLimit int, pollDuration time.Duration) error
+	StartConsumingWithPollConfig(prefetchLimit int, pollConfig ConsumerPollConfig) error
+	StartConsumingN(n, prefetchLimit int, pollDuration time.Duration) (<-chan int, error)
+	StartConsumingRecover(prefetchLimit int, pollDuration time.Duration) (returned int, err error)
+	ConsumeChannel(prefetchLimit int, pollDuration time.Duration) (<-chan Delivery, error)
+	PauseConsuming()
+	ResumeConsuming()
 	StopConsuming() <-chan struct{}
-	AddConsumer(tag string, consumer Consumer) string
-	AddConsumerFunc(tag string, consumerFunc ConsumerFunc) string
-	AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string
-	AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string
+	StopConsumingAndWait(ctx context.Context) error
+	AddConsumer(tag string, consumer Consumer) (string, error)
+	AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (string, error)
+	AddConsumerWithConcurrency(tag string, concurrency int, consumer Consumer) ([]string, error)
+	AddConsumerWithRateLimit(tag string, perSecond float64, consumer Consumer) (string, error)
+	AddConsumerWithRateLimiter(tag string, limiter *RateLimiter, consumer Consumer) (string, error)
+	AddConsumerWithDescription(tag, description string, consumer Consumer) (string, error)
+	AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) (string, error)
+	AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) (string, error)
+	AddCommitConsumer(tag string, consumer CommitConsumer) (string, error)
+	RemoveConsumer(name string) error
+	ReadyCount() int
+	RejectedCount() int
+	UnackedCount() int
+	InFlightCount() int
 	PurgeReady() int
 	PurgeRejected() int
+	Peek(from, count int) ([]string, error)
+	RejectedErrors(count int) ([]RejectedEntry, error)
+	ReturnUnacked(count int) int
 	ReturnRejected(count int) int
 	ReturnAllRejected() int
+	WaitEmpty(ctx context.Context) error
+	Snapshot() (QueueSnapshot, error)
+	Restore(snapshot QueueSnapshot) error
 	Close() bool
 }
 
 type redisQueue struct {
 	name             string
 	connectionName   string
-	queuesKey        string // key to list of queues consumed by this connection
-	consumersKey     string // key to set of consumers using this connection
-	readyKey         string // key to list of ready deliveries
-	rejectedKey      string // key to list of rejected deliveries
-	unackedKey       string // key to list of currently consuming deliveries
-	pushKey          string // key to list of pushed deliveries
+	namespace        string   // prepended to all keys, empty for none
+	queuesKey        string   // key to list of queues consumed by this connection
+	consumersKey     string   // key to set of consumers using this connection
+	readyKey         string   // key to list of ready deliveries
+	priorityKeys     []string // keys to lists of ready deliveries by priority starting at 1, nil without priorities
+	rejectedKey      string   // key to list of rejected deliveries
+	errorsKey        string   // key to list of the latest deliveries rejected with an error
+	unackedKey       string   // key to list of currently consuming deliveries
+	leasesKey        string   // key to sorted set of lease deadlines of unacked deliveries
+	pushKey          string   // key to list of pushed deliveries
 	redisClient      RedisClient
-	deliveryChan     chan Delivery // nil for publish channels, not nil for consuming channels
-	prefetchLimit    int           // max number of prefetched deliveries number of unacked can go up to prefetchLimit + numConsumers
-	pollDuration     time.Duration
-	consumingStopped int32 // queue status, 1 for stopped, 0 for consuming
+	deliveryChan     chan Delivery   // nil for publish channels, not nil for consuming channels
+	prefetchLimit    int64           // max number of prefetched deliveries number of unacked can go up to prefetchLimit + numConsumers
+	maxPrefetchLimit int             // prefetch limit passed to StartConsuming, the size of deliveryChan
+	prefetchedCount  int64           // fetched deliveries which count against the prefetch limit, see received()
+	pollDuration     time.Duration   // sleep after polling found no deliveries
+	maxPollDuration  time.Duration   // pollDuration doubles after each empty poll up to this
+	ctx              context.Context // stops consuming when done, passed on to deliveries
+	dispatchTimeout  time.Duration   // max time a fetched delivery waits for a consumer, 0 for no limit
+	returnBuffered   bool            // return deliveries left in deliveryChan to ready on stop, see SetReturnBufferedOnStop
+	leaseDuration    time.Duration   // lease of fetched deliveries, 0 for none, see SetLeaseDuration
+	maxMessageBytes  int             // max size of published payloads, 0 for no limit
+	codec            Codec           // of PublishValue and Delivery.Decode, see SetCodec
+	consumingStopped int32           // queue status, 1 for stopped, 0 for consuming
+	consumingPaused  int32           // 1 while fetching is paused, see PauseConsuming
 	stopWg           sync.WaitGroup
+	fetchLimit       int          // number of deliveries to fetch before stopping, 0 for no limit
+	fetchedCount     int          // number of deliveries fetched so far, only used with fetchLimit
+	consumedCount    int64        // number of deliveries consumed so far, only used with fetchLimit
+	consumedAll      chan int     // gets the consumed count once consuming N stopped, see StartConsumingN
+	consumedAllOnce  sync.Once    // sends to consumedAll only once
+	slotKeys         []string     // keys of the global concurrency slots, nil for no limit
+	heldSlots        *heldSlots   // slots of deliveries in flight, refreshed by the heartbeat
+	attemptsKey      string       // key to hash of fetch attempts by delivery, empty if not tracked
+	rejectsKey       string       // key to hash of rejections by delivery, empty if not tracked
+	maxRejects       int          // rejections after which deliveries get pushed instead, 0 for no limit
+	retryConfig      *retryConfig // retry policy, nil for none, see SetRetryPolicy
+	retriesKey       string       // key to hash of retries by delivery, empty without retry policy
+	consumeOrder     ConsumeOrder
+	idleDuration     time.Duration
+	onIdle           func()       // called after idleDuration without deliveries, nil for none
+	lastActive       time.Time    // last time deliveries were fetched or waiting, only used by consume()
+	panicHandler     PanicHandler // called with deliveries whose consumer panicked, nil to log them
+	propagator       Propagator   // carries contexts through delivery headers, nil for none
+	middlewares      []Middleware // wrap consumers added afterwards, see Use
+	consumersMutex   sync.Mutex
+	consumerHandles  map[string]consumerHandle // by name, for consumers added to this queue value
+	connection       *redisConnection          // which opened the queue, nil for queues opened internally
+}
+
+// consumerHandle lets RemoveConsumer stop a single consumer goroutine
+type consumerHandle struct {
+	name    string        // of the consumer, see Delivery.Consumer
+	stop    chan struct{} // closed to stop the consumer
+	stopped chan struct{} // closed once the consumer returned
 }
 
-func newQueue(name, connectionName, queuesKey string, redisClient RedisClient) *redisQueue {
-	consumersKey := strings.Replace(connectionQueueConsumersTemplate, phConnection, connectionName, 1)
+func newQueue(name, connectionName, namespace, queuesKey string, redisClient RedisClient) *redisQueue {
+	consumersKey := strings.Replace(namespaced(namespace, connectionQueueConsumersTemplate), phConnection, connectionName, 1)
 	consumersKey = strings.Replace(consumersKey, phQueue, name, 1)
 
-	readyKey := strings.Replace(queueReadyTemplate, phQueue, name, 1)
-	rejectedKey := strings.Replace(queueRejectedTemplate, phQueue, name, 1)
+	readyKey := strings.Replace(namespaced(namespace, queueReadyTemplate), phQueue, name, 1)
+	rejectedKey := strings.Replace(namespaced(namespace, queueRejectedTemplate), phQueue, name, 1)
+	errorsKey := strings.Replace(namespaced(namespace, queueErrorsTemplate), phQueue, name, 1)
 
-	unackedKey := strings.Replace(connectionQueueUnackedTemplate, phConnection, connectionName, 1)
+	unackedKey := strings.Replace(namespaced(namespace, connectionQueueUnackedTemplate), phConnection, connectionName, 1)
 	unackedKey = strings.Replace(unackedKey, phQueue, name, 1)
+	leasesKey := strings.Replace(namespaced(namespace, connectionQueueLeasesTemplate), phConnection, connectionName, 1)
+	leasesKey = strings.Replace(leasesKey, phQueue, name, 1)
 
 	queue := &redisQueue{
 		name:             name,
 		connectionName:   connectionName,
+		namespace:        namespace,
 		queuesKey:        queuesKey,
 		consumersKey:     consumersKey,
 		readyKey:         readyKey,
 		rejectedKey:      rejectedKey,
+		errorsKey:        errorsKey,
 		unackedKey:       unackedKey,
+		leasesKey:        leasesKey,
 		redisClient:      redisClient,
 		consumingStopped: 1, // start with stopped status
+		consumerHandles:  map[string]consumerHandle{},
+		heldSlots:        newHeldSlots(),
+		codec:            RawCodec{},
 	}
 	return queue
 }
 
+// key returns the key or key template in the namespace of the queue
+func (queue *redisQueue) key(template string) string {
+	return namespaced(queue.namespace, template)
+}
+
 func (queue *redisQueue) String() string {
 	return fmt.Sprintf("[%s conn:%s]", queue.name, queue.connectionName)
 }
 
-// Publish adds a delivery with the given payload to the queue
+// logger returns the logger of the connection the queue was opened with, see
+// ConnectionConfig.Logger. Queues opened internally log with the default.
+func (queue *redisQueue) logger() Logger {
+	if queue.connection == nil {
+		return stdLogger{}
+	}
+	return queue.connection.logger
+}
+
+// Publish adds a delivery with the given payload to the queue. Returns false
+// without publishing any of them if a payload exceeds the max message size,
+// see SetMaxMessageBytes. Use PublishE to find out why publishing failed.
 func (queue *redisQueue) Publish(payload ...string) bool {
-	return queue.redisClient.LPush(queue.readyKey, payload...)
+	return queue.PublishE(payload...) == nil
+}
+
+// PublishE is like Publish but returns the error why the deliveries couldn't
+// be published, ErrMessageTooLarge if a payload exceeds the max message size.
+func (queue *redisQueue) PublishE(payload ...string) error {
+	if queue.tooLarge(payload...) {
+		return ErrMessageTooLarge
+	}
+	if err := queue.redisClient.LPush(queue.readyKey, payload...); err != nil {
+		return fmt.Errorf("rmq queue failed to publish %s: %w", queue, err)
+	}
+	return nil
 }
 
 // PublishBytes just casts the bytes and calls Publish
@@ -106,12 +355,169 @@ func (queue *redisQueue) PublishBytes(payload ...[]byte) bool {
 	return queue.Publish(stringifiedBytes...)
 }
 
+// PublishBatch adds deliveries with the given payloads to the queue in one
+// atomic step and round-trip, they get consumed in the given order. Returns
+// the number of published deliveries.
+func (queue *redisQueue) PublishBatch(payloads []string) (int, error) {
+	if len(payloads) == 0 {
+		return 0, nil
+	}
+	if queue.tooLarge(payloads...) {
+		return 0, ErrMessageTooLarge
+	}
+	if err := queue.redisClient.LPush(queue.readyKey, payloads...); err != nil {
+		return 0, fmt.Errorf("rmq queue failed to publish batch %s %d: %w", queue, len(payloads), err)
+	}
+	return len(payloads), nil
+}
+
+// PublishWithPriority adds a delivery with the given payload to the queue,
+// deliveries with higher priorities get consumed first. The priority is
+// capped to the ones the queue was opened with, see
+// Connection.OpenQueueWithPriorities. Priority 0 is the default of Publish.
+func (queue *redisQueue) PublishWithPriority(payload string, priority int) bool {
+	if priority <= 0 || len(queue.priorityKeys) == 0 {
+		return queue.Publish(payload)
+	}
+	if priority > len(queue.priorityKeys) {
+		priority = len(queue.priorityKeys)
+	}
+	if queue.tooLarge(payload) {
+		return false
+	}
+	return queue.redisClient.LPush(queue.priorityKeys[priority-1], payload) == nil
+}
+
+// PublishWithTrace adds a delivery with the given payload to the queue which
+// carries the trace ID to the consumer, see Delivery.TraceID()
+func (queue *redisQueue) PublishWithTrace(payload, traceID string) bool {
+	if traceID == "" {
+		return queue.Publish(payload)
+	}
+	return queue.Publish(encodeEnvelope(payload, map[string]string{traceIDHeader: traceID}))
+}
+
+// PublishWithHeaders adds a delivery with the given payload to the queue
+// which carries the headers to the consumer, see Delivery.Headers(). Header
+// keys starting with "rmq-" are reserved. Without headers the payload gets
+// published bare like with Publish.
+func (queue *redisQueue) PublishWithHeaders(payload string, headers map[string]string) bool {
+	return queue.Publish(encodeEnvelope(payload, headers))
+}
+
+// PublishWithContext adds a delivery with the given payload to the queue
+// which carries the context values injected by the propagator, like the
+// current span, to the consumer. Without propagator it's the same as Publish,
+// see SetPropagator.
+func (queue *redisQueue) PublishWithContext(ctx context.Context, payload string) bool {
+	if queue.propagator == nil {
+		return queue.Publish(payload)
+	}
+	headers := map[string]string{}
+	queue.propagator.Inject(ctx, headers)
+	return queue.PublishWithHeaders(payload, headers)
+}
+
+// PublishUnique adds a delivery with the given payload to the queue unless a
+// delivery with the same dedupKey was published within the window before, in
+// that case it returns false without publishing. Use it to drop duplicates
+// caused by publishers retrying.
+func (queue *redisQueue) PublishUnique(dedupKey, payload string, window time.Duration) (bool, error) {
+	if window < time.Millisecond {
+		return false, fmt.Errorf("rmq queue dedup window must be at least a millisecond %s %s", queue, window)
+	}
+	if queue.tooLarge(payload) {
+		return false, ErrMessageTooLarge
+	}
+
+	markerKey := strings.Replace(queue.key(queueDedupTemplate), phQueue, queue.name, 1)
+	markerKey = strings.Replace(markerKey, phDedup, dedupKey, 1)
+	result, err := runScript(queue.redisClient, publishUniqueScript, []string{markerKey, queue.readyKey}, int64(window/time.Millisecond), payload)
+	if err != nil {
+		return false, fmt.Errorf("rmq queue failed to publish unique %s %s: %w", queue, dedupKey, err)
+	}
+	published, _ := result.(int64)
+	return published == 1, nil
+}
+
+// PublishWithBackpressure adds a delivery with the given payload to the queue
+// only if it holds less than maxReady ready deliveries, otherwise it returns
+// false without publishing. Checking and publishing happen in one atomic step,
+// so concurrent publishers can't exceed the limit together. Use it to shed
+// load while consumers fall behind. Deliveries published with a priority
+// don't count.
+func (queue *redisQueue) PublishWithBackpressure(payload string, maxReady int) (bool, error) {
+	if queue.tooLarge(payload) {
+		return false, ErrMessageTooLarge
+	}
+
+	result, err := runScript(queue.redisClient, publishWithBackpressureScript, []string{queue.readyKey}, int64(maxReady), payload)
+	if err != nil {
+		return false, fmt.Errorf("rmq queue failed to publish with backpressure %s %d: %w", queue, maxReady, err)
+	}
+	published, _ := result.(int64)
+	return published == 1, nil
+}
+
+// PublishWithTTL adds a delivery with the given payload to the queue which
+// expires after ttl, see Delivery.Expired(). Expiry is only checked when the
+// delivery gets fetched, expired deliveries then get acked without passing
+// them to a consumer. They stay in redis until then and count as ready.
+func (queue *redisQueue) PublishWithTTL(payload string, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return queue.Publish(payload)
+	}
+	expiresAt := time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	return queue.Publish(encodeEnvelope(payload, map[string]string{expiresAtHeader: strconv.FormatInt(expiresAt, 10)}))
+}
+
+// Request publishes the payload to the queue and waits for the consumer to
+// answer with Delivery.Reply. Each request gets a reply list of its own under
+// replyQueue, so many requesters can share it without taking each other's
+// replies. The reply list expires after the timeout, so replies which arrive
+// too late don't pile up. Returns ErrRequestTimeout if there's no reply
+// within the timeout, which is rounded up to whole seconds.
+func (queue *redisQueue) Request(payload, replyQueue string, timeout time.Duration) (string, error) {
+	correlationID := uniuri.NewLen(16)
+	request := encodeEnvelope(payload, map[string]string{
+		correlationIDHeader: correlationID,
+		replyQueueHeader:    replyQueue,
+		replyTTLHeader:      strconv.FormatInt(int64(timeout/time.Millisecond), 10),
+	})
+	if ok := queue.Publish(request); !ok {
+		return "", fmt.Errorf("rmq queue failed to publish request %s", queue)
+	}
+
+	reply, err := queue.redisClient.BRPop(timeout, replyKey(queue.namespace, replyQueue, correlationID))
+	if err == ErrNotFound {
+		return "", ErrRequestTimeout
+	}
+	if err != nil {
+		return "", fmt.Errorf("rmq queue failed to receive reply %s %s: %w", queue, replyQueue, err)
+	}
+	return reply, nil
+}
+
+// replyKey returns the key of the reply list of the request with the
+// correlation ID
+func replyKey(namespace, replyQueue, correlationID string) string {
+	key := strings.Replace(namespaced(namespace, queueReplyTemplate), phQueue, replyQueue, 1)
+	return strings.Replace(key, phToken, correlationID, 1)
+}
+
 // PurgeReady removes all ready deliveries from the queue and returns the number of purged deliveries
+// It's safe to call while publishing and consuming, deliveries published after the call don't get purged
+// The attempt and reject counts of purged deliveries get deleted as well
 func (queue *redisQueue) PurgeReady() int {
-	return queue.deleteRedisList(queue.readyKey)
+	count := queue.deleteRedisList(queue.readyKey)
+	for _, priorityKey := range queue.priorityKeys {
+		count += queue.deleteRedisList(priorityKey)
+	}
+	return count
 }
 
 // PurgeRejected removes all rejected deliveries from the queue and returns the number of purged deliveries
+// Like PurgeReady it also deletes their attempt and reject counts
 func (queue *redisQueue) PurgeRejected() int {
 	return queue.deleteRedisList(queue.rejectedKey)
 }
@@ -120,43 +526,127 @@ func (queue *redisQueue) PurgeRejected() int {
 func (queue *redisQueue) Close() bool {
 	queue.PurgeRejected()
 	queue.PurgeReady()
-	count, _ := queue.redisClient.SRem(queuesKey, queue.name)
+	count, _ := queue.redisClient.SRem(queue.key(queuesKey), queue.name)
 	return count > 0
 }
 
+// ReadyCount returns the number of ready deliveries of all priorities
 func (queue *redisQueue) ReadyCount() int {
 	count, _ := queue.redisClient.LLen(queue.readyKey)
+	for _, priorityKey := range queue.priorityKeys {
+		priorityCount, _ := queue.redisClient.LLen(priorityKey)
+		count += priorityCount
+	}
 	return count
 }
 
+// UnackedCount returns the number of deliveries this connection is consuming
 func (queue *redisQueue) UnackedCount() int {
 	count, _ := queue.redisClient.LLen(queue.unackedKey)
 	return count
 }
 
+// InFlightCount returns the number of deliveries this connection fetched but
+// didn't ack, reject or push yet. It's the same as UnackedCount.
+func (queue *redisQueue) InFlightCount() int {
+	return queue.UnackedCount()
+}
+
+// WaitEmpty blocks until the queue has neither ready nor unacked deliveries
+// on any connection. Returns the context's error if it's done before that.
+func (queue *redisQueue) WaitEmpty(ctx context.Context) error {
+	ticker := time.NewTicker(emptyPollDuration)
+	defer ticker.Stop()
+	for {
+		if queue.isEmpty() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (queue *redisQueue) isEmpty() bool {
+	if queue.ReadyCount() > 0 {
+		return false
+	}
+	unackedKeys, err := queue.unackedKeys()
+	if err != nil {
+		return false
+	}
+	for _, unackedKey := range unackedKeys {
+		if count, err := queue.redisClient.LLen(unackedKey); err != nil || count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// RejectedCount returns the number of rejected deliveries
 func (queue *redisQueue) RejectedCount() int {
 	count, _ := queue.redisClient.LLen(queue.rejectedKey)
 	return count
 }
 
+// Peek returns the payloads of up to count ready deliveries starting at index
+// from without consuming them. The indexes are like in redis, 0 is the
+// youngest delivery and -1 the oldest one, which gets consumed next by FIFO
+// queues. Deliveries published with a priority aren't included.
+func (queue *redisQueue) Peek(from, count int) ([]string, error) {
+	if count <= 0 {
+		return []string{}, nil
+	}
+
+	to := from + count - 1
+	if from < 0 && to >= 0 {
+		to = -1 // don't wrap around to the head
+	}
+
+	values, err := queue.redisClient.LRange(queue.readyKey, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("rmq queue failed to peek %s: %w", queue, err)
+	}
+	payloads := make([]string, len(values))
+	for i, value := range values {
+		payloads[i], _ = decodeEnvelope(value)
+	}
+	return payloads, nil
+}
+
 // ReturnAllUnacked moves all unacked deliveries back to the ready
 // queue and deletes the unacked key afterwards, returns number of returned
 // deliveries
 func (queue *redisQueue) ReturnAllUnacked() int {
-	count, ok := queue.redisClient.LLen(queue.unackedKey)
-	if !ok {
+	count, err := queue.redisClient.LLen(queue.unackedKey)
+	if err != nil {
+		return 0
+	}
+	return queue.ReturnUnacked(count)
+}
+
+// ReturnUnacked tries to return count unacked deliveries of this connection
+// back to the ready list and returns the number of returned deliveries, which
+// is less than count if there are fewer unacked deliveries. Use it to recover
+// the deliveries of crashed consumers without waiting for the cleaner. The
+// oldest unacked deliveries get returned first. Deliveries which are still
+// being consumed get returned too, so stop consuming before.
+func (queue *redisQueue) ReturnUnacked(count int) int {
+	if count <= 0 {
 		return 0
 	}
 
-	unackedCount := count
-	for i := 0; i < unackedCount; i++ {
-		if _, ok := queue.redisClient.RPopLPush(queue.unackedKey, queue.readyKey); !ok {
+	for i := 0; i < count; i++ {
+		if _, err := queue.redisClient.RPopLPush(queue.unackedKey, queue.readyKey); err != nil {
 			return i
 		}
 		// debug(fmt.Sprintf("rmq queue returned unacked delivery %s %s", count, queue.readyKey)) // COMMENTOUT
 	}
 
-	return unackedCount
+	return count
 }
 
 // ReturnAllRejected moves all rejected deliveries back to the ready
@@ -167,15 +657,17 @@ func (queue *redisQueue) ReturnAllRejected() int {
 }
 
 // ReturnRejected tries to return count rejected deliveries back to
-// the ready list and returns the number of returned deliveries
+// the ready list and returns the number of returned deliveries, which is less
+// than count if there are fewer rejected deliveries. The oldest rejected
+// deliveries get returned first, like new deliveries they get consumed after
+// the ones which are already ready.
 func (queue *redisQueue) ReturnRejected(count int) int {
-	if count == 0 {
+	if count <= 0 {
 		return 0
 	}
 
 	for i := 0; i < count; i++ {
-		_, ok := queue.redisClient.RPopLPush(queue.rejectedKey, queue.readyKey)
-		if !ok {
+		if _, err := queue.redisClient.RPopLPush(queue.rejectedKey, queue.readyKey); err != nil {
 			return i
 		}
 		// debug(fmt.Sprintf("rmq queue returned rejected delivery %s %s", value, queue.readyKey)) // COMMENTOUT
@@ -187,6 +679,7 @@ func (queue *redisQueue) ReturnRejected(count int) int {
 // CloseInConnection closes the queue in the associated connection by removing all related keys
 func (queue *redisQueue) CloseInConnection() {
 	queue.redisClient.Del(queue.unackedKey)
+	queue.redisClient.Del(queue.leasesKey)
 	queue.redisClient.Del(queue.consumersKey)
 	queue.redisClient.SRem(queue.queuesKey, queue.name)
 }
@@ -200,39 +693,312 @@ func (queue *redisQueue) SetPushQueue(pushQueue Queue) {
 	queue.pushKey = redisPushQueue.readyKey
 }
 
+// SetDispatchTimeout limits how long a fetched delivery waits to be handed
+// to a consumer. If no consumer takes it in time it gets moved back to the
+// ready list (as youngest delivery) and fetching pauses for pollDuration.
+// With a dispatch timeout deliveries are fetched one at a time instead of
+// being buffered up to prefetchLimit. Must be called before StartConsuming.
+func (queue *redisQueue) SetDispatchTimeout(timeout time.Duration) {
+	queue.dispatchTimeout = timeout
+}
+
+// SetReturnBufferedOnStop makes the queue return fetched deliveries which no
+// consumer took yet from the prefetch buffer to the front of the ready list
+// once it stops consuming. Otherwise they get consumed before the consumers
+// return, or stay unacked until the cleaner returns them if the process exits
+// first. Enable it for fast failover, like during rolling deploys. Must be
+// called before StartConsuming.
+func (queue *redisQueue) SetReturnBufferedOnStop(enabled bool) {
+	queue.returnBuffered = enabled
+}
+
+// SetGlobalConcurrency limits the number of deliveries of this queue being
+// consumed at the same time across all connections. Each fetched delivery
+// holds one of n slots in redis until it gets acked, rejected or pushed. If
+// no slot is free deliveries stay in ready. The heartbeat of the connection
+// keeps the slots of deliveries in flight, slots of crashed consumers expire
+// after globalSlotDuration. Must be called before StartConsuming.
+func (queue *redisQueue) SetGlobalConcurrency(n int) {
+	queue.slotKeys = nil
+	for i := 1; i <= n; i++ {
+		slotKey := strings.Replace(queue.key(queueSlotTemplate), phQueue, queue.name, 1)
+		queue.slotKeys = append(queue.slotKeys, strings.Replace(slotKey, phSlot, strconv.Itoa(i), 1))
+	}
+}
+
+// SetAttemptTracking enables counting how often each delivery got fetched, see
+// Delivery.Attempts(). The counts are stored in redis so they survive restarts
+// and get deleted when the delivery is acked or pushed. Deliveries are
+// identified by their payload, so equal payloads share a count. Must be
+// called before StartConsuming.
+func (queue *redisQueue) SetAttemptTracking(enabled bool) {
+	queue.attemptsKey = ""
+	if enabled {
+		queue.attemptsKey = strings.Replace(queue.key(queueAttemptsTemplate), phQueue, queue.name, 1)
+	}
+}
+
+// SetMaxMessageBytes limits the size of published payloads to maxBytes,
+// including the headers of deliveries published with them. Publishing larger
+// payloads fails without contacting redis, so a faulty publisher can't fill up
+// redis. Pass 0 to disable, which is the default.
+func (queue *redisQueue) SetMaxMessageBytes(maxBytes int) {
+	queue.maxMessageBytes = maxBytes
+}
+
+// tooLarge returns whether any of the payloads exceeds the max message size
+func (queue *redisQueue) tooLarge(payloads ...string) bool {
+	if queue.maxMessageBytes <= 0 {
+		return false
+	}
+	for _, payload := range payloads {
+		if len(payload) > queue.maxMessageBytes {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMaxRejects makes deliveries which got rejected more than maxRejects times
+// get pushed to the push queue instead of being rejected again, so the push
+// queue can serve as dead letter queue, see SetPushQueue. Without push queue
+// they keep getting rejected. Like attempts the rejections are counted in
+// redis by payload, see Delivery.RejectCount(). Pass 0 to disable. Must be
+// called before StartConsuming.
+func (queue *redisQueue) SetMaxRejects(maxRejects int) {
+	queue.maxRejects = maxRejects
+	queue.rejectsKey = ""
+	if maxRejects > 0 {
+		queue.rejectsKey = strings.Replace(queue.key(queueRejectsTemplate), phQueue, queue.name, 1)
+	}
+}
+
+// SetConsumeOrder sets whether the oldest (FIFO, the default) or the youngest
+// (LIFO) ready delivery gets consumed next. Must be called before StartConsuming.
+func (queue *redisQueue) SetConsumeOrder(order ConsumeOrder) {
+	queue.consumeOrder = order
+}
+
+// SetIdleCallback sets a function which gets called when no delivery was
+// fetched for idleDuration, and again after each further idleDuration as long
+// as the queue stays idle. It's called from the goroutine fetching deliveries,
+// so keep it short. Must be called before StartConsuming.
+func (queue *redisQueue) SetIdleCallback(idleDuration time.Duration, onIdle func()) {
+	queue.idleDuration = idleDuration
+	queue.onIdle = onIdle
+}
+
+// SetPanicHandler sets a function which gets called when a consumer panics.
+// Panicking consumers keep consuming, the deliveries they were consuming get
+// rejected unless they were acked or rejected already. Without handler the
+// panics get logged. Must be called before StartConsuming.
+func (queue *redisQueue) SetPanicHandler(handler PanicHandler) {
+	queue.panicHandler = handler
+}
+
+// SetPropagator sets the propagator which injects context values into the
+// headers of deliveries published with PublishWithContext and extracts them
+// into Delivery.Context() of consumed deliveries. Publishers and consumers
+// need to set the same propagator. Must be called before StartConsuming.
+func (queue *redisQueue) SetPropagator(propagator Propagator) {
+	queue.propagator = propagator
+}
+
+// SetLeaseDuration gives each fetched delivery a lease of the given duration.
+// The cleaner returns deliveries whose lease expired to ready, even if their
+// connection is still alive, so a stuck consumer doesn't hold on to them
+// forever. Consumers which take longer need to extend the lease with
+// Delivery.Touch(). The connection heartbeat still applies: once it expired
+// the cleaner returns all unacked deliveries of the connection regardless of
+// their leases. Pass 0 to disable. Must be called before StartConsuming.
+func (queue *redisQueue) SetLeaseDuration(duration time.Duration) {
+	queue.leaseDuration = duration
+}
+
 // StartConsuming starts consuming into a channel of size prefetchLimit
 // must be called before consumers can be added!
 // pollDuration is the duration the queue sleeps before checking for new deliveries
-func (queue *redisQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
+// returns an error without starting to consume if redis can't be reached
+// Once it returns the poll goroutine is running and its first fetch hasn't
+// started yet. So deliveries published before StartConsuming returned get
+// fetched by that first fetch, up to the prefetch limit, without waiting for
+// pollDuration. Deliveries published later may have to wait for the next poll.
+func (queue *redisQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	return queue.startConsuming(context.Background(), prefetchLimit, ConsumerPollConfig{MinInterval: pollDuration, MaxInterval: pollDuration})
+}
+
+// StartConsumingWithContext is like StartConsuming, but stops consuming like
+// StopConsuming once ctx is done. Consumers finish the deliveries which were
+// already fetched. Deliveries return ctx from their Context method.
+func (queue *redisQueue) StartConsumingWithContext(ctx context.Context, prefetchLimit int, pollDuration time.Duration) error {
+	return queue.startConsuming(ctx, prefetchLimit, ConsumerPollConfig{MinInterval: pollDuration, MaxInterval: pollDuration})
+}
+
+// StartConsumingWithPollConfig is like StartConsuming, but backs off
+// exponentially while the queue is empty, which saves redis round-trips for
+// queues which are empty most of the time, see ConsumerPollConfig
+func (queue *redisQueue) StartConsumingWithPollConfig(prefetchLimit int, pollConfig ConsumerPollConfig) error {
+	return queue.startConsuming(context.Background(), prefetchLimit, pollConfig)
+}
+
+// StartConsumingRecover is like StartConsuming, but first moves the unacked
+// deliveries this connection left in the queue back to the ready list, for
+// example after consumers crashed and the queue was reopened. It returns how
+// many were returned. Only this connection's unacked list is touched, those of
+// other connections are left to the cleaner. Note that a restarted process
+// opens a new connection with a new name, see ReturnUnackedOf for that.
+func (queue *redisQueue) StartConsumingRecover(prefetchLimit int, pollDuration time.Duration) (returned int, err error) {
 	if queue.deliveryChan != nil {
-		return false // already consuming
+		return 0, ErrAlreadyConsuming // would return deliveries we're consuming
+	}
+
+	count, err := queue.redisClient.LLen(queue.unackedKey)
+	if err != nil {
+		return 0, fmt.Errorf("rmq queue failed to recover unacked %s: %w", queue, err)
+	}
+	returned = queue.ReturnUnacked(count)
+	if returned < count {
+		return returned, fmt.Errorf("rmq queue failed to recover unacked %s: returned %d of %d", queue, returned, count)
+	}
+
+	return returned, queue.StartConsuming(prefetchLimit, pollDuration)
+}
+
+func (queue *redisQueue) startConsuming(ctx context.Context, prefetchLimit int, pollConfig ConsumerPollConfig) error {
+	if queue.deliveryChan != nil {
+		return ErrAlreadyConsuming
+	}
+	if queue.connection != nil && queue.connection.inspectionOnly {
+		return ErrInspectionOnly
+	}
+
+	if err := queue.redisClient.Ping(); err != nil {
+		return fmt.Errorf("rmq queue failed to start consuming %s: %w", queue, err)
 	}
 
 	// add queue to list of queues consumed on this connection
-	if ok := queue.redisClient.SAdd(queue.queuesKey, queue.name); !ok {
-		log.Panicf("rmq queue failed to start consuming %s", queue)
+	if err := queue.redisClient.SAdd(queue.queuesKey, queue.name); err != nil {
+		return fmt.Errorf("rmq queue failed to start consuming %s: %w", queue, err)
 	}
 
-	queue.prefetchLimit = prefetchLimit
-	queue.pollDuration = pollDuration
-	queue.deliveryChan = make(chan Delivery, prefetchLimit)
+	queue.prefetchLimit = int64(prefetchLimit)
+	queue.maxPrefetchLimit = prefetchLimit
+	queue.pollDuration = pollConfig.MinInterval
+	queue.maxPollDuration = pollConfig.MaxInterval
+	if queue.maxPollDuration < queue.pollDuration {
+		queue.maxPollDuration = queue.pollDuration
+	}
+	queue.ctx = ctx
+	if queue.dispatchTimeout > 0 {
+		queue.deliveryChan = make(chan Delivery) // hand over directly so we notice busy consumers
+	} else {
+		queue.deliveryChan = make(chan Delivery, prefetchLimit)
+	}
 	atomic.StoreInt32(&queue.consumingStopped, 0)
-	// log.Printf("rmq queue started consuming %s %d %s", queue, prefetchLimit, pollDuration)
-	go queue.consume()
-	return true
+	if queue.connection != nil {
+		queue.connection.addConsumingQueue(queue)
+	}
+	// log.Printf("rmq queue started consuming %s %d %s", queue, prefetchLimit, pollConfig.MinInterval)
+	started := make(chan struct{})
+	go queue.consume(started)
+	<-started // see StartConsuming
+	return nil
+}
+
+// SetPrefetchLimit changes the prefetch limit while consuming, it takes effect
+// on the next fetch. Deliveries which were already fetched stay unacked, so
+// after lowering the limit fetching pauses until consumers caught up. The
+// limit can't be raised above the one passed to StartConsuming as that's the
+// size of the prefetch buffer.
+func (queue *redisQueue) SetPrefetchLimit(prefetchLimit int) {
+	if prefetchLimit > queue.maxPrefetchLimit {
+		prefetchLimit = queue.maxPrefetchLimit
+	}
+	if prefetchLimit < 0 {
+		prefetchLimit = 0
+	}
+	atomic.StoreInt64(&queue.prefetchLimit, int64(prefetchLimit))
+}
+
+// StartConsumingN is like StartConsuming, but stops consuming after n
+// deliveries have been fetched. If the queue holds less than n deliveries it
+// keeps waiting for new ones. Once the consumers have returned from consuming
+// all n deliveries the returned channel receives n and gets closed. Call
+// StopConsuming to give up early, then it receives the number of deliveries
+// which were consumed until the consumers returned. Returns an error if n
+// isn't positive.
+func (queue *redisQueue) StartConsumingN(n, prefetchLimit int, pollDuration time.Duration) (<-chan int, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("rmq queue can't consume %d deliveries %s", n, queue)
+	}
+	if queue.deliveryChan != nil {
+		return nil, ErrAlreadyConsuming
+	}
+
+	queue.fetchLimit = n
+	queue.consumedAll = make(chan int, 1)
+	if err := queue.StartConsuming(prefetchLimit, pollDuration); err != nil {
+		queue.fetchLimit = 0
+		return nil, err
+	}
+
+	return queue.consumedAll, nil
+}
+
+// ConsumeChannel starts consuming like StartConsuming, but instead of calling
+// consumers it passes the deliveries to the returned channel, so they can be
+// selected on together with other events. Ack or reject each delivery. The
+// channel gets closed once consuming stopped and all fetched deliveries were
+// received, so keep receiving until then, otherwise StopConsuming blocks.
+func (queue *redisQueue) ConsumeChannel(prefetchLimit int, pollDuration time.Duration) (<-chan Delivery, error) {
+	if err := queue.StartConsuming(prefetchLimit, pollDuration); err != nil {
+		return nil, err
+	}
+
+	_, handle, err := queue.addConsumer("channel")
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make(chan Delivery)
+	queue.stopWg.Add(1)
+	go func() {
+		defer close(deliveries)
+		queue.consumerConsume(ConsumerFunc(func(delivery Delivery) {
+			deliveries <- delivery
+		}), handle, false, nil)
+	}()
+	return deliveries, nil
+}
+
+// PauseConsuming stops fetching new deliveries until ResumeConsuming gets
+// called, for example during maintenance. Unlike StopConsuming the consumers
+// stay registered and keep consuming the deliveries which were fetched
+// already, those can be acked and rejected as usual.
+func (queue *redisQueue) PauseConsuming() {
+	atomic.StoreInt32(&queue.consumingPaused, 1)
+}
+
+// ResumeConsuming continues fetching deliveries after PauseConsuming with the
+// same consumers and prefetch limit, it takes effect on the next poll
+func (queue *redisQueue) ResumeConsuming() {
+	atomic.StoreInt32(&queue.consumingPaused, 0)
 }
 
 func (queue *redisQueue) StopConsuming() <-chan struct{} {
 	finishedChan := make(chan struct{})
-	if queue.deliveryChan == nil || atomic.LoadInt32(&queue.consumingStopped) == int32(1) {
-		close(finishedChan) // not consuming or already stopped
+	if queue.deliveryChan == nil {
+		close(finishedChan) // not consuming
 		return finishedChan
 	}
 
 	// log.Printf("rmq queue stopping %s", queue)
 	atomic.StoreInt32(&queue.consumingStopped, 1)
-	go func() {
+	go func() { // also wait if already stopped, the consumers might still be busy
 		queue.stopWg.Wait()
+		queue.removeConsumerDescriptions()
+		if queue.fetchLimit > 0 {
+			queue.finishConsumingN()
+		}
 		close(finishedChan)
 		// log.Printf("rmq queue stopped consuming %s", queue)
 	}()
@@ -240,56 +1006,223 @@ func (queue *redisQueue) StopConsuming() <-chan struct{} {
 	return finishedChan
 }
 
-// AddConsumer adds a consumer to the queue and returns its internal name
-// panics if StartConsuming wasn't called before!
-func (queue *redisQueue) AddConsumer(tag string, consumer Consumer) string {
+// StopConsumingAndWait stops fetching deliveries like StopConsuming and waits
+// until the consumers consumed all fetched deliveries and returned. Returns
+// the context's error if it's done before that, then the remaining fetched
+// deliveries stay unacked until the cleaner returns them.
+func (queue *redisQueue) StopConsumingAndWait(ctx context.Context) error {
+	select {
+	case <-queue.StopConsuming():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AddConsumer adds a consumer to the queue and returns its internal name. It
+// returns ErrConsumerTagTaken if a consumer with the same tag was added to
+// this queue by this connection before, as it's most likely a configuration
+// mistake. Returns an error if StartConsuming wasn't called before.
+func (queue *redisQueue) AddConsumer(tag string, consumer Consumer) (string, error) {
+	name, handle, err := queue.addConsumer(tag)
+	if err != nil {
+		return "", err
+	}
 	queue.stopWg.Add(1)
-	name := queue.addConsumer(tag)
-	go queue.consumerConsume(consumer)
-	return name
+	go queue.consumerConsume(queue.withMiddlewares(consumer), handle, false, nil)
+	return name, nil
+}
+
+// AddConsumerWithConcurrency adds concurrency consumers which share the
+// consumer value, so it must be safe for concurrent use. It returns their
+// names. Unlike with AddConsumer, deliveries being consumed by them still
+// count against the prefetch limit until Consume returns. So at most
+// prefetchLimit deliveries are fetched at once and with concurrency above the
+// prefetch limit some consumers stay idle. With concurrency below it the
+// remaining deliveries wait in the prefetch buffer. The consumers get the
+// tags tag-1 to tag-concurrency, if one of them is taken none get added and
+// it returns ErrConsumerTagTaken like AddConsumer.
+func (queue *redisQueue) AddConsumerWithConcurrency(tag string, concurrency int, consumer Consumer) ([]string, error) {
+	names := make([]string, 0, concurrency)
+	consumer = queue.withMiddlewares(consumer)
+	for i := 1; i <= concurrency; i++ {
+		name, handle, err := queue.addConsumer(fmt.Sprintf("%s-%d", tag, i))
+		if err != nil {
+			for _, name := range names {
+				queue.RemoveConsumer(name)
+			}
+			return nil, err
+		}
+		queue.stopWg.Add(1)
+		go queue.consumerConsume(consumer, handle, true, nil)
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// AddConsumerWithRateLimit is like AddConsumer, but the consumer takes at
+// most perSecond deliveries per second. It waits for its turn before taking a
+// delivery from the prefetch buffer, so with a low prefetch limit only a few
+// deliveries are unacked while it's throttled. When consuming stops it still
+// consumes the fetched deliveries at its rate. panics if perSecond isn't
+// positive!
+func (queue *redisQueue) AddConsumerWithRateLimit(tag string, perSecond float64, consumer Consumer) (string, error) {
+	return queue.AddConsumerWithRateLimiter(tag, NewRateLimiter(perSecond), consumer)
 }
 
-func (queue *redisQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) string {
+// AddConsumerWithRateLimiter is like AddConsumerWithRateLimit, but with the
+// given limiter. Consumers sharing a limiter take at most its rate of
+// deliveries per second together.
+func (queue *redisQueue) AddConsumerWithRateLimiter(tag string, limiter *RateLimiter, consumer Consumer) (string, error) {
+	name, handle, err := queue.addConsumer(tag)
+	if err != nil {
+		return "", err
+	}
+	queue.stopWg.Add(1)
+	go queue.consumerConsume(queue.withMiddlewares(consumer), handle, false, limiter)
+	return name, nil
+}
+
+// AddConsumerFunc is like AddConsumer for a consumer function
+func (queue *redisQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (string, error) {
 	return queue.AddConsumer(tag, consumerFunc)
 }
 
+// AddConsumerWithDescription is similar to AddConsumer, but also registers a
+// human readable description which shows up in the stats of this process
+func (queue *redisQueue) AddConsumerWithDescription(tag, description string, consumer Consumer) (string, error) {
+	name, handle, err := queue.addConsumer(tag)
+	if err != nil {
+		return "", err
+	}
+	setConsumerDescription(name, description)
+	queue.stopWg.Add(1)
+	go queue.consumerConsume(queue.withMiddlewares(consumer), handle, false, nil)
+	return name, nil
+}
+
 // AddBatchConsumer is similar to AddConsumer, but for batches of deliveries
-func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
+func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) (string, error) {
 	return queue.AddBatchConsumerWithTimeout(tag, batchSize, defaultBatchTimeout, consumer)
 }
 
 // Timeout limits the amount of time waiting to fill an entire batch
 // The timer is only started when the first message in a batch is received
-func (queue *redisQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
+func (queue *redisQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) (string, error) {
+	name, handle, err := queue.addConsumer(tag)
+	if err != nil {
+		return "", err
+	}
+	queue.stopWg.Add(1)
+	go queue.consumerBatchConsume(batchSize, timeout, consumer, handle)
+	return name, nil
+}
+
+// AddCommitConsumer is similar to AddConsumer, but the consumer acks all
+// deliveries since its last commit at once, see CommitConsumer
+func (queue *redisQueue) AddCommitConsumer(tag string, consumer CommitConsumer) (string, error) {
+	name, handle, err := queue.addConsumer(tag)
+	if err != nil {
+		return "", err
+	}
 	queue.stopWg.Add(1)
-	name := queue.addConsumer(tag)
-	go queue.consumerBatchConsume(batchSize, timeout, consumer)
-	return name
+	go queue.consumerCommitConsume(consumer, handle)
+	return name, nil
 }
 
 func (queue *redisQueue) GetConsumers() []string {
-	return queue.redisClient.SMembers(queue.consumersKey)
+	consumers, err := queue.redisClient.SMembers(queue.consumersKey)
+	if err != nil {
+		queue.logger().Printf("rmq queue failed to get consumers %s: %s", queue, err)
+		return []string{}
+	}
+	return consumers
 }
 
-func (queue *redisQueue) RemoveConsumer(name string) bool {
+// RemoveConsumer removes a single consumer from the queue while the other
+// consumers keep running. If the consumer was added to this queue it gets
+// stopped and RemoveConsumer blocks until it finished its current delivery
+// (or batch), so don't call it from within that consumer.
+func (queue *redisQueue) RemoveConsumer(name string) error {
+	queue.consumersMutex.Lock()
+	handle, local := queue.consumerHandles[name]
+	delete(queue.consumerHandles, name)
+	queue.consumersMutex.Unlock()
+
+	if local {
+		close(handle.stop)
+		<-handle.stopped
+	}
+
 	count, _ := queue.redisClient.SRem(queue.consumersKey, name)
-	return count > 0
+	removeConsumerDescription(name)
+	if !local && count == 0 {
+		return fmt.Errorf("rmq queue failed to remove consumer %s %s", queue, name)
+	}
+	queue.connection.emit(Event{Type: ConsumerRemoved, Queue: queue.name, Consumer: name})
+
+	// log.Printf("rmq queue removed consumer %s %s", queue, name)
+	return nil
 }
 
-func (queue *redisQueue) addConsumer(tag string) string {
-	if queue.deliveryChan == nil {
-		log.Panicf("rmq queue failed to add consumer, call StartConsuming first! %s", queue)
+// removeConsumerDescriptions forgets the descriptions of the consumers added
+// to this queue value once they stopped, see AddConsumerWithDescription
+func (queue *redisQueue) removeConsumerDescriptions() {
+	queue.consumersMutex.Lock()
+	defer queue.consumersMutex.Unlock()
+	for name := range queue.consumerHandles {
+		removeConsumerDescription(name)
 	}
+}
 
-	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
+// addConsumer registers a consumer with a new name for the tag, see
+// registerConsumer, and returns its name and handle. Returns an error if
+// StartConsuming wasn't called before.
+func (queue *redisQueue) addConsumer(tag string) (string, consumerHandle, error) {
+	if queue.deliveryChan == nil {
+		return "", consumerHandle{}, fmt.Errorf("rmq queue failed to add consumer, call StartConsuming first! %s", queue)
+	}
 
-	// add consumer to list of consumers of this queue
-	if ok := queue.redisClient.SAdd(queue.consumersKey, name); !ok {
-		log.Panicf("rmq queue failed to add consumer %s %s", queue, tag)
+	name := consumerName(tag)
+	if err := queue.registerConsumer(tag, name); err != nil {
+		return "", consumerHandle{}, err
 	}
 
 	// log.Printf("rmq queue added consumer %s %s", queue, name)
-	return name
+	return name, queue.newConsumerHandle(name), nil
+}
+
+// consumerName returns a new consumer name for the tag
+func consumerName(tag string) string {
+	return fmt.Sprintf("%s-%s", tag, uniuri.NewLen(consumerTokenLength))
+}
+
+// registerConsumer adds the consumer name of the tag to the consumers of this
+// connection. Returns ErrConsumerTagTaken if this connection added a consumer
+// with the same tag to the queue before, as it's most likely a configuration
+// mistake.
+func (queue *redisQueue) registerConsumer(tag, name string) error {
+	result, err := runScript(queue.redisClient, addUniqueConsumerScript, []string{queue.consumersKey}, name, int64(len(tag)))
+	if err != nil {
+		return fmt.Errorf("rmq queue failed to add consumer %s %s: %w", queue, tag, err)
+	}
+	if added, _ := result.(int64); added != 1 {
+		return ErrConsumerTagTaken
+	}
+	return nil
+}
+
+func (queue *redisQueue) newConsumerHandle(name string) consumerHandle {
+	queue.connection.emit(Event{Type: ConsumerAdded, Queue: queue.name, Consumer: name})
+	handle := consumerHandle{
+		name:    name,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	queue.consumersMutex.Lock()
+	queue.consumerHandles[name] = handle
+	queue.consumersMutex.Unlock()
+	return handle
 }
 
 func (queue *redisQueue) RemoveAllConsumers() int {
@@ -297,32 +1230,114 @@ func (queue *redisQueue) RemoveAllConsumers() int {
 	return count
 }
 
-func (queue *redisQueue) consume() {
+// consume fetches deliveries until consuming stops, it closes started before
+// the first fetch
+func (queue *redisQueue) consume(started chan<- struct{}) {
+	queue.lastActive = time.Now()
+	pollDuration := queue.pollDuration
+	close(started)
 	for {
-		batchSize := queue.batchSize()
+		batchSize, empty := queue.batchSize()
 		wantMore := queue.consumeBatch(batchSize)
 
+		if !empty {
+			pollDuration = queue.pollDuration
+		}
 		if !wantMore {
-			time.Sleep(queue.pollDuration)
+			time.Sleep(pollDuration)
+		}
+		if empty && pollDuration < queue.maxPollDuration {
+			pollDuration *= 2 // back off while the queue is empty
+			if pollDuration > queue.maxPollDuration {
+				pollDuration = queue.maxPollDuration
+			}
+		}
+
+		queue.checkIdle()
+
+		if queue.ctx.Err() != nil {
+			atomic.StoreInt32(&queue.consumingStopped, 1) // context done, stop like StopConsuming
 		}
 
 		if atomic.LoadInt32(&queue.consumingStopped) == int32(1) {
 			// log.Printf("rmq queue stopped consuming %s", queue)
+			if queue.returnBuffered {
+				queue.returnBufferedDeliveries()
+			}
 			close(queue.deliveryChan)
+			if queue.fetchedCount < queue.fetchLimit {
+				go func() { // stopped early, count what the consumers finished
+					queue.stopWg.Wait()
+					queue.finishConsumingN()
+				}()
+			}
 			// log.Printf("rmq queue stopped fetching %s", queue)
 			return
 		}
 	}
 }
 
-func (queue *redisQueue) batchSize() int {
-	prefetchCount := len(queue.deliveryChan)
-	prefetchLimit := queue.prefetchLimit - prefetchCount
+// returnBufferedDeliveries takes the deliveries no consumer took yet from the
+// prefetch buffer and returns them to the front of the ready list, in reverse
+// so they keep their order
+func (queue *redisQueue) returnBufferedDeliveries() {
+	buffered := []*wrapDelivery{}
+	for len(queue.deliveryChan) > 0 {
+		select {
+		case delivery := <-queue.deliveryChan:
+			buffered = append(buffered, delivery.(*wrapDelivery))
+		default: // a consumer took the last one
+		}
+	}
+	queue.received(len(buffered))
+
+	for i := len(buffered) - 1; i >= 0; i-- {
+		if !buffered[i].requeue(true) {
+			queue.logger().Printf("rmq queue failed to return buffered delivery %s %s", queue, buffered[i])
+		}
+	}
+}
+
+// checkIdle calls onIdle if there was nothing to consume for idleDuration
+func (queue *redisQueue) checkIdle() {
+	if queue.onIdle == nil {
+		return
+	}
+
+	if len(queue.deliveryChan) > 0 || queue.isPaused() { // consumers are still busy or we don't fetch
+		queue.lastActive = time.Now()
+		return
+	}
+
+	if time.Since(queue.lastActive) >= queue.idleDuration {
+		queue.onIdle()
+		queue.lastActive = time.Now()
+	}
+}
+
+func (queue *redisQueue) isPaused() bool {
+	return atomic.LoadInt32(&queue.consumingPaused) == 1
+}
+
+// batchSize returns how many deliveries to fetch next, empty is true if there
+// are no ready deliveries
+func (queue *redisQueue) batchSize() (batchSize int, empty bool) {
+	if queue.isPaused() {
+		return 0, false
+	}
+	prefetchCount := int(atomic.LoadInt64(&queue.prefetchedCount))
+	prefetchLimit := int(atomic.LoadInt64(&queue.prefetchLimit)) - prefetchCount
+	if prefetchLimit < 0 { // limit got lowered, wait for consumers
+		return 0, false
+	}
+	if queue.fetchLimit > 0 && queue.fetchLimit-queue.fetchedCount < prefetchLimit {
+		prefetchLimit = queue.fetchLimit - queue.fetchedCount
+	}
 	// TODO: ignore ready count here and just return prefetchLimit?
 	if readyCount := queue.ReadyCount(); readyCount < prefetchLimit {
-		return readyCount
+		return readyCount, readyCount == 0
 	}
-	return prefetchLimit
+	return prefetchLimit, false
 }
 
 // consumeBatch tries to read batchSize deliveries, returns true if any and all were consumed
@@ -332,42 +1347,223 @@ func (queue *redisQueue) consumeBatch(batchSize int) bool {
 	}
 
 	for i := 0; i < batchSize; i++ {
-		value, ok := queue.redisClient.RPopLPush(queue.readyKey, queue.unackedKey)
-		if !ok {
+		if atomic.LoadInt32(&queue.consumingStopped) == int32(1) || queue.isPaused() {
+			return false // don't fetch more once StopConsuming or PauseConsuming was called
+		}
+
+		slot := slot{}
+		if len(queue.slotKeys) > 0 {
+			var ok bool
+			if slot, ok = acquireSlot(queue.redisClient, queue.slotKeys, queue.heldSlots); !ok {
+				// debug(fmt.Sprintf("rmq queue found no free slot %s", queue)) // COMMENTOUT
+				return false
+			}
+		}
+
+		value, err := queue.fetch()
+		if err != nil {
+			slot.release(queue.redisClient)
+			if err != ErrNotFound {
+				queue.logger().Printf("rmq queue failed to fetch delivery %s: %s", queue, err)
+			}
 			// debug(fmt.Sprintf("rmq queue consumed last batch %s %d", queue, i)) // COMMENTOUT
 			return false
 		}
 
 		// debug(fmt.Sprintf("consume %d/%d %s %s", i, batchSize, value, queue)) // COMMENTOUT
-		queue.deliveryChan <- newDelivery(value, queue.unackedKey, queue.rejectedKey, queue.pushKey, queue.redisClient)
+		delivery, ok := queue.prepareDelivery(value, slot)
+		if !ok {
+			continue
+		}
+		queue.lastActive = time.Now()
+		atomic.AddInt64(&queue.prefetchedCount, 1) // before dispatching so consumers can't decrement first
+		if !queue.dispatch(delivery) {
+			atomic.AddInt64(&queue.prefetchedCount, -1)
+			return false
+		}
+
+		if queue.fetchLimit > 0 {
+			queue.fetchedCount++
+			if queue.fetchedCount >= queue.fetchLimit {
+				atomic.StoreInt32(&queue.consumingStopped, 1) // fetched enough, stop like StopConsuming
+				return true
+			}
+		}
 	}
 
 	// debug(fmt.Sprintf("rmq queue consumed batch %s %d", queue, batchSize)) // COMMENTOUT
 	return true
 }
 
-func (queue *redisQueue) consumerConsume(consumer Consumer) {
-	for delivery := range queue.deliveryChan {
-		// debug(fmt.Sprintf("consumer consume %s %s", delivery, consumer)) // COMMENTOUT
-		consumer.Consume(delivery)
+// prepareDelivery sets up the delivery of a fetched value to be passed to a
+// consumer, holding the global concurrency slot. Returns false if the
+// delivery expired, then it was acked instead.
+func (queue *redisQueue) prepareDelivery(value string, slot slot) (*wrapDelivery, bool) {
+	delivery := newDelivery(value, queue.readyKey, queue.unackedKey, queue.rejectedKey, queue.pushKey, queue.redisClient)
+	delivery.slot = slot
+	if delivery.Expired() {
+		// debug(fmt.Sprintf("rmq queue discarded expired delivery %s %s", queue, delivery)) // COMMENTOUT
+		delivery.Ack()
+		return nil, false
+	}
+	delivery.ctx = queue.ctx
+	if queue.propagator != nil && len(delivery.headers) > 0 {
+		delivery.ctx = queue.propagator.Extract(delivery.Context(), delivery.headers)
+	}
+	if queue.attemptsKey != "" {
+		attempts, _ := queue.redisClient.HIncrBy(queue.attemptsKey, value, 1)
+		delivery.attemptsKey = queue.attemptsKey
+		delivery.attempts = int(attempts)
+	}
+	delivery.rejectsKey = queue.rejectsKey
+	delivery.retriesKey = queue.retriesKey
+	delivery.errorsKey = queue.errorsKey
+	delivery.namespace = queue.namespace
+	delivery.maxRejects = queue.maxRejects
+	delivery.consumeOrder = queue.consumeOrder
+	delivery.codec = queue.codec
+	delivery.connection = queue.connectionName
+	delivery.logger = queue.logger()
+	if queue.leaseDuration > 0 {
+		if err := queue.lease(delivery); err != nil {
+			// the connection heartbeat still protects it
+			queue.logger().Printf("rmq queue failed to lease delivery %s %s: %s", queue, delivery, err)
+		}
 	}
-	queue.stopWg.Done()
+	return delivery, true
 }
 
-func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Duration, consumer BatchConsumer) {
+// fetch moves the next ready delivery to the unacked list and returns it,
+// deliveries with higher priority first. Returns ErrNotFound if there are no
+// ready deliveries.
+func (queue *redisQueue) fetch() (value string, err error) {
+	for i := len(queue.priorityKeys) - 1; i >= 0; i-- {
+		if value, err := queue.fetchFrom(queue.priorityKeys[i]); err != ErrNotFound {
+			return value, err
+		}
+	}
+	return queue.fetchFrom(queue.readyKey)
+}
+
+func (queue *redisQueue) fetchFrom(readyKey string) (value string, err error) {
+	if queue.consumeOrder == LIFO {
+		result, err := runScript(queue.redisClient, lpopLPushScript, []string{readyKey, queue.unackedKey})
+		if err != nil {
+			return "", err
+		}
+		value, _ = result.(string)
+		return value, nil
+	}
+	return queue.redisClient.RPopLPush(readyKey, queue.unackedKey)
+}
+
+// dispatch hands the delivery to a consumer, returns false if it was moved
+// back to ready because no consumer took it within the dispatch timeout
+func (queue *redisQueue) dispatch(delivery *wrapDelivery) bool {
+	if queue.dispatchTimeout <= 0 {
+		queue.deliveryChan <- delivery
+		return true
+	}
+
+	timer := time.NewTimer(queue.dispatchTimeout)
+	defer timer.Stop()
+	select {
+	case queue.deliveryChan <- delivery:
+		return true
+	case <-timer.C:
+		delivery.move(queue.readyKey)
+		// debug(fmt.Sprintf("rmq queue returned undispatched delivery %s %s", delivery, queue)) // COMMENTOUT
+		return false
+	}
+}
+
+// consumerConsume passes deliveries to the consumer until stopped, with
+// countConsuming the delivery being consumed counts against the prefetch limit.
+// With a limiter it waits for its turn before taking each delivery.
+func (queue *redisQueue) consumerConsume(consumer Consumer, handle consumerHandle, countConsuming bool, limiter *RateLimiter) {
 	defer queue.stopWg.Done()
+	defer close(handle.stopped)
+	for {
+		if handle.isStopped() {
+			return
+		}
+		if limiter != nil && !limiter.wait(handle.stop) {
+			return
+		}
+
+		select {
+		case <-handle.stop:
+			return
+		case delivery, ok := <-queue.deliveryChan:
+			if !ok {
+				return
+			}
+			// debug(fmt.Sprintf("consumer consume %s %s", delivery, consumer)) // COMMENTOUT
+			assignConsumer(handle.name, delivery)
+			if !countConsuming {
+				queue.received(1)
+			}
+			queue.consumeDelivery(consumer, delivery)
+			if countConsuming {
+				queue.received(1)
+			}
+			queue.countConsumed(1)
+		}
+	}
+}
+
+func (queue *redisQueue) consumerCommitConsume(consumer CommitConsumer, handle consumerHandle) {
+	defer queue.stopWg.Done()
+	defer close(handle.stopped)
+	committer := &committer{queue: queue}
+	for {
+		if handle.isStopped() {
+			return
+		}
+
+		select {
+		case <-handle.stop:
+			return
+		case delivery, ok := <-queue.deliveryChan:
+			if !ok {
+				return
+			}
+			queue.received(1)
+			assignConsumer(handle.name, delivery)
+			committer.add(delivery.(*wrapDelivery))
+			queue.commitConsumeDelivery(consumer, delivery, committer)
+			queue.countConsumed(1)
+		}
+	}
+}
+
+func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Duration, consumer BatchConsumer, handle consumerHandle) {
+	defer queue.stopWg.Done()
+	defer close(handle.stopped)
 	batch := []Delivery{}
 	for {
+		if handle.isStopped() {
+			return
+		}
+
 		// Wait for first delivery
-		delivery, ok := <-queue.deliveryChan
+		var delivery Delivery
+		ok := false
+		select {
+		case <-handle.stop:
+		case delivery, ok = <-queue.deliveryChan:
+		}
 		if !ok {
 			// debug("batch channel closed") // COMMENTOUT
 			return
 		}
+		queue.received(1)
 		batch = append(batch, delivery)
 		// debug(fmt.Sprintf("batch consume added delivery %d", len(batch))) // COMMENTOUT
-		batch, ok = queue.batchTimeout(batchSize, batch, timeout)
-		consumer.Consume(batch)
+		batch, ok = queue.batchTimeout(batchSize, batch, timeout, handle.stop)
+		assignConsumer(handle.name, batch...)
+		queue.batchConsumeDeliveries(consumer, batch)
+		queue.countConsumed(len(batch))
 		if !ok {
 			// debug("batch channel closed") // COMMENTOUT
 			return
@@ -376,11 +1572,99 @@ func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Durati
 	}
 }
 
-func (queue *redisQueue) batchTimeout(batchSize int, batch []Delivery, timeout time.Duration) (fullBatch []Delivery, ok bool) {
+func (queue *redisQueue) consumeDelivery(consumer Consumer, delivery Delivery) {
+	defer queue.recoverConsumer(delivery)
+	consumer.Consume(delivery)
+}
+
+func (queue *redisQueue) commitConsumeDelivery(consumer CommitConsumer, delivery Delivery, committer *committer) {
+	defer queue.recoverConsumer(delivery)
+	consumer.Consume(delivery, committer.commit)
+}
+
+func (queue *redisQueue) batchConsumeDeliveries(consumer BatchConsumer, batch []Delivery) {
+	defer queue.recoverConsumer(batch...)
+	consumer.Consume(batch)
+}
+
+// recoverConsumer must be deferred around consumer calls, if the consumer
+// panicked it rejects the given deliveries and passes them to the panic handler
+func (queue *redisQueue) recoverConsumer(deliveries ...Delivery) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	for _, delivery := range deliveries {
+		if wrapped, ok := delivery.(*wrapDelivery); ok {
+			wrapped.rejectUnacked()
+		}
+		if queue.panicHandler != nil {
+			queue.panicHandler(delivery, recovered)
+			continue
+		}
+		queue.logger().Printf("rmq queue recovered from consumer panic %s %s: %v", queue, delivery, recovered)
+	}
+}
+
+// assignConsumer records the consumer which took the deliveries, see
+// Delivery.Consumer
+func assignConsumer(name string, deliveries ...Delivery) {
+	for _, delivery := range deliveries {
+		if wrapped, ok := delivery.(*wrapDelivery); ok {
+			wrapped.consumer = name
+		}
+	}
+}
+
+func (handle consumerHandle) isStopped() bool {
+	select {
+	case <-handle.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// received makes room for count more deliveries to be fetched once consumers
+// took them from the prefetch buffer, or finished consuming them if they
+// count against the prefetch limit
+func (queue *redisQueue) received(count int) {
+	atomic.AddInt64(&queue.prefetchedCount, -int64(count))
+}
+
+// countConsumed finishes consuming N once fetchLimit deliveries were consumed
+func (queue *redisQueue) countConsumed(count int) {
+	if queue.fetchLimit == 0 {
+		return
+	}
+
+	if atomic.AddInt64(&queue.consumedCount, int64(count)) == int64(queue.fetchLimit) {
+		queue.finishConsumingN()
+	}
+}
+
+// finishConsumingN sends the number of consumed deliveries to consumedAll and
+// closes it, only the first call does something
+func (queue *redisQueue) finishConsumingN() {
+	queue.consumedAllOnce.Do(func() {
+		queue.consumedAll <- int(atomic.LoadInt64(&queue.consumedCount))
+		close(queue.consumedAll)
+	})
+}
+
+func (queue *redisQueue) batchTimeout(batchSize int, batch []Delivery, timeout time.Duration, stop <-chan struct{}) (fullBatch []Delivery, ok bool) {
+	if len(batch) >= batchSize {
+		return batch, true // already full, don't wait for the timeout
+	}
+
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 	for {
 		select {
+		case <-stop:
+			// debug("batch consumer removed") // COMMENTOUT
+			return batch, false
 		case <-timer.C:
 			// debug("batch timer fired") // COMMENTOUT
 			// debug(fmt.Sprintf("batch consume consume %d", len(batch))) // COMMENTOUT
@@ -390,6 +1674,7 @@ func (queue *redisQueue) batchTimeout(batchSize int, batch []Delivery, timeout t
 				// debug("batch channel closed") // COMMENTOUT
 				return batch, false
 			}
+			queue.received(1)
 			batch = append(batch, delivery)
 			// debug(fmt.Sprintf("batch consume added delivery %d", len(batch))) // COMMENTOUT
 			if len(batch) >= batchSize {
@@ -403,12 +1688,24 @@ func (queue *redisQueue) batchTimeout(batchSize int, batch []Delivery, timeout t
 // return number of deleted list items
 // https://www.redisgreen.net/blog/deleting-large-lists
 func (queue *redisQueue) deleteRedisList(key string) int {
-	total, _ := queue.redisClient.LLen(key)
-	if total == 0 {
+	// move the list out of the way first so we don't delete deliveries which
+	// get published or consumed concurrently
+	purgingKey := strings.Replace(queue.key(queuePurgingTemplate), phQueue, queue.name, 1)
+	purgingKey = strings.Replace(purgingKey, phToken, uniuri.NewLen(8), 1)
+	result, err := runScript(queue.redisClient, renameListScript, []string{key, purgingKey})
+	count, _ := result.(int64)
+	if err != nil || count == 0 {
 		return 0 // nothing to do
 	}
 
-	// delete elements without blocking
+	total := int(count)
+	keys := []string{
+		purgingKey,
+		strings.Replace(queue.key(queueAttemptsTemplate), phQueue, queue.name, 1),
+		strings.Replace(queue.key(queueRejectsTemplate), phQueue, queue.name, 1),
+	}
+
+	// delete elements and their counts without blocking
 	for todo := total; todo > 0; todo -= purgeBatchSize {
 		// minimum of purgeBatchSize and todo
 		batchSize := purgeBatchSize
@@ -417,7 +1714,10 @@ func (queue *redisQueue) deleteRedisList(key string) int {
 		}
 
 		// remove one batch
-		queue.redisClient.LTrim(key, 0, -1-batchSize)
+		if _, err := runScript(queue.redisClient, purgeBatchScript, keys, int64(batchSize)); err != nil {
+			queue.logger().Printf("rmq queue failed to purge list %s %s: %s", queue, purgingKey, err)
+			return total - todo
+		}
 	}
 
 	return total
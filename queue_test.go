@@ -1,12 +1,20 @@
 package rmq
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	. "github.com/adjust/gocheck"
+	"github.com/adjust/uniuri"
+	"github.com/go-redis/redis/v7"
 )
 
 func TestQueueSuite(t *testing.T) {
@@ -22,7 +30,8 @@ func (suite *QueueSuite) TestConnections(c *C) {
 
 	connection := OpenConnection("conns-conn", "tcp", "localhost:6379", 1)
 	c.Assert(connection, NotNil)
-	c.Assert(NewCleaner(connection).Clean(), IsNil)
+	_, err := NewCleaner(connection).Clean()
+	c.Assert(err, IsNil)
 
 	c.Check(connection.GetConnections(), HasLen, 1, Commentf("cleaner %s", connection.Name)) // cleaner connection remains
 
@@ -49,6 +58,467 @@ func (suite *QueueSuite) TestConnections(c *C) {
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestOpenConnectionE(c *C) {
+	connection, err := OpenConnectionE("conn-e", "tcp", "localhost:1", 1) // nothing listening
+	c.Check(connection, IsNil)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, "rmq connection failed to connect conn-e: .*connection refused.*")
+
+	connection, err = OpenConnectionE("conn-e", "tcp", "localhost:6379", 1)
+	c.Assert(err, IsNil)
+	c.Check(connection.(*redisConnection).Check(), Equals, true)
+	connection.(*redisConnection).StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOpenConnectionFromURL(c *C) {
+	_, err := OpenConnectionFromURL("url-conn", "http://localhost:6379/1")
+	c.Check(err, ErrorMatches, "rmq connection failed to parse url url-conn: invalid redis URL scheme: http")
+	_, err = OpenConnectionFromURL("url-conn", "redis://localhost:1/1")
+	c.Check(err, ErrorMatches, "rmq connection failed to connect url-conn: .*connection refused.*")
+
+	connection, err := OpenConnectionFromURL("url-conn", "redis://localhost:6379/1")
+	c.Assert(err, IsNil)
+	conn := connection.(*redisConnection)
+	c.Check(conn.Check(), Equals, true)
+	c.Check(conn.GetConnections(), Not(HasLen), 0) // same db as the other tests
+	conn.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOpenConnectionWithSentinel(c *C) {
+	defer func() {
+		c.Check(recover(), Matches, "rmq connection failed to connect sentinel-conn: .*sentinels are unreachable.*")
+	}()
+	OpenConnectionWithSentinel("sentinel-conn", "mymaster", []string{"localhost:1"}, 1, "")
+	c.Error("expected panic")
+}
+
+func (suite *QueueSuite) TestOpenConnectionWithConfig(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+
+	_, err := OpenConnectionWithConfig("config-conn", redisClient, ConnectionConfig{HeartbeatInterval: time.Second, HeartbeatTTL: 2 * time.Second})
+	c.Check(err, ErrorMatches, "rmq connection config heartbeat interval 1s must be at most a third of heartbeat ttl 2s")
+	_, err = OpenConnectionWithConfig("config-conn", redisClient, ConnectionConfig{HeartbeatInterval: 30 * time.Second}) // default ttl
+	c.Check(err, NotNil)
+
+	connection, err := OpenConnectionWithConfig("config-conn", redisClient, ConnectionConfig{HeartbeatInterval: 10 * time.Millisecond, HeartbeatTTL: 3 * time.Second})
+	c.Assert(err, IsNil)
+	conn := connection.(*redisConnection)
+	c.Check(conn.heartbeatInterval, Equals, 10*time.Millisecond)
+	ttl, _ := conn.redisClient.TTL(conn.heartbeatKey)
+	c.Check(ttl > 0 && ttl <= 3*time.Second, Equals, true, Commentf("ttl %s", ttl))
+	conn.StopHeartbeat()
+
+	connection, err = OpenConnectionWithConfig("config-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	conn = connection.(*redisConnection)
+	c.Check(conn.heartbeatInterval, Equals, time.Second)
+	c.Check(conn.heartbeatTTL, Equals, time.Minute)
+	conn.StopHeartbeat()
+}
+
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (logger *recordingLogger) Printf(format string, args ...interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.messages = append(logger.messages, fmt.Sprintf(format, args...))
+}
+
+func (logger *recordingLogger) Messages() []string {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return append([]string(nil), logger.messages...)
+}
+
+func (suite *QueueSuite) TestConnectionLogger(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	logger := &recordingLogger{}
+	debugLogger := &recordingLogger{}
+
+	connection, err := OpenConnectionWithConfig("logger-conn", redisClient, ConnectionConfig{
+		HeartbeatInterval: 10 * time.Millisecond,
+		Logger:            logger,
+		DebugLogger:       debugLogger,
+	})
+	c.Assert(err, IsNil)
+	conn := connection.(*redisConnection)
+	time.Sleep(35 * time.Millisecond)
+	conn.StopHeartbeat()
+	time.Sleep(15 * time.Millisecond)
+
+	c.Check(logger.Messages(), HasLen, 0)
+	messages := debugLogger.Messages()
+	c.Assert(len(messages) >= 4, Equals, true, Commentf("%v", messages))
+	c.Check(messages[0], Equals, "rmq connection connected "+conn.Name)
+	c.Check(messages[1], Equals, "rmq connection updated heartbeat "+conn.Name)
+	c.Check(messages[len(messages)-1], Equals, "rmq connection stopped heartbeat "+conn.Name)
+
+	// defaults
+	conn = OpenConnection("logger-conn", "tcp", "localhost:6379", 1)
+	c.Check(conn.logger, Equals, Logger(stdLogger{}))
+	c.Check(conn.debugLogger, Equals, Logger(noopLogger{}))
+	conn.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestHeartbeatLogInterval(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	updates := func(config ConnectionConfig) int {
+		debugLogger := &recordingLogger{}
+		config.HeartbeatInterval = 5 * time.Millisecond
+		config.DebugLogger = debugLogger
+		connection, err := OpenConnectionWithConfig("hb-log-conn", redisClient, config)
+		c.Assert(err, IsNil)
+		time.Sleep(102 * time.Millisecond) // 20 ticks
+		connection.(*redisConnection).StopHeartbeat()
+
+		count := 0
+		for _, message := range debugLogger.Messages() {
+			if strings.HasPrefix(message, "rmq connection updated heartbeat") {
+				count++
+			}
+		}
+		return count
+	}
+
+	// every update by default
+	count := updates(ConnectionConfig{})
+	c.Check(count >= 15 && count <= 20, Equals, true, Commentf("%d", count))
+
+	// every fifth update
+	count = updates(ConnectionConfig{HeartbeatLogInterval: 25 * time.Millisecond})
+	c.Check(count >= 3 && count <= 4, Equals, true, Commentf("%d", count))
+
+	// never
+	c.Check(updates(ConnectionConfig{HeartbeatLogInterval: -1}), Equals, 0)
+}
+
+func (suite *QueueSuite) TestHeartbeatLost(c *C) {
+	redisClient := NewTestRedisClient()
+	lost := make(chan int, 10)
+	restored := make(chan struct{}, 10)
+	connection, err := openConnectionWithRedisClient("hb-lost-conn", redisClient, ConnectionConfig{
+		HeartbeatInterval:   5 * time.Millisecond,
+		HeartbeatTTL:        60 * time.Millisecond,
+		Logger:              &recordingLogger{},
+		OnHeartbeatLost:     func(consecutiveFailures int) { lost <- consecutiveFailures },
+		OnHeartbeatRestored: func() { restored <- struct{}{} },
+	})
+	c.Assert(err, IsNil)
+
+	// the interval doubles with each failure up to a third of the ttl
+	c.Check(connection.heartbeatWait(0), Equals, 5*time.Millisecond)
+	c.Check(connection.heartbeatWait(1), Equals, 10*time.Millisecond)
+	c.Check(connection.heartbeatWait(2), Equals, 20*time.Millisecond)
+	c.Check(connection.heartbeatWait(10), Equals, 20*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		redisClient.FailNext("Set", errors.New("redis down"))
+	}
+	c.Check(<-lost, Equals, 1)
+	c.Check(<-lost, Equals, 2)
+	c.Check(<-lost, Equals, 3)
+	select {
+	case <-restored:
+	case <-time.After(time.Second):
+		c.Error("heartbeat not restored")
+	}
+	c.Check(lost, HasLen, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestEvents(c *C) {
+	redisClient := NewTestRedisClient()
+	connection, err := openConnectionWithRedisClient("events-conn", redisClient, ConnectionConfig{
+		HeartbeatInterval: 5 * time.Millisecond,
+		HeartbeatTTL:      60 * time.Millisecond,
+		Logger:            &recordingLogger{},
+	})
+	c.Assert(err, IsNil)
+	nextEvent := func() Event {
+		select {
+		case event := <-connection.Events():
+			return event
+		case <-time.After(time.Second):
+			c.Fatal("no event")
+			return Event{}
+		}
+	}
+
+	event := nextEvent()
+	c.Check(event.Type, Equals, ConnectionOpened)
+	c.Check(event.Connection, Equals, connection.Name)
+	c.Check(event.Time.IsZero(), Equals, false)
+
+	queue := connection.OpenQueue("events-q")
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	name, err := queue.AddConsumer("events-cons", NewTestConsumer("events-A"))
+	c.Assert(err, IsNil)
+	event = nextEvent()
+	c.Check(event.Type, Equals, ConsumerAdded)
+	c.Check(event.Queue, Equals, "events-q")
+	c.Check(event.Consumer, Equals, name)
+	c.Check(queue.RemoveConsumer(name), IsNil)
+	event = nextEvent()
+	c.Check(event.Type, Equals, ConsumerRemoved)
+	c.Check(event.Consumer, Equals, name)
+	<-queue.StopConsuming()
+
+	redisClient.FailNext("Set", errors.New("redis down"))
+	event = nextEvent()
+	c.Check(event.Type, Equals, HeartbeatLost)
+	c.Check(event.Count, Equals, 1)
+	c.Check(nextEvent().Type, Equals, HeartbeatRestored)
+
+	dead, err := openConnectionWithRedisClient("events-dead", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	deadQueue := dead.OpenQueue("events-q")
+	c.Check(deadQueue.Publish("events-d1"), Equals, true)
+	c.Assert(deadQueue.StartConsuming(10, time.Millisecond), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	<-deadQueue.StopConsuming()
+	dead.StopHeartbeat()
+	returned, err := NewCleaner(connection).Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	event = nextEvent()
+	c.Check(event.Type, Equals, DeliveriesReclaimed)
+	c.Check(event.Connection, Equals, dead.Name)
+	c.Check(event.Count, Equals, 1)
+
+	c.Check(connection.Close(), Equals, true)
+	c.Check(nextEvent().Type, Equals, ConnectionClosed)
+	c.Check(connection.Events(), HasLen, 0)
+
+	for i := 0; i <= eventBufferSize; i++ {
+		connection.emit(Event{Type: ConsumerAdded})
+	}
+	c.Check(connection.DroppedEvents(), Equals, int64(1))
+}
+
+func (suite *QueueSuite) TestCloseConnection(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	debugLogger := &recordingLogger{}
+	connection, err := OpenConnectionWithConfig("close-conn", redisClient, ConnectionConfig{
+		HeartbeatInterval: 10 * time.Millisecond,
+		DebugLogger:       debugLogger,
+	})
+	c.Assert(err, IsNil)
+	conn := connection.(*redisConnection)
+	other := OpenConnection("close-other", "tcp", "localhost:6379", 1)
+
+	queue := conn.OpenQueue("close-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("close-A")
+	queue.AddConsumer("close-cons", consumer)
+	c.Check(queue.Publish("close-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 1)
+
+	c.Check(conn.Close(), Equals, true)
+	c.Check(atomic.LoadInt32(&queue.consumingStopped), Equals, int32(1))
+	c.Check(conn.Check(), Equals, false)
+	for _, name := range other.GetConnections() {
+		c.Check(name, Not(Equals), conn.Name)
+	}
+
+	// the heartbeat returns right away and doesn't come back
+	time.Sleep(25 * time.Millisecond)
+	messages := debugLogger.Messages()
+	c.Check(messages[len(messages)-1], Equals, "rmq connection stopped heartbeat "+conn.Name)
+	c.Check(conn.Check(), Equals, false)
+
+	// consumers stopped, so deliveries stay ready
+	c.Check(queue.Publish("close-d2"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 1)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	queue.PurgeReady()
+	other.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRedisErrors(c *C) {
+	for _, redisClient := range []RedisClient{
+		RedisWrapper{redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})},
+		NewTestRedisClient(),
+	} {
+		redisClient.Del("errors-list")
+		redisClient.Del("errors-string")
+
+		_, err := redisClient.RPopLPush("errors-list", "errors-list")
+		c.Check(err, Equals, ErrNotFound)
+		_, err = redisClient.HGet("errors-list", "field")
+		c.Check(err, Equals, ErrNotFound)
+		count, err := redisClient.LLen("errors-list")
+		c.Check(err, IsNil)
+		c.Check(count, Equals, 0)
+
+		// real errors don't look like missing keys
+		c.Check(redisClient.Set("errors-string", "value", 0), IsNil)
+		_, err = redisClient.LLen("errors-string")
+		c.Check(err, NotNil)
+		c.Check(err, Not(Equals), ErrNotFound)
+		c.Check(redisClient.LPush("errors-string", "value"), NotNil)
+		redisClient.Del("errors-string")
+	}
+}
+
+func (suite *QueueSuite) TestGetMembersErrors(c *C) {
+	redisClient := NewTestRedisClient()
+	logger := &recordingLogger{}
+	connection, err := openConnectionWithRedisClient("members-conn", redisClient, ConnectionConfig{Logger: logger})
+	c.Assert(err, IsNil)
+	connection.OpenQueue("members-q")
+
+	queues, err := connection.GetOpenQueuesE()
+	c.Check(err, IsNil)
+	c.Check(queues, DeepEquals, []string{"members-q"})
+	connections, err := connection.GetConnectionsE()
+	c.Check(err, IsNil)
+	c.Check(connections, DeepEquals, []string{connection.Name})
+	queues, err = connection.GetConsumingQueuesE()
+	c.Check(err, IsNil)
+	c.Check(queues, HasLen, 0)
+
+	failure := errors.New("connection refused")
+	for i := 0; i < 6; i++ {
+		redisClient.FailNext("SMembers", failure)
+	}
+	_, err = connection.GetOpenQueuesE()
+	c.Check(errors.Is(err, failure), Equals, true)
+	_, err = connection.GetConnectionsE()
+	c.Check(errors.Is(err, failure), Equals, true)
+	_, err = connection.GetConsumingQueuesE()
+	c.Check(errors.Is(err, failure), Equals, true)
+
+	// the variants without error log it
+	c.Check(connection.GetOpenQueues(), HasLen, 0)
+	c.Check(connection.GetConnections(), HasLen, 0)
+	c.Check(connection.GetConsumingQueues(), HasLen, 0)
+	c.Check(logger.Messages(), HasLen, 3)
+
+	// the cleaner doesn't go on without knowing the connections
+	redisClient.FailNext("SMembers", failure)
+	_, err = NewCleaner(connection).Clean()
+	c.Check(errors.Is(err, failure), Equals, true)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestGetConsumingQueuesFor(c *C) {
+	redisClient := NewTestRedisClient()
+	inspector, err := openConnectionWithRedisClient("inspect-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	other, err := openConnectionWithRedisClient("inspect-other", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+
+	queue := other.OpenQueue("inspect-q")
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	queues, err := inspector.GetConsumingQueuesFor(other.Name)
+	c.Check(err, IsNil)
+	c.Check(queues, DeepEquals, []string{"inspect-q"})
+	queues, err = inspector.GetConsumingQueuesFor(inspector.Name)
+	c.Check(err, IsNil)
+	c.Check(queues, HasLen, 0)
+
+	_, err = inspector.GetConsumingQueuesFor("inspect-unknown")
+	c.Check(err, Equals, ErrNoConnection)
+	failure := errors.New("connection refused")
+	redisClient.FailNext("SIsMember", failure)
+	_, err = inspector.GetConsumingQueuesFor(other.Name)
+	c.Check(errors.Is(err, failure), Equals, true)
+
+	<-queue.StopConsuming()
+	inspector.StopHeartbeat()
+	other.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOpenConnectionForInspection(c *C) {
+	redisClient := NewTestRedisClient()
+	inspector, err := openConnectionWithRedisClient("inspection-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	other, err := openConnectionWithRedisClient("inspection-other", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+
+	queue := other.OpenQueue("inspection-q")
+	c.Check(queue.Publish("inspection-d1", "inspection-d2"), Equals, true)
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	time.Sleep(10 * time.Millisecond)
+
+	inspected := inspector.OpenConnectionForInspection(other.Name)
+	c.Check(inspected.OpenQueue("inspection-q").UnackedCount(), Equals, 2)
+	queues, err := inspected.(*redisConnection).GetConsumingQueuesE()
+	c.Check(err, IsNil)
+	c.Check(queues, DeepEquals, []string{"inspection-q"})
+	inspected.OpenQueue("inspection-unregistered-q")
+	exists, err := inspector.QueueExists("inspection-unregistered-q")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, false)
+
+	// it doesn't touch the inspected connection
+	c.Check(inspected.(*redisConnection).StopHeartbeat(), Equals, false)
+	c.Check(inspected.(*redisConnection).Close(), Equals, false)
+	c.Check(inspected.(*redisConnection).CloseAllQueuesInConnection(), Equals, ErrInspectionOnly)
+	c.Check(other.Check(), Equals, true)
+	registered, err := redisClient.SIsMember(connectionsKey, other.Name)
+	c.Check(err, IsNil)
+	c.Check(registered, Equals, true)
+	c.Check(inspected.OpenQueue("inspection-q").StartConsuming(10, time.Millisecond), Equals, ErrInspectionOnly)
+	_, err = inspected.StartConsumingMulti([]Queue{inspected.OpenQueue("inspection-q")}, 10, time.Millisecond)
+	c.Check(err, Equals, ErrInspectionOnly)
+
+	// it doesn't keep the connection alive
+	<-queue.StopConsuming()
+	other.StopHeartbeat()
+	c.Check(inspected.(*redisConnection).Check(), Equals, false)
+	c.Check(inspected.OpenQueue("inspection-q").SetRetryPolicy(RetryPolicy{
+		Backoffs:    []time.Duration{time.Second},
+		MaxAttempts: 1,
+		DeadLetter:  inspector.OpenQueue("inspection-dead-q"),
+	}), NotNil)
+	inspector.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRunScript(c *C) {
+	rawClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	for _, redisClient := range []RedisClient{RedisWrapper{rawClient}, NewTestRedisClient()} {
+		redisClient.Del("script-unacked")
+		redisClient.Del("script-attempts")
+		c.Check(rawClient.ScriptFlush().Err(), IsNil)
+
+		_, err := redisClient.EvalSha(scriptSha(ackScript), []string{"script-unacked"}, "script-d1")
+		c.Check(err, Equals, ErrNoScript)
+
+		// loads the script when needed
+		c.Check(redisClient.LPush("script-unacked", "script-d1", "script-d2"), IsNil)
+		_, err = redisClient.HIncrBy("script-attempts", "script-d1", 1)
+		c.Check(err, IsNil)
+		result, err := runScript(redisClient, ackScript, []string{"script-unacked", "script-attempts"}, "script-d1")
+		c.Check(err, IsNil)
+		c.Check(result, Equals, int64(1))
+		values, err := redisClient.LRange("script-unacked", 0, -1)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, []string{"script-d2"})
+		_, err = redisClient.HGet("script-attempts", "script-d1")
+		c.Check(err, Equals, ErrNotFound)
+
+		// then uses the loaded script
+		result, err = redisClient.EvalSha(scriptSha(ackScript), []string{"script-unacked"}, "script-d1")
+		c.Check(err, IsNil)
+		c.Check(result, Equals, int64(0))
+
+		_, err = redisClient.ScriptLoad("return 1")
+		if _, ok := redisClient.(*TestRedisClient); ok {
+			c.Check(err, NotNil) // only rmq's own scripts
+		}
+		redisClient.Del("script-unacked")
+	}
+}
+
 func (suite *QueueSuite) TestConnectionQueues(c *C) {
 	connection := OpenConnection("conn-q-conn", "tcp", "localhost:6379", 1)
 	c.Assert(connection, NotNil)
@@ -87,6 +557,680 @@ func (suite *QueueSuite) TestConnectionQueues(c *C) {
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestAutoRegisterQueues(c *C) {
+	connection := OpenConnection("register-conn", "tcp", "localhost:6379", 1)
+	connection.OpenQueue("register-q1").Close()
+	connection.OpenQueue("register-q2").Close()
+	isOpen := func(name string) bool {
+		for _, openName := range connection.GetOpenQueues() {
+			if openName == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	connection.SetAutoRegisterQueues(false)
+	queue := connection.OpenQueue("register-q1")
+	c.Check(isOpen("register-q1"), Equals, false)
+	c.Check(queue.Publish("register-d1"), Equals, true)
+	c.Check(isOpen("register-q1"), Equals, false)
+	c.Check(connection.RegisterQueue("register-q1"), Equals, true)
+	c.Check(isOpen("register-q1"), Equals, true)
+
+	connection.SetAutoRegisterQueues(true)
+	connection.OpenQueue("register-q2")
+	c.Check(isOpen("register-q2"), Equals, true)
+
+	queue.(*redisQueue).PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOverview(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("overview-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("overview-conn"),
+	} {
+		queue := connection.OpenQueueWithPriorities("overview-q", 2).(*redisQueue)
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		c.Check(queue.Publish("overview-d1", "overview-d2"), Equals, true)
+		c.Check(queue.PublishWithPriority("overview-d3", 2), Equals, true)
+		c.Check(queue.PublishWithPriority("overview-d4", 2), Equals, true)
+		// as if consuming, without waiting for consumers
+		c.Check(connection.redisClient.SAdd(connection.queuesKey, "overview-q"), IsNil)
+		c.Check(connection.redisClient.SAdd(queue.consumersKey, "overview-cons"), IsNil)
+		c.Check(connection.redisClient.LPush(queue.unackedKey, "overview-d5", "overview-d6"), IsNil)
+		other := connection.openQueue("overview-other-q")
+		c.Check(connection.redisClient.SAdd(connection.queuesKey, other.name), IsNil)
+		c.Check(connection.redisClient.SAdd(other.consumersKey, "overview-cons2"), IsNil)
+		rejected := connection.openQueue("overview-rejected-q")
+		rejected.PurgeReady()
+		rejected.PurgeRejected()
+		connection.RegisterQueue("overview-rejected-q")
+		c.Check(connection.redisClient.LPush(rejected.rejectedKey, "overview-d7"), IsNil)
+
+		overview, err := connection.Overview()
+		c.Check(err, IsNil)
+		c.Check(overview.CollectedAt.IsZero(), Equals, false)
+		c.Check(overview.Queues["overview-q"], Equals, QueueOverview{
+			ReadyCount:    4,
+			UnackedCount:  2,
+			ConsumerCount: 1,
+		})
+		c.Check(overview.Queues["overview-rejected-q"], Equals, QueueOverview{RejectedCount: 1})
+		c.Check(overview.Connections[connection.Name], DeepEquals, ConnectionOverview{
+			Active: true,
+			Queues: []string{"overview-other-q", "overview-q"},
+		})
+		c.Check(overview.Queues["overview-other-q"], Equals, QueueOverview{ConsumerCount: 1})
+
+		queue.PurgeReady()
+		connection.redisClient.Del(queue.unackedKey)
+		connection.redisClient.Del(other.consumersKey)
+		connection.StopHeartbeat()
+		overview, err = connection.Overview()
+		c.Check(err, IsNil)
+		c.Check(overview.Connections[connection.Name].Active, Equals, false)
+		connection.redisClient.SRem(connection.key(connectionsKey), connection.Name) // not counted by later runs
+	}
+
+	redisClient := NewTestRedisClient()
+	connection, err := openConnectionWithRedisClient("overview-failing-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	failure := errors.New("connection refused")
+	redisClient.FailNext("TTL", failure)
+	_, err = connection.Overview()
+	c.Check(errors.Is(err, failure), Equals, true)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestQueueExists(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("exists-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("exists-conn"),
+	} {
+		connection.redisClient.SRem(connection.key(queuesKey), "exists-q")
+		exists, err := connection.QueueExists("exists-q")
+		c.Check(err, IsNil)
+		c.Check(exists, Equals, false)
+		exists, _ = connection.QueueExists("exists-q")
+		c.Check(exists, Equals, false) // checking doesn't register it
+
+		connection.OpenQueue("exists-q")
+		exists, err = connection.QueueExists("exists-q")
+		c.Check(err, IsNil)
+		c.Check(exists, Equals, true)
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestDiscoverQueues(c *C) {
+	connection := OpenConnection("discover-conn", "tcp", "localhost:6379", 1)
+	connection.OpenQueue("discover-q1").Close()
+	queue := connection.OpenQueue("discover-q2").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.Publish("discover-d1"), Equals, true)
+
+	// ready list of a queue which was never opened
+	readyKey := strings.Replace(queueReadyTemplate, phQueue, "discover-q3", 1)
+	c.Check(connection.redisClient.LPush(readyKey, "discover-d2"), IsNil)
+
+	queues, err := connection.DiscoverQueues()
+	c.Assert(err, IsNil)
+	discovered := map[string]bool{}
+	for _, name := range queues {
+		discovered[name] = true
+	}
+	c.Check(discovered["discover-q1"], Equals, false)
+	c.Check(discovered["discover-q2"], Equals, true)
+	c.Check(discovered["discover-q3"], Equals, true)
+	for _, name := range connection.GetOpenQueues() {
+		c.Check(name, Not(Equals), "discover-q3")
+	}
+
+	queue.PurgeReady()
+	connection.redisClient.Del(readyKey)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestQueuesWithoutConsumers(c *C) {
+	connection := OpenConnection("without-conn", "tcp", "localhost:6379", 1)
+	connection.OpenQueue("without-q1")
+	queue2 := connection.OpenQueue("without-q2").(*redisQueue)
+	queue2.StartConsuming(10, time.Millisecond)
+	queue2.AddConsumer("without-cons2", NewTestConsumer("without-A"))
+
+	// consumers of dead connections don't count
+	deadConnection := OpenConnection("without-dead", "tcp", "localhost:6379", 1)
+	queue3 := deadConnection.OpenQueue("without-q3").(*redisQueue)
+	queue3.StartConsuming(10, time.Millisecond)
+	queue3.AddConsumer("without-cons3", NewTestConsumer("without-B"))
+	<-queue3.StopConsuming()
+	deadConnection.StopHeartbeat()
+
+	queues, err := connection.QueuesWithoutConsumers()
+	c.Assert(err, IsNil)
+	without := map[string]bool{}
+	for _, name := range queues {
+		without[name] = true
+	}
+	c.Check(without["without-q1"], Equals, true)
+	c.Check(without["without-q2"], Equals, false)
+	c.Check(without["without-q3"], Equals, true)
+
+	<-queue2.StopConsuming()
+	queue2.RemoveAllConsumers()
+	queue3.RemoveAllConsumers()
+	connection.StopHeartbeat()
+}
+
+// run with -race to detect unsynchronized access
+func (suite *QueueSuite) TestConcurrentConnection(c *C) {
+	connection := OpenConnection("concurrent-conn", "tcp", "localhost:6379", 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			queue := connection.OpenQueue(fmt.Sprintf("concurrent-q%d", i%3))
+			queue.Publish("concurrent-d")
+		}(i)
+		go func() {
+			defer wg.Done()
+			connection.CollectStats(connection.GetOpenQueues())
+		}()
+		go func() {
+			defer wg.Done()
+			connection.Check()
+			connection.StopHeartbeat()
+		}()
+	}
+	wg.Wait()
+	c.Check(connection.GetOpenQueues(), Not(HasLen), 0)
+
+	for i := 0; i < 3; i++ {
+		connection.openQueue(fmt.Sprintf("concurrent-q%d", i)).PurgeReady()
+	}
+}
+
+func (suite *QueueSuite) TestReturnUnackedOf(c *C) {
+	connection := OpenConnection("return-of-conn", "tcp", "localhost:6379", 1)
+	dead := connection.hijackConnection("return-of-dead")
+	other := connection.hijackConnection("return-of-other")
+
+	queue1 := dead.openQueue("return-of-q1")
+	queue1.PurgeReady()
+	queue2 := dead.openQueue("return-of-q2")
+	queue2.PurgeReady()
+	c.Check(connection.redisClient.SAdd(dead.queuesKey, queue1.name), IsNil)
+	c.Check(connection.redisClient.SAdd(dead.queuesKey, queue2.name), IsNil)
+	c.Check(connection.redisClient.LPush(queue1.unackedKey, "return-of-d1", "return-of-d2"), IsNil)
+	c.Check(connection.redisClient.LPush(queue2.unackedKey, "return-of-d3"), IsNil)
+	queue1.leaseDuration = time.Minute
+	c.Check(queue1.lease(newDelivery("return-of-d1", "", "", "", "", connection.redisClient)), IsNil)
+	otherQueue := other.openQueue("return-of-q1")
+	c.Check(connection.redisClient.LPush(otherQueue.unackedKey, "return-of-d4"), IsNil)
+
+	returned, err := connection.ReturnUnackedOf("return-of-dead")
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 3)
+	leases, _ := connection.redisClient.Del(queue1.leasesKey)
+	c.Check(leases, Equals, 0)
+	c.Check(queue1.UnackedCount(), Equals, 0)
+	c.Check(queue1.ReadyCount(), Equals, 2)
+	c.Check(queue2.UnackedCount(), Equals, 0)
+	c.Check(queue2.ReadyCount(), Equals, 1)
+	c.Check(otherQueue.UnackedCount(), Equals, 1) // other connection untouched
+
+	returned, err = connection.ReturnUnackedOf("return-of-dead")
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 0)
+
+	queue1.PurgeReady()
+	queue2.PurgeReady()
+	connection.redisClient.Del(otherQueue.unackedKey)
+	connection.redisClient.Del(dead.queuesKey)
+	connection.StopHeartbeat()
+
+	redisClient := NewTestRedisClient()
+	failing, err := openConnectionWithRedisClient("return-of-failing-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	dead = failing.hijackConnection("return-of-dead")
+	queue1 = dead.openQueue("return-of-q1")
+	c.Check(redisClient.SAdd(dead.queuesKey, queue1.name), IsNil)
+	c.Check(redisClient.LPush(queue1.unackedKey, "return-of-d1", "return-of-d2"), IsNil)
+	failure := errors.New("connection refused")
+	redisClient.FailNext("RPopLPush", failure)
+	returned, err = failing.ReturnUnackedOf("return-of-dead")
+	c.Check(err, NotNil)
+	c.Check(returned, Equals, 0)
+	redisClient.FailNext("LLen", failure)
+	_, err = failing.ReturnUnackedOf("return-of-dead")
+	c.Check(errors.Is(err, failure), Equals, true)
+	returned, err = failing.ReturnUnackedOf("return-of-dead")
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	failing.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAcquireLock(c *C) {
+	connection := OpenConnection("lock-conn", "tcp", "localhost:6379", 1)
+	other := OpenConnection("lock-other", "tcp", "localhost:6379", 1)
+
+	_, err := connection.AcquireLock("lock-l1", time.Millisecond)
+	c.Check(err, NotNil)
+
+	lock, err := connection.AcquireLock("lock-l1", 90*time.Millisecond)
+	c.Assert(err, IsNil)
+	_, err = other.AcquireLock("lock-l1", 90*time.Millisecond)
+	c.Check(err, Equals, ErrLockTaken)
+	otherLock, err := other.AcquireLock("lock-l2", 90*time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Check(otherLock.Release(), IsNil)
+
+	// held longer than the ttl while refreshed
+	time.Sleep(200 * time.Millisecond)
+	_, err = other.AcquireLock("lock-l1", 90*time.Millisecond)
+	c.Check(err, Equals, ErrLockTaken)
+
+	c.Check(lock.Release(), IsNil)
+	c.Check(lock.Release(), IsNil)
+	otherLock, err = other.AcquireLock("lock-l1", 90*time.Millisecond)
+	c.Assert(err, IsNil)
+
+	// releasing doesn't delete a lock taken over by someone else
+	connection.redisClient.Del(strings.Replace(lockTemplate, phLock, "lock-l1", 1))
+	lock, err = connection.AcquireLock("lock-l1", time.Minute)
+	c.Assert(err, IsNil)
+	c.Check(otherLock.Release(), Equals, ErrLockLost)
+	_, err = other.AcquireLock("lock-l1", 90*time.Millisecond)
+	c.Check(err, Equals, ErrLockTaken)
+	c.Check(lock.Release(), IsNil)
+
+	connection.StopHeartbeat()
+	other.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestNamespace(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	connectionA, err := OpenConnectionWithConfig("ns-conn", redisClient, ConnectionConfig{Namespace: "ns-a"})
+	c.Assert(err, IsNil)
+	connectionB, err := OpenConnectionWithConfig("ns-conn", redisClient, ConnectionConfig{Namespace: "ns-b"})
+	c.Assert(err, IsNil)
+	plain := OpenConnection("ns-conn", "tcp", "localhost:6379", 1)
+
+	queueA := connectionA.OpenQueue("ns-q")
+	queueA.PurgeReady()
+	queueB := connectionB.OpenQueue("ns-q")
+	queueB.PurgeReady()
+	queuePlain := plain.OpenQueue("ns-q")
+	queuePlain.PurgeReady()
+
+	c.Check(queueA.Publish("ns-d1"), Equals, true)
+	c.Check(queueB.Publish("ns-d2", "ns-d3"), Equals, true)
+	c.Check(queueA.ReadyCount(), Equals, 1)
+	c.Check(queueB.ReadyCount(), Equals, 2)
+	c.Check(queuePlain.ReadyCount(), Equals, 0)
+
+	count, err := plain.redisClient.LLen("ns-a::rmq::queue::[ns-q]::ready")
+	c.Check(err, IsNil)
+	c.Check(count, Equals, 1)
+
+	// connections only see the connections of their namespace
+	nameA := connectionA.(*redisConnection).Name
+	c.Check(connectionA.(*redisConnection).GetConnections(), DeepEquals, []string{nameA})
+	for _, name := range plain.GetConnections() {
+		c.Check(name, Not(Equals), nameA)
+	}
+
+	// locks of different namespaces don't conflict
+	lockA, err := connectionA.AcquireLock("ns-l", time.Minute)
+	c.Assert(err, IsNil)
+	lockB, err := connectionB.AcquireLock("ns-l", time.Minute)
+	c.Assert(err, IsNil)
+	c.Check(lockA.Release(), IsNil)
+	c.Check(lockB.Release(), IsNil)
+
+	// the cleaner only returns unacked deliveries of its namespace
+	consumer := NewTestConsumer("ns-cons")
+	consumer.AutoAck = false
+	c.Check(queueA.StartConsuming(10, time.Millisecond), IsNil)
+	queueA.AddConsumer("ns-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queueA.UnackedCount(), Equals, 1)
+	<-queueA.StopConsuming()
+	connectionA.(*redisConnection).StopHeartbeat()
+
+	returned, err := NewCleaner(plain).Clean()
+	c.Check(err, IsNil)
+	c.Check(queueA.UnackedCount(), Equals, 1)
+	returned, err = NewCleaner(connectionB).Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 0)
+	c.Check(queueA.UnackedCount(), Equals, 1)
+
+	cleanerConnection, err := OpenConnectionWithConfig("ns-cleaner", redisClient, ConnectionConfig{Namespace: "ns-a"})
+	c.Assert(err, IsNil)
+	returned, err = NewCleaner(cleanerConnection).Clean()
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+	c.Check(queueA.ReadyCount(), Equals, 1)
+	c.Check(queueB.ReadyCount(), Equals, 2)
+
+	queueA.PurgeReady()
+	queueB.PurgeReady()
+	cleanerConnection.(*redisConnection).StopHeartbeat()
+	connectionB.(*redisConnection).StopHeartbeat()
+	plain.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDeleteQueue(c *C) {
+	connection := OpenConnection("delete-conn", "tcp", "localhost:6379", 1)
+	dead := connection.hijackConnection("delete-dead")
+	queue := connection.OpenQueueWithPriorities("delete-q", 2).(*redisQueue)
+	queue.SetAttemptTracking(true)
+	other := connection.OpenQueue("delete-q2").(*redisQueue)
+	other.PurgeReady()
+	c.Check(other.Publish("delete-d0"), Equals, true)
+
+	consumer := NewTestConsumer("delete-A")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("delete-cons", consumer)
+	c.Check(queue.Publish("delete-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	<-queue.StopConsuming()
+	c.Check(queue.Publish("delete-d2"), Equals, true)
+	c.Check(queue.PublishWithPriority("delete-d3", 1), Equals, true)
+	c.Check(consumer.LastDelivery.Reject(), Equals, true)
+	c.Check(connection.redisClient.LPush(dead.openQueue("delete-q").unackedKey, "delete-d4"), IsNil)
+
+	c.Check(connection.DeleteQueue("delete-q"), Equals, ErrQueueHasConsumers)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	keys, err := scanKeys(connection.redisClient, `rmq::*\[delete-q\]*`)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 7) // ready, priority, priorities, rejected, attempts, dead unacked, consumers
+
+	queue.RemoveAllConsumers()
+	c.Check(connection.DeleteQueue("delete-q"), IsNil)
+	keys, err = scanKeys(connection.redisClient, `rmq::*\[delete-q\]*`)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 0)
+	for _, name := range connection.GetOpenQueues() {
+		c.Check(name, Not(Equals), "delete-q")
+	}
+	for _, name := range connection.GetConsumingQueues() {
+		c.Check(name, Not(Equals), "delete-q")
+	}
+	c.Check(other.ReadyCount(), Equals, 1) // other queue untouched
+
+	// force deleting ignores consumers
+	queue = connection.OpenQueue("delete-q").(*redisQueue)
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("delete-cons", NewTestConsumer("delete-B"))
+	c.Check(connection.DeleteQueue("delete-q"), Equals, ErrQueueHasConsumers)
+	c.Check(connection.ForceDeleteQueue("delete-q"), IsNil)
+	keys, err = scanKeys(connection.redisClient, `rmq::*\[delete-q\]*`)
+	c.Check(err, IsNil)
+	c.Check(keys, HasLen, 0)
+
+	<-queue.StopConsuming()
+	other.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+// countingRedisClient counts the polls of a queue, which check the ready count
+type countingRedisClient struct {
+	*TestRedisClient
+	polls int32
+}
+
+func (client *countingRedisClient) LLen(key string) (int, error) {
+	atomic.AddInt32(&client.polls, 1)
+	return client.TestRedisClient.LLen(key)
+}
+
+func (suite *QueueSuite) TestPollBackoff(c *C) {
+	redisClient := &countingRedisClient{TestRedisClient: NewTestRedisClient()}
+	queue := newQueue("backoff-q", "backoff-conn", "", "backoff-queues", redisClient)
+	consumer := NewTestConsumer("backoff-A")
+	c.Check(queue.StartConsumingWithPollConfig(10, ConsumerPollConfig{MinInterval: time.Millisecond, MaxInterval: 16 * time.Millisecond}), IsNil)
+	queue.AddConsumer("backoff-cons", consumer)
+
+	// sleeps 1, 2, 4, 8, 16, 16, ... milliseconds, about 60 polls without backoff
+	time.Sleep(60 * time.Millisecond)
+	polls := atomic.LoadInt32(&redisClient.polls)
+	c.Check(polls >= 3 && polls < 15, Equals, true, Commentf("%d polls", polls))
+
+	c.Check(queue.Publish("backoff-d1"), Equals, true)
+	time.Sleep(30 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 1)
+
+	<-queue.StopConsuming()
+}
+
+func (suite *QueueSuite) TestAddConsumerTagTaken(c *C) {
+	connection := OpenConnection("consumer-e-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("consumer-e-q").(*redisQueue)
+	queue.RemoveAllConsumers()
+	_, err := queue.AddConsumer("consumer-e-cons", NewTestConsumer("consumer-e-A"))
+	c.Check(err, ErrorMatches, "rmq queue failed to add consumer, call StartConsuming first!.*")
+
+	queue.StartConsuming(10, time.Millisecond)
+	name, err := queue.AddConsumer("consumer-e-cons", NewTestConsumer("consumer-e-A"))
+	c.Check(err, IsNil)
+	c.Check(name, Matches, "consumer-e-cons-.{6}")
+	_, err = queue.AddConsumer("consumer-e-cons", NewTestConsumer("consumer-e-B"))
+	c.Check(err, Equals, ErrConsumerTagTaken)
+	_, err = queue.AddConsumerFunc("consumer-e-cons", func(delivery Delivery) {})
+	c.Check(err, Equals, ErrConsumerTagTaken)
+	_, err = queue.AddConsumerFunc("consumer-e", func(delivery Delivery) {}) // prefix of the taken tag
+	c.Check(err, IsNil)
+	c.Check(queue.GetConsumers(), HasLen, 2)
+
+	// the tag can be used again once the consumer was removed
+	c.Check(queue.RemoveConsumer(name), IsNil)
+	_, err = queue.AddConsumer("consumer-e-cons", NewTestConsumer("consumer-e-C"))
+	c.Check(err, IsNil)
+
+	<-queue.StopConsuming()
+	queue.RemoveAllConsumers()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumerRateLimit(c *C) {
+	connection := OpenConnectionWithTestRedisClient("rate-limit-conn")
+	queue := connection.OpenQueue("rate-limit-q")
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	for i := 0; i < 10; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("rate-limit-d%d", i)), Equals, true)
+	}
+
+	// two consumers sharing a limiter of 10 deliveries per second get one
+	// delivery right away and the next one after 100ms
+	limiter := NewRateLimiter(10)
+	consumerA := NewTestConsumer("rate-limit-A")
+	consumerB := NewTestConsumer("rate-limit-B")
+	nameA, err := queue.AddConsumerWithRateLimiter("rate-limit-A", limiter, consumerA)
+	c.Check(err, IsNil)
+	nameB, err := queue.AddConsumerWithRateLimiter("rate-limit-B", limiter, consumerB)
+	c.Check(err, IsNil)
+	time.Sleep(50 * time.Millisecond)
+	c.Check(len(consumerA.LastDeliveries)+len(consumerB.LastDeliveries), Equals, 1)
+	time.Sleep(100 * time.Millisecond)
+	c.Check(len(consumerA.LastDeliveries)+len(consumerB.LastDeliveries), Equals, 2)
+
+	// removing a consumer doesn't wait for its next turn
+	removed := make(chan struct{})
+	go func() {
+		c.Check(queue.RemoveConsumer(nameA), IsNil)
+		c.Check(queue.RemoveConsumer(nameB), IsNil)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(50 * time.Millisecond):
+		c.Error("removing consumers waited for rate limiter")
+	}
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestTopic(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("topic-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("topic-conn"),
+	} {
+		queue1 := connection.OpenQueue("topic-q1")
+		queue2 := connection.OpenQueue("topic-q2")
+		queue1.PurgeReady()
+		queue2.PurgeReady()
+
+		topic := connection.OpenTopic("topic-t")
+		c.Check(topic.Publish("topic-d0"), Equals, true) // no bound queues
+		c.Check(topic.Bind(queue1), IsNil)
+		c.Check(topic.Bind(queue2), IsNil)
+		c.Check(topic.Bind(NewTestQueue("topic-q3")), NotNil)
+
+		// bindings are shared with other connections
+		otherTopic := connection.hijackConnection("topic-other-conn").OpenTopic("topic-t")
+		c.Check(otherTopic.Publish("topic-d1"), Equals, true)
+		c.Check(queue1.ReadyCount(), Equals, 1)
+		c.Check(queue2.ReadyCount(), Equals, 1)
+
+		c.Check(topic.Unbind(queue1), IsNil)
+		c.Check(topic.Publish("topic-d2"), Equals, true)
+		c.Check(queue1.ReadyCount(), Equals, 1)
+		c.Check(queue2.ReadyCount(), Equals, 2)
+		ready, err := queue2.Peek(0, 2)
+		c.Check(err, IsNil)
+		c.Check(ready, DeepEquals, []string{"topic-d2", "topic-d1"})
+
+		c.Check(topic.Unbind(queue2), IsNil)
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestMiddleware(c *C) {
+	connection := OpenConnectionWithTestRedisClient("middleware-conn")
+	queue := connection.OpenQueue("middleware-q")
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+
+	var mutex sync.Mutex
+	calls := []string{}
+	record := func(name string) Middleware {
+		return func(consumer Consumer) Consumer {
+			return ConsumerFunc(func(delivery Delivery) {
+				mutex.Lock()
+				calls = append(calls, name)
+				mutex.Unlock()
+				consumer.Consume(delivery)
+			})
+		}
+	}
+	durations := make(chan time.Duration, 1)
+	panicked := make(chan interface{}, 1)
+	queue.Use(record("outer"), record("inner"))
+	queue.Use(
+		TimingMiddleware(func(delivery Delivery, duration time.Duration) { durations <- duration }),
+		RecoverMiddleware(func(delivery Delivery, recovered interface{}) { panicked <- recovered }),
+	)
+
+	_, err := queue.AddConsumerFunc("middleware-cons", func(delivery Delivery) {
+		time.Sleep(5 * time.Millisecond)
+		panic("middleware-panic")
+	})
+	c.Check(err, IsNil)
+	c.Check(queue.Publish("middleware-d1"), Equals, true)
+
+	c.Check(<-panicked, Equals, "middleware-panic")
+	c.Check(<-durations >= 5*time.Millisecond, Equals, true)
+	mutex.Lock()
+	c.Check(calls, DeepEquals, []string{"outer", "inner"})
+	mutex.Unlock()
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeMulti(c *C) {
+	connection := OpenConnectionWithTestRedisClient("multi-conn")
+	queue1 := connection.OpenQueue("multi-q1")
+	queue2 := connection.OpenQueue("multi-q2")
+	c.Check(queue1.Publish("multi-d1", "multi-d2"), Equals, true)
+	c.Check(queue2.Publish("multi-d3"), Equals, true)
+
+	multi, err := connection.StartConsumingMulti([]Queue{queue1, queue2}, 10, time.Millisecond)
+	c.Assert(err, IsNil)
+	consumingQueue := connection.OpenQueue("multi-q3")
+	c.Check(consumingQueue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err = connection.StartConsumingMulti([]Queue{queue1, consumingQueue}, 10, time.Millisecond)
+	c.Check(err, Equals, ErrAlreadyConsuming)
+
+	var mutex sync.Mutex
+	consumed := map[string][]string{}
+	name, err := multi.AddMultiConsumer("multi-cons", MultiConsumerFunc(func(queueName string, delivery Delivery) {
+		mutex.Lock()
+		consumed[queueName] = append(consumed[queueName], delivery.Payload())
+		mutex.Unlock()
+		c.Check(delivery.Ack(), Equals, true)
+	}))
+	c.Check(err, IsNil)
+	c.Check(queue1.(*redisQueue).GetConsumers(), DeepEquals, []string{name})
+	c.Check(queue2.(*redisQueue).GetConsumers(), DeepEquals, []string{name})
+	_, err = multi.AddMultiConsumer("multi-cons", MultiConsumerFunc(func(queueName string, delivery Delivery) {}))
+	c.Check(err, Equals, ErrConsumerTagTaken)
+	c.Check(queue2.(*redisQueue).GetConsumers(), DeepEquals, []string{name})
+
+	c.Check(queue2.Publish("multi-d4"), Equals, true)
+	time.Sleep(20 * time.Millisecond)
+	mutex.Lock()
+	c.Check(consumed["multi-q1"], DeepEquals, []string{"multi-d1", "multi-d2"})
+	c.Check(consumed["multi-q2"], DeepEquals, []string{"multi-d3", "multi-d4"})
+	mutex.Unlock()
+	c.Check(queue1.UnackedCount(), Equals, 0)
+	c.Check(queue2.UnackedCount(), Equals, 0)
+
+	<-connection.StopAllConsuming()
+	c.Check(queue1.Publish("multi-d5"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue1.ReadyCount(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+// hangingRedisClient never answers pings, like a redis which can't be reached
+type hangingRedisClient struct {
+	*TestRedisClient
+	hang chan struct{}
+}
+
+func (client *hangingRedisClient) Ping() error {
+	<-client.hang
+	return nil
+}
+
+func (suite *QueueSuite) TestPing(c *C) {
+	connection := OpenConnection("ping-conn", "tcp", "localhost:6379", 1)
+	c.Check(connection.Ping(), IsNil)
+
+	unreachable := connection.hijackConnection("ping-unreachable")
+	unreachable.redisClient = RedisWrapper{redis.NewClient(&redis.Options{Addr: "localhost:1"})}
+	c.Check(unreachable.Ping(), NotNil)
+
+	hanging := &hangingRedisClient{TestRedisClient: NewTestRedisClient(), hang: make(chan struct{})}
+	defer close(hanging.hang)
+	unreachable.redisClient = hanging
+	c.Check(unreachable.Ping(), Equals, ErrPingTimeout)
+
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestQueue(c *C) {
 	connection := OpenConnection("queue-conn", "tcp", "localhost:6379", 1)
 	c.Assert(connection, NotNil)
@@ -106,24 +1250,91 @@ func (suite *QueueSuite) TestQueue(c *C) {
 	queue.RemoveAllConsumers()
 	c.Check(queue.GetConsumers(), HasLen, 0)
 	c.Check(connection.GetConsumingQueues(), HasLen, 0)
-	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
-	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, false)
-	cons1name := queue.AddConsumer("queue-cons1", NewTestConsumer("queue-A"))
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, ErrAlreadyConsuming)
+	cons1name, err := queue.AddConsumer("queue-cons1", NewTestConsumer("queue-A"))
+	c.Assert(err, IsNil)
 	time.Sleep(time.Millisecond)
 	c.Check(connection.GetConsumingQueues(), HasLen, 1)
 	c.Check(queue.GetConsumers(), DeepEquals, []string{cons1name})
-	cons2name := queue.AddConsumer("queue-cons2", NewTestConsumer("queue-B"))
+	cons2name, err := queue.AddConsumer("queue-cons2", NewTestConsumer("queue-B"))
+	c.Assert(err, IsNil)
 	c.Check(queue.GetConsumers(), HasLen, 2)
-	c.Check(queue.RemoveConsumer("queue-cons3"), Equals, false)
-	c.Check(queue.RemoveConsumer(cons1name), Equals, true)
+	c.Check(queue.RemoveConsumer("queue-cons3"), NotNil)
+	c.Check(queue.RemoveConsumer(cons1name), IsNil)
 	c.Check(queue.GetConsumers(), DeepEquals, []string{cons2name})
-	c.Check(queue.RemoveConsumer(cons2name), Equals, true)
+	c.Check(queue.RemoveConsumer(cons2name), IsNil)
 	c.Check(queue.GetConsumers(), HasLen, 0)
 
 	queue.StopConsuming()
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestPurge(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("purge-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("purge-conn"),
+	} {
+		queue := connection.OpenQueue("purge-q").(*redisQueue)
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		c.Check(queue.PurgeRejected(), Equals, 0)
+
+		for i := 0; i < 250; i++ { // more than purgeBatchSize
+			c.Check(queue.Publish(fmt.Sprintf("purge-d%d", i)), Equals, true)
+		}
+		c.Check(queue.redisClient.LPush(queue.rejectedKey, "purge-r1", "purge-r2"), IsNil)
+
+		c.Check(queue.PurgeReady(), Equals, 250)
+		c.Check(queue.ReadyCount(), Equals, 0)
+		c.Check(queue.RejectedCount(), Equals, 2)
+		c.Check(queue.PurgeRejected(), Equals, 2)
+		c.Check(queue.RejectedCount(), Equals, 0)
+
+		// purged deliveries don't stay around in other keys
+		purgingPattern := strings.Replace(keyPattern(queuePurgingTemplate), phToken, "*", 1)
+		keys, err := scanKeys(queue.redisClient, purgingPattern)
+		c.Check(err, IsNil)
+		c.Check(keys, HasLen, 0)
+
+		// queue stays usable
+		c.Check(queue.Publish("purge-d"), Equals, true)
+		c.Check(queue.ReadyCount(), Equals, 1)
+		c.Check(queue.PurgeReady(), Equals, 1)
+
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestStartConsumingUnreachable(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:1"})
+	queue := newQueue("unreachable-q", "unreachable-conn", "", "unreachable-queues", RedisWrapper{redisClient})
+
+	err := queue.StartConsuming(10, time.Millisecond)
+	c.Check(err, NotNil)
+	c.Check(err, Not(Equals), ErrAlreadyConsuming)
+	c.Check(queue.deliveryChan, IsNil) // didn't start polling
+}
+
+func (suite *QueueSuite) TestStartConsumingFetchesRightAway(c *C) {
+	connection := OpenConnection("started-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("started-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.Publish("started-d1"), Equals, true)
+
+	// no need to wait for the poll duration
+	c.Check(queue.StartConsuming(10, time.Hour), IsNil)
+	select {
+	case delivery := <-queue.deliveryChan:
+		c.Check(delivery.Payload(), Equals, "started-d1")
+		c.Check(delivery.Ack(), Equals, true)
+	case <-time.After(time.Second):
+		c.Error("delivery published before StartConsuming wasn't fetched")
+	}
+
+	c.Check(connection.Close(), Equals, true)
+}
+
 func (suite *QueueSuite) TestConsumer(c *C) {
 	connection := OpenConnection("cons-conn", "tcp", "localhost:6379", 1)
 	c.Assert(connection, NotNil)
@@ -135,13 +1346,16 @@ func (suite *QueueSuite) TestConsumer(c *C) {
 	consumer := NewTestConsumer("cons-A")
 	consumer.AutoAck = false
 	queue1.StartConsuming(10, time.Millisecond)
-	queue1.AddConsumer("cons-cons", consumer)
+	consumerName, err := queue1.AddConsumer("cons-cons", consumer)
+	c.Check(err, IsNil)
 	c.Check(consumer.LastDelivery, IsNil)
 
 	c.Check(queue1.Publish("cons-d1"), Equals, true)
 	time.Sleep(2 * time.Millisecond)
 	c.Assert(consumer.LastDelivery, NotNil)
 	c.Check(consumer.LastDelivery.Payload(), Equals, "cons-d1")
+	c.Check(consumer.LastDelivery.Consumer(), Equals, consumerName)
+	c.Check(consumer.LastDelivery.Connection(), Equals, connection.Name)
 	c.Check(queue1.ReadyCount(), Equals, 0)
 	c.Check(queue1.UnackedCount(), Equals, 1)
 
@@ -150,10 +1364,12 @@ func (suite *QueueSuite) TestConsumer(c *C) {
 	c.Check(consumer.LastDelivery.Payload(), Equals, "cons-d2")
 	c.Check(queue1.ReadyCount(), Equals, 0)
 	c.Check(queue1.UnackedCount(), Equals, 2)
+	c.Check(queue1.InFlightCount(), Equals, 2)
 
 	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
 	c.Check(queue1.ReadyCount(), Equals, 0)
 	c.Check(queue1.UnackedCount(), Equals, 1)
+	c.Check(queue1.InFlightCount(), Equals, 1)
 
 	c.Check(consumer.LastDeliveries[1].Ack(), Equals, true)
 	c.Check(queue1.ReadyCount(), Equals, 0)
@@ -208,6 +1424,36 @@ func (suite *QueueSuite) TestConsumer(c *C) {
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestRemoveConsumer(c *C) {
+	connection := OpenConnection("remove-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("remove-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.StartConsuming(10, time.Millisecond)
+	consumer1 := NewTestConsumer("remove-A")
+	consumer2 := NewTestConsumer("remove-B")
+	name1, err := queue.AddConsumer("remove-cons1", consumer1)
+	c.Assert(err, IsNil)
+	name2, err := queue.AddConsumer("remove-cons2", consumer2)
+	c.Assert(err, IsNil)
+
+	c.Check(queue.RemoveConsumer(name1), IsNil)
+	c.Check(queue.GetConsumers(), DeepEquals, []string{name2})
+	c.Check(queue.RemoveConsumer(name1), NotNil) // already removed
+
+	for i := 0; i < 10; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("remove-d%d", i)), Equals, true)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer1.LastDeliveries, HasLen, 0)
+	c.Check(consumer2.LastDeliveries, HasLen, 10)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	<-queue.StopConsuming()
+	c.Check(queue.RemoveConsumer(name2), IsNil)
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestMulti(c *C) {
 	connection := OpenConnection("multi-conn", "tcp", "localhost:6379", 1)
 	queue := connection.OpenQueue("multi-q").(*redisQueue)
@@ -257,22 +1503,184 @@ func (suite *QueueSuite) TestMulti(c *C) {
 	connection.StopHeartbeat()
 }
 
-func (suite *QueueSuite) TestBatch(c *C) {
-	connection := OpenConnection("batch-conn", "tcp", "localhost:6379", 1)
-	queue := connection.OpenQueue("batch-q").(*redisQueue)
-	queue.PurgeRejected()
+func (suite *QueueSuite) TestSetPrefetchLimit(c *C) {
+	connection := OpenConnection("prefetch-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("prefetch-q").(*redisQueue)
 	queue.PurgeReady()
 
-	for i := 0; i < 5; i++ {
-		c.Check(queue.Publish(fmt.Sprintf("batch-d%d", i)), Equals, true)
+	for i := 0; i < 20; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("prefetch-d%d", i)), Equals, true)
 	}
 
-	queue.StartConsuming(10, time.Millisecond)
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("prefetch-cons")
+	consumer.AutoFinish = false
+	queue.AddConsumer("prefetch-cons", consumer)
 	time.Sleep(10 * time.Millisecond)
-	c.Check(queue.UnackedCount(), Equals, 5)
+	c.Check(queue.ReadyCount(), Equals, 9)
+	c.Check(queue.UnackedCount(), Equals, 10) // prefetched, the consumer acked the 11th
 
-	consumer := NewTestBatchConsumer()
-	queue.AddBatchConsumerWithTimeout("batch-cons", 2, 50*time.Millisecond, consumer)
+	// lowering the limit doesn't return prefetched deliveries, but pauses
+	// fetching until less than 3 are prefetched
+	queue.SetPrefetchLimit(3)
+	for i := 0; i < 7; i++ {
+		consumer.Finish()
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 9)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	consumer.Finish()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 8)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	// can't raise above the limit passed to StartConsuming
+	queue.SetPrefetchLimit(100)
+	consumer.Finish()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 10)
+
+	consumer.AutoFinish = true
+	consumer.Finish()
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishBytes(c *C) {
+	connection := OpenConnection("bytes-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("bytes-q").(*redisQueue)
+	queue.PurgeReady()
+
+	payload := []byte{0x1f, 0x8b, 0x00, 0xff, 0xfe} // gzip magic and invalid UTF-8
+	c.Check(queue.PublishBytes(payload), Equals, true)
+	c.Check(queue.Publish("bytes-d2"), Equals, true)
+
+	consumer := NewTestConsumer("bytes-A")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("bytes-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDeliveries[0].PayloadBytes(), DeepEquals, payload)
+	c.Check(consumer.LastDeliveries[1].PayloadBytes(), DeepEquals, []byte("bytes-d2"))
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPriorities(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("priority-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("priority-conn"),
+	} {
+		queue := connection.OpenQueueWithPriorities("priority-q", 3).(*redisQueue)
+		queue.PurgeReady()
+		c.Check(queue.priorityKeys, HasLen, 2)
+
+		c.Check(queue.Publish("priority-d0"), Equals, true)
+		c.Check(queue.PublishWithPriority("priority-d1", 1), Equals, true)
+		c.Check(queue.PublishWithPriority("priority-d2", 2), Equals, true)
+		c.Check(queue.PublishWithPriority("priority-d3", 5), Equals, true) // capped to 2
+		c.Check(queue.PublishWithPriority("priority-d4", -1), Equals, true)
+		c.Check(queue.ReadyCount(), Equals, 5)
+
+		stats := CollectStats([]string{"priority-q"}, connection)
+		c.Check(stats.QueueStats["priority-q"].ReadyCount, Equals, 5)
+		c.Check(stats.QueueStats["priority-q"].PriorityReadyCounts, DeepEquals, map[int]int{0: 2, 1: 1, 2: 2})
+
+		consumer := NewTestConsumer("priority-A")
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("priority-cons", consumer)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 5)
+		payloads := []string{}
+		for _, delivery := range consumer.LastDeliveries {
+			payloads = append(payloads, delivery.Payload())
+		}
+		c.Check(payloads, DeepEquals, []string{"priority-d2", "priority-d3", "priority-d1", "priority-d0", "priority-d4"})
+		c.Check(queue.ReadyCount(), Equals, 0)
+		c.Check(CollectStats([]string{"priority-q"}, connection).QueueStats["priority-q"].PriorityReadyCounts, IsNil)
+
+		<-queue.StopConsuming()
+		connection.StopHeartbeat()
+	}
+
+	// without priorities everything gets the default priority
+	connection := OpenConnection("priority-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("priority-q").(*redisQueue)
+	c.Check(queue.PublishWithPriority("priority-d5", 2), Equals, true)
+	values, err := queue.redisClient.LRange(queue.readyKey, 0, -1)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, []string{"priority-d5"})
+	c.Check(queue.PurgeReady(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+// blockingConsumer acks deliveries once released, it's safe for concurrent use
+type blockingConsumer struct {
+	release  chan struct{}
+	consumed int32
+}
+
+func (consumer *blockingConsumer) Consume(delivery Delivery) {
+	<-consumer.release
+	delivery.Ack()
+	atomic.AddInt32(&consumer.consumed, 1)
+}
+
+func (suite *QueueSuite) TestConsumerWithConcurrency(c *C) {
+	connection := OpenConnection("concurrency-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("concurrency-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.RemoveAllConsumers()
+
+	for i := 0; i < 10; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("concurrency-d%d", i)), Equals, true)
+	}
+
+	consumer := &blockingConsumer{release: make(chan struct{})}
+	queue.StartConsuming(3, time.Millisecond)
+	names, err := queue.AddConsumerWithConcurrency("concurrency-cons", 5, consumer)
+	c.Check(err, IsNil)
+	c.Check(names, HasLen, 5)
+	c.Check(queue.GetConsumers(), HasLen, 5)
+	_, err = queue.AddConsumerWithConcurrency("concurrency-cons", 5, consumer)
+	c.Check(err, Equals, ErrConsumerTagTaken)
+	c.Check(queue.GetConsumers(), HasLen, 5)
+
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 3) // three consuming, two idle
+	c.Check(queue.ReadyCount(), Equals, 7)
+
+	for i := 0; i < 10; i++ {
+		consumer.release <- struct{}{}
+		c.Check(queue.UnackedCount() <= 3, Equals, true)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Check(atomic.LoadInt32(&consumer.consumed), Equals, int32(10))
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestBatch(c *C) {
+	connection := OpenConnection("batch-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("batch-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("batch-d%d", i)), Equals, true)
+	}
+
+	queue.StartConsuming(10, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 5)
+
+	consumer := NewTestBatchConsumer()
+	queue.AddBatchConsumerWithTimeout("batch-cons", 2, 50*time.Millisecond, consumer)
 	time.Sleep(10 * time.Millisecond)
 	c.Assert(consumer.LastBatch, HasLen, 2)
 	c.Check(consumer.LastBatch[0].Payload(), Equals, "batch-d0")
@@ -306,6 +1714,379 @@ func (suite *QueueSuite) TestBatch(c *C) {
 	c.Check(queue.RejectedCount(), Equals, 3)
 }
 
+func (suite *QueueSuite) TestBatchSizeOne(c *C) {
+	connection := OpenConnection("batch1-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("batch1-q").(*redisQueue)
+	queue.PurgeReady()
+
+	queue.StartConsuming(10, time.Millisecond)
+	consumer := NewTestBatchConsumer()
+	consumer.AutoFinish = true
+	queue.AddBatchConsumerWithTimeout("batch1-cons", 1, time.Second, consumer)
+
+	c.Check(queue.Publish("batch1-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond) // way before the timeout
+	c.Check(consumer.LastBatch.Payloads(), DeepEquals, []string{"batch1-d1"})
+	c.Check(consumer.LastBatch.Ack(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestCommitConsumer(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("commit-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("commit-conn"),
+	} {
+		queue := connection.OpenQueue("commit-q").(*redisQueue)
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		queue.SetAttemptTracking(true)
+		queue.SetMaxRejects(5)
+		connection.redisClient.Del(queue.attemptsKey)
+		connection.redisClient.Del(queue.rejectsKey)
+
+		var commit CommitFunc
+		consumed := make(chan string, 20)
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddCommitConsumer("commit-cons", CommitConsumerFunc(func(delivery Delivery, commitFunc CommitFunc) {
+			commit = commitFunc
+			if delivery.Payload() == "commit-d0" {
+				delivery.Reject()
+			}
+			consumed <- delivery.Payload()
+		}))
+
+		for i := 0; i < 10; i++ {
+			c.Check(queue.Publish(fmt.Sprintf("commit-d%d", i)), Equals, true)
+		}
+		time.Sleep(10 * time.Millisecond)
+		c.Check(consumed, HasLen, 10)
+		c.Check(queue.UnackedCount(), Equals, 9)
+
+		c.Check(commit(), IsNil)
+		c.Check(queue.UnackedCount(), Equals, 0)
+		c.Check(queue.RejectedCount(), Equals, 1)
+		c.Check(commit(), IsNil) // nothing to commit
+
+		// keeps the counts of the rejected delivery
+		rejects, err := connection.redisClient.HGet(queue.rejectsKey, "commit-d0")
+		c.Check(err, IsNil)
+		c.Check(rejects, Equals, "1")
+		attempts, err := connection.redisClient.HGet(queue.attemptsKey, "commit-d0")
+		c.Check(err, IsNil)
+		c.Check(attempts, Equals, "1")
+		_, err = connection.redisClient.HGet(queue.attemptsKey, "commit-d1")
+		c.Check(err, Equals, ErrNotFound)
+
+		<-queue.StopConsuming()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestConsumeOrder(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("order-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("order-conn"),
+	} {
+		for order, expected := range map[ConsumeOrder][]string{
+			FIFO: {"order-d1", "order-d2", "order-d3", "order-d4", "order-d5"},
+			LIFO: {"order-d5", "order-d4", "order-d3", "order-d2", "order-d1"},
+		} {
+			queue := connection.OpenQueue("order-q").(*redisQueue)
+			queue.PurgeReady()
+			for i := 1; i <= 5; i++ {
+				c.Check(queue.Publish(fmt.Sprintf("order-d%d", i)), Equals, true)
+			}
+
+			queue.SetConsumeOrder(order)
+			consumer := NewTestConsumer("order-A")
+			c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+			queue.AddConsumer("order-cons", consumer)
+			time.Sleep(10 * time.Millisecond)
+			<-queue.StopConsuming()
+			queue.RemoveAllConsumers()
+
+			payloads := []string{}
+			for _, delivery := range consumer.LastDeliveries {
+				payloads = append(payloads, delivery.Payload())
+			}
+			c.Check(payloads, DeepEquals, expected)
+			c.Check(queue.UnackedCount(), Equals, 0)
+		}
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestIdleCallback(c *C) {
+	connection := OpenConnection("idle-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("idle-q").(*redisQueue)
+	queue.PurgeReady()
+
+	var idleCount int32
+	queue.SetIdleCallback(20*time.Millisecond, func() {
+		atomic.AddInt32(&idleCount, 1)
+	})
+	consumer := NewTestConsumer("idle-A")
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	queue.AddConsumer("idle-cons", consumer)
+
+	time.Sleep(10 * time.Millisecond)
+	c.Check(atomic.LoadInt32(&idleCount), Equals, int32(0))
+	time.Sleep(20 * time.Millisecond)
+	c.Check(atomic.LoadInt32(&idleCount), Equals, int32(1))
+
+	// doesn't fire while deliveries keep coming
+	for i := 0; i < 10; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("idle-d%d", i)), Equals, true)
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Check(atomic.LoadInt32(&idleCount), Equals, int32(1))
+	c.Check(consumer.LastDeliveries, HasLen, 10)
+
+	time.Sleep(30 * time.Millisecond)
+	c.Check(atomic.LoadInt32(&idleCount), Equals, int32(2))
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeN(c *C) {
+	connection := OpenConnection("consume-n-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("consume-n-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("consume-n-d%d", i)), Equals, true)
+	}
+
+	consumer := NewTestConsumer("consume-n-cons")
+	_, err := queue.StartConsumingN(0, 10, time.Millisecond)
+	c.Check(err, NotNil)
+	consumedChan, err := queue.StartConsumingN(3, 10, time.Millisecond)
+	c.Assert(err, IsNil)
+	_, err = queue.StartConsumingN(3, 10, time.Millisecond)
+	c.Check(err, Equals, ErrAlreadyConsuming)
+	queue.AddConsumer("consume-n-cons", consumer)
+
+	select {
+	case consumed := <-consumedChan:
+		c.Check(consumed, Equals, 3)
+	case <-time.After(time.Second):
+		c.Fatal("consuming 3 deliveries didn't finish")
+	}
+
+	c.Check(consumer.LastDeliveries, HasLen, 3)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	queue.RemoveAllConsumers()
+
+	// fewer deliveries than requested, keeps waiting for more
+	queue = connection.OpenQueue("consume-n-q").(*redisQueue)
+	consumer = NewTestConsumer("consume-n-cons")
+	consumedChan, err = queue.StartConsumingN(3, 10, time.Millisecond)
+	c.Assert(err, IsNil)
+	queue.AddConsumer("consume-n-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 2)
+	select {
+	case <-consumedChan:
+		c.Fatal("consuming 3 deliveries finished early")
+	default:
+	}
+
+	c.Check(queue.Publish("consume-n-d5"), Equals, true)
+	select {
+	case <-consumedChan:
+	case <-time.After(time.Second):
+		c.Fatal("consuming 3 deliveries didn't finish")
+	}
+	c.Check(consumer.LastDeliveries, HasLen, 3)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	queue.RemoveAllConsumers()
+
+	// stopping early closes the channel with the number consumed until then
+	queue = connection.OpenQueue("consume-n-q").(*redisQueue)
+	c.Check(queue.Publish("consume-n-d6"), Equals, true)
+	consumedChan, err = queue.StartConsumingN(3, 10, time.Millisecond)
+	c.Assert(err, IsNil)
+	queue.AddConsumer("consume-n-cons", NewTestConsumer("consume-n-cons"))
+	time.Sleep(10 * time.Millisecond)
+	<-queue.StopConsuming()
+	select {
+	case consumed := <-consumedChan:
+		c.Check(consumed, Equals, 1)
+	case <-time.After(time.Second):
+		c.Fatal("stopping didn't close the channel")
+	}
+	_, open := <-consumedChan
+	c.Check(open, Equals, false)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeChannel(c *C) {
+	connection := OpenConnection("channel-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("channel-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	for i := 0; i < 15; i++ { // more than the prefetch limit
+		c.Check(queue.Publish(fmt.Sprintf("channel-d%d", i)), Equals, true)
+	}
+
+	deliveries, err := queue.ConsumeChannel(10, time.Millisecond)
+	c.Assert(err, IsNil)
+	_, err = queue.ConsumeChannel(10, time.Millisecond)
+	c.Check(err, Equals, ErrAlreadyConsuming)
+	c.Check(queue.GetConsumers(), HasLen, 1)
+
+	for i := 0; i < 15; i++ {
+		select {
+		case delivery := <-deliveries:
+			c.Check(delivery.Payload(), Equals, fmt.Sprintf("channel-d%d", i))
+			if i%2 == 0 {
+				c.Check(delivery.Ack(), Equals, true)
+			} else {
+				c.Check(delivery.Reject(), Equals, true)
+			}
+		case <-time.After(time.Second):
+			c.Fatalf("delivery %d wasn't received", i)
+		}
+	}
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 7)
+
+	// stopping closes the channel
+	finishedChan := queue.StopConsuming()
+	for range deliveries {
+		c.Error("no more deliveries expected")
+	}
+	<-finishedChan
+
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDispatchTimeout(c *C) {
+	connection := OpenConnection("dispatch-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("dispatch-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("dispatch-d%d", i)), Equals, true)
+	}
+
+	consumer := NewTestConsumer("dispatch-cons")
+	consumer.AutoAck = false
+	consumer.AutoFinish = false
+	queue.SetDispatchTimeout(10 * time.Millisecond)
+	c.Check(queue.StartConsuming(10, 50*time.Millisecond), IsNil)
+	queue.AddConsumer("dispatch-cons", consumer)
+
+	// consumer is blocked on d0, d1 couldn't be dispatched and went back to ready
+	time.Sleep(30 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "dispatch-d0")
+	values, err := queue.redisClient.LRange(queue.readyKey, 0, -1)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, []string{"dispatch-d1", "dispatch-d2"})
+
+	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	consumer.Finish()
+	time.Sleep(60 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "dispatch-d2")
+
+	consumer.AutoFinish = true
+	consumer.Finish()
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestGlobalConcurrency(c *C) {
+	connection1 := OpenConnection("global-conn1", "tcp", "localhost:6379", 1)
+	connection2 := OpenConnection("global-conn2", "tcp", "localhost:6379", 1)
+	queue1 := connection1.OpenQueue("global-q").(*redisQueue)
+	queue2 := connection2.OpenQueue("global-q").(*redisQueue)
+	queue1.PurgeReady()
+
+	var running, maxRunning, consumed int32
+	consumer := func(delivery Delivery) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&consumed, 1)
+		delivery.Ack()
+	}
+
+	for _, queue := range []*redisQueue{queue1, queue2} {
+		queue.SetGlobalConcurrency(1)
+		c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+		queue.AddConsumerFunc("global-cons1", consumer)
+		queue.AddConsumerFunc("global-cons2", consumer)
+	}
+
+	for i := 0; i < 6; i++ {
+		c.Check(queue1.Publish(fmt.Sprintf("global-d%d", i)), Equals, true)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&consumed) < 6; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Check(atomic.LoadInt32(&consumed), Equals, int32(6))
+	c.Check(atomic.LoadInt32(&maxRunning), Equals, int32(1))
+	c.Check(queue1.ReadyCount(), Equals, 0)
+	c.Check(queue1.UnackedCount(), Equals, 0)
+	c.Check(queue2.UnackedCount(), Equals, 0)
+
+	<-queue1.StopConsuming()
+	<-queue2.StopConsuming()
+	connection1.StopHeartbeat()
+	connection2.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestGlobalConcurrencyRefresh(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	connection, err := OpenConnectionWithConfig("refresh-conn", redisClient, ConnectionConfig{HeartbeatInterval: 10 * time.Millisecond})
+	c.Assert(err, IsNil)
+	queue := connection.OpenQueue("refresh-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.SetGlobalConcurrency(1)
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("refresh-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("refresh-cons", consumer)
+	c.Check(queue.Publish("refresh-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+
+	// the heartbeat keeps the slot of the delivery in flight
+	slotKey := queue.slotKeys[0]
+	c.Assert(queue.heldSlots.tokens, HasLen, 1)
+	c.Check(redisClient.Set(slotKey, queue.heldSlots.tokens[slotKey], time.Second).Err(), IsNil)
+	time.Sleep(25 * time.Millisecond)
+	ttl, err := redisClient.PTTL(slotKey).Result()
+	c.Check(err, IsNil)
+	c.Check(ttl > time.Second, Equals, true, Commentf("%s", ttl))
+
+	// acking releases it
+	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	c.Check(queue.heldSlots.tokens, HasLen, 0)
+	c.Check(redisClient.Exists(slotKey).Val(), Equals, int64(0))
+
+	<-queue.StopConsuming()
+	connection.(*redisConnection).StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestReturnRejected(c *C) {
 	connection := OpenConnection("return-conn", "tcp", "localhost:6379", 1)
 	queue := connection.OpenQueue("return-q").(*redisQueue)
@@ -348,15 +2129,966 @@ func (suite *QueueSuite) TestReturnRejected(c *C) {
 
 	queue.StopConsuming()
 
-	queue.ReturnRejected(2)
+	c.Check(queue.ReturnRejected(0), Equals, 0)
+	c.Check(queue.ReturnRejected(-1), Equals, 0)
+	c.Check(queue.ReturnRejected(2), Equals, 2)
 	c.Check(queue.ReadyCount(), Equals, 2)    // delivery 0, 2
 	c.Check(queue.UnackedCount(), Equals, 1)  // delivery 4
 	c.Check(queue.RejectedCount(), Equals, 2) // delivery 3, 5
 
-	queue.ReturnAllRejected()
+	c.Check(queue.ReturnAllRejected(), Equals, 2)
 	c.Check(queue.ReadyCount(), Equals, 4)   // delivery 0, 2, 3, 5
 	c.Check(queue.UnackedCount(), Equals, 1) // delivery 4
 	c.Check(queue.RejectedCount(), Equals, 0)
+
+	c.Check(queue.ReturnRejected(5), Equals, 0)
+	c.Check(queue.ReturnAllRejected(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 4)
+}
+
+func (suite *QueueSuite) TestAttempts(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("attempts-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("attempts-conn"),
+	} {
+		queue := connection.OpenQueue("attempts-q").(*redisQueue)
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		queue.SetAttemptTracking(true)
+		consumer := NewTestConsumer("attempts-A")
+		consumer.AutoAck = false
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("attempts-cons", consumer)
+
+		c.Check(queue.Publish("attempts-d1"), Equals, true)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 1)
+		attempts, err := consumer.LastDelivery.Attempts()
+		c.Check(err, IsNil)
+		c.Check(attempts, Equals, 1)
+
+		// redeliver
+		c.Check(consumer.LastDelivery.Reject(), Equals, true)
+		c.Check(queue.ReturnAllRejected(), Equals, 1)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 2)
+		attempts, err = consumer.LastDelivery.Attempts()
+		c.Check(err, IsNil)
+		c.Check(attempts, Equals, 2)
+
+		// acking deletes the count
+		c.Check(consumer.LastDelivery.Ack(), Equals, true)
+		affected, _ := queue.redisClient.HDel(queue.attemptsKey, "attempts-d1")
+		c.Check(affected, Equals, 0)
+
+		<-queue.StopConsuming()
+		connection.StopHeartbeat()
+	}
+
+	connection := OpenConnection("attempts-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("attempts-q").(*redisQueue)
+	queue.StartConsuming(10, time.Millisecond)
+	consumer := NewTestConsumer("attempts-B")
+	queue.AddConsumer("attempts-cons", consumer)
+	c.Check(queue.Publish("attempts-d2"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	_, err := consumer.LastDelivery.Attempts()
+	c.Check(err, NotNil) // not tracked
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMaxMessageBytes(c *C) {
+	redisClient := NewTestRedisClient()
+	connection, err := openConnectionWithRedisClient("max-bytes-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	queue := connection.OpenQueueWithPriorities("max-bytes-q", 2).(*redisQueue)
+	queue.SetMaxMessageBytes(5)
+
+	// oversized payloads don't reach redis
+	redisClient.FailNext("LPush", errors.New("contacted redis"))
+	c.Check(queue.Publish("small", "too large"), Equals, false)
+	c.Check(queue.PublishWithPriority("too large", 1), Equals, false)
+	c.Check(queue.PublishWithHeaders("small", map[string]string{"k": "v"}), Equals, false)
+	_, err = queue.PublishBatch([]string{"small", "too large"})
+	c.Check(err, Equals, ErrMessageTooLarge)
+	_, err = queue.PublishUnique("max-bytes", "too large", time.Minute)
+	c.Check(err, Equals, ErrMessageTooLarge)
+	c.Check(queue.Publish("small"), Equals, false) // fails with the error set above
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	c.Check(queue.Publish("small", "12345"), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	queue.SetMaxMessageBytes(0)
+	c.Check(queue.Publish("no limit"), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 3)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishE(c *C) {
+	redisClient := NewTestRedisClient()
+	connection, err := openConnectionWithRedisClient("publish-e-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	queue := connection.OpenQueue("publish-e-q")
+	queue.SetMaxMessageBytes(5)
+
+	failure := errors.New("redis down")
+	redisClient.FailNext("LPush", failure)
+	err = queue.PublishE("d1")
+	c.Check(errors.Is(err, failure), Equals, true)
+	c.Check(queue.PublishE("too large"), Equals, ErrMessageTooLarge)
+	c.Check(queue.PublishE("d1", "d2"), IsNil)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishWithBackpressure(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("backpressure-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("backpressure-conn"),
+	} {
+		queue := connection.OpenQueue("backpressure-q")
+		queue.PurgeReady()
+
+		for i := 0; i < 2; i++ {
+			published, err := queue.PublishWithBackpressure("backpressure-d", 2)
+			c.Check(err, IsNil)
+			c.Check(published, Equals, true)
+		}
+		published, err := queue.PublishWithBackpressure("backpressure-d", 2)
+		c.Check(err, IsNil)
+		c.Check(published, Equals, false)
+		c.Check(queue.ReadyCount(), Equals, 2)
+
+		queue.SetMaxMessageBytes(5)
+		_, err = queue.PublishWithBackpressure("backpressure-d", 10)
+		c.Check(err, Equals, ErrMessageTooLarge)
+		c.Check(queue.ReadyCount(), Equals, 2)
+
+		queue.PurgeReady()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestJSON(c *C) {
+	connection := OpenConnectionWithTestRedisClient("json-conn")
+	queue := connection.OpenQueue("json-q")
+	consumer := NewTestConsumer("json-A")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("json-cons", consumer)
+
+	type message struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	c.Check(PublishJSON(queue, message{ID: 1, Name: "json-d1"}), IsNil)
+	c.Check(PublishJSON(queue, make(chan int)), NotNil)
+	c.Check(queue.Publish("{invalid"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+
+	var decoded message
+	c.Check(UnmarshalJSON(consumer.LastDeliveries[0], &decoded), IsNil)
+	c.Check(decoded, Equals, message{ID: 1, Name: "json-d1"})
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+
+	c.Check(UnmarshalJSON(consumer.LastDeliveries[1], &decoded), NotNil)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	err := UnmarshalJSONOrReject(consumer.LastDeliveries[1], &decoded)
+	var syntaxErr *json.SyntaxError
+	c.Check(errors.As(err, &syntaxErr), Equals, true)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestCodec(c *C) {
+	type message struct {
+		ID   int
+		Name string
+	}
+	for _, connection := range []*redisConnection{
+		OpenConnection("codec-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("codec-conn"),
+	} {
+		for i, codec := range []Codec{JSONCodec{}, GobCodec{}, NewGzipCodec(JSONCodec{}), NewGzipCodec(GobCodec{})} {
+			queue := connection.OpenQueue("codec-q")
+			queue.PurgeReady()
+			queue.SetCodec(codec)
+			c.Check(queue.PublishValue(message{ID: 1, Name: "codec-d1"}), IsNil)
+			c.Check(queue.PublishValue(make(chan int)), NotNil)
+
+			consumer := NewTestConsumer("codec-A")
+			queue.StartConsuming(10, time.Millisecond)
+			_, err := queue.AddConsumer(fmt.Sprintf("codec-cons-%d", i), consumer)
+			c.Check(err, IsNil)
+			time.Sleep(10 * time.Millisecond)
+			c.Assert(consumer.LastDeliveries, HasLen, 1)
+			var decoded message
+			c.Check(consumer.LastDeliveries[0].Decode(&decoded), IsNil)
+			c.Check(decoded, Equals, message{ID: 1, Name: "codec-d1"})
+			var name string
+			c.Check(consumer.LastDeliveries[0].Decode(&name), NotNil)
+			<-queue.StopConsuming()
+		}
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestRawCodec(c *C) {
+	connection := OpenConnectionWithTestRedisClient("raw-codec-conn")
+	queue := connection.OpenQueue("raw-codec-q")
+	c.Check(queue.PublishValue("raw-codec-d1"), IsNil)
+	c.Check(queue.PublishValue([]byte("raw-codec-d2")), IsNil)
+	c.Check(queue.PublishValue(1), NotNil)
+
+	consumer := NewTestConsumer("raw-codec-A")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("raw-codec-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	var payload string
+	c.Check(consumer.LastDeliveries[0].Decode(&payload), IsNil)
+	c.Check(payload, Equals, "raw-codec-d1")
+	var bytes []byte
+	c.Check(consumer.LastDeliveries[1].Decode(&bytes), IsNil)
+	c.Check(string(bytes), Equals, "raw-codec-d2")
+	var id int
+	c.Check(consumer.LastDeliveries[1].Decode(&id), NotNil)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPurgeCounts(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("purge-counts-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("purge-counts-conn"),
+	} {
+		queue := connection.OpenQueue("purge-counts-q").(*redisQueue)
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		queue.SetAttemptTracking(true)
+		queue.SetMaxRejects(5)
+		consumer := NewTestConsumer("purge-counts-A")
+		consumer.AutoAck = false
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("purge-counts-cons", consumer)
+
+		c.Check(queue.Publish("purge-counts-d1", "purge-counts-d2"), Equals, true)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 2)
+		for _, delivery := range consumer.LastDeliveries {
+			c.Check(delivery.Reject(), Equals, true)
+		}
+		<-queue.StopConsuming()
+		c.Check(queue.Publish("purge-counts-d3"), Equals, true)
+		_, err := queue.redisClient.HIncrBy(queue.attemptsKey, "purge-counts-d3", 1)
+		c.Check(err, IsNil)
+
+		c.Check(queue.PurgeRejected(), Equals, 2)
+		c.Check(queue.PurgeReady(), Equals, 1)
+		for _, payload := range []string{"purge-counts-d1", "purge-counts-d2", "purge-counts-d3"} {
+			_, err := queue.redisClient.HGet(queue.attemptsKey, payload)
+			c.Check(err, Equals, ErrNotFound)
+			_, err = queue.redisClient.HGet(queue.rejectsKey, payload)
+			c.Check(err, Equals, ErrNotFound)
+		}
+
+		queue.RemoveAllConsumers()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestMaxRejects(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("rejects-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("rejects-conn"),
+	} {
+		queue := connection.OpenQueue("rejects-q").(*redisQueue)
+		deadQueue := connection.OpenQueue("rejects-dead-q").(*redisQueue)
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		deadQueue.PurgeReady()
+		queue.SetPushQueue(deadQueue)
+		queue.SetMaxRejects(2)
+		consumer := NewTestConsumer("rejects-A")
+		consumer.AutoAck = false
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("rejects-cons", consumer)
+
+		c.Check(queue.Publish("rejects-d1"), Equals, true)
+		for i := 0; i < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			c.Assert(consumer.LastDeliveries, HasLen, i+1)
+			c.Check(consumer.LastDelivery.RejectCount(), Equals, i)
+			c.Check(consumer.LastDelivery.Reject(), Equals, true)
+			c.Check(queue.RejectedCount(), Equals, 1)
+			c.Check(queue.ReturnAllRejected(), Equals, 1)
+		}
+
+		// third rejection exceeds the limit
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 3)
+		c.Check(consumer.LastDelivery.RejectCount(), Equals, 2)
+		c.Check(consumer.LastDelivery.Reject(), Equals, true)
+		c.Check(queue.RejectedCount(), Equals, 0)
+		c.Check(queue.UnackedCount(), Equals, 0)
+		c.Check(deadQueue.ReadyCount(), Equals, 1)
+		_, err := queue.redisClient.HGet(queue.rejectsKey, "rejects-d1")
+		c.Check(err, Equals, ErrNotFound) // done with this queue
+
+		// acking deletes the count
+		c.Check(queue.Publish("rejects-d2"), Equals, true)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 4)
+		c.Check(consumer.LastDelivery.Reject(), Equals, true)
+		c.Check(queue.ReturnAllRejected(), Equals, 1)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 5)
+		c.Check(consumer.LastDelivery.RejectCount(), Equals, 1)
+		c.Check(consumer.LastDelivery.Ack(), Equals, true)
+		_, err = queue.redisClient.HGet(queue.rejectsKey, "rejects-d2")
+		c.Check(err, Equals, ErrNotFound)
+
+		<-queue.StopConsuming()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestSnapshot(c *C) {
+	connection := OpenConnection("snapshot-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("snapshot-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("snapshot-d%d", i)), Equals, true)
+	}
+
+	consumer := NewTestConsumer("snapshot-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), IsNil)
+	queue.AddConsumer("snapshot-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	<-queue.StopConsuming()
+	c.Assert(consumer.LastDeliveries, HasLen, 5)
+	c.Check(consumer.LastDeliveries[0].Reject(), Equals, true)
+	c.Check(consumer.LastDeliveries[1].Ack(), Equals, true)
+	c.Check(queue.Publish("snapshot-d5"), Equals, true)
+	c.Check(queue.Publish("snapshot-d6"), Equals, true)
+
+	snapshot, err := queue.Snapshot()
+	c.Assert(err, IsNil)
+	c.Check(snapshot.Ready, DeepEquals, []string{"snapshot-d6", "snapshot-d5"})
+	c.Check(snapshot.Rejected, DeepEquals, []string{"snapshot-d0"})
+	c.Check(snapshot.Unacked, DeepEquals, map[string][]string{connection.Name: {"snapshot-d4", "snapshot-d3", "snapshot-d2"}})
+
+	// snapshots can be stored as JSON fixtures
+	encoded, err := json.Marshal(snapshot)
+	c.Assert(err, IsNil)
+	var decoded QueueSnapshot
+	c.Assert(json.Unmarshal(encoded, &decoded), IsNil)
+
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	c.Check(queue.Restore(decoded), IsNil)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	restored, err := queue.Snapshot()
+	c.Assert(err, IsNil)
+	c.Check(restored, DeepEquals, snapshot)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAckAndPublish(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("ack-publish-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("ack-publish-test-conn"),
+	} {
+		queue1 := connection.OpenQueue("ack-publish-q1").(*redisQueue)
+		queue2 := connection.OpenQueue("ack-publish-q2").(*redisQueue)
+		queue1.PurgeReady()
+		queue2.PurgeReady()
+
+		queue1.SetAttemptTracking(true)
+		queue2.SetMaxMessageBytes(14)
+
+		consumer := NewTestConsumer("ack-publish-cons")
+		consumer.AutoAck = false
+		c.Check(queue1.StartConsuming(10, time.Millisecond), IsNil)
+		queue1.AddConsumer("ack-publish-cons", consumer)
+		c.Check(queue1.Publish("ack-publish-d1"), Equals, true)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 1)
+		c.Check(queue1.UnackedCount(), Equals, 1)
+
+		c.Check(consumer.LastDelivery.AckAndPublish(NewTestQueue("ack-publish-q2"), "ack-publish-r1"), NotNil)
+		c.Check(consumer.LastDelivery.AckAndPublish(queue2, "ack-publish-too-large"), Equals, ErrMessageTooLarge)
+		c.Check(queue1.UnackedCount(), Equals, 1)
+		c.Check(consumer.LastDelivery.AckAndPublish(queue2, "ack-publish-r1"), IsNil)
+		c.Check(queue1.UnackedCount(), Equals, 0)
+		attempts, err := queue1.redisClient.HGet(queue1.attemptsKey, "ack-publish-d1")
+		c.Check(err, Equals, ErrNotFound) // forgotten with the ack
+		c.Check(attempts, Equals, "")
+		c.Check(queue2.ReadyCount(), Equals, 1)
+		values, err := queue2.redisClient.LRange(queue2.readyKey, 0, -1)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, []string{"ack-publish-r1"})
+
+		// already acked, so nothing gets published
+		c.Check(consumer.LastDelivery.AckAndPublish(queue2, "ack-publish-r2"), NotNil)
+		c.Check(queue1.UnackedCount(), Equals, 0)
+		c.Check(queue2.ReadyCount(), Equals, 1)
+
+		<-queue1.StopConsuming()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestPublishWithTrace(c *C) {
+	connection := OpenConnection("trace-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("trace-q").(*redisQueue)
+	queue.PurgeReady()
+	consumer := NewTestConsumer("trace-A")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("trace-cons", consumer)
+
+	c.Check(queue.PublishWithTrace("trace-d1", "4bf92f3577b34da6"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "trace-d1")
+	c.Check(consumer.LastDelivery.TraceID(), Equals, "4bf92f3577b34da6")
+	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	c.Check(queue.Publish("trace-d2"), Equals, true)
+	c.Check(queue.Publish(`{"h":{"x":"y"}}`), Equals, true) // looks like an envelope, but has no payload
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+	c.Check(consumer.LastDeliveries[1].Payload(), Equals, "trace-d2")
+	c.Check(consumer.LastDeliveries[1].TraceID(), Equals, "")
+	c.Check(consumer.LastDeliveries[2].Payload(), Equals, `{"h":{"x":"y"}}`)
+	c.Check(consumer.LastDeliveries[2].TraceID(), Equals, "")
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishWithHeaders(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("headers-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("headers-conn"),
+	} {
+		queue := connection.OpenQueue("headers-q").(*redisQueue)
+		queue.PurgeReady()
+		consumer := NewTestConsumer("headers-A")
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("headers-cons", consumer)
+
+		headers := map[string]string{"content-type": "application/json"}
+		c.Check(queue.PublishWithHeaders(`{"id":1}`, headers), Equals, true)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 1)
+		c.Check(consumer.LastDelivery.Payload(), Equals, `{"id":1}`)
+		c.Check(consumer.LastDelivery.Headers(), DeepEquals, headers)
+
+		// reserved headers are left out
+		c.Check(queue.PublishWithHeaders("headers-d2", map[string]string{traceIDHeader: "4bf92f3577b34da6", "x": "y"}), Equals, true)
+		c.Check(queue.PublishWithHeaders("headers-d3", nil), Equals, true)
+		c.Check(queue.PublishWithTrace("headers-d4", "4bf92f3577b34da6"), Equals, true)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 4)
+		c.Check(consumer.LastDeliveries[1].TraceID(), Equals, "4bf92f3577b34da6")
+		c.Check(consumer.LastDeliveries[1].Headers(), DeepEquals, map[string]string{"x": "y"})
+		c.Check(consumer.LastDeliveries[2].Payload(), Equals, "headers-d3")
+		c.Check(consumer.LastDeliveries[2].Headers(), IsNil)
+		c.Check(consumer.LastDeliveries[3].Headers(), IsNil)
+
+		<-queue.StopConsuming()
+		connection.StopHeartbeat()
+	}
+}
+
+type requestIDKey struct{}
+
+// requestIDPropagator carries a request ID through deliveries
+type requestIDPropagator struct{}
+
+func (requestIDPropagator) Inject(ctx context.Context, headers map[string]string) {
+	if requestID, ok := ctx.Value(requestIDKey{}).(string); ok {
+		headers["request-id"] = requestID
+	}
+}
+
+func (requestIDPropagator) Extract(ctx context.Context, headers map[string]string) context.Context {
+	if requestID, ok := headers["request-id"]; ok {
+		return context.WithValue(ctx, requestIDKey{}, requestID)
+	}
+	return ctx
+}
+
+func (suite *QueueSuite) TestPropagator(c *C) {
+	connection := OpenConnection("propagator-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("propagator-q").(*redisQueue)
+	queue.PurgeReady()
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-1")
+
+	// without propagator nothing gets injected
+	c.Check(queue.PublishWithContext(ctx, "propagator-d1"), Equals, true)
+	values, err := queue.redisClient.LRange(queue.readyKey, 0, -1)
+	c.Check(err, IsNil)
+	c.Check(values, DeepEquals, []string{"propagator-d1"})
+
+	queue.SetPropagator(requestIDPropagator{})
+	consumer := NewTestConsumer("propagator-A")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("propagator-cons", consumer)
+	c.Check(queue.PublishWithContext(ctx, "propagator-d2"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDeliveries[0].Context().Value(requestIDKey{}), IsNil)
+	c.Check(consumer.LastDeliveries[1].Payload(), Equals, "propagator-d2")
+	c.Check(consumer.LastDeliveries[1].Context().Value(requestIDKey{}), Equals, "req-1")
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishUnique(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("unique-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("unique-conn"),
+	} {
+		queue := connection.OpenQueue("unique-q").(*redisQueue)
+		queue.PurgeReady()
+		dedupKey := uniuri.NewLen(8)
+
+		published, err := queue.PublishUnique(dedupKey, "unique-d1", time.Minute)
+		c.Check(err, IsNil)
+		c.Check(published, Equals, true)
+		published, err = queue.PublishUnique(dedupKey, "unique-d2", time.Minute)
+		c.Check(err, IsNil)
+		c.Check(published, Equals, false)
+		published, err = queue.PublishUnique(uniuri.NewLen(8), "unique-d3", time.Minute)
+		c.Check(err, IsNil)
+		c.Check(published, Equals, true)
+		values, err := queue.redisClient.LRange(queue.readyKey, 0, -1)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, []string{"unique-d3", "unique-d1"})
+
+		_, err = queue.PublishUnique(dedupKey, "unique-d4", 0)
+		c.Check(err, ErrorMatches, "rmq queue dedup window must be at least a millisecond.*")
+
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestPublishWithTTL(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("ttl-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("ttl-conn"),
+	} {
+		queue := connection.OpenQueue("ttl-q").(*redisQueue)
+		queue.PurgeReady()
+		c.Check(queue.PublishWithTTL("ttl-d1", time.Millisecond), Equals, true)
+		c.Check(queue.PublishWithTTL("ttl-d2", time.Minute), Equals, true)
+		c.Check(queue.PublishWithTTL("ttl-d3", 0), Equals, true)
+		time.Sleep(5 * time.Millisecond)
+
+		// the expired delivery gets discarded when fetched
+		consumer := NewTestConsumer("ttl-A")
+		consumer.AutoAck = false
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("ttl-cons", consumer)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 2)
+		c.Check(consumer.LastDeliveries[0].Payload(), Equals, "ttl-d2")
+		c.Check(consumer.LastDeliveries[0].Expired(), Equals, false)
+		c.Check(consumer.LastDeliveries[1].Payload(), Equals, "ttl-d3")
+		c.Check(consumer.LastDeliveries[1].Expired(), Equals, false)
+		c.Check(queue.ReadyCount(), Equals, 0)
+		c.Check(queue.UnackedCount(), Equals, 2)
+
+		<-queue.StopConsuming()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestPublishBatch(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("batch-publish-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("batch-publish-conn"),
+	} {
+		queue := connection.OpenQueue("batch-publish-q").(*redisQueue)
+		queue.PurgeReady()
+
+		count, err := queue.PublishBatch(nil)
+		c.Check(err, IsNil)
+		c.Check(count, Equals, 0)
+		count, err = queue.PublishBatch([]string{"batch-publish-d1", "batch-publish-d2", "batch-publish-d3"})
+		c.Check(err, IsNil)
+		c.Check(count, Equals, 3)
+		c.Check(queue.ReadyCount(), Equals, 3)
+
+		// consumed in the given order
+		value, err := queue.redisClient.RPopLPush(queue.readyKey, queue.unackedKey)
+		c.Check(err, IsNil)
+		c.Check(value, Equals, "batch-publish-d1")
+		queue.redisClient.Del(queue.unackedKey)
+
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestQueueCounts(c *C) {
+	connection := OpenConnection("counts-conn", "tcp", "localhost:6379", 1)
+	var queue Queue = connection.OpenQueue("counts-q")
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	c.Check(queue.ReadyCount(), Equals, 0) // missing keys count as empty
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	c.Check(queue.Publish("counts-d1", "counts-d2"), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.PurgeReady(), Equals, 2)
+
+	var testQueue Queue = NewTestQueue("counts-test-q")
+	c.Check(testQueue.Publish("counts-d1"), Equals, true)
+	c.Check(testQueue.ReadyCount(), Equals, 1)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRetryPolicy(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("retry-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("retry-conn"),
+	} {
+		queue := connection.OpenQueue("retry-q").(*redisQueue)
+		deadLetter := connection.OpenQueue("retry-dead-q")
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		deadLetter.PurgeReady()
+		retriesKey := strings.Replace(queue.key(queueRetriesTemplate), phQueue, queue.name, 1)
+		connection.redisClient.Del(retriesKey)
+		connection.redisClient.Del(strings.Replace(queue.key(queueRetryTemplate), phQueue, queue.name, 1))
+
+		c.Check(queue.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, DeadLetter: deadLetter}), NotNil)
+		c.Check(queue.SetRetryPolicy(RetryPolicy{Backoffs: []time.Duration{time.Millisecond}, MaxAttempts: 3}), NotNil)
+		c.Assert(queue.SetRetryPolicy(RetryPolicy{
+			Backoffs:    []time.Duration{10 * time.Millisecond, 30 * time.Millisecond},
+			MaxAttempts: 3,
+			DeadLetter:  deadLetter,
+		}), IsNil)
+
+		var mutex sync.Mutex
+		consumed := map[string]int{}
+		c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+		_, err := queue.AddConsumerFunc("retry-cons", func(delivery Delivery) {
+			mutex.Lock()
+			consumed[delivery.Payload()]++
+			count := consumed[delivery.Payload()]
+			mutex.Unlock()
+			if delivery.Payload() == "retry-d2" && count == 2 {
+				delivery.Ack()
+				return
+			}
+			delivery.Reject()
+		})
+		c.Assert(err, IsNil)
+		c.Check(queue.Publish("retry-d1", "retry-d2"), Equals, true)
+
+		for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+			if deadLetter.ReadyCount() == 1 {
+				break
+			}
+		}
+		c.Check(deadLetter.ReadyCount(), Equals, 1)
+		ready, err := deadLetter.Peek(0, 1)
+		c.Check(err, IsNil)
+		c.Check(ready, DeepEquals, []string{"retry-d1"})
+		mutex.Lock()
+		c.Check(consumed, DeepEquals, map[string]int{"retry-d1": 3, "retry-d2": 2})
+		mutex.Unlock()
+		c.Check(queue.RejectedCount(), Equals, 0)
+		c.Check(queue.ReadyCount(), Equals, 0)
+		// the counts are gone once dead lettered or acked
+		_, err = connection.redisClient.HGet(retriesKey, "retry-d1")
+		c.Check(err, Equals, ErrNotFound)
+		_, err = connection.redisClient.HGet(retriesKey, "retry-d2")
+		c.Check(err, Equals, ErrNotFound)
+
+		<-queue.StopConsuming()
+		deadLetter.PurgeReady()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestRejectWithError(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("reject-error-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("reject-error-conn"),
+	} {
+		queue := connection.OpenQueue("reject-error-q").(*redisQueue)
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		connection.redisClient.Del(queue.errorsKey)
+		consumer := NewTestConsumer("reject-error-A")
+		consumer.AutoAck = false
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("reject-error-cons", consumer)
+
+		before := time.Now()
+		_, err := queue.PublishBatch([]string{"reject-error-d1", "reject-error-d2", "reject-error-d3"})
+		c.Check(err, IsNil)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 3)
+		c.Check(consumer.LastDeliveries[0].RejectWithError(errors.New("invalid json")), Equals, true)
+		c.Check(consumer.LastDeliveries[1].Reject(), Equals, true)
+		c.Check(consumer.LastDeliveries[2].RejectWithError(errors.New("unknown id")), Equals, true)
+		c.Check(queue.RejectedCount(), Equals, 3)
+
+		entries, err := queue.RejectedErrors(10)
+		c.Check(err, IsNil)
+		c.Assert(entries, HasLen, 2)
+		c.Check(entries[0].Payload, Equals, "reject-error-d3")
+		c.Check(entries[0].Error, Equals, "unknown id")
+		c.Check(entries[0].RejectedAt.Before(before), Equals, false)
+		c.Check(entries[1].Payload, Equals, "reject-error-d1")
+		c.Check(entries[1].Error, Equals, "invalid json")
+		entries, err = queue.RejectedErrors(1)
+		c.Check(err, IsNil)
+		c.Check(entries, HasLen, 1)
+
+		<-queue.StopConsuming()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestPeek(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("peek-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("peek-conn"),
+	} {
+		queue := connection.OpenQueue("peek-q").(*redisQueue)
+		queue.PurgeReady()
+		for i := 1; i <= 4; i++ {
+			c.Check(queue.PublishWithTrace(fmt.Sprintf("peek-d%d", i), "peek-trace"), Equals, true)
+		}
+
+		payloads, err := queue.Peek(0, 2)
+		c.Check(err, IsNil)
+		c.Check(payloads, DeepEquals, []string{"peek-d4", "peek-d3"})
+		payloads, err = queue.Peek(-2, 2)
+		c.Check(err, IsNil)
+		c.Check(payloads, DeepEquals, []string{"peek-d2", "peek-d1"})
+		payloads, err = queue.Peek(-1, 10)
+		c.Check(err, IsNil)
+		c.Check(payloads, DeepEquals, []string{"peek-d1"})
+		payloads, err = queue.Peek(3, 10)
+		c.Check(err, IsNil)
+		c.Check(payloads, DeepEquals, []string{"peek-d1"})
+		payloads, err = queue.Peek(0, 0)
+		c.Check(err, IsNil)
+		c.Check(payloads, HasLen, 0)
+		c.Check(queue.ReadyCount(), Equals, 4)
+
+		queue.PurgeReady()
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestReturnUnacked(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("return-unacked-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("return-unacked-conn"),
+	} {
+		queue := connection.OpenQueue("return-unacked-q").(*redisQueue)
+		queue.PurgeReady()
+		queue.redisClient.Del(queue.unackedKey)
+		consumer := NewTestConsumer("return-unacked-A")
+		consumer.AutoAck = false
+		queue.StartConsuming(10, time.Millisecond)
+		queue.AddConsumer("return-unacked-cons", consumer)
+
+		count, err := queue.PublishBatch([]string{"return-unacked-d1", "return-unacked-d2", "return-unacked-d3"})
+		c.Check(err, IsNil)
+		c.Check(count, Equals, 3)
+		time.Sleep(10 * time.Millisecond)
+		<-queue.StopConsuming()
+		c.Check(queue.UnackedCount(), Equals, 3)
+
+		c.Check(queue.ReturnUnacked(0), Equals, 0)
+		c.Check(queue.ReturnUnacked(2), Equals, 2)
+		c.Check(queue.UnackedCount(), Equals, 1)
+		values, err := queue.redisClient.LRange(queue.readyKey, 0, -1)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, []string{"return-unacked-d2", "return-unacked-d1"})
+		c.Check(queue.ReturnUnacked(2), Equals, 1)
+		c.Check(queue.UnackedCount(), Equals, 0)
+		c.Check(queue.ReadyCount(), Equals, 3)
+
+		connection.StopHeartbeat()
+	}
+}
+
+func (suite *QueueSuite) TestStartConsumingRecover(c *C) {
+	connection := OpenConnection("recover-conn", "tcp", "localhost:6379", 1)
+	other := connection.hijackConnection("recover-other")
+
+	queue := connection.OpenQueue("recover-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(connection.redisClient.LPush(queue.unackedKey, "recover-d1", "recover-d2"), IsNil)
+	otherQueue := other.openQueue("recover-q")
+	c.Check(connection.redisClient.LPush(otherQueue.unackedKey, "recover-d3"), IsNil)
+
+	queue = connection.OpenQueue("recover-q").(*redisQueue) // reopened after consumers died
+	returned, err := queue.StartConsumingRecover(10, time.Millisecond)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	consumer := NewTestConsumer("recover-A")
+	queue.AddConsumer("recover-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(otherQueue.UnackedCount(), Equals, 1) // other connection untouched
+
+	returned, err = queue.StartConsumingRecover(10, time.Millisecond)
+	c.Check(err, Equals, ErrAlreadyConsuming)
+	c.Check(returned, Equals, 0)
+
+	<-queue.StopConsuming()
+	connection.redisClient.Del(otherQueue.unackedKey)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRequest(c *C) {
+	connection := OpenConnection("request-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("request-q").(*redisQueue)
+	queue.PurgeReady()
+	replyQueue := connection.OpenQueue("request-replies").(*redisQueue)
+	replyQueue.PurgeReady()
+
+	// no responder yet
+	reply, err := queue.Request("request-d0", "request-replies", 20*time.Millisecond)
+	c.Check(err, Equals, ErrRequestTimeout)
+	c.Check(reply, Equals, "")
+
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumerFunc("request-echo", func(delivery Delivery) {
+		c.Check(delivery.Reply("echo "+delivery.Payload()), IsNil)
+		delivery.Ack()
+	})
+
+	// the late reply to the first request expires
+	time.Sleep(10 * time.Millisecond)
+	replyKeys, err := scanKeys(connection.redisClient, `rmq::queue::\[request-replies\]::reply::*`)
+	c.Check(err, IsNil)
+	c.Assert(replyKeys, HasLen, 1)
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	ttl, err := redisClient.PTTL(replyKeys[0]).Result()
+	c.Check(err, IsNil)
+	c.Check(ttl > 0 && ttl <= 20*time.Millisecond, Equals, true, Commentf("%s", ttl))
+	_, err = connection.redisClient.Del(replyKeys[0])
+	c.Check(err, IsNil)
+
+	reply, err = queue.Request("request-d1", "request-replies", time.Second)
+	c.Check(err, IsNil)
+	c.Check(reply, Equals, "echo request-d1")
+	reply, err = queue.Request("request-d2", "request-replies", time.Second)
+	c.Check(err, IsNil)
+	c.Check(reply, Equals, "echo request-d2")
+	replyKeys, err = scanKeys(connection.redisClient, `rmq::queue::\[request-replies\]::reply::*`)
+	c.Check(err, IsNil)
+	c.Check(replyKeys, HasLen, 0)
+	c.Check(replyQueue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeUntilEmpty(c *C) {
+	connection := OpenConnection("until-empty-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueueWithPriorities("until-empty-q", 2).(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("until-empty-d%d", i)), Equals, true)
+	}
+	c.Check(queue.PublishWithPriority("until-empty-d5", 1), Equals, true)
+
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	payloads := []string{}
+	processed, err := ConsumeUntilEmpty(client, "until-empty-q", 20*time.Millisecond, func(delivery Delivery) error {
+		c.Check(delivery.Connection(), Matches, "consume-until-empty-.*")
+		payloads = append(payloads, delivery.Payload())
+		if delivery.Payload() == "until-empty-d2" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	c.Check(err, IsNil)
+	c.Check(processed, Equals, 6)
+	c.Check(payloads, DeepEquals, []string{"until-empty-d5", "until-empty-d0", "until-empty-d1", "until-empty-d2", "until-empty-d3", "until-empty-d4"})
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	for _, name := range connection.GetConnections() {
+		c.Check(name, Not(Matches), "consume-until-empty-.*")
+	}
+
+	_, err = ConsumeUntilEmpty(redis.NewClient(&redis.Options{Addr: "localhost:1"}), "until-empty-q", time.Millisecond, nil)
+	c.Check(err, NotNil)
+
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestWaitEmpty(c *C) {
+	connection := OpenConnection("wait-empty-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("wait-empty-q").(*redisQueue)
+	queue.PurgeReady()
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("wait-empty-d%d", i)), Equals, true)
+	}
+
+	// nobody consumes
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	c.Check(queue.WaitEmpty(ctx), Equals, context.DeadlineExceeded)
+	cancel()
+
+	consumer := NewTestConsumer("wait-empty-A")
+	consumer.SleepDuration = 5 * time.Millisecond
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("wait-empty-cons", consumer)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	c.Check(queue.WaitEmpty(ctx), IsNil)
+	cancel()
+	c.Check(consumer.LastDeliveries, HasLen, 5)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
 }
 
 func (suite *QueueSuite) TestPushQueue(c *C) {
@@ -417,6 +3149,103 @@ func (suite *QueueSuite) TestConsuming(c *C) {
 	}
 }
 
+func (suite *QueueSuite) TestStartConsumingWithContext(c *C) {
+	connection := OpenConnection("ctx-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("ctx-q").(*redisQueue)
+	queue.PurgeReady()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Assert(queue.StartConsumingWithContext(ctx, 10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("ctx-A")
+	queue.AddConsumer("ctx-cons", consumer)
+
+	c.Check(queue.Publish("ctx-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Context(), Equals, ctx)
+	c.Check(consumer.LastDelivery.Context().Err(), IsNil)
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(atomic.LoadInt32(&queue.consumingStopped), Equals, int32(1))
+	c.Check(consumer.LastDelivery.Context().Err(), Equals, context.Canceled)
+
+	c.Check(queue.Publish("ctx-d2"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 1)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPauseConsuming(c *C) {
+	connection := OpenConnection("pause-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("pause-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	consumer := NewTestConsumer("pause-A")
+	consumer.AutoAck = false
+	queue.AddConsumer("pause-cons", consumer)
+
+	c.Check(queue.Publish("pause-d1"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+
+	queue.PauseConsuming()
+	c.Check(queue.Publish("pause-d2"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 1)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(consumer.LastDelivery.Ack(), Equals, true) // fetched deliveries can still be acked
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.GetConsumers(), HasLen, 1)
+
+	queue.ResumeConsuming()
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "pause-d2")
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnBufferedOnStop(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("return-buffered-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("return-buffered-conn"),
+	} {
+		queue := connection.OpenQueue("return-buffered-q").(*redisQueue)
+		queue.PurgeReady()
+		queue.SetReturnBufferedOnStop(true)
+		for i := 0; i < 5; i++ {
+			queue.Publish("return-buffered-d" + strconv.Itoa(i))
+		}
+
+		consumer := NewTestConsumer("return-buffered-A")
+		consumer.AutoFinish = false
+		c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+		queue.AddConsumer("return-buffered-cons", consumer)
+		time.Sleep(10 * time.Millisecond)
+		c.Check(queue.UnackedCount(), Equals, 4) // the consumer acked d0 and blocks
+
+		finishedChan := queue.StopConsuming()
+		time.Sleep(10 * time.Millisecond)
+		c.Check(queue.UnackedCount(), Equals, 0)
+		ready, err := queue.Peek(0, 10)
+		c.Check(err, IsNil)
+		c.Check(ready, DeepEquals, []string{"return-buffered-d4", "return-buffered-d3", "return-buffered-d2", "return-buffered-d1"})
+
+		consumer.Finish()
+		<-finishedChan
+		c.Check(consumer.LastDeliveries, HasLen, 1)
+		queue.PurgeReady()
+		connection.StopHeartbeat()
+	}
+}
+
 func (suite *QueueSuite) TestStopConsuming_Consumer(c *C) {
 	connection := OpenConnection("consume", "tcp", "localhost:6379", 1)
 	queue := connection.OpenQueue("consume-q").(*redisQueue)
@@ -453,6 +3282,34 @@ func (suite *QueueSuite) TestStopConsuming_Consumer(c *C) {
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestStopConsumingAndWait(c *C) {
+	connection := OpenConnection("drain-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("drain-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 10; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("drain-d%d", i)), Equals, true)
+	}
+
+	queue.StartConsuming(3, time.Millisecond)
+	consumer := NewTestConsumer("drain-A")
+	consumer.SleepDuration = 20 * time.Millisecond
+	queue.AddConsumer("drain-cons", consumer)
+	time.Sleep(10 * time.Millisecond) // one consuming, three buffered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Check(queue.StopConsumingAndWait(ctx), Equals, context.DeadlineExceeded)
+	c.Check(queue.ReadyCount(), Equals, 6) // no more fetched after stopping
+
+	c.Check(queue.StopConsumingAndWait(context.Background()), IsNil)
+	c.Check(consumer.LastDeliveries, HasLen, 4)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 6)
+
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestStopConsuming_BatchConsumer(c *C) {
 	connection := OpenConnection("batchConsume", "tcp", "localhost:6379", 1)
 	queue := connection.OpenQueue("batchConsume-q").(*redisQueue)
@@ -493,6 +3350,113 @@ func (suite *QueueSuite) TestStopConsuming_BatchConsumer(c *C) {
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestPanicHandler(c *C) {
+	connection := OpenConnection("panic-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("panic-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	var mutex sync.Mutex
+	recovered := map[string]interface{}{}
+	queue.SetPanicHandler(func(delivery Delivery, value interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		recovered[delivery.Payload()] = value
+	})
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumerFunc("panic-cons", func(delivery Delivery) {
+		switch delivery.Payload() {
+		case "panic-d1":
+			panic("consumer failed")
+		case "panic-d2":
+			delivery.Ack()
+			panic("consumer failed after ack")
+		}
+		delivery.Ack()
+	})
+
+	c.Check(queue.Publish("panic-d1"), Equals, true)
+	c.Check(queue.Publish("panic-d2"), Equals, true)
+	c.Check(queue.Publish("panic-d3"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+
+	// the consumer kept consuming and only the unacked delivery got rejected
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	mutex.Lock()
+	c.Check(recovered, DeepEquals, map[string]interface{}{
+		"panic-d1": "consumer failed",
+		"panic-d2": "consumer failed after ack",
+	})
+	mutex.Unlock()
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestNack(c *C) {
+	for _, connection := range []*redisConnection{
+		OpenConnection("nack-conn", "tcp", "localhost:6379", 1),
+		OpenConnectionWithTestRedisClient("nack-conn"),
+	} {
+		queue := connection.OpenQueue("nack-q").(*redisQueue)
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		consumer := NewTestConsumer("nack-A")
+		consumer.AutoAck = false
+		queue.StartConsuming(1, time.Millisecond)
+		queue.AddConsumer("nack-cons", consumer)
+
+		c.Check(queue.Publish("nack-d1"), Equals, true)
+		time.Sleep(10 * time.Millisecond)
+		c.Assert(consumer.LastDeliveries, HasLen, 1)
+		<-queue.StopConsuming()
+		c.Check(queue.Publish("nack-d2"), Equals, true)
+
+		// requeued deliveries get consumed next
+		c.Check(consumer.LastDelivery.Nack(true), Equals, true)
+		c.Check(consumer.LastDelivery.Nack(true), Equals, false)
+		c.Check(queue.UnackedCount(), Equals, 0)
+		values, err := queue.redisClient.LRange(queue.readyKey, 0, -1)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, []string{"nack-d2", "nack-d1"})
+
+		value, err := queue.redisClient.RPopLPush(queue.readyKey, queue.unackedKey)
+		c.Check(err, IsNil)
+		delivery := newDelivery(value, queue.readyKey, queue.unackedKey, queue.rejectedKey, queue.pushKey, queue.redisClient)
+		c.Check(delivery.Payload(), Equals, "nack-d1")
+
+		// deliveries requeued to the back get consumed last
+		c.Check(delivery.RequeueBack(), Equals, true)
+		c.Check(delivery.RequeueFront(), Equals, false)
+		values, err = queue.redisClient.LRange(queue.readyKey, 0, -1)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, []string{"nack-d1", "nack-d2"})
+
+		// with LIFO the front is the head
+		value, err = queue.redisClient.RPopLPush(queue.readyKey, queue.unackedKey)
+		c.Check(err, IsNil)
+		delivery = newDelivery(value, queue.readyKey, queue.unackedKey, queue.rejectedKey, queue.pushKey, queue.redisClient)
+		delivery.consumeOrder = LIFO
+		c.Check(delivery.RequeueFront(), Equals, true)
+		values, err = queue.redisClient.LRange(queue.readyKey, 0, -1)
+		c.Check(err, IsNil)
+		c.Check(values, DeepEquals, []string{"nack-d2", "nack-d1"})
+
+		value, err = queue.redisClient.RPopLPush(queue.readyKey, queue.unackedKey)
+		c.Check(err, IsNil)
+		delivery = newDelivery(value, queue.readyKey, queue.unackedKey, queue.rejectedKey, queue.pushKey, queue.redisClient)
+		c.Check(delivery.Payload(), Equals, "nack-d1")
+		c.Check(delivery.Nack(false), Equals, true)
+		c.Check(queue.UnackedCount(), Equals, 0)
+		c.Check(queue.RejectedCount(), Equals, 1)
+		c.Check(queue.ReadyCount(), Equals, 1)
+
+		connection.StopHeartbeat()
+	}
+}
+
 func (suite *QueueSuite) BenchmarkQueue(c *C) {
 	// open queue
 	connection := OpenConnection("bench-conn", "tcp", "localhost:6379", 1)
@@ -0,0 +1,59 @@
+package rmq
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter paces consumers to at most a given number of deliveries per
+// second. It's a token bucket holding a single token, so deliveries get handed
+// out evenly instead of in bursts. It's safe for concurrent use, pass the same
+// limiter to AddConsumerWithRateLimiter to share it between consumers.
+type RateLimiter struct {
+	interval time.Duration // between two tokens
+
+	mutex sync.Mutex
+	next  time.Time // when the next token is available
+}
+
+// NewRateLimiter returns a limiter which allows perSecond deliveries per
+// second. panics if perSecond isn't positive!
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	if perSecond <= 0 {
+		panic("rmq rate limiter needs a positive rate")
+	}
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// reserve takes the next token and returns how long to wait until it's
+// available
+func (limiter *RateLimiter) reserve() time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	wait := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(limiter.interval)
+	return wait
+}
+
+// wait blocks until the next token is available, returns false if stop got
+// closed before
+func (limiter *RateLimiter) wait(stop <-chan struct{}) bool {
+	wait := limiter.reserve()
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
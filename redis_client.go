@@ -2,24 +2,53 @@ package rmq
 
 import "time"
 
+// RedisClient is the interface rmq uses to talk to redis. Methods return
+// ErrNotFound if redis replies with nil, like for RPopLPush on an empty list,
+// and the redis error for all other failures.
 type RedisClient interface {
 	// simple keys
-	Set(key string, value string, expiration time.Duration) bool
-	Del(key string) (affected int, ok bool)      // default affected: 0
-	TTL(key string) (ttl time.Duration, ok bool) // default ttl: 0
+	Set(key string, value string, expiration time.Duration) error
+	Del(key string) (affected int, err error)
+	TTL(key string) (ttl time.Duration, err error)
 
 	// lists
-	LPush(key string, value ...string) bool
-	LLen(key string) (affected int, ok bool)
-	LRem(key string, count int, value string) (affected int, ok bool)
-	LTrim(key string, start, stop int)
-	RPopLPush(source, destination string) (value string, ok bool)
+	LPush(key string, value ...string) error
+	LLen(key string) (affected int, err error)
+	LRem(key string, count int, value string) (affected int, err error)
+	LTrim(key string, start, stop int) error
+	LRange(key string, start, stop int) (values []string, err error)
+	RPopLPush(source, destination string) (value string, err error)    // ErrNotFound if source is empty
+	BRPop(timeout time.Duration, key string) (value string, err error) // waits whole seconds, ErrNotFound if nothing arrived in time
 
 	// sets
-	SAdd(key, value string) bool
-	SMembers(key string) (members []string)         // default members: []string{}
-	SRem(key, value string) (affected int, ok bool) // default affected: 0
+	SAdd(key, value string) error
+	SMembers(key string) (members []string, err error)
+	SIsMember(key, value string) (isMember bool, err error)
+	SRem(key, value string) (affected int, err error)
+
+	// hashes
+	HGet(key, field string) (value string, err error) // ErrNotFound if field doesn't exist
+	HIncrBy(key, field string, increment int64) (value int64, err error)
+	HDel(key, field string) (affected int, err error)
+
+	// scripting
+	Eval(script string, keys []string, args ...interface{}) (result interface{}, err error) // ErrNotFound if the script returns nil
+	EvalSha(sha string, keys []string, args ...interface{}) (result interface{}, err error) // like Eval, ErrNoScript if the script wasn't loaded
+	ScriptLoad(script string) (sha string, err error)
 
 	// special
-	FlushDb()
+	Pipeline() Pipeline
+	Ping() error
+	Scan(cursor uint64, match string, count int64) (keys []string, nextCursor uint64, err error)
+	FlushDb() error
+}
+
+// Pipeline collects read commands and sends them to redis in a single
+// round-trip on Exec, which stores their results in the given pointers. Exec
+// returns the first error, results of failed commands stay unset.
+type Pipeline interface {
+	LLen(key string, length *int)
+	SMembers(key string, members *[]string)
+	TTL(key string, ttl *time.Duration)
+	Exec() error
 }
@@ -1,7 +1,7 @@
 package rmq
 
 import (
-	"log"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v7"
@@ -11,89 +11,182 @@ type RedisWrapper struct {
 	rawClient *redis.Client
 }
 
-func (wrapper RedisWrapper) Set(key string, value string, expiration time.Duration) bool {
-	return checkErr(wrapper.rawClient.Set(key, value, expiration).Err())
+func (wrapper RedisWrapper) Set(key string, value string, expiration time.Duration) error {
+	return mapErr(wrapper.rawClient.Set(key, value, expiration).Err())
 }
 
-func (wrapper RedisWrapper) Del(key string) (affected int, ok bool) {
+func (wrapper RedisWrapper) Del(key string) (affected int, err error) {
 	n, err := wrapper.rawClient.Del(key).Result()
-	ok = checkErr(err)
-	if !ok {
-		return 0, false
-	}
-	return int(n), ok
+	return int(n), mapErr(err)
 }
 
-func (wrapper RedisWrapper) TTL(key string) (ttl time.Duration, ok bool) {
-	ttl, err := wrapper.rawClient.TTL(key).Result()
-	ok = checkErr(err)
-	if !ok {
-		return 0, false
-	}
-	return ttl, ok
+func (wrapper RedisWrapper) TTL(key string) (ttl time.Duration, err error) {
+	ttl, err = wrapper.rawClient.TTL(key).Result()
+	return ttl, mapErr(err)
+}
+
+func (wrapper RedisWrapper) Scan(cursor uint64, match string, count int64) (keys []string, nextCursor uint64, err error) {
+	keys, nextCursor, err = wrapper.rawClient.Scan(cursor, match, count).Result()
+	return keys, nextCursor, mapErr(err)
 }
 
-func (wrapper RedisWrapper) LPush(key string, value ...string) bool {
-	return checkErr(wrapper.rawClient.LPush(key, value).Err())
+func (wrapper RedisWrapper) LPush(key string, value ...string) error {
+	return mapErr(wrapper.rawClient.LPush(key, value).Err())
 }
 
-func (wrapper RedisWrapper) LLen(key string) (affected int, ok bool) {
+func (wrapper RedisWrapper) LLen(key string) (affected int, err error) {
 	n, err := wrapper.rawClient.LLen(key).Result()
-	ok = checkErr(err)
-	if !ok {
-		return 0, false
-	}
-	return int(n), ok
+	return int(n), mapErr(err)
 }
 
-func (wrapper RedisWrapper) LRem(key string, count int, value string) (affected int, ok bool) {
+func (wrapper RedisWrapper) LRem(key string, count int, value string) (affected int, err error) {
 	n, err := wrapper.rawClient.LRem(key, int64(count), value).Result()
-	return int(n), checkErr(err)
+	return int(n), mapErr(err)
 }
 
-func (wrapper RedisWrapper) LTrim(key string, start, stop int) {
-	checkErr(wrapper.rawClient.LTrim(key, int64(start), int64(stop)).Err())
+func (wrapper RedisWrapper) LTrim(key string, start, stop int) error {
+	return mapErr(wrapper.rawClient.LTrim(key, int64(start), int64(stop)).Err())
 }
 
-func (wrapper RedisWrapper) RPopLPush(source, destination string) (value string, ok bool) {
-	value, err := wrapper.rawClient.RPopLPush(source, destination).Result()
-	return value, checkErr(err)
+func (wrapper RedisWrapper) LRange(key string, start, stop int) (values []string, err error) {
+	values, err = wrapper.rawClient.LRange(key, int64(start), int64(stop)).Result()
+	return values, mapErr(err)
 }
 
-func (wrapper RedisWrapper) SAdd(key, value string) bool {
-	return checkErr(wrapper.rawClient.SAdd(key, value).Err())
+func (wrapper RedisWrapper) RPopLPush(source, destination string) (value string, err error) {
+	value, err = wrapper.rawClient.RPopLPush(source, destination).Result()
+	return value, mapErr(err)
 }
 
-func (wrapper RedisWrapper) SMembers(key string) []string {
-	members, err := wrapper.rawClient.SMembers(key).Result()
-	if ok := checkErr(err); !ok {
-		return []string{}
+// BRPop rounds the timeout up to whole seconds, which is the smallest timeout
+// redis supports. A timeout of zero would block forever.
+func (wrapper RedisWrapper) BRPop(timeout time.Duration, key string) (value string, err error) {
+	timeout = (timeout + time.Second - 1) / time.Second * time.Second
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	values, err := wrapper.rawClient.BRPop(timeout, key).Result()
+	if err != nil {
+		return "", mapErr(err)
 	}
-	return members
+	return values[1], nil
 }
 
-func (wrapper RedisWrapper) SRem(key, value string) (affected int, ok bool) {
+func (wrapper RedisWrapper) SAdd(key, value string) error {
+	return mapErr(wrapper.rawClient.SAdd(key, value).Err())
+}
+
+func (wrapper RedisWrapper) SMembers(key string) (members []string, err error) {
+	members, err = wrapper.rawClient.SMembers(key).Result()
+	return members, mapErr(err)
+}
+
+func (wrapper RedisWrapper) SIsMember(key, value string) (isMember bool, err error) {
+	isMember, err = wrapper.rawClient.SIsMember(key, value).Result()
+	return isMember, mapErr(err)
+}
+
+func (wrapper RedisWrapper) SRem(key, value string) (affected int, err error) {
 	n, err := wrapper.rawClient.SRem(key, value).Result()
-	ok = checkErr(err)
-	if !ok {
-		return 0, false
-	}
-	return int(n), ok
+	return int(n), mapErr(err)
+}
+
+func (wrapper RedisWrapper) HGet(key, field string) (value string, err error) {
+	value, err = wrapper.rawClient.HGet(key, field).Result()
+	return value, mapErr(err)
+}
+
+func (wrapper RedisWrapper) HIncrBy(key, field string, increment int64) (value int64, err error) {
+	value, err = wrapper.rawClient.HIncrBy(key, field, increment).Result()
+	return value, mapErr(err)
+}
+
+func (wrapper RedisWrapper) HDel(key, field string) (affected int, err error) {
+	n, err := wrapper.rawClient.HDel(key, field).Result()
+	return int(n), mapErr(err)
+}
+
+func (wrapper RedisWrapper) Eval(script string, keys []string, args ...interface{}) (result interface{}, err error) {
+	result, err = wrapper.rawClient.Eval(script, keys, args...).Result()
+	return result, mapErr(err)
 }
 
-func (wrapper RedisWrapper) FlushDb() {
-	wrapper.rawClient.FlushDB()
+func (wrapper RedisWrapper) EvalSha(sha string, keys []string, args ...interface{}) (result interface{}, err error) {
+	result, err = wrapper.rawClient.EvalSha(sha, keys, args...).Result()
+	return result, mapErr(err)
 }
 
-// checkErr returns true if there is no error, false if the result error is nil and panics if there's another error
-func checkErr(err error) (ok bool) {
-	switch err {
-	case nil:
-		return true
-	case redis.Nil:
-		return false
-	default:
-		log.Panicf("rmq redis error is not nil %s", err)
-		return false
+func (wrapper RedisWrapper) ScriptLoad(script string) (sha string, err error) {
+	sha, err = wrapper.rawClient.ScriptLoad(script).Result()
+	return sha, mapErr(err)
+}
+
+func (wrapper RedisWrapper) Ping() error {
+	return wrapper.rawClient.Ping().Err()
+}
+
+func (wrapper RedisWrapper) Pipeline() Pipeline {
+	return &redisPipeline{pipeliner: wrapper.rawClient.Pipeline()}
+}
+
+func (wrapper RedisWrapper) FlushDb() error {
+	return mapErr(wrapper.rawClient.FlushDB().Err())
+}
+
+// redisPipeline assigns the results of the go-redis commands once the
+// pipeline got executed
+type redisPipeline struct {
+	pipeliner redis.Pipeliner
+	assigns   []func() // set the results of successful commands
+}
+
+func (pipeline *redisPipeline) LLen(key string, length *int) {
+	cmd := pipeline.pipeliner.LLen(key)
+	pipeline.assigns = append(pipeline.assigns, func() {
+		if cmd.Err() == nil {
+			*length = int(cmd.Val())
+		}
+	})
+}
+
+func (pipeline *redisPipeline) SMembers(key string, members *[]string) {
+	cmd := pipeline.pipeliner.SMembers(key)
+	pipeline.assigns = append(pipeline.assigns, func() {
+		if cmd.Err() == nil {
+			*members = cmd.Val()
+		}
+	})
+}
+
+func (pipeline *redisPipeline) TTL(key string, ttl *time.Duration) {
+	cmd := pipeline.pipeliner.TTL(key)
+	pipeline.assigns = append(pipeline.assigns, func() {
+		if cmd.Err() == nil {
+			*ttl = cmd.Val()
+		}
+	})
+}
+
+func (pipeline *redisPipeline) Exec() error {
+	if len(pipeline.assigns) == 0 {
+		return nil
+	}
+	_, err := pipeline.pipeliner.Exec()
+	for _, assign := range pipeline.assigns {
+		assign()
+	}
+	pipeline.assigns = nil
+	return mapErr(err)
+}
+
+// mapErr returns ErrNotFound if redis replied with nil, ErrNoScript if it
+// doesn't know a script and err otherwise
+func mapErr(err error) error {
+	if err == redis.Nil {
+		return ErrNotFound
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return ErrNoScript
 	}
+	return err
 }
@@ -0,0 +1,56 @@
+package rmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// maxRejectedErrors is how many of the latest deliveries rejected with an
+// error are kept per queue
+const maxRejectedErrors = 1000
+
+// RejectedEntry is a delivery which got rejected with an error, see
+// Delivery.RejectWithError()
+type RejectedEntry struct {
+	Payload    string    `json:"payload"`
+	Error      string    `json:"error"`
+	RejectedAt time.Time `json:"rejected_at"`
+}
+
+func recordRejectedError(redisClient RedisClient, errorsKey, payload string, err error) {
+	bytes, marshalErr := json.Marshal(RejectedEntry{
+		Payload:    payload,
+		Error:      err.Error(),
+		RejectedAt: time.Now(),
+	})
+	if marshalErr != nil { // can't happen for strings and times
+		return
+	}
+
+	redisClient.LPush(errorsKey, string(bytes))
+	redisClient.LTrim(errorsKey, 0, maxRejectedErrors-1)
+}
+
+// RejectedErrors returns up to count of the latest deliveries which were
+// rejected with an error, youngest first. Only the latest 1000 are kept. The
+// deliveries might have been returned or purged since.
+func (queue *redisQueue) RejectedErrors(count int) ([]RejectedEntry, error) {
+	if count <= 0 {
+		return []RejectedEntry{}, nil
+	}
+
+	values, err := queue.redisClient.LRange(queue.errorsKey, 0, count-1)
+	if err != nil {
+		return nil, fmt.Errorf("rmq queue failed to get rejected errors %s: %w", queue, err)
+	}
+	entries := make([]RejectedEntry, 0, len(values))
+	for _, value := range values {
+		var entry RejectedEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			return nil, fmt.Errorf("rmq queue failed to decode rejected error %s: %w", queue, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,150 @@
+package rmq
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
+
+const (
+	retryIDLength        = 12                    // random part of retry members, see retryScript
+	retryBatchSize       = 1000                  // max deliveries a retry run schedules and returns each
+	minRetryPollDuration = 10 * time.Millisecond // how often the retry worker runs at most
+	maxRetryPollDuration = time.Second           // how often the retry worker runs at least
+)
+
+// takes up to ARGV[3] deliveries from the rejected list (KEYS[1]) and counts
+// their retries in the hash (KEYS[3]). Deliveries which were retried ARGV[2]
+// times already get pushed to the dead letter ready list (KEYS[5]), the
+// others get added to the sorted set of retries (KEYS[2]) by when they're
+// due, which is ARGV[4..] milliseconds (by retry) from now on the redis clock.
+// Then it moves up to ARGV[3] due deliveries to the ready list (KEYS[4]) and
+// returns their number. Retry members consist of the ID ARGV[1], a four digit
+// number and the delivery, so deliveries with equal payloads get members of
+// their own.
+const retryScript = `
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local maxRetries = tonumber(ARGV[2])
+local batchSize = tonumber(ARGV[3])
+local backoffs = #ARGV - 3
+for i = 1, batchSize do
+	local value = redis.call("RPOP", KEYS[1])
+	if not value then
+		break
+	end
+	local retries = redis.call("HINCRBY", KEYS[3], value, 1)
+	if retries > maxRetries then
+		redis.call("HDEL", KEYS[3], value)
+		redis.call("LPUSH", KEYS[5], value)
+	else
+		local backoff = tonumber(ARGV[3 + math.min(retries, backoffs)])
+		redis.call("ZADD", KEYS[2], now + backoff, ARGV[1] .. string.format("%04d", i) .. value)
+	end
+end
+local due = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", now, "LIMIT", 0, batchSize)
+for _, member in ipairs(due) do
+	redis.call("ZREM", KEYS[2], member)
+	redis.call("LPUSH", KEYS[4], string.sub(member, #ARGV[1] + 5))
+end
+return #due
+`
+
+// RetryPolicy makes rejected deliveries come back after a delay, see
+// Queue.SetRetryPolicy
+type RetryPolicy struct {
+	// Backoffs are the delays before the first, second, ... retry of a
+	// rejected delivery. Further retries wait as long as the last one
+	Backoffs []time.Duration
+	// MaxAttempts is how often a delivery gets consumed at most, including
+	// the first time. Once it got rejected that often it gets published to
+	// DeadLetter instead of being retried
+	MaxAttempts int
+	// DeadLetter gets the deliveries which were rejected MaxAttempts times
+	DeadLetter Queue
+}
+
+// SetRetryPolicy makes the queue return rejected deliveries to ready after
+// the policy's backoffs, until they were rejected MaxAttempts times and get
+// published to the dead letter queue. A worker checks for rejected and due
+// deliveries as often as the shortest backoff, at least once and at most 100
+// times a second, until the connection's heartbeat stops. Other processes may
+// run workers for the same queue. Retries are counted in redis by payload like
+// rejections, see SetMaxRejects, and acking forgets the count if the consuming
+// queue has the policy too. Call it before StartConsuming. Returns an error if
+// the policy is invalid.
+func (queue *redisQueue) SetRetryPolicy(policy RetryPolicy) error {
+	if len(policy.Backoffs) == 0 || policy.MaxAttempts < 1 {
+		return fmt.Errorf("rmq queue needs backoffs and max attempts for retry policy %s", queue)
+	}
+	deadLetter, ok := policy.DeadLetter.(*redisQueue)
+	if !ok {
+		return fmt.Errorf("rmq queue can't use dead letter queue for retry policy %s %s", queue, policy.DeadLetter)
+	}
+	if queue.connection == nil || queue.connection.stopHeartbeat == nil {
+		return fmt.Errorf("rmq queue can't retry without connection heartbeat %s", queue)
+	}
+
+	args := []interface{}{int64(policy.MaxAttempts - 1), int64(retryBatchSize)}
+	pollDuration := maxRetryPollDuration
+	for _, backoff := range policy.Backoffs {
+		args = append(args, int64(backoff/time.Millisecond))
+		if backoff < pollDuration {
+			pollDuration = backoff
+		}
+	}
+	if pollDuration < minRetryPollDuration {
+		pollDuration = minRetryPollDuration
+	}
+	settings := &retryConfig{
+		keys: []string{
+			queue.rejectedKey,
+			strings.Replace(queue.key(queueRetryTemplate), phQueue, queue.name, 1),
+			strings.Replace(queue.key(queueRetriesTemplate), phQueue, queue.name, 1),
+			queue.readyKey,
+			deadLetter.readyKey,
+		},
+		args:         args,
+		pollDuration: pollDuration,
+	}
+
+	queue.consumersMutex.Lock()
+	started := queue.retryConfig != nil
+	queue.retryConfig = settings
+	queue.retriesKey = settings.keys[2]
+	queue.consumersMutex.Unlock()
+	if !started {
+		go queue.retry()
+	}
+	return nil
+}
+
+// retryConfig holds the arguments of retryScript for the policy of a queue
+type retryConfig struct {
+	keys         []string
+	args         []interface{} // all but the ID, which is new on each run
+	pollDuration time.Duration
+}
+
+// retry runs retryScript with the latest retry policy until the connection's
+// heartbeat stops
+func (queue *redisQueue) retry() {
+	for {
+		queue.consumersMutex.Lock()
+		settings := queue.retryConfig
+		queue.consumersMutex.Unlock()
+
+		args := append([]interface{}{uniuri.NewLen(retryIDLength)}, settings.args...)
+		if _, err := runScript(queue.redisClient, retryScript, settings.keys, args...); err != nil {
+			queue.connection.logger.Printf("rmq queue failed to retry rejected deliveries %s: %s", queue, err)
+		}
+
+		select {
+		case <-queue.connection.stopHeartbeat:
+			return
+		case <-time.After(settings.pollDuration):
+		}
+	}
+}
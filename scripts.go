@@ -0,0 +1,36 @@
+package rmq
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+)
+
+var scriptShas sync.Map // sha1 hex digests by script
+
+// runScript runs the lua script with EVALSHA, so redis doesn't need to receive
+// and parse it again on every call. If redis doesn't know the script yet, like
+// after a restart, it gets loaded with SCRIPT LOAD first.
+func runScript(redisClient RedisClient, script string, keys []string, args ...interface{}) (interface{}, error) {
+	sha := scriptSha(script)
+	result, err := redisClient.EvalSha(sha, keys, args...)
+	if err != ErrNoScript {
+		return result, err
+	}
+
+	if sha, err = redisClient.ScriptLoad(script); err != nil {
+		return nil, err
+	}
+	return redisClient.EvalSha(sha, keys, args...)
+}
+
+// scriptSha returns the sha1 digest of the script redis identifies it by
+func scriptSha(script string) string {
+	if sha, ok := scriptShas.Load(script); ok {
+		return sha.(string)
+	}
+	digest := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(digest[:])
+	scriptShas.Store(script, sha)
+	return sha
+}
@@ -0,0 +1,95 @@
+package rmq
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
+
+// globalSlotDuration is how long a slot stays taken if it doesn't get
+// released, for example because the consumer crashed. Slots of deliveries in
+// flight get refreshed with each heartbeat of the connection.
+const globalSlotDuration = time.Minute
+
+// takes the first free slot (KEYS) by setting it to the token (ARGV[1]) with
+// an expiry in milliseconds (ARGV[2]), returns the slot's index or 0 if all
+// slots are taken
+const acquireSlotScript = `
+for index, key in ipairs(KEYS) do
+	if redis.call("SET", key, ARGV[1], "NX", "PX", ARGV[2]) then
+		return index
+	end
+end
+return 0
+`
+
+// deletes the slot (KEYS[1]) only if it's still held by the token (ARGV[1])
+const releaseSlotScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+// slot is a taken global concurrency slot, the zero value holds no slot
+type slot struct {
+	key   string
+	token string
+	held  *heldSlots // which the slot is part of until it gets released
+}
+
+// heldSlots are the slots taken by the deliveries of a queue which are in
+// flight, so they can be refreshed until they get released
+type heldSlots struct {
+	mutex  sync.Mutex
+	tokens map[string]string // by slot key
+}
+
+func newHeldSlots() *heldSlots {
+	return &heldSlots{tokens: map[string]string{}}
+}
+
+func acquireSlot(redisClient RedisClient, slotKeys []string, held *heldSlots) (slot, bool) {
+	token := uniuri.NewLen(16)
+	result, err := runScript(redisClient, acquireSlotScript, slotKeys, token, int64(globalSlotDuration/time.Millisecond))
+	index, _ := result.(int64)
+	if err != nil || index < 1 || int(index) > len(slotKeys) {
+		return slot{}, false
+	}
+	slot := slot{key: slotKeys[index-1], token: token, held: held}
+	held.mutex.Lock()
+	held.tokens[slot.key] = slot.token
+	held.mutex.Unlock()
+	return slot, true
+}
+
+func (slot slot) release(redisClient RedisClient) {
+	if slot.key == "" {
+		return
+	}
+	slot.held.mutex.Lock()
+	delete(slot.held.tokens, slot.key)
+	slot.held.mutex.Unlock()
+	runScript(redisClient, releaseSlotScript, []string{slot.key}, slot.token)
+}
+
+// refresh extends the expiry of all held slots to globalSlotDuration. Slots
+// which expired and were taken by someone else in the meantime stay
+// untouched.
+func (held *heldSlots) refresh(redisClient RedisClient) error {
+	held.mutex.Lock()
+	tokens := make(map[string]string, len(held.tokens))
+	for key, token := range held.tokens {
+		tokens[key] = token
+	}
+	held.mutex.Unlock()
+
+	for key, token := range tokens {
+		if _, err := runScript(redisClient, refreshLockScript, []string{key}, token, int64(globalSlotDuration/time.Millisecond)); err != nil {
+			return fmt.Errorf("rmq failed to refresh slot %s: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package rmq
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QueueSnapshot holds the deliveries of all lists of a queue. Each list is
+// ordered like in redis, so the last delivery is the next one to be consumed.
+type QueueSnapshot struct {
+	Ready    []string            `json:"ready"`
+	Rejected []string            `json:"rejected"`
+	Unacked  map[string][]string `json:"unacked"` // by connection name
+}
+
+// Snapshot returns the current deliveries of the ready, rejected and the
+// unacked lists of all connections of the queue
+func (queue *redisQueue) Snapshot() (QueueSnapshot, error) {
+	snapshot := QueueSnapshot{Unacked: map[string][]string{}}
+
+	var err error
+	if snapshot.Ready, err = queue.redisClient.LRange(queue.readyKey, 0, -1); err != nil {
+		return QueueSnapshot{}, fmt.Errorf("rmq queue failed to snapshot ready %s: %w", queue, err)
+	}
+	if snapshot.Rejected, err = queue.redisClient.LRange(queue.rejectedKey, 0, -1); err != nil {
+		return QueueSnapshot{}, fmt.Errorf("rmq queue failed to snapshot rejected %s: %w", queue, err)
+	}
+
+	unackedKeys, err := queue.unackedKeys()
+	if err != nil {
+		return QueueSnapshot{}, err
+	}
+	for connectionName, unackedKey := range unackedKeys {
+		unacked, err := queue.redisClient.LRange(unackedKey, 0, -1)
+		if err != nil {
+			return QueueSnapshot{}, fmt.Errorf("rmq queue failed to snapshot unacked %s %s: %w", queue, connectionName, err)
+		}
+		if len(unacked) > 0 {
+			snapshot.Unacked[connectionName] = unacked
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Restore replaces the ready, rejected and all unacked lists of the queue
+// with the deliveries from the given snapshot
+func (queue *redisQueue) Restore(snapshot QueueSnapshot) error {
+	unackedKeys, err := queue.unackedKeys()
+	if err != nil {
+		return err
+	}
+	for _, unackedKey := range unackedKeys {
+		if _, err := queue.redisClient.Del(unackedKey); err != nil {
+			return fmt.Errorf("rmq queue failed to delete unacked %s %s: %w", queue, unackedKey, err)
+		}
+	}
+
+	if err := queue.restoreList(queue.readyKey, snapshot.Ready); err != nil {
+		return err
+	}
+	if err := queue.restoreList(queue.rejectedKey, snapshot.Rejected); err != nil {
+		return err
+	}
+
+	for connectionName, unacked := range snapshot.Unacked {
+		unackedKey := strings.Replace(queue.key(connectionQueueUnackedTemplate), phConnection, connectionName, 1)
+		unackedKey = strings.Replace(unackedKey, phQueue, queue.name, 1)
+		if err := queue.restoreList(unackedKey, unacked); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unackedKeys returns the unacked keys of all connections for this queue by
+// connection name. The keys are built from the set of connections, so this
+// doesn't need to scan the keyspace.
+func (queue *redisQueue) unackedKeys() (map[string]string, error) {
+	connectionNames, err := queue.redisClient.SMembers(queue.key(connectionsKey))
+	if err != nil {
+		return nil, fmt.Errorf("rmq queue failed to get connections %s: %w", queue, err)
+	}
+
+	template := strings.Replace(queue.key(connectionQueueUnackedTemplate), phQueue, queue.name, 1)
+	unackedKeys := map[string]string{}
+	for _, connectionName := range connectionNames {
+		unackedKeys[connectionName] = strings.Replace(template, phConnection, connectionName, 1)
+	}
+	return unackedKeys, nil
+}
+
+func (queue *redisQueue) restoreList(key string, values []string) error {
+	if _, err := queue.redisClient.Del(key); err != nil {
+		return fmt.Errorf("rmq queue failed to delete list %s %s: %w", queue, key, err)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	// LPUSH inserts one value after the other at the head, so push them in
+	// reverse order to end up with the original order
+	reversed := make([]string, len(values))
+	for i, value := range values {
+		reversed[len(values)-1-i] = value
+	}
+
+	if err := queue.redisClient.LPush(key, reversed...); err != nil {
+		return fmt.Errorf("rmq queue failed to restore list %s %s: %w", queue, key, err)
+	}
+	return nil
+}
@@ -2,8 +2,11 @@ package rmq
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"sync/atomic"
+	"time"
 )
 
 type ConnectionStat struct {
@@ -22,16 +25,19 @@ func (stat ConnectionStat) String() string {
 type ConnectionStats map[string]ConnectionStat
 
 type QueueStat struct {
-	ReadyCount      int `json:"ready"`
-	RejectedCount   int `json:"rejected"`
-	connectionStats ConnectionStats
+	ReadyCount           int               `json:"ready"`
+	RejectedCount        int               `json:"rejected"`
+	PriorityReadyCounts  map[int]int       `json:"priority_ready,omitempty"`        // by priority, nil if all deliveries have priority 0
+	ConsumerDescriptions map[string]string `json:"consumer_descriptions,omitempty"` // by consumer name
+	connectionStats      ConnectionStats
 }
 
 func NewQueueStat(readyCount, rejectedCount int) QueueStat {
 	return QueueStat{
-		ReadyCount:      readyCount,
-		RejectedCount:   rejectedCount,
-		connectionStats: ConnectionStats{},
+		ReadyCount:           readyCount,
+		RejectedCount:        rejectedCount,
+		ConsumerDescriptions: map[string]string{},
+		connectionStats:      ConnectionStats{},
 	}
 }
 
@@ -43,6 +49,27 @@ func (stat QueueStat) String() string {
 	)
 }
 
+// MarshalJSON includes the counts which are only available via methods
+func (stat QueueStat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ReadyCount           int               `json:"ready"`
+		RejectedCount        int               `json:"rejected"`
+		ConnectionCount      int               `json:"connections"`
+		UnackedCount         int               `json:"unacked"`
+		ConsumerCount        int               `json:"consumers"`
+		PriorityReadyCounts  map[int]int       `json:"priority_ready,omitempty"`
+		ConsumerDescriptions map[string]string `json:"consumer_descriptions,omitempty"`
+	}{
+		ReadyCount:           stat.ReadyCount,
+		RejectedCount:        stat.RejectedCount,
+		ConnectionCount:      stat.ConnectionCount(),
+		UnackedCount:         stat.UnackedCount(),
+		ConsumerCount:        stat.ConsumerCount(),
+		PriorityReadyCounts:  stat.PriorityReadyCounts,
+		ConsumerDescriptions: stat.ConsumerDescriptions,
+	})
+}
+
 func (stat QueueStat) UnackedCount() int {
 	unacked := 0
 	for _, connectionStat := range stat.connectionStats {
@@ -66,7 +93,13 @@ func (stat QueueStat) ConnectionCount() int {
 type QueueStats map[string]QueueStat
 
 type Stats struct {
-	QueueStats       QueueStats      `json:"queues"`
+	QueueStats  QueueStats `json:"queues"`
+	CollectedAt time.Time  `json:"collectedAt"`
+	// RecoveryFailures counts how often a cleaner using the connection the
+	// stats were collected with failed to return the unacked deliveries of a
+	// dead connection. Those deliveries stay unacked until a later run
+	// succeeds.
+	RecoveryFailures int64           `json:"recovery_failures"`
 	otherConnections map[string]bool // non consuming connections, active or not
 }
 
@@ -77,35 +110,52 @@ func NewStats() Stats {
 	}
 }
 
+// CollectStats collects the stats of the queues and all connections consuming
+// them. It reads them in three pipelined batches, so the number of round-trips
+// doesn't grow with the number of queues and connections. Redis errors get
+// logged, the affected counts stay 0 then.
 func CollectStats(queueList []string, mainConnection *redisConnection) Stats {
 	stats := NewStats()
-	for _, queueName := range queueList {
-		queue := mainConnection.openQueue(queueName)
-		stats.QueueStats[queueName] = NewQueueStat(queue.ReadyCount(), queue.RejectedCount())
+	stats.CollectedAt = time.Now()
+	stats.RecoveryFailures = atomic.LoadInt64(&mainConnection.recoveryFailures)
+
+	collected, err := mainConnection.collect(queueList, false)
+	if err != nil {
+		mainConnection.logger.Printf("rmq connection failed to collect stats %s: %s", mainConnection, err)
 	}
 
-	connectionNames := mainConnection.GetConnections()
-	for _, connectionName := range connectionNames {
-		connection := mainConnection.hijackConnection(connectionName)
-		connectionActive := connection.Check()
+	for _, queue := range collected.queues {
+		queueStat := NewQueueStat(queue.readyCount, queue.rejectedCount)
+		for priority, count := range queue.priorityCounts {
+			if count <= 0 {
+				continue
+			}
+			if queueStat.PriorityReadyCounts == nil {
+				queueStat.PriorityReadyCounts = map[int]int{0: queue.readyCount}
+			}
+			queueStat.PriorityReadyCounts[priority] = count
+			queueStat.ReadyCount += count
+		}
+		stats.QueueStats[queue.name] = queueStat
+	}
 
-		queueNames := connection.GetConsumingQueues()
-		if len(queueNames) == 0 {
-			stats.otherConnections[connectionName] = connectionActive
+	for _, connection := range collected.connections {
+		if len(connection.queues) == 0 {
+			stats.otherConnections[connection.name] = connection.active
 			continue
 		}
 
-		for _, queueName := range queueNames {
-			queue := connection.openQueue(queueName)
-			consumers := queue.GetConsumers()
-			openQueueStat, ok := stats.QueueStats[queueName]
-			if !ok {
-				continue
+		for queueName, consumed := range connection.consumed {
+			openQueueStat := stats.QueueStats[queueName]
+			for _, consumer := range consumed.consumers {
+				if description, ok := getConsumerDescription(consumer); ok {
+					openQueueStat.ConsumerDescriptions[consumer] = description
+				}
 			}
-			openQueueStat.connectionStats[connectionName] = ConnectionStat{
-				active:       connectionActive,
-				unackedCount: queue.UnackedCount(),
-				consumers:    consumers,
+			openQueueStat.connectionStats[connection.name] = ConnectionStat{
+				active:       connection.active,
+				unackedCount: consumed.unackedCount,
+				consumers:    consumed.consumers,
 			}
 		}
 	}
@@ -113,6 +163,40 @@ func CollectStats(queueList []string, mainConnection *redisConnection) Stats {
 	return stats
 }
 
+// GetQueue returns the stats of a single queue, ok is false if it wasn't
+// collected
+func (stats Stats) GetQueue(name string) (stat QueueStat, ok bool) {
+	stat, ok = stats.QueueStats[name]
+	return stat, ok
+}
+
+// Consumers returns the names of the consumers of all collected queues by
+// queue and connection name, including those of connections which died
+func (stats Stats) Consumers() map[string]map[string][]string {
+	consumers := map[string]map[string][]string{}
+	for queueName, queueStat := range stats.QueueStats {
+		consumers[queueName] = map[string][]string{}
+		for connectionName, connectionStat := range queueStat.connectionStats {
+			consumers[queueName][connectionName] = connectionStat.consumers
+		}
+	}
+	return consumers
+}
+
+// ConsumerCount returns the number of consumers of the queue on connections
+// which are still alive, so 0 means nothing is consuming the queue. Unlike
+// QueueStat.ConsumerCount it skips the consumers of dead connections which the
+// cleaner didn't remove yet.
+func (stats Stats) ConsumerCount(queueName string) int {
+	count := 0
+	for _, connectionStat := range stats.QueueStats[queueName].connectionStats {
+		if connectionStat.active {
+			count += len(connectionStat.consumers)
+		}
+	}
+	return count
+}
+
 func (stats Stats) String() string {
 	var buffer bytes.Buffer
 
@@ -1,6 +1,9 @@
 package rmq
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
 	"testing"
 	"time"
 
@@ -15,7 +18,8 @@ type StatsSuite struct{}
 
 func (suite *StatsSuite) TestStats(c *C) {
 	connection := OpenConnection("stats-conn", "tcp", "localhost:6379", 1)
-	c.Assert(NewCleaner(connection).Clean(), IsNil)
+	_, err := NewCleaner(connection).Clean()
+	c.Assert(err, IsNil)
 
 	conn1 := OpenConnection("stats-conn1", "tcp", "localhost:6379", 1)
 	conn2 := OpenConnection("stats-conn2", "tcp", "localhost:6379", 1)
@@ -63,3 +67,196 @@ func (suite *StatsSuite) TestStats(c *C) {
 	conn1.StopHeartbeat()
 	conn2.StopHeartbeat()
 }
+
+func (suite *StatsSuite) TestConsumerDescription(c *C) {
+	connection := OpenConnection("stats-desc-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("stats-desc-q").(*redisQueue)
+	queue.StartConsuming(10, time.Millisecond)
+	described, err := queue.AddConsumerWithDescription("stats-desc-cons1", "sends welcome emails", NewTestConsumer("desc-A"))
+	c.Assert(err, IsNil)
+	_, err = queue.AddConsumerWithDescription("stats-desc-cons1", "sends welcome emails", NewTestConsumer("desc-A"))
+	c.Check(err, Equals, ErrConsumerTagTaken)
+	undescribed, err := queue.AddConsumer("stats-desc-cons2", NewTestConsumer("desc-B"))
+	c.Assert(err, IsNil)
+
+	stats := CollectStats([]string{"stats-desc-q"}, connection)
+	queueStat := stats.QueueStats["stats-desc-q"]
+	c.Check(queueStat.ConsumerCount(), Equals, 2)
+	c.Check(queueStat.ConsumerDescriptions, DeepEquals, map[string]string{described: "sends welcome emails"})
+	c.Check(queueStat.ConsumerDescriptions[undescribed], Equals, "")
+
+	encoded, err := json.Marshal(stats)
+	c.Assert(err, IsNil)
+	c.Check(string(encoded), Matches, `.*"consumer_descriptions":\{"`+described+`":"sends welcome emails"\}.*`)
+
+	c.Check(queue.RemoveConsumer(described), IsNil)
+	stats = CollectStats([]string{"stats-desc-q"}, connection)
+	c.Check(stats.QueueStats["stats-desc-q"].ConsumerDescriptions, HasLen, 0)
+
+	// stopping forgets the descriptions of the remaining consumers
+	described, err = queue.AddConsumerWithDescription("stats-desc-cons3", "sends reminders", NewTestConsumer("desc-C"))
+	c.Assert(err, IsNil)
+	_, ok := getConsumerDescription(described)
+	c.Check(ok, Equals, true)
+	<-queue.StopConsuming()
+	_, ok = getConsumerDescription(described)
+	c.Check(ok, Equals, false)
+
+	queue.RemoveAllConsumers()
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestConsumerCount(c *C) {
+	connection := OpenConnection("stats-count-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("stats-count-q").(*redisQueue)
+	queue.StartConsuming(10, time.Millisecond)
+	consumer1, err := queue.AddConsumer("stats-count-cons1", NewTestConsumer("count-A"))
+	c.Assert(err, IsNil)
+	consumer2, err := queue.AddConsumer("stats-count-cons2", NewTestConsumer("count-B"))
+	c.Assert(err, IsNil)
+
+	deadConnection := OpenConnection("stats-count-dead", "tcp", "localhost:6379", 1)
+	deadQueue := deadConnection.OpenQueue("stats-count-q").(*redisQueue)
+	deadQueue.StartConsuming(10, time.Millisecond)
+	deadConsumer, err := deadQueue.AddConsumer("stats-count-cons3", NewTestConsumer("count-C"))
+	c.Assert(err, IsNil)
+	<-deadQueue.StopConsuming()
+	deadConnection.StopHeartbeat()
+
+	stats := CollectStats([]string{"stats-count-q"}, connection)
+	consumers := stats.Consumers()["stats-count-q"]
+	sort.Strings(consumers[queue.connectionName])
+	c.Check(consumers, DeepEquals, map[string][]string{
+		queue.connectionName:     {consumer1, consumer2},
+		deadQueue.connectionName: {deadConsumer},
+	})
+	c.Check(stats.QueueStats["stats-count-q"].ConsumerCount(), Equals, 3)
+	c.Check(stats.ConsumerCount("stats-count-q"), Equals, 2)
+	c.Check(stats.ConsumerCount("stats-count-nope"), Equals, 0)
+
+	<-queue.StopConsuming()
+	queue.RemoveAllConsumers()
+	deadQueue.RemoveAllConsumers()
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) TestStatsJSON(c *C) {
+	connection := OpenConnection("stats-json-conn", "tcp", "localhost:6379", 1)
+	queue := connection.OpenQueue("stats-json-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.Publish("stats-json-d1")
+	queue.Publish("stats-json-d2")
+	consumer := NewTestConsumer("json-A")
+	consumer.AutoAck = false
+	queue.StartConsuming(1, time.Millisecond)
+	queue.AddConsumer("stats-json-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+
+	before := time.Now()
+	stats := CollectStats([]string{"stats-json-q"}, connection)
+	c.Check(stats.CollectedAt.Before(before), Equals, false)
+
+	queueStat, ok := stats.GetQueue("stats-json-q")
+	c.Assert(ok, Equals, true)
+	c.Check(queueStat.ReadyCount, Equals, 0)
+	_, ok = stats.GetQueue("stats-json-nope")
+	c.Check(ok, Equals, false)
+
+	encoded, err := json.Marshal(stats)
+	c.Assert(err, IsNil)
+	var decoded struct {
+		CollectedAt time.Time `json:"collectedAt"`
+		Queues      map[string]map[string]int
+	}
+	c.Assert(json.Unmarshal(encoded, &decoded), IsNil)
+	c.Check(decoded.CollectedAt.Equal(stats.CollectedAt), Equals, true)
+	c.Check(decoded.Queues, DeepEquals, map[string]map[string]int{
+		"stats-json-q": {"ready": 0, "rejected": 0, "connections": 1, "unacked": 2, "consumers": 1},
+	})
+
+	<-queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+// roundTripCounter counts the requests to redis CollectStats makes
+type roundTripCounter struct {
+	*TestRedisClient
+	roundTrips int
+}
+
+func (client *roundTripCounter) LLen(key string) (int, error) {
+	client.roundTrips++
+	return client.TestRedisClient.LLen(key)
+}
+
+func (client *roundTripCounter) SMembers(key string) ([]string, error) {
+	client.roundTrips++
+	return client.TestRedisClient.SMembers(key)
+}
+
+func (client *roundTripCounter) TTL(key string) (time.Duration, error) {
+	client.roundTrips++
+	return client.TestRedisClient.TTL(key)
+}
+
+func (client *roundTripCounter) Pipeline() Pipeline {
+	return roundTripCounterPipeline{Pipeline: client.TestRedisClient.Pipeline(), client: client}
+}
+
+type roundTripCounterPipeline struct {
+	Pipeline
+	client *roundTripCounter
+}
+
+func (pipeline roundTripCounterPipeline) Exec() error {
+	pipeline.client.roundTrips++
+	return pipeline.Pipeline.Exec()
+}
+
+func (suite *StatsSuite) TestStatsRoundTrips(c *C) {
+	redisClient := &roundTripCounter{TestRedisClient: NewTestRedisClient()}
+	connection, err := openConnectionWithRedisClient("stats-trips-conn", redisClient, ConnectionConfig{})
+	c.Assert(err, IsNil)
+	var queueNames []string
+	for i := 0; i < 50; i++ {
+		queue := connection.OpenQueueWithPriorities(fmt.Sprintf("stats-trips-q%d", i), 2).(*redisQueue)
+		c.Check(queue.PublishWithPriority("stats-trips-d", 1), Equals, true)
+		c.Check(redisClient.SAdd(connection.queuesKey, queue.name), IsNil)
+		c.Check(redisClient.LPush(queue.unackedKey, "stats-trips-d"), IsNil)
+		queueNames = append(queueNames, queue.name)
+	}
+
+	redisClient.roundTrips = 0
+	stats := CollectStats(queueNames, connection)
+	c.Check(redisClient.roundTrips, Equals, 3)
+	c.Check(stats.QueueStats, HasLen, 50)
+	queueStat := stats.QueueStats["stats-trips-q7"]
+	c.Check(queueStat.ReadyCount, Equals, 1)
+	c.Check(queueStat.PriorityReadyCounts, DeepEquals, map[int]int{0: 0, 1: 1})
+	c.Check(queueStat.UnackedCount(), Equals, 1)
+	c.Check(queueStat.ConnectionCount(), Equals, 1)
+
+	connection.StopHeartbeat()
+}
+
+func (suite *StatsSuite) BenchmarkCollectStats(c *C) {
+	connection := OpenConnection("stats-bench-conn", "tcp", "localhost:6379", 1)
+	var queueNames []string
+	for i := 0; i < 500; i++ {
+		queue := connection.OpenQueue(fmt.Sprintf("stats-bench-q%d", i))
+		queue.Publish("stats-bench-d")
+		queueNames = append(queueNames, fmt.Sprintf("stats-bench-q%d", i))
+	}
+
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		CollectStats(queueNames, connection)
+	}
+	c.StopTimer()
+
+	for _, queueName := range queueNames {
+		connection.OpenQueue(queueName).PurgeReady()
+	}
+	connection.StopHeartbeat()
+}
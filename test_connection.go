@@ -3,15 +3,20 @@ package rmq
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 type TestConnection struct {
 	queues *sync.Map
+	locks  *sync.Map
+	topics *sync.Map
 }
 
 func NewTestConnection() TestConnection {
 	return TestConnection{
 		queues: &sync.Map{},
+		locks:  &sync.Map{},
+		topics: &sync.Map{},
 	}
 }
 
@@ -20,10 +25,38 @@ func (connection TestConnection) OpenQueue(name string) Queue {
 	return queue.(*TestQueue)
 }
 
+func (connection TestConnection) OpenQueueWithPriorities(name string, priorities int) Queue {
+	return connection.OpenQueue(name)
+}
+
+// OpenTopic returns a topic which publishes to the bound queues of this test
+// connection
+func (connection TestConnection) OpenTopic(name string) Topic {
+	topic, _ := connection.topics.LoadOrStore(name, &testTopic{})
+	return topic.(*testTopic)
+}
+
+// StartConsumingMulti returns a multi queue which never consumes, like test
+// queues
+func (connection TestConnection) StartConsumingMulti(queues []Queue, prefetchLimit int, pollDuration time.Duration) (MultiQueue, error) {
+	return testMultiQueue{}, nil
+}
+
+func (connection TestConnection) RegisterQueue(name string) bool {
+	return true
+}
+
+func (connection TestConnection) SetAutoRegisterQueues(enabled bool) {
+}
+
 func (connection TestConnection) CollectStats(queueList []string) Stats {
 	return Stats{}
 }
 
+func (connection TestConnection) Overview() (Overview, error) {
+	return Overview{}, nil
+}
+
 func (connection TestConnection) GetDeliveries(queueName string) []string {
 	queue, ok := connection.queues.Load(queueName)
 	if !ok {
@@ -42,6 +75,26 @@ func (connection TestConnection) GetDelivery(queueName string, index int) string
 	return queue.(*TestQueue).LastDeliveries[index]
 }
 
+// GetRejected returns the payload of the rejected delivery at index of the
+// queue, see TestQueue.Consume
+func (connection TestConnection) GetRejected(queueName string, index int) string {
+	queue, ok := connection.queues.Load(queueName)
+	if !ok || index < 0 || index >= len(queue.(*TestQueue).rejected) {
+		return fmt.Sprintf("rmq.TestConnection: rejected delivery not found: %s[%d]", queueName, index)
+	}
+
+	return queue.(*TestQueue).rejected[index]
+}
+
+// RejectedCount returns the number of rejected deliveries of the queue
+func (connection TestConnection) RejectedCount(queueName string) int {
+	queue, ok := connection.queues.Load(queueName)
+	if !ok {
+		return 0
+	}
+	return queue.(*TestQueue).RejectedCount()
+}
+
 func (connection TestConnection) Reset() {
 	connection.queues.Range(func(_, v interface{}) bool {
 		v.(*TestQueue).Reset()
@@ -52,3 +105,137 @@ func (connection TestConnection) Reset() {
 func (connection TestConnection) GetOpenQueues() []string {
 	return []string{}
 }
+
+func (connection TestConnection) GetOpenQueuesE() ([]string, error) {
+	return []string{}, nil
+}
+
+func (connection TestConnection) DiscoverQueues() ([]string, error) {
+	return []string{}, nil
+}
+
+// QueueExists returns whether the queue was opened on this connection
+func (connection TestConnection) QueueExists(name string) (bool, error) {
+	_, ok := connection.queues.Load(name)
+	return ok, nil
+}
+
+func (connection TestConnection) GetConsumingQueuesFor(connectionName string) ([]string, error) {
+	return []string{}, nil
+}
+
+// OpenConnectionForInspection returns this test connection
+func (connection TestConnection) OpenConnectionForInspection(name string) Connection {
+	return connection
+}
+
+func (connection TestConnection) QueuesWithoutConsumers() ([]string, error) {
+	return []string{}, nil
+}
+
+func (connection TestConnection) ReturnUnackedOf(connectionName string) (int, error) {
+	return 0, nil
+}
+
+// Events returns nil, test connections don't emit events
+func (connection TestConnection) Events() <-chan Event {
+	return nil
+}
+
+func (connection TestConnection) DroppedEvents() int64 {
+	return 0
+}
+
+func (connection TestConnection) DeleteQueue(name string) error {
+	return nil
+}
+
+func (connection TestConnection) ForceDeleteQueue(name string) error {
+	return nil
+}
+
+func (connection TestConnection) Verify() (VerifyReport, error) {
+	return VerifyReport{}, nil
+}
+
+func (connection TestConnection) Repair(report VerifyReport) (int, error) {
+	return 0, nil
+}
+
+func (connection TestConnection) Ping() error {
+	return nil
+}
+
+func (connection TestConnection) StopAllConsuming() <-chan struct{} {
+	finishedChan := make(chan struct{})
+	close(finishedChan)
+	return finishedChan
+}
+
+// AcquireLock takes the named lock of this test connection, it never expires
+func (connection TestConnection) AcquireLock(name string, ttl time.Duration) (Lock, error) {
+	if _, taken := connection.locks.LoadOrStore(name, true); taken {
+		return nil, ErrLockTaken
+	}
+	return testLock{locks: connection.locks, name: name}, nil
+}
+
+type testLock struct {
+	locks *sync.Map
+	name  string
+}
+
+func (lock testLock) Release() error {
+	lock.locks.Delete(lock.name)
+	return nil
+}
+
+type testTopic struct {
+	mutex  sync.Mutex
+	queues []Queue
+}
+
+func (topic *testTopic) Bind(queue Queue) error {
+	topic.mutex.Lock()
+	defer topic.mutex.Unlock()
+	for _, bound := range topic.queues {
+		if bound == queue {
+			return nil
+		}
+	}
+	topic.queues = append(topic.queues, queue)
+	return nil
+}
+
+func (topic *testTopic) Unbind(queue Queue) error {
+	topic.mutex.Lock()
+	defer topic.mutex.Unlock()
+	for i, bound := range topic.queues {
+		if bound == queue {
+			topic.queues = append(topic.queues[:i], topic.queues[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (topic *testTopic) Publish(payload string) bool {
+	topic.mutex.Lock()
+	defer topic.mutex.Unlock()
+	for _, queue := range topic.queues {
+		queue.Publish(payload)
+	}
+	return true
+}
+
+type testMultiQueue struct{}
+
+func (multi testMultiQueue) AddMultiConsumer(tag string, consumer MultiConsumer) (string, error) {
+	return "", nil
+}
+
+func (multi testMultiQueue) StopConsuming() <-chan struct{} {
+	finishedChan := make(chan struct{})
+	close(finishedChan)
+	return finishedChan
+}
@@ -2,6 +2,7 @@ package rmq
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/adjust/gocheck"
 )
@@ -16,6 +17,7 @@ func (suite *ConnectionSuite) TestConnection(c *C) {
 	connection := NewTestConnection()
 	var conn Connection
 	c.Check(connection, Implements, &conn)
+	c.Check(connection.Ping(), IsNil)
 	c.Check(connection.GetDelivery("things", 0), Equals, "rmq.TestConnection: delivery not found: things[0]")
 
 	queue := connection.OpenQueue("things")
@@ -39,4 +41,71 @@ func (suite *ConnectionSuite) TestConnection(c *C) {
 	c.Check(queue.Publish("blab"), Equals, true)
 	c.Check(connection.GetDelivery("things", 0), Equals, "blab")
 	c.Check(connection.GetDelivery("things", 1), Equals, "rmq.TestConnection: delivery not found: things[1]")
+
+	lock, err := connection.AcquireLock("things", time.Minute)
+	c.Assert(err, IsNil)
+	_, err = connection.AcquireLock("things", time.Minute)
+	c.Check(err, Equals, ErrLockTaken)
+	c.Check(lock.Release(), IsNil)
+	_, err = connection.AcquireLock("things", time.Minute)
+	c.Check(err, IsNil)
+
+	c.Check(connection.OpenTopic("events").Bind(queue), IsNil)
+	c.Check(connection.OpenTopic("events").Publish("event"), Equals, true)
+	c.Check(connection.GetDelivery("things", 1), Equals, "event")
+}
+
+func (suite *ConnectionSuite) TestConsume(c *C) {
+	connection := NewTestConnection()
+	queue := connection.OpenQueue("things").(*TestQueue)
+	deadLetters := connection.OpenQueue("dead").(*TestQueue)
+	queue.SetPushQueue(deadLetters)
+	c.Check(connection.GetRejected("things", 0), Equals, "rmq.TestConnection: rejected delivery not found: things[0]")
+	c.Check(connection.RejectedCount("things"), Equals, 0)
+
+	queue.Publish("ack", "reject", "push", "requeue", "keep")
+	var kept Delivery
+	c.Check(queue.Consume(ConsumerFunc(func(delivery Delivery) {
+		c.Check(queue.UnackedCount() > 0, Equals, true)
+		switch delivery.Payload() {
+		case "ack":
+			c.Check(delivery.Ack(), Equals, true)
+		case "reject":
+			c.Check(delivery.Reject(), Equals, true)
+			c.Check(delivery.Ack(), Equals, false)
+		case "push":
+			c.Check(delivery.Push(), Equals, true)
+		case "requeue":
+			c.Check(delivery.Nack(true), Equals, true)
+		default:
+			kept = delivery
+		}
+	})), Equals, 5)
+
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(queue.InFlightCount(), Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 1) // requeued
+	c.Check(connection.RejectedCount("things"), Equals, 1)
+	c.Check(connection.GetRejected("things", 0), Equals, "reject")
+	c.Check(connection.GetRejected("things", 1), Equals, "rmq.TestConnection: rejected delivery not found: things[1]")
+	c.Check(connection.GetDeliveries("dead"), DeepEquals, []string{"push"})
+
+	c.Check(kept.Reject(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(connection.GetRejected("things", 1), Equals, "keep")
+
+	// requeued deliveries get consumed again
+	c.Check(queue.Consume(ConsumerFunc(func(delivery Delivery) {
+		c.Check(delivery.Payload(), Equals, "requeue")
+		delivery.Ack()
+	})), Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	c.Check(queue.ReturnAllRejected(), Equals, 2)
+	c.Check(connection.RejectedCount("things"), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	connection.Reset()
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
 }
@@ -1,10 +1,16 @@
 package rmq
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
 
 type TestDelivery struct {
 	State   State
 	payload string
+	headers map[string]string
+	queue   *TestQueue // consumed from, nil if created directly
 }
 
 func NewTestDelivery(content interface{}) *TestDelivery {
@@ -26,30 +32,122 @@ func NewTestDeliveryString(payload string) *TestDelivery {
 	}
 }
 
+// NewTestDeliveryWithHeaders returns a test delivery whose Headers() returns
+// the given headers
+func NewTestDeliveryWithHeaders(payload string, headers map[string]string) *TestDelivery {
+	return &TestDelivery{
+		payload: payload,
+		headers: headers,
+	}
+}
+
 func (delivery *TestDelivery) Payload() string {
 	return delivery.payload
 }
 
-func (delivery *TestDelivery) Ack() bool {
-	if delivery.State == Unacked {
-		delivery.State = Acked
-		return true
+func (delivery *TestDelivery) PayloadBytes() []byte {
+	return []byte(delivery.payload)
+}
+
+func (delivery *TestDelivery) TraceID() string {
+	return ""
+}
+
+func (delivery *TestDelivery) Headers() map[string]string {
+	return delivery.headers
+}
+
+// Decode decodes the payload with the codec of the test queue it was consumed
+// from, RawCodec for deliveries created directly
+func (delivery *TestDelivery) Decode(value interface{}) error {
+	codec := Codec(RawCodec{})
+	if delivery.queue != nil {
+		codec = delivery.queue.getCodec()
 	}
+	return codec.Decode([]byte(delivery.payload), value)
+}
+
+func (delivery *TestDelivery) Expired() bool {
 	return false
 }
 
+func (delivery *TestDelivery) Context() context.Context {
+	return context.Background()
+}
+
+func (delivery *TestDelivery) Attempts() (int, error) {
+	return 1, nil
+}
+
+func (delivery *TestDelivery) Consumer() string {
+	return ""
+}
+
+func (delivery *TestDelivery) Connection() string {
+	return ""
+}
+
+func (delivery *TestDelivery) RejectCount() int {
+	return 0
+}
+
+func (delivery *TestDelivery) Ack() bool {
+	return delivery.settle(Acked)
+}
+
+// AckAndPublish acks the delivery and publishes the payload to the next queue
+func (delivery *TestDelivery) AckAndPublish(nextQueue Queue, payload string) error {
+	if !delivery.settle(Acked) {
+		return fmt.Errorf("rmq.TestDelivery: failed to ack and publish to %s", nextQueue)
+	}
+	nextQueue.Publish(payload)
+	return nil
+}
+
 func (delivery *TestDelivery) Reject() bool {
-	if delivery.State == Unacked {
-		delivery.State = Rejected
-		return true
+	return delivery.settle(Rejected)
+}
+
+func (delivery *TestDelivery) RejectWithError(err error) bool {
+	return delivery.Reject()
+}
+
+func (delivery *TestDelivery) Nack(requeue bool) bool {
+	if !requeue {
+		return delivery.Reject()
 	}
-	return false
+	return delivery.settle(Requeued)
+}
+
+func (delivery *TestDelivery) RequeueFront() bool {
+	return delivery.settle(Requeued)
+}
+
+func (delivery *TestDelivery) RequeueBack() bool {
+	return delivery.settle(Requeued)
+}
+
+func (delivery *TestDelivery) Reply(payload string) error {
+	return nil
+}
+
+func (delivery *TestDelivery) Touch() error {
+	return nil
 }
 
 func (delivery *TestDelivery) Push() bool {
-	if delivery.State == Unacked {
-		delivery.State = Pushed
-		return true
+	return delivery.settle(Pushed)
+}
+
+// settle moves an unacked delivery to the given state and updates the queue
+// it was consumed from, returns false if it wasn't unacked
+func (delivery *TestDelivery) settle(state State) bool {
+	if delivery.State != Unacked {
+		return false
 	}
-	return false
+	delivery.State = state
+	if delivery.queue != nil {
+		delivery.queue.settle(delivery)
+	}
+	return true
 }
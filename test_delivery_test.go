@@ -41,3 +41,20 @@ func (suite *DeliverySuite) TestDeliveryReject(c *C) {
 	c.Check(delivery.Ack(), Equals, false)
 	c.Check(delivery.State, Equals, Rejected)
 }
+
+func (suite *DeliverySuite) TestDeliveryNack(c *C) {
+	delivery := NewTestDelivery("p")
+	c.Check(delivery.Nack(true), Equals, true)
+	c.Check(delivery.State, Equals, Requeued)
+	c.Check(delivery.Nack(true), Equals, false)
+	c.Check(delivery.Ack(), Equals, false)
+
+	delivery = NewTestDelivery("p")
+	c.Check(delivery.Nack(false), Equals, true)
+	c.Check(delivery.State, Equals, Rejected)
+
+	delivery = NewTestDelivery("p")
+	c.Check(delivery.RequeueBack(), Equals, true)
+	c.Check(delivery.State, Equals, Requeued)
+	c.Check(delivery.RequeueFront(), Equals, false)
+}
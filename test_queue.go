@@ -1,10 +1,18 @@
 package rmq
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type TestQueue struct {
 	name           string
 	LastDeliveries []string
+	consumedCount  int // deliveries of LastDeliveries passed to Consume already
+	unackedCount   int
+	rejected       []string
+	pushQueue      *TestQueue // nil for none
+	codec          Codec      // nil for RawCodec
 }
 
 func NewTestQueue(name string) *TestQueue {
@@ -22,6 +30,11 @@ func (queue *TestQueue) Publish(payload ...string) bool {
 	return true
 }
 
+func (queue *TestQueue) PublishE(payload ...string) error {
+	queue.Publish(payload...)
+	return nil
+}
+
 func (queue *TestQueue) PublishBytes(payload ...[]byte) bool {
 	stringifiedBytes := make([]string, len(payload))
 	for i, b := range payload {
@@ -30,39 +43,245 @@ func (queue *TestQueue) PublishBytes(payload ...[]byte) bool {
 	return queue.Publish(stringifiedBytes...)
 }
 
+func (queue *TestQueue) PublishBatch(payloads []string) (int, error) {
+	queue.Publish(payloads...)
+	return len(payloads), nil
+}
+
+func (queue *TestQueue) PublishWithBackpressure(payload string, maxReady int) (bool, error) {
+	if queue.ReadyCount() >= maxReady {
+		return false, nil
+	}
+	return queue.Publish(payload), nil
+}
+
+// PublishValue encodes the value with the codec passed to SetCodec and adds
+// the payload to LastDeliveries
+func (queue *TestQueue) PublishValue(value interface{}) error {
+	data, err := queue.getCodec().Encode(value)
+	if err != nil {
+		return err
+	}
+	queue.Publish(string(data))
+	return nil
+}
+
+func (queue *TestQueue) PublishWithPriority(payload string, priority int) bool {
+	return queue.Publish(payload)
+}
+
+func (queue *TestQueue) PublishWithTrace(payload, traceID string) bool {
+	return queue.Publish(payload)
+}
+
+func (queue *TestQueue) PublishWithHeaders(payload string, headers map[string]string) bool {
+	return queue.Publish(payload)
+}
+
+func (queue *TestQueue) PublishWithContext(ctx context.Context, payload string) bool {
+	return queue.Publish(payload)
+}
+
+func (queue *TestQueue) PublishUnique(dedupKey, payload string, window time.Duration) (bool, error) {
+	return queue.Publish(payload), nil
+}
+
+func (queue *TestQueue) PublishWithTTL(payload string, ttl time.Duration) bool {
+	return queue.Publish(payload)
+}
+
+func (queue *TestQueue) Request(payload, replyQueue string, timeout time.Duration) (string, error) {
+	queue.Publish(payload)
+	return "", nil
+}
+
+// SetPushQueue sets the queue pushed deliveries get published to, only test
+// queues are supported
 func (queue *TestQueue) SetPushQueue(pushQueue Queue) {
+	queue.pushQueue, _ = pushQueue.(*TestQueue)
 }
 
-func (queue *TestQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
-	return true
+func (queue *TestQueue) SetDispatchTimeout(timeout time.Duration) {
+}
+
+func (queue *TestQueue) SetReturnBufferedOnStop(enabled bool) {
+}
+
+func (queue *TestQueue) SetRetryPolicy(policy RetryPolicy) error {
+	return nil
+}
+
+func (queue *TestQueue) SetGlobalConcurrency(n int) {
+}
+
+func (queue *TestQueue) SetPrefetchLimit(prefetchLimit int) {
+}
+
+func (queue *TestQueue) SetAttemptTracking(enabled bool) {
+}
+
+func (queue *TestQueue) SetMaxRejects(maxRejects int) {
+}
+
+func (queue *TestQueue) SetMaxMessageBytes(maxBytes int) {
+}
+
+func (queue *TestQueue) SetCodec(codec Codec) {
+	queue.codec = codec
+}
+
+func (queue *TestQueue) getCodec() Codec {
+	if queue.codec == nil {
+		return RawCodec{}
+	}
+	return queue.codec
+}
+
+func (queue *TestQueue) SetPanicHandler(handler PanicHandler) {
+}
+
+func (queue *TestQueue) SetPropagator(propagator Propagator) {
+}
+
+func (queue *TestQueue) SetLeaseDuration(duration time.Duration) {
+}
+
+func (queue *TestQueue) SetConsumeOrder(order ConsumeOrder) {
+}
+
+func (queue *TestQueue) SetIdleCallback(idleDuration time.Duration, onIdle func()) {
+}
+
+func (queue *TestQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) error {
+	return nil
+}
+
+func (queue *TestQueue) StartConsumingWithContext(ctx context.Context, prefetchLimit int, pollDuration time.Duration) error {
+	return nil
+}
+
+func (queue *TestQueue) StartConsumingWithPollConfig(prefetchLimit int, pollConfig ConsumerPollConfig) error {
+	return nil
+}
+
+func (queue *TestQueue) StartConsumingN(n, prefetchLimit int, pollDuration time.Duration) (<-chan int, error) {
+	return nil, nil
+}
+
+func (queue *TestQueue) StartConsumingRecover(prefetchLimit int, pollDuration time.Duration) (int, error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) ConsumeChannel(prefetchLimit int, pollDuration time.Duration) (<-chan Delivery, error) {
+	return nil, nil
+}
+
+func (queue *TestQueue) PauseConsuming() {
+}
+
+func (queue *TestQueue) ResumeConsuming() {
+}
+
+func (queue *TestQueue) StopConsumingAndWait(ctx context.Context) error {
+	return nil
 }
 
 func (queue *TestQueue) StopConsuming() <-chan struct{} {
 	return nil
 }
 
-func (queue *TestQueue) AddConsumer(tag string, consumer Consumer) string {
-	return ""
+func (queue *TestQueue) Use(middlewares ...Middleware) {
 }
 
-func (queue *TestQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) string {
-	return ""
+func (queue *TestQueue) AddConsumer(tag string, consumer Consumer) (string, error) {
+	return "", nil
 }
 
-func (queue *TestQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
-	return ""
+func (queue *TestQueue) AddConsumerFunc(tag string, consumerFunc ConsumerFunc) (string, error) {
+	return "", nil
 }
 
-func (queue *TestQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
-	return ""
+func (queue *TestQueue) AddConsumerWithConcurrency(tag string, concurrency int, consumer Consumer) ([]string, error) {
+	return nil, nil
 }
 
-func (queue *TestQueue) ReturnRejected(count int) int {
+func (queue *TestQueue) AddConsumerWithRateLimit(tag string, perSecond float64, consumer Consumer) (string, error) {
+	return "", nil
+}
+
+func (queue *TestQueue) AddConsumerWithRateLimiter(tag string, limiter *RateLimiter, consumer Consumer) (string, error) {
+	return "", nil
+}
+
+func (queue *TestQueue) AddConsumerWithDescription(tag, description string, consumer Consumer) (string, error) {
+	return "", nil
+}
+
+func (queue *TestQueue) AddCommitConsumer(tag string, consumer CommitConsumer) (string, error) {
+	return "", nil
+}
+
+func (queue *TestQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) (string, error) {
+	return "", nil
+}
+
+func (queue *TestQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) (string, error) {
+	return "", nil
+}
+
+func (queue *TestQueue) RemoveConsumer(name string) error {
+	return nil
+}
+
+func (queue *TestQueue) WaitEmpty(ctx context.Context) error {
+	return nil
+}
+
+func (queue *TestQueue) Peek(from, count int) ([]string, error) {
+	return []string{}, nil
+}
+
+func (queue *TestQueue) RejectedErrors(count int) ([]RejectedEntry, error) {
+	return []RejectedEntry{}, nil
+}
+
+func (queue *TestQueue) ReturnUnacked(count int) int {
 	return 0
 }
 
+// ReturnRejected publishes up to count rejected deliveries again
+func (queue *TestQueue) ReturnRejected(count int) int {
+	if count > len(queue.rejected) {
+		count = len(queue.rejected)
+	}
+	queue.Publish(queue.rejected[:count]...)
+	queue.rejected = queue.rejected[count:]
+	return count
+}
+
 func (queue *TestQueue) ReturnAllRejected() int {
-	return 0
+	return queue.ReturnRejected(len(queue.rejected))
+}
+
+// ReadyCount returns the number of published deliveries which weren't
+// consumed yet, see LastDeliveries and Consume
+func (queue *TestQueue) ReadyCount() int {
+	return len(queue.LastDeliveries) - queue.consumedCount
+}
+
+func (queue *TestQueue) RejectedCount() int {
+	return len(queue.rejected)
+}
+
+// UnackedCount returns the number of deliveries passed to Consume which
+// weren't acked, rejected, pushed or requeued yet
+func (queue *TestQueue) UnackedCount() int {
+	return queue.unackedCount
+}
+
+// InFlightCount is the same as UnackedCount
+func (queue *TestQueue) InFlightCount() int {
+	return queue.UnackedCount()
 }
 
 func (queue *TestQueue) PurgeReady() int {
@@ -70,7 +289,17 @@ func (queue *TestQueue) PurgeReady() int {
 }
 
 func (queue *TestQueue) PurgeRejected() int {
-	return 0
+	count := len(queue.rejected)
+	queue.rejected = []string{}
+	return count
+}
+
+func (queue *TestQueue) Snapshot() (QueueSnapshot, error) {
+	return QueueSnapshot{}, nil
+}
+
+func (queue *TestQueue) Restore(snapshot QueueSnapshot) error {
+	return nil
 }
 
 func (queue *TestQueue) Close() bool {
@@ -79,4 +308,43 @@ func (queue *TestQueue) Close() bool {
 
 func (queue *TestQueue) Reset() {
 	queue.LastDeliveries = []string{}
+	queue.consumedCount = 0
+	queue.unackedCount = 0
+	queue.rejected = []string{}
+}
+
+// Consume passes the published deliveries which weren't consumed yet to the
+// consumer one after the other and returns how many it passed. Like with a
+// redis queue they stay unacked until the consumer settles them: rejected
+// deliveries end up in the rejected list, pushed ones in the push queue and
+// requeued ones get published again. Requeued deliveries get consumed by the
+// next call.
+func (queue *TestQueue) Consume(consumer Consumer) int {
+	end := len(queue.LastDeliveries)
+	count := 0
+	for ; queue.consumedCount < end; queue.consumedCount++ {
+		delivery := NewTestDeliveryString(queue.LastDeliveries[queue.consumedCount])
+		delivery.queue = queue
+		queue.unackedCount++
+		consumer.Consume(delivery)
+		count++
+	}
+	return count
+}
+
+// settle updates the lists after a consumed delivery left the unacked state
+func (queue *TestQueue) settle(delivery *TestDelivery) {
+	queue.unackedCount--
+	switch delivery.State {
+	case Rejected:
+		queue.rejected = append(queue.rejected, delivery.payload)
+	case Pushed:
+		if queue.pushQueue == nil { // like redis queues reject without push queue
+			queue.rejected = append(queue.rejected, delivery.payload)
+		} else {
+			queue.pushQueue.Publish(delivery.payload)
+		}
+	case Requeued:
+		queue.Publish(delivery.payload)
+	}
 }
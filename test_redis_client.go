@@ -2,6 +2,10 @@ package rmq
 
 import (
 	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -9,8 +13,11 @@ import (
 
 //TestRedisClient is a mock for redis
 type TestRedisClient struct {
-	store sync.Map
-	ttl   sync.Map
+	store         sync.Map
+	ttl           sync.Map
+	scripts       sync.Map // by sha, see ScriptLoad
+	failuresMutex sync.Mutex
+	failures      map[string][]error // by method name, see FailNext
 }
 
 var lock sync.Mutex
@@ -20,10 +27,42 @@ func NewTestRedisClient() *TestRedisClient {
 	return &TestRedisClient{}
 }
 
+// FailNext makes the next call of the method op, like "RPopLPush" or "Set",
+// return err without doing anything. Calling it several times for the same
+// method makes that many calls fail in order. This lets tests exercise the
+// error handling of code using a RedisClient.
+func (client *TestRedisClient) FailNext(op string, err error) {
+	client.failuresMutex.Lock()
+	defer client.failuresMutex.Unlock()
+
+	if client.failures == nil {
+		client.failures = map[string][]error{}
+	}
+	client.failures[op] = append(client.failures[op], err)
+}
+
+// failure returns the next error set with FailNext for the method op, nil if
+// the call should succeed
+func (client *TestRedisClient) failure(op string) error {
+	client.failuresMutex.Lock()
+	defer client.failuresMutex.Unlock()
+
+	errs := client.failures[op]
+	if len(errs) == 0 {
+		return nil
+	}
+	client.failures[op] = errs[1:]
+	return errs[0]
+}
+
 // Set sets key to hold the string value.
 // If key already holds a value, it is overwritten, regardless of its type.
 // Any previous time to live associated with the key is discarded on successful SET operation.
-func (client *TestRedisClient) Set(key string, value string, expiration time.Duration) bool {
+func (client *TestRedisClient) Set(key string, value string, expiration time.Duration) error {
+
+	if err := client.failure("Set"); err != nil {
+		return err
+	}
 
 	lock.Lock()
 	defer lock.Unlock()
@@ -38,7 +77,7 @@ func (client *TestRedisClient) Set(key string, value string, expiration time.Dur
 		client.ttl.Store(key, time.Now().Add(expiration).Unix())
 	}
 
-	return true
+	return nil
 }
 
 // Get the value of key.
@@ -58,16 +97,20 @@ func (client *TestRedisClient) Get(key string) string {
 }
 
 //Del removes the specified key. A key is ignored if it does not exist.
-func (client *TestRedisClient) Del(key string) (affected int, ok bool) {
+func (client *TestRedisClient) Del(key string) (affected int, err error) {
+
+	if err := client.failure("Del"); err != nil {
+		return 0, err
+	}
 
 	_, found := client.store.Load(key)
 	client.store.Delete(key)
 	client.ttl.Delete(key)
 
 	if found {
-		return 1, true
+		return 1, nil
 	}
-	return 0, false
+	return 0, nil
 
 }
 
@@ -77,7 +120,11 @@ func (client *TestRedisClient) Del(key string) (affected int, ok bool) {
 // Starting with Redis 2.8 the return value in case of error changed:
 // The command returns -2 if the key does not exist.
 // The command returns -1 if the key exists but has no associated expire.
-func (client *TestRedisClient) TTL(key string) (ttl time.Duration, ok bool) {
+func (client *TestRedisClient) TTL(key string) (ttl time.Duration, err error) {
+
+	if err := client.failure("TTL"); err != nil {
+		return 0, err
+	}
 
 	//Lookup the expiration map
 	expiration, found := client.ttl.Load(key)
@@ -88,11 +135,11 @@ func (client *TestRedisClient) TTL(key string) (ttl time.Duration, ok bool) {
 		//It was there, but it expired; removing it now
 		if expiration.(int64) < time.Now().Unix() {
 			client.ttl.Delete(key)
-			return -2, false
+			return -2, nil
 		}
 
 		ttl = time.Duration(expiration.(int64) - time.Now().Unix())
-		return ttl, true
+		return ttl, nil
 	}
 
 	//Lookup the store in case this key exists but don't have an expiration
@@ -102,10 +149,10 @@ func (client *TestRedisClient) TTL(key string) (ttl time.Duration, ok bool) {
 	//The key was in store but didn't have an expiration associated
 	//to it.
 	if found {
-		return -1, false
+		return -1, nil
 	}
 
-	return -2, false
+	return -2, nil
 }
 
 // LPush inserts the specified value at the head of the list stored at key.
@@ -114,7 +161,11 @@ func (client *TestRedisClient) TTL(key string) (ttl time.Duration, ok bool) {
 // It is possible to push multiple elements using a single command call just specifying multiple arguments
 // at the end of the command. Elements are inserted one after the other to the head of the list,
 // from the leftmost element to the rightmost element.
-func (client *TestRedisClient) LPush(key string, value ...string) bool {
+func (client *TestRedisClient) LPush(key string, value ...string) error {
+
+	if err := client.failure("LPush"); err != nil {
+		return err
+	}
 
 	lock.Lock()
 	defer lock.Unlock()
@@ -122,23 +173,31 @@ func (client *TestRedisClient) LPush(key string, value ...string) bool {
 	list, err := client.findList(key)
 
 	if err != nil {
-		return false
+		return err
 	}
 
-	client.storeList(key, append(value, list...))
-	return true
+	pushed := make([]string, 0, len(value)+len(list))
+	for i := len(value) - 1; i >= 0; i-- {
+		pushed = append(pushed, value[i])
+	}
+	client.storeList(key, append(pushed, list...))
+	return nil
 }
 
 //LLen returns the length of the list stored at key.
 //If key does not exist, it is interpreted as an empty list and 0 is returned.
 //An error is returned when the value stored at key is not a list.
-func (client *TestRedisClient) LLen(key string) (affected int, ok bool) {
+func (client *TestRedisClient) LLen(key string) (affected int, err error) {
+	if err := client.failure("LLen"); err != nil {
+		return 0, err
+	}
+
 	list, err := client.findList(key)
 
 	if err != nil {
-		return 0, false
+		return 0, err
 	}
-	return len(list), true
+	return len(list), nil
 }
 
 // LRem removes the first count occurrences of elements equal to
@@ -150,16 +209,25 @@ func (client *TestRedisClient) LLen(key string) (affected int, ok bool) {
 // LREM list -2 "hello" will remove the last two occurrences of "hello" in
 // the list stored at list. Note that non-existing keys are treated like empty
 // lists, so when key does not exist, the command will always return 0.
-func (client *TestRedisClient) LRem(key string, count int, value string) (affected int, ok bool) {
+func (client *TestRedisClient) LRem(key string, count int, value string) (affected int, err error) {
+
+	if err := client.failure("LRem"); err != nil {
+		return 0, err
+	}
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	list, err := client.findList(key)
 
-	//Wasn't a list, or is empty
-	if err != nil || len(list) == 0 {
-		return 0, true
+	//Wasn't a list
+	if err != nil {
+		return 0, err
+	}
+
+	//Is empty
+	if len(list) == 0 {
+		return 0, nil
 	}
 
 	//Create a list that have the capacity to store
@@ -168,10 +236,6 @@ func (client *TestRedisClient) LRem(key string, count int, value string) (affect
 	//very long list
 	newList := make([]string, 0, len(list))
 
-	if err != nil {
-		return 0, false
-	}
-
 	//left to right removal of count elements
 	if count >= 0 {
 
@@ -209,7 +273,7 @@ func (client *TestRedisClient) LRem(key string, count int, value string) (affect
 	//store the updated list
 	client.storeList(key, newList)
 
-	return affected, true
+	return affected, nil
 }
 
 // LTrim trims an existing list so that it will contain only the specified range of elements specified.
@@ -221,32 +285,48 @@ func (client *TestRedisClient) LRem(key string, count int, value string) (affect
 // Out of range indexes will not produce an error: if start is larger than the end of the list,
 // or start > end, the result will be an empty list (which causes key to be removed).
 // If end is larger than the end of the list, Redis will treat it like the last element of the list
-func (client *TestRedisClient) LTrim(key string, start, stop int) {
+func (client *TestRedisClient) LTrim(key string, start, stop int) error {
+
+	if err := client.failure("LTrim"); err != nil {
+		return err
+	}
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	list, err := client.findList(key)
 
-	//Wasn't a list, or is empty
-	if err != nil || len(list) == 0 {
-		return
+	//Wasn't a list
+	if err != nil {
+		return err
+	}
+
+	//Is empty
+	if len(list) == 0 {
+		return nil
 	}
 
 	if start < 0 {
 		start += len(list)
 	}
+	if start < 0 {
+		start = 0
+	}
 	if stop < 0 {
 		stop += len(list)
 	}
+	if stop >= len(list) {
+		stop = len(list) - 1
+	}
 
 	//invalid values cause the remove of the key
 	if start > stop {
 		client.store.Delete(key)
-		return
+		return nil
 	}
 
-	client.storeList(key, list[start:stop])
+	client.storeList(key, list[start:stop+1])
+	return nil
 }
 
 // RPopLPush atomically returns and removes the last element (tail) of the list stored at source,
@@ -257,7 +337,11 @@ func (client *TestRedisClient) LTrim(key string, start, stop int) {
 // If source and destination are the same, the operation is equivalent to removing the
 // last element from the list and pushing it as first element of the list,
 // so it can be considered as a list rotation command.
-func (client *TestRedisClient) RPopLPush(source, destination string) (value string, ok bool) {
+func (client *TestRedisClient) RPopLPush(source, destination string) (value string, err error) {
+
+	if err := client.failure("RPopLPush"); err != nil {
+		return "", err
+	}
 
 	lock.Lock()
 	defer lock.Unlock()
@@ -266,8 +350,11 @@ func (client *TestRedisClient) RPopLPush(source, destination string) (value stri
 	destList, destErr := client.findList(destination)
 
 	//One of the two isn't a list
-	if sourceErr != nil || destErr != nil {
-		return "", false
+	if sourceErr != nil {
+		return "", sourceErr
+	}
+	if destErr != nil {
+		return "", destErr
 	}
 	//we have one element to move
 	if len(sourceList) > 0 {
@@ -276,10 +363,41 @@ func (client *TestRedisClient) RPopLPush(source, destination string) (value stri
 		//Put the last element of source (tail) and prepend it to dest
 		client.storeList(destination, append([]string{sourceList[len(sourceList)-1]}, destList...))
 
-		return sourceList[len(sourceList)-1], true
+		return sourceList[len(sourceList)-1], nil
 	}
 
-	return "", false
+	return "", ErrNotFound
+}
+
+// BRPop removes and returns the last element of the list stored at key. If
+// the list is empty it waits up to timeout for an element to arrive and
+// returns ErrNotFound if none did.
+func (client *TestRedisClient) BRPop(timeout time.Duration, key string) (value string, err error) {
+
+	if err := client.failure("BRPop"); err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		lock.Lock()
+		list, err := client.findList(key)
+		if err != nil {
+			lock.Unlock()
+			return "", err
+		}
+		if len(list) > 0 {
+			client.storeList(key, list[:len(list)-1])
+			lock.Unlock()
+			return list[len(list)-1], nil
+		}
+		lock.Unlock()
+
+		if time.Now().After(deadline) {
+			return "", ErrNotFound
+		}
+		time.Sleep(time.Millisecond)
+	}
 }
 
 // LRange returns the specified elements of the list stored at key.
@@ -289,53 +407,72 @@ func (client *TestRedisClient) RPopLPush(source, destination string) (value stri
 // These offsets can also be negative numbers indicating offsets
 // starting at the end of the list. For example, -1 is the last
 // element of the list, -2 the penultimate, and so on.
-func (client *TestRedisClient) LRange(key string, start, end int) []string {
+// Both offsets are inclusive and out of range indexes will not produce an error.
+func (client *TestRedisClient) LRange(key string, start, stop int) (values []string, err error) {
 
-	list, err := client.findList(key)
-	if list == nil || err != nil || len(list) == 0 || end < 0 {
-		return []string{}
+	if err := client.failure("LRange"); err != nil {
+		return nil, err
 	}
 
-	if start >= 0 {
-		if end >= len(list) {
-			end = len(list)
-		}
-		return list[start:end]
+	list, err := client.findList(key)
+	if err != nil {
+		return nil, err
 	}
 
-	if end > -start {
-		return list[len(list)+start:]
+	if start < 0 {
+		start += len(list)
+	}
+	if stop < 0 {
+		stop += len(list)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(list) {
+		stop = len(list) - 1
+	}
+	if start > stop {
+		return []string{}, nil
 	}
 
-	return list[len(list)+start : len(list)+start+end]
-
+	values = make([]string, stop-start+1)
+	copy(values, list[start:stop+1])
+	return values, nil
 }
 
 // SAdd adds the specified members to the set stored at key.
 // Specified members that are already a member of this set are ignored.
 // If key does not exist, a new set is created before adding the specified members.
 // An error is returned when the value stored at key is not a set.
-func (client *TestRedisClient) SAdd(key, value string) bool {
+func (client *TestRedisClient) SAdd(key, value string) error {
+
+	if err := client.failure("SAdd"); err != nil {
+		return err
+	}
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	set, err := client.findSet(key)
 	if err != nil {
-		return false
+		return err
 	}
 
 	set[value] = struct{}{}
 	client.storeSet(key, set)
-	return true
+	return nil
 }
 
 // SMembers returns all the members of the set value stored at key.
 // This has the same effect as running SINTER with one argument key.
-func (client *TestRedisClient) SMembers(key string) (members []string) {
+func (client *TestRedisClient) SMembers(key string) (members []string, err error) {
+	if err := client.failure("SMembers"); err != nil {
+		return nil, err
+	}
+
 	set, err := client.findSet(key)
 	if err != nil {
-		return members
+		return nil, err
 	}
 
 	members = make([]string, 0, len(set))
@@ -343,35 +480,694 @@ func (client *TestRedisClient) SMembers(key string) (members []string) {
 		members = append(members, k)
 	}
 
-	return members
+	return members, nil
+}
+
+// SIsMember returns whether value is a member of the set stored at key.
+// If key does not exist, it is treated as an empty set.
+func (client *TestRedisClient) SIsMember(key, value string) (isMember bool, err error) {
+	if err := client.failure("SIsMember"); err != nil {
+		return false, err
+	}
+
+	set, err := client.findSet(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, isMember = set[value]
+	return isMember, nil
 }
 
 // SRem removes the specified members from the set stored at key.
 // Specified members that are not a member of this set are ignored.
 // If key does not exist, it is treated as an empty set and this command returns 0.
 // An error is returned when the value stored at key is not a set.
-func (client *TestRedisClient) SRem(key, value string) (affected int, ok bool) {
+func (client *TestRedisClient) SRem(key, value string) (affected int, err error) {
+
+	if err := client.failure("SRem"); err != nil {
+		return 0, err
+	}
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	set, err := client.findSet(key)
-	if err != nil || len(set) == 0 {
-		return 0, false
+	if err != nil {
+		return 0, err
 	}
 
 	if _, found := set[value]; found != false {
 		delete(set, value)
-		return 1, true
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+// HGet returns the value of field in the hash stored at key.
+// If key or field don't exist, ErrNotFound is returned.
+func (client *TestRedisClient) HGet(key, field string) (value string, err error) {
+
+	if err := client.failure("HGet"); err != nil {
+		return "", err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	hash, err := client.findHash(key)
+	if err != nil {
+		return "", err
+	}
+
+	intValue, found := hash[field]
+	if !found {
+		return "", ErrNotFound
+	}
+	return strconv.FormatInt(intValue, 10), nil
+}
+
+// HIncrBy increments the number stored at field in the hash stored at key by increment.
+// If key does not exist, a new key holding a hash is created.
+// If field does not exist the value is set to 0 before the operation is performed.
+func (client *TestRedisClient) HIncrBy(key, field string, increment int64) (value int64, err error) {
+
+	if err := client.failure("HIncrBy"); err != nil {
+		return 0, err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	hash, err := client.findHash(key)
+	if err != nil {
+		return 0, err
+	}
+
+	hash[field] += increment
+	client.store.Store(key, hash)
+	return hash[field], nil
+}
+
+// HDel removes the specified field from the hash stored at key.
+// If key does not exist, it is treated as an empty hash and this command returns 0.
+func (client *TestRedisClient) HDel(key, field string) (affected int, err error) {
+
+	if err := client.failure("HDel"); err != nil {
+		return 0, err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	hash, err := client.findHash(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, found := hash[field]; !found {
+		return 0, nil
+	}
+
+	delete(hash, field)
+	if len(hash) == 0 {
+		client.store.Delete(key)
+	}
+	return 1, nil
+}
+
+// testScripts holds go implementations of the lua scripts used by rmq
+var testScripts = map[string]func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error){
+	ackAndPublishScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		unacked, err := client.findList(keys[0])
+		if err != nil {
+			return int64(0), nil
+		}
+		for index, value := range unacked {
+			if value == args[0].(string) {
+				ready, err := client.findList(keys[1])
+				if err != nil {
+					return int64(0), nil
+				}
+				client.storeList(keys[0], append(unacked[:index:index], unacked[index+1:]...))
+				client.storeList(keys[1], append([]string{args[1].(string)}, ready...))
+				for _, key := range keys[2:] {
+					if hash, err := client.findHash(key); err == nil {
+						delete(hash, value)
+						if len(hash) == 0 {
+							client.store.Delete(key)
+						}
+					}
+				}
+				return int64(1), nil
+			}
+		}
+		return int64(0), nil
+	},
+	ackScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		unacked, err := client.findList(keys[0])
+		if err != nil {
+			return int64(0), nil
+		}
+		for index, value := range unacked {
+			if value == args[0].(string) {
+				client.storeList(keys[0], append(unacked[:index:index], unacked[index+1:]...))
+				for _, key := range keys[1:] {
+					if hash, err := client.findHash(key); err == nil {
+						delete(hash, value)
+						if len(hash) == 0 {
+							client.store.Delete(key)
+						}
+					}
+				}
+				return int64(1), nil
+			}
+		}
+		return int64(0), nil
+	},
+	requeueScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		unacked, err := client.findList(keys[0])
+		if err != nil {
+			return int64(0), nil
+		}
+		for index, value := range unacked {
+			if value == args[0].(string) {
+				ready, err := client.findList(keys[1])
+				if err != nil {
+					return int64(0), nil
+				}
+				client.storeList(keys[0], append(unacked[:index:index], unacked[index+1:]...))
+				if args[1].(string) == "RPUSH" {
+					client.storeList(keys[1], append(ready, value))
+				} else {
+					client.storeList(keys[1], append([]string{value}, ready...))
+				}
+				return int64(1), nil
+			}
+		}
+		return int64(0), nil
+	},
+	ackManyScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		removed := make([]interface{}, len(args))
+		unacked, err := client.findList(keys[0])
+		if err != nil {
+			unacked = nil
+		}
+		for i, arg := range args {
+			removed[i] = int64(0)
+			for index, value := range unacked {
+				if value == arg.(string) {
+					unacked = append(unacked[:index:index], unacked[index+1:]...)
+					removed[i] = int64(1)
+					for _, key := range keys[1:] {
+						if hash, err := client.findHash(key); err == nil {
+							delete(hash, value)
+							if len(hash) == 0 {
+								client.store.Delete(key)
+							}
+						}
+					}
+					break
+				}
+			}
+		}
+		if err == nil {
+			client.storeList(keys[0], unacked)
+		}
+		return removed, nil
+	},
+	addUniqueConsumerScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		consumers, err := client.findSet(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		name := args[0].(string)
+		prefix := name[:args[1].(int64)+1]
+		for consumer := range consumers {
+			if len(consumer) == len(name) && strings.HasPrefix(consumer, prefix) {
+				return int64(0), nil
+			}
+		}
+		consumers[name] = struct{}{}
+		client.storeSet(keys[0], consumers)
+		return int64(1), nil
+	},
+	lpopLPushScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		ready, readyErr := client.findList(keys[0])
+		unacked, unackedErr := client.findList(keys[1])
+		if readyErr != nil {
+			return nil, readyErr
+		}
+		if unackedErr != nil {
+			return nil, unackedErr
+		}
+		if len(ready) == 0 {
+			return nil, ErrNotFound
+		}
+		client.storeList(keys[0], ready[1:])
+		client.storeList(keys[1], append([]string{ready[0]}, unacked...))
+		return ready[0], nil
+	},
+	renameListScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		list, err := client.findList(keys[0])
+		if err != nil || len(list) == 0 {
+			return int64(0), nil
+		}
+		client.store.Delete(keys[0])
+		client.storeList(keys[1], list)
+		return int64(len(list)), nil
+	},
+	purgeBatchScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		list, err := client.findList(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		batchSize := int(args[0].(int64))
+		if batchSize > len(list) {
+			batchSize = len(list)
+		}
+		for _, value := range list[len(list)-batchSize:] {
+			for _, key := range keys[1:] {
+				hash, err := client.findHash(key)
+				if err != nil {
+					return nil, err
+				}
+				delete(hash, value)
+				if len(hash) == 0 {
+					client.store.Delete(key)
+				}
+			}
+		}
+		if batchSize == len(list) {
+			client.store.Delete(keys[0])
+		} else {
+			client.storeList(keys[0], list[:len(list)-batchSize])
+		}
+		return "OK", nil
+	},
+	publishWithBackpressureScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		ready, err := client.findList(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(ready)) >= args[0].(int64) {
+			return int64(0), nil
+		}
+		client.storeList(keys[0], append([]string{args[1].(string)}, ready...))
+		return int64(1), nil
+	},
+	publishUniqueScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		if client.exists(keys[0]) {
+			return int64(0), nil
+		}
+		ready, err := client.findList(keys[1])
+		if err != nil {
+			return nil, err
+		}
+		client.store.Store(keys[0], "1")
+		client.ttl.Store(keys[0], time.Now().Add(time.Duration(args[0].(int64))*time.Millisecond).Unix())
+		client.storeList(keys[1], append([]string{args[1].(string)}, ready...))
+		return int64(1), nil
+	},
+	publishTopicScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		for _, key := range keys {
+			ready, err := client.findList(key)
+			if err != nil {
+				return nil, err
+			}
+			client.storeList(key, append([]string{args[0].(string)}, ready...))
+		}
+		return int64(len(keys)), nil
+	},
+	acquireSlotScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		for index, key := range keys {
+			if client.exists(key) {
+				continue
+			}
+			client.store.Store(key, args[0].(string))
+			client.ttl.Store(key, time.Now().Add(time.Duration(args[1].(int64))*time.Millisecond).Unix())
+			return int64(index + 1), nil
+		}
+		return int64(0), nil
+	},
+	refreshLockScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		if value, found := client.store.Load(keys[0]); !found || !client.exists(keys[0]) || value != args[0].(string) {
+			return int64(0), nil
+		}
+		client.ttl.Store(keys[0], time.Now().Add(time.Duration(args[1].(int64))*time.Millisecond).Unix())
+		return int64(1), nil
+	},
+	// sorted sets of leases are stored like hashes with the deadlines as values
+	leaseScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		leases, err := client.findHash(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, found := leases[args[0].(string)]; args[2].(int64) == 1 && !found {
+			return int64(0), nil
+		}
+		leases[args[0].(string)] = time.Now().UnixNano()/int64(time.Millisecond) + args[1].(int64)
+		client.store.Store(keys[0], leases)
+		return int64(1), nil
+	},
+	releaseLeaseScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		leases, err := client.findHash(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, found := leases[args[0].(string)]; !found {
+			return int64(0), nil
+		}
+		delete(leases, args[0].(string))
+		if len(leases) == 0 {
+			client.store.Delete(keys[0])
+		}
+		return int64(1), nil
+	},
+	returnExpiredLeasesScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		leases, err := client.findHash(keys[0])
+		if err != nil || len(leases) == 0 {
+			return int64(0), err
+		}
+		unacked, unackedErr := client.findList(keys[1])
+		ready, readyErr := client.findList(keys[2])
+		if unackedErr != nil {
+			return nil, unackedErr
+		}
+		if readyErr != nil {
+			return nil, readyErr
+		}
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		count := int64(0)
+		for member, deadline := range leases {
+			if deadline > now {
+				continue
+			}
+			delete(leases, member)
+			value := member[args[0].(int64)+1:]
+			for index, unackedValue := range unacked {
+				if unackedValue == value {
+					unacked = append(unacked[:index:index], unacked[index+1:]...)
+					ready = append([]string{value}, ready...)
+					count++
+					break
+				}
+			}
+		}
+		if len(leases) == 0 {
+			client.store.Delete(keys[0])
+		}
+		client.storeList(keys[1], unacked)
+		client.storeList(keys[2], ready)
+		return count, nil
+	},
+	// sorted sets of retries are stored like hashes with the due times as values
+	retryScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		rejected, err := client.findList(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		retry, err := client.findHash(keys[1])
+		if err != nil {
+			return nil, err
+		}
+		retries, err := client.findHash(keys[2])
+		if err != nil {
+			return nil, err
+		}
+		ready, err := client.findList(keys[3])
+		if err != nil {
+			return nil, err
+		}
+		id, maxRetries, batchSize, backoffs := args[0].(string), args[1].(int64), int(args[2].(int64)), args[3:]
+
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		for i := 1; i <= batchSize && len(rejected) > 0; i++ {
+			value := rejected[len(rejected)-1]
+			rejected = rejected[:len(rejected)-1]
+			retries[value]++
+			if retries[value] > maxRetries {
+				delete(retries, value)
+				deadLetter, err := client.findList(keys[4])
+				if err != nil {
+					return nil, err
+				}
+				client.storeList(keys[4], append([]string{value}, deadLetter...))
+				continue
+			}
+			backoff := backoffs[len(backoffs)-1]
+			if retries[value] <= int64(len(backoffs)) {
+				backoff = backoffs[retries[value]-1]
+			}
+			retry[fmt.Sprintf("%s%04d%s", id, i, value)] = now + backoff.(int64)
+		}
+
+		due := []string{}
+		for member, dueAt := range retry {
+			if dueAt <= now {
+				due = append(due, member)
+			}
+		}
+		sort.Slice(due, func(i, j int) bool { return retry[due[i]] < retry[due[j]] })
+		if len(due) > batchSize {
+			due = due[:batchSize]
+		}
+		for _, member := range due {
+			delete(retry, member)
+			ready = append([]string{member[len(id)+4:]}, ready...)
+		}
+
+		client.storeList(keys[0], rejected)
+		client.storeList(keys[3], ready)
+		for key, hash := range map[string]map[string]int64{keys[1]: retry, keys[2]: retries} {
+			if len(hash) == 0 {
+				client.store.Delete(key)
+			} else {
+				client.store.Store(key, hash)
+			}
+		}
+		return int64(len(due)), nil
+	},
+	replyScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		replies, err := client.findList(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		client.storeList(keys[0], append([]string{args[0].(string)}, replies...))
+		client.ttl.Store(keys[0], time.Now().Add(time.Duration(args[1].(int64))*time.Millisecond).Unix())
+		return int64(1), nil
+	},
+	releaseSlotScript: func(client *TestRedisClient, keys []string, args []interface{}) (interface{}, error) {
+		if value, found := client.store.Load(keys[0]); !found || value != args[0].(string) {
+			return int64(0), nil
+		}
+		client.store.Delete(keys[0])
+		client.ttl.Delete(keys[0])
+		return int64(1), nil
+	},
+}
+
+// Pipeline returns a pipeline which runs the commands on Exec, calls fail like
+// the methods of the client, see FailNext
+func (client *TestRedisClient) Pipeline() Pipeline {
+	return &testPipeline{client: client}
+}
+
+type testPipeline struct {
+	client   *TestRedisClient
+	commands []func() error
+}
+
+func (pipeline *testPipeline) LLen(key string, length *int) {
+	pipeline.commands = append(pipeline.commands, func() error {
+		result, err := pipeline.client.LLen(key)
+		if err == nil {
+			*length = result
+		}
+		return err
+	})
+}
+
+func (pipeline *testPipeline) SMembers(key string, members *[]string) {
+	pipeline.commands = append(pipeline.commands, func() error {
+		result, err := pipeline.client.SMembers(key)
+		if err == nil {
+			*members = result
+		}
+		return err
+	})
+}
+
+func (pipeline *testPipeline) TTL(key string, ttl *time.Duration) {
+	pipeline.commands = append(pipeline.commands, func() error {
+		result, err := pipeline.client.TTL(key)
+		if err == nil {
+			*ttl = result
+		}
+		return err
+	})
+}
+
+func (pipeline *testPipeline) Exec() error {
+	var firstErr error
+	for _, command := range pipeline.commands {
+		if err := command(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	pipeline.commands = nil
+	return firstErr
+}
+
+// Eval evaluates a lua script. This implementation can't run lua, instead it
+// runs the go implementation of the given script. Only rmq's own scripts are
+// supported, other scripts fail.
+func (client *TestRedisClient) Eval(script string, keys []string, args ...interface{}) (result interface{}, err error) {
+
+	if err := client.failure("Eval"); err != nil {
+		return nil, err
+	}
+
+	return client.eval(script, keys, args)
+}
+
+func (client *TestRedisClient) eval(script string, keys []string, args []interface{}) (result interface{}, err error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	implementation, found := testScripts[script]
+	if !found {
+		return nil, errors.New("Script isn't supported by the test client")
+	}
+
+	return implementation(client, keys, args)
+}
+
+// EvalSha evaluates a script loaded with ScriptLoad before like Eval. Returns
+// ErrNoScript if there's no script with that sha.
+func (client *TestRedisClient) EvalSha(sha string, keys []string, args ...interface{}) (result interface{}, err error) {
+	if err := client.failure("EvalSha"); err != nil {
+		return nil, err
+	}
+
+	script, found := client.scripts.Load(sha)
+	if !found {
+		return nil, ErrNoScript
+	}
+	return client.eval(script.(string), keys, args)
+}
+
+// ScriptLoad remembers the script for EvalSha and returns its sha. Like Eval
+// it only supports rmq's own scripts.
+func (client *TestRedisClient) ScriptLoad(script string) (sha string, err error) {
+	if err := client.failure("ScriptLoad"); err != nil {
+		return "", err
+	}
+
+	if _, found := testScripts[script]; !found {
+		return "", errors.New("Script isn't supported by the test client")
+	}
+	sha = scriptSha(script)
+	client.scripts.Store(sha, script)
+	return sha, nil
+}
+
+// Ping checks the connection to the server, which always succeeds for this
+// in memory implementation.
+func (client *TestRedisClient) Ping() error {
+	if err := client.failure("Ping"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Scan iterates the set of keys in the currently selected database.
+// This implementation returns all keys matching the glob-style pattern in
+// a single iteration, so the returned cursor is always 0.
+func (client *TestRedisClient) Scan(cursor uint64, match string, count int64) (keys []string, nextCursor uint64, err error) {
+	if err := client.failure("Scan"); err != nil {
+		return nil, 0, err
 	}
 
-	return 0, true
+	keys = []string{}
+	client.store.Range(func(key, _ interface{}) bool {
+		if match == "" || matchPattern(match, key.(string)) {
+			keys = append(keys, key.(string))
+		}
+		return true
+	})
+
+	return keys, 0, nil
 }
 
 // FlushDb delete all the keys of the currently selected DB. This command never fails.
-func (client *TestRedisClient) FlushDb() {
+func (client *TestRedisClient) FlushDb() error {
+	if err := client.failure("FlushDb"); err != nil {
+		return err
+	}
+
 	client.store = *new(sync.Map)
 	client.ttl = *new(sync.Map)
+	return nil
+}
+
+//matchPattern reports whether key matches the glob-style pattern as used by
+//KEYS and SCAN: * matches any sequence, ? any single character, [...] a
+//character class and \ escapes the following character
+func matchPattern(pattern, key string) bool {
+	var expression strings.Builder
+	expression.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch char := pattern[i]; char {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				expression.WriteString(regexp.QuoteMeta(pattern[i:]))
+				i = len(pattern)
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			expression.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			expression.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	expression.WriteString("$")
+
+	matched, err := regexp.MatchString(expression.String(), key)
+	return err == nil && matched
+}
+
+// exists returns whether key holds a value which didn't expire yet
+func (client *TestRedisClient) exists(key string) bool {
+	if _, found := client.store.Load(key); !found {
+		return false
+	}
+
+	if expiration, found := client.ttl.Load(key); found && expiration.(int64) < time.Now().Unix() {
+		client.store.Delete(key)
+		client.ttl.Delete(key)
+		return false
+	}
+	return true
 }
 
 //storeSet stores a set
@@ -398,6 +1194,23 @@ func (client *TestRedisClient) findSet(key string) (map[string]struct{}, error)
 	return make(map[string]struct{}), nil
 }
 
+//findHash returns the hash stored at key.
+//if key doesn't exist, an empty hash is returned
+//an error is returned when the value at key isn't a hash
+func (client *TestRedisClient) findHash(key string) (map[string]int64, error) {
+	storedValue, found := client.store.Load(key)
+	if found {
+		hash, casted := storedValue.(map[string]int64)
+		if casted {
+			return hash, nil
+		}
+
+		return nil, errors.New("Stored value wasn't a hash")
+	}
+
+	return make(map[string]int64), nil
+}
+
 //storeList is an helper function so others don't have to deal with pointers
 func (client *TestRedisClient) storeList(key string, list []string) {
 	client.store.Store(key, &list)
@@ -1,6 +1,7 @@
 package rmq
 
 import (
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -16,7 +17,7 @@ func TestTestRedisClient_Set(t *testing.T) {
 		name   string
 		client *TestRedisClient
 		args   args
-		want   bool
+		want   error
 	}{
 		{
 			"successfull add",
@@ -26,7 +27,7 @@ func TestTestRedisClient_Set(t *testing.T) {
 				"somevalue",
 				time.Duration(0),
 			},
-			true,
+			nil,
 		},
 	}
 	for _, tt := range tests {
@@ -43,13 +44,13 @@ func TestTestRedisClient_Set(t *testing.T) {
 			}
 
 			//delete
-			if affected, found := tt.client.Del(tt.args.key); affected != 1 || found != true {
-				t.Errorf("TestRedisClient.Del(%v) =, want %v, %v", tt.args.key, 1, true)
+			if affected, err := tt.client.Del(tt.args.key); affected != 1 || err != nil {
+				t.Errorf("TestRedisClient.Del(%v) = %v, %v want %v, %v", tt.args.key, affected, err, 1, nil)
 			}
 
 			//delete it again
-			if affected, found := tt.client.Del(tt.args.key); affected != 0 || found != false {
-				t.Errorf("TestRedisClient.Del(%v) =, want %v, %v", tt.args.key, 0, false)
+			if affected, err := tt.client.Del(tt.args.key); affected != 0 || err != nil {
+				t.Errorf("TestRedisClient.Del(%v) = %v, %v want %v, %v", tt.args.key, affected, err, 0, nil)
 			}
 		})
 	}
@@ -64,7 +65,7 @@ func TestTestRedisClient_SAdd(t *testing.T) {
 		name   string
 		client *TestRedisClient
 		args   args
-		want   bool
+		want   error
 	}{
 		{
 			"adding member",
@@ -73,7 +74,7 @@ func TestTestRedisClient_SAdd(t *testing.T) {
 				"somekey",
 				"somevalue",
 			},
-			true,
+			nil,
 		},
 	}
 	for _, tt := range tests {
@@ -86,12 +87,20 @@ func TestTestRedisClient_SAdd(t *testing.T) {
 				t.Errorf("TestRedisClient.SAdd() = %v, want %v", got, tt.want)
 			}
 
-			if got := tt.client.SMembers(tt.args.key); len(got) != 1 || strings.Compare(got[0], tt.args.value) != 0 {
+			if got, err := tt.client.SMembers(tt.args.key); err != nil || len(got) != 1 || strings.Compare(got[0], tt.args.value) != 0 {
 				t.Errorf("TestRedisClient.SMembers(%v) = %v, want %v", tt.args.key, got, []string{tt.args.value})
 			}
 
-			if got, ok := tt.client.SRem(tt.args.key, tt.args.value); got != 1 || ok != true {
-				t.Errorf("TestRedisClient.SRem(%v, %v) = %v, %v, want %v, %v", tt.args.key, tt.args.value, got, ok, 1, true)
+			if got, err := tt.client.SIsMember(tt.args.key, tt.args.value); !got || err != nil {
+				t.Errorf("TestRedisClient.SIsMember(%v, %v) = %v, %v, want %v, %v", tt.args.key, tt.args.value, got, err, true, nil)
+			}
+
+			if got, err := tt.client.SRem(tt.args.key, tt.args.value); got != 1 || err != nil {
+				t.Errorf("TestRedisClient.SRem(%v, %v) = %v, %v, want %v, %v", tt.args.key, tt.args.value, got, err, 1, nil)
+			}
+
+			if got, err := tt.client.SIsMember(tt.args.key, tt.args.value); got || err != nil {
+				t.Errorf("TestRedisClient.SIsMember(%v, %v) = %v, %v, want %v, %v", tt.args.key, tt.args.value, got, err, false, nil)
 			}
 		})
 	}
@@ -106,7 +115,7 @@ func TestTestRedisClient_LPush(t *testing.T) {
 		name   string
 		client *TestRedisClient
 		args   args
-		want   bool
+		want   error
 	}{
 		{
 			"adding to list",
@@ -115,7 +124,7 @@ func TestTestRedisClient_LPush(t *testing.T) {
 				"somekey",
 				"somevalue",
 			},
-			true,
+			nil,
 		},
 	}
 	for _, tt := range tests {
@@ -127,29 +136,63 @@ func TestTestRedisClient_LPush(t *testing.T) {
 			}
 
 			//Len
-			if got, ok := tt.client.LLen(tt.args.key); got != 1 || ok != true {
-				t.Errorf("TestRedisClient.LLen(%v) = %v, %v want %v, %v", tt.args.key, got, ok, 1, true)
+			if got, err := tt.client.LLen(tt.args.key); got != 1 || err != nil {
+				t.Errorf("TestRedisClient.LLen(%v) = %v, %v want %v, %v", tt.args.key, got, err, 1, nil)
 			}
 
 			//Len of non-existing
-			if got, ok := tt.client.LLen(tt.args.key + "nonsense"); got != 0 || ok != true {
-				t.Errorf("TestRedisClient.LLen(%vnonsense) = %v, %v want %v, %v", tt.args.key, got, ok, 0, true)
+			if got, err := tt.client.LLen(tt.args.key + "nonsense"); got != 0 || err != nil {
+				t.Errorf("TestRedisClient.LLen(%vnonsense) = %v, %v want %v, %v", tt.args.key, got, err, 0, nil)
 			}
 
 			//Range
-			if got := tt.client.LRange(tt.args.key, 0, 100); len(got) != 1 || strings.Compare(got[0], tt.args.value) != 0 {
+			if got, err := tt.client.LRange(tt.args.key, 0, 100); err != nil || len(got) != 1 || strings.Compare(got[0], tt.args.value) != 0 {
 				t.Errorf("TestRedisClient.LRange(%v, 0, 100) = %v want %v", tt.args.key, got, []string{tt.args.value})
 			}
+			if got, err := tt.client.LRange(tt.args.key, -1, -1); err != nil || len(got) != 1 || strings.Compare(got[0], tt.args.value) != 0 {
+				t.Errorf("TestRedisClient.LRange(%v, -1, -1) = %v want %v", tt.args.key, got, []string{tt.args.value})
+			}
 
 			//Lrem
-			if got, ok := tt.client.LRem(tt.args.key, 100, tt.args.value); got != 1 || ok != true {
-				t.Errorf("TestRedisClient.LRem(%v, 100, %v) = %v, %v want %v, %v", tt.args.key, tt.args.value, got, ok, 1, true)
+			if got, err := tt.client.LRem(tt.args.key, 100, tt.args.value); got != 1 || err != nil {
+				t.Errorf("TestRedisClient.LRem(%v, 100, %v) = %v, %v want %v, %v", tt.args.key, tt.args.value, got, err, 1, nil)
 			}
 
 			//Len again
-			if got, ok := tt.client.LLen(tt.args.key); got != 0 || ok != true {
-				t.Errorf("TestRedisClient.LLen(%v) = %v, %v want %v, %v", tt.args.key, got, ok, 0, true)
+			if got, err := tt.client.LLen(tt.args.key); got != 0 || err != nil {
+				t.Errorf("TestRedisClient.LLen(%v) = %v, %v want %v, %v", tt.args.key, got, err, 0, nil)
 			}
 		})
 	}
 }
+
+func TestTestRedisClient_FailNext(t *testing.T) {
+	client := NewTestRedisClient()
+	errFirst := errors.New("first")
+	errSecond := errors.New("second")
+	client.FailNext("LPush", errFirst)
+	client.FailNext("LPush", errSecond)
+	client.FailNext("RPopLPush", errFirst)
+
+	//fails in order, then succeeds
+	if got := client.LPush("somekey", "somevalue"); got != errFirst {
+		t.Errorf("TestRedisClient.LPush() = %v, want %v", got, errFirst)
+	}
+	if got := client.LPush("somekey", "somevalue"); got != errSecond {
+		t.Errorf("TestRedisClient.LPush() = %v, want %v", got, errSecond)
+	}
+	if got, err := client.LLen("somekey"); got != 0 || err != nil {
+		t.Errorf("TestRedisClient.LLen(somekey) = %v, %v want %v, %v", got, err, 0, nil)
+	}
+	if got := client.LPush("somekey", "somevalue"); got != nil {
+		t.Errorf("TestRedisClient.LPush() = %v, want %v", got, nil)
+	}
+
+	//other methods aren't affected
+	if got, err := client.RPopLPush("somekey", "otherkey"); got != "" || err != errFirst {
+		t.Errorf("TestRedisClient.RPopLPush(somekey, otherkey) = %v, %v want %v, %v", got, err, "", errFirst)
+	}
+	if got, err := client.RPopLPush("somekey", "otherkey"); got != "somevalue" || err != nil {
+		t.Errorf("TestRedisClient.RPopLPush(somekey, otherkey) = %v, %v want %v, %v", got, err, "somevalue", nil)
+	}
+}
@@ -0,0 +1,102 @@
+package rmq
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pushes the payload (ARGV[1]) to all ready lists (KEYS) in one atomic step,
+// returns the number of lists it was pushed to
+const publishTopicScript = `
+for _, key in ipairs(KEYS) do
+	redis.call("LPUSH", key, ARGV[1])
+end
+return #KEYS
+`
+
+// Topic copies each published delivery to all queues bound to it, see
+// Connection.OpenTopic
+type Topic interface {
+	// Bind makes the queue receive all deliveries published to the topic
+	// from now on, by all connections
+	Bind(queue Queue) error
+	// Unbind stops the queue from receiving deliveries published to the topic
+	Unbind(queue Queue) error
+	// Publish adds a delivery with the given payload to all bound queues.
+	// Returns false if it couldn't be published, but true if there are no
+	// bound queues.
+	Publish(payload string) bool
+}
+
+// redisTopic keeps the names of the bound queues in a set, so all producers
+// publish to the same queues
+type redisTopic struct {
+	name        string
+	namespace   string // prepended to all keys, empty for none
+	queuesKey   string // key to set of bound queues
+	redisClient RedisClient
+	logger      Logger // of the connection the topic was opened with
+}
+
+// OpenTopic returns the topic with the given name. Topics don't need to be
+// registered, a topic exists as long as queues are bound to it.
+func (connection *redisConnection) OpenTopic(name string) Topic {
+	return &redisTopic{
+		name:        name,
+		namespace:   connection.namespace,
+		queuesKey:   strings.Replace(connection.key(topicQueuesTemplate), phTopic, name, 1),
+		redisClient: connection.redisClient,
+		logger:      connection.logger,
+	}
+}
+
+func (topic *redisTopic) String() string {
+	return fmt.Sprintf("[topic %s]", topic.name)
+}
+
+// Bind adds the queue to the set of bound queues. Deliveries get published to
+// its ready list, with priorities they get priority 0.
+func (topic *redisTopic) Bind(queue Queue) error {
+	redisQueue, ok := queue.(*redisQueue)
+	if !ok {
+		return fmt.Errorf("rmq topic can't bind queue %s %s", topic, queue)
+	}
+	if err := topic.redisClient.SAdd(topic.queuesKey, redisQueue.name); err != nil {
+		return fmt.Errorf("rmq topic failed to bind queue %s %s: %w", topic, redisQueue.name, err)
+	}
+	return nil
+}
+
+func (topic *redisTopic) Unbind(queue Queue) error {
+	redisQueue, ok := queue.(*redisQueue)
+	if !ok {
+		return fmt.Errorf("rmq topic can't unbind queue %s %s", topic, queue)
+	}
+	if _, err := topic.redisClient.SRem(topic.queuesKey, redisQueue.name); err != nil {
+		return fmt.Errorf("rmq topic failed to unbind queue %s %s: %w", topic, redisQueue.name, err)
+	}
+	return nil
+}
+
+// Publish pushes the payload to the ready lists of all bound queues in one
+// atomic step, so either all of them or none get the delivery
+func (topic *redisTopic) Publish(payload string) bool {
+	queueNames, err := topic.redisClient.SMembers(topic.queuesKey)
+	if err != nil {
+		topic.logger.Printf("rmq topic failed to get bound queues %s: %s", topic, err)
+		return false
+	}
+	if len(queueNames) == 0 {
+		return true
+	}
+
+	readyKeys := make([]string, 0, len(queueNames))
+	for _, queueName := range queueNames {
+		readyKeys = append(readyKeys, strings.Replace(namespaced(topic.namespace, queueReadyTemplate), phQueue, queueName, 1))
+	}
+	if _, err := runScript(topic.redisClient, publishTopicScript, readyKeys, payload); err != nil {
+		topic.logger.Printf("rmq topic failed to publish %s: %s", topic, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+//go:build go1.21
+
+package rmq
+
+// Type parameters need go1.18, but as go.mod still targets go1.13 only
+// toolchains from go1.21 on compile this file with a newer language version.
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// TypedQueue is a queue bound to a message type. Values get published as JSON
+// and are decoded before they are passed to the consumer.
+type TypedQueue[T any] struct {
+	queue Queue
+}
+
+// NewTyped opens the queue with the given name for values of type T
+func NewTyped[T any](connection Connection, name string) *TypedQueue[T] {
+	return &TypedQueue[T]{queue: connection.OpenQueue(name)}
+}
+
+// Queue returns the underlying queue, use it to start and stop consuming
+func (typed *TypedQueue[T]) Queue() Queue {
+	return typed.queue
+}
+
+// Publish adds a delivery with the JSON encoded value to the queue
+func (typed *TypedQueue[T]) Publish(value T) error {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("rmq typed queue failed to encode %s: %w", typed.queue, err)
+	}
+
+	if ok := typed.queue.PublishBytes(bytes); !ok {
+		return fmt.Errorf("rmq typed queue failed to publish %s", typed.queue)
+	}
+	return nil
+}
+
+// Consume adds a consumer with the given tag which gets called with the
+// decoded value of each delivery and returns its name. Deliveries are acked if
+// the consumer returns nil and rejected otherwise. Deliveries which can't be
+// decoded get rejected without calling the consumer. Returns an error like
+// Queue.AddConsumer.
+func (typed *TypedQueue[T]) Consume(tag string, consumer func(T, Delivery) error) (string, error) {
+	return typed.queue.AddConsumerFunc(tag, func(delivery Delivery) {
+		var value T
+		if err := json.Unmarshal([]byte(delivery.Payload()), &value); err != nil {
+			// log.Printf("rmq typed queue failed to decode %s %s", delivery, err)
+			delivery.Reject()
+			return
+		}
+
+		if err := consumer(value, delivery); err != nil {
+			delivery.Reject()
+			return
+		}
+		delivery.Ack()
+	})
+}
@@ -0,0 +1,72 @@
+//go:build go1.21
+
+package rmq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestTypedSuite(t *testing.T) {
+	TestingSuiteT(&TypedSuite{}, t)
+}
+
+type TypedSuite struct{}
+
+type typedOrder struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+}
+
+func (suite *TypedSuite) TestTyped(c *C) {
+	connection := OpenConnection("typed-conn", "tcp", "localhost:6379", 1)
+	typed := NewTyped[typedOrder](connection, "typed-q")
+	queue := typed.Queue().(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	orders := make(chan typedOrder, 10)
+	c.Assert(queue.StartConsuming(10, time.Millisecond), IsNil)
+	_, err := typed.Consume("typed-cons", func(order typedOrder, delivery Delivery) error {
+		orders <- order
+		if order.Status == "invalid" {
+			return errors.New("invalid order")
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	_, err = typed.Consume("typed-cons", func(order typedOrder, delivery Delivery) error { return nil })
+	c.Check(err, Equals, ErrConsumerTagTaken)
+
+	c.Check(typed.Publish(typedOrder{ID: 1, Status: "paid"}), IsNil)
+	select {
+	case order := <-orders:
+		c.Check(order, Equals, typedOrder{ID: 1, Status: "paid"})
+	case <-time.After(time.Second):
+		c.Fatal("order not consumed")
+	}
+	time.Sleep(5 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+
+	// malformed payloads get rejected without calling the consumer
+	c.Check(queue.Publish("not json"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(orders, HasLen, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	// errors returned by the consumer reject the delivery
+	c.Check(typed.Publish(typedOrder{ID: 2, Status: "invalid"}), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(orders, HasLen, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 2)
+
+	<-queue.StopConsuming()
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
@@ -0,0 +1,216 @@
+package rmq
+
+import (
+	"fmt"
+	"strings"
+)
+
+const scanBatchSize = 100
+
+// OrphanedUnacked is an unacked list of a connection which is not registered
+// in the set of connections anymore
+type OrphanedUnacked struct {
+	Connection string
+	Queue      string
+	Count      int
+}
+
+// OrphanedConsumers is a consumers set of a connection which is not
+// registered in the set of connections anymore
+type OrphanedConsumers struct {
+	Connection string
+	Queue      string
+}
+
+// VerifyReport lists the inconsistencies found by Verify
+type VerifyReport struct {
+	OrphanedUnacked   []OrphanedUnacked
+	OrphanedConsumers []OrphanedConsumers
+}
+
+// Verify looks for unacked lists and consumer sets which belong to
+// connections that are not in the set of connections anymore. The cleaner
+// only visits registered connections, so those keys would never be cleaned
+// up. Use Repair to fix the returned inconsistencies.
+func (connection *redisConnection) Verify() (VerifyReport, error) {
+	report := VerifyReport{}
+	registered, err := connection.registeredConnections()
+	if err != nil {
+		return report, err
+	}
+
+	unackedTemplate := connection.key(connectionQueueUnackedTemplate)
+	unackedKeys, err := scanKeys(connection.redisClient, keyPattern(unackedTemplate))
+	if err != nil {
+		return report, err
+	}
+	for _, key := range unackedKeys {
+		connectionName, queueName, ok := parseConnectionQueueKey(unackedTemplate, key)
+		if !ok || registered[connectionName] {
+			continue
+		}
+
+		count, err := connection.redisClient.LLen(key)
+		if err != nil {
+			return report, fmt.Errorf("rmq connection failed to verify unacked %s %s: %w", connection, key, err)
+		}
+		if count == 0 {
+			continue
+		}
+
+		report.OrphanedUnacked = append(report.OrphanedUnacked, OrphanedUnacked{
+			Connection: connectionName,
+			Queue:      queueName,
+			Count:      count,
+		})
+	}
+
+	consumersTemplate := connection.key(connectionQueueConsumersTemplate)
+	consumersKeys, err := scanKeys(connection.redisClient, keyPattern(consumersTemplate))
+	if err != nil {
+		return report, err
+	}
+	for _, key := range consumersKeys {
+		connectionName, queueName, ok := parseConnectionQueueKey(consumersTemplate, key)
+		if !ok || registered[connectionName] {
+			continue
+		}
+
+		report.OrphanedConsumers = append(report.OrphanedConsumers, OrphanedConsumers{
+			Connection: connectionName,
+			Queue:      queueName,
+		})
+	}
+
+	return report, nil
+}
+
+// Repair returns the orphaned unacked deliveries found by Verify back to the
+// ready lists of their queues and deletes the orphaned consumer sets. It
+// returns the number of returned deliveries plus deleted consumer sets. It's
+// safe to call Repair repeatedly with the same report.
+func (connection *redisConnection) Repair(report VerifyReport) (fixed int, err error) {
+	registered, err := connection.registeredConnections()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, orphaned := range report.OrphanedUnacked {
+		if registered[orphaned.Connection] {
+			continue // connection came back, leave it to the cleaner
+		}
+
+		queue := connection.hijackConnection(orphaned.Connection).openQueue(orphaned.Queue)
+		returned := queue.ReturnAllUnacked()
+		fixed += returned
+		connection.logger.Printf("rmq connection repair returned unacked deliveries %s %d", queue, returned)
+	}
+
+	for _, orphaned := range report.OrphanedConsumers {
+		if registered[orphaned.Connection] {
+			continue
+		}
+
+		queue := connection.hijackConnection(orphaned.Connection).openQueue(orphaned.Queue)
+		if count := queue.RemoveAllConsumers(); count > 0 {
+			fixed++
+			connection.logger.Printf("rmq connection repair deleted consumers %s", queue)
+		}
+	}
+
+	return fixed, nil
+}
+
+func (connection *redisConnection) registeredConnections() (map[string]bool, error) {
+	names, err := connection.redisClient.SMembers(connection.key(connectionsKey))
+	if err != nil {
+		return nil, fmt.Errorf("rmq connection failed to get connections %s: %w", connection, err)
+	}
+
+	registered := map[string]bool{}
+	for _, name := range names {
+		registered[name] = true
+	}
+	return registered, nil
+}
+
+// scanKeys returns all keys matching the given pattern without blocking redis
+func scanKeys(redisClient RedisClient, pattern string) ([]string, error) {
+	keys := []string{}
+	cursor := uint64(0)
+	for {
+		batch, nextCursor, err := redisClient.Scan(cursor, pattern, scanBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("rmq failed to scan keys %s: %w", pattern, err)
+		}
+		keys = append(keys, batch...)
+		if nextCursor == 0 {
+			return keys, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// namespaced prepends the namespace to a key or key template, the empty
+// namespace keeps it as it is
+func namespaced(namespace, template string) string {
+	if namespace == "" {
+		return template
+	}
+	return namespace + "::" + template
+}
+
+// keyPattern turns a key template into a glob pattern matching all keys built
+// from that template
+func keyPattern(template string) string {
+	pattern := template
+	for _, char := range []string{`\`, "*", "?", "[", "]"} {
+		pattern = strings.Replace(pattern, char, `\`+char, -1)
+	}
+	for _, placeholder := range []string{phConnection, phQueue, phConsumer, phSlot, phToken, phPriority, phDedup, phLock} {
+		pattern = strings.Replace(pattern, placeholder, "*", -1)
+	}
+	return pattern
+}
+
+// parseQueueKey extracts the queue name from a key built from a template
+// containing only the queue placeholder
+func parseQueueKey(template, key string) (queueName string, ok bool) {
+	queueIndex := strings.Index(template, phQueue)
+	if queueIndex < 0 {
+		return "", false
+	}
+
+	prefix := template[:queueIndex]
+	suffix := template[queueIndex+len(phQueue):]
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, suffix) || len(key) < len(prefix)+len(suffix) {
+		return "", false
+	}
+
+	return key[len(prefix) : len(key)-len(suffix)], true
+}
+
+// parseConnectionQueueKey extracts the connection and queue name from a key
+// built from a template containing both placeholders
+func parseConnectionQueueKey(template, key string) (connectionName, queueName string, ok bool) {
+	connectionIndex := strings.Index(template, phConnection)
+	queueIndex := strings.Index(template, phQueue)
+	if connectionIndex < 0 || queueIndex < connectionIndex {
+		return "", "", false
+	}
+
+	prefix := template[:connectionIndex]
+	infix := template[connectionIndex+len(phConnection) : queueIndex]
+	suffix := template[queueIndex+len(phQueue):]
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, suffix) || len(key) < len(prefix)+len(suffix) {
+		return "", "", false
+	}
+
+	names := key[len(prefix) : len(key)-len(suffix)]
+	infixIndex := strings.Index(names, infix)
+	if infixIndex < 0 {
+		return "", "", false
+	}
+
+	return names[:infixIndex], names[infixIndex+len(infix):], true
+}
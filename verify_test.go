@@ -0,0 +1,94 @@
+package rmq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+	"github.com/go-redis/redis/v7"
+)
+
+func TestVerifySuite(t *testing.T) {
+	TestingSuiteT(&VerifySuite{}, t)
+}
+
+type VerifySuite struct{}
+
+func (suite *VerifySuite) TestVerifyRepair(c *C) {
+	flushConn := OpenConnection("verify-flush", "tcp", "localhost:6379", 1)
+	flushConn.flushDb()
+	flushConn.StopHeartbeat()
+
+	conn := OpenConnection("verify-conn1", "tcp", "localhost:6379", 1)
+	queue := conn.OpenQueue("verify-q").(*redisQueue)
+	queue.Publish("verify-d1")
+	queue.Publish("verify-d2")
+	queue.Publish("verify-d3")
+
+	consumer := NewTestConsumer("verify-A")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("verify-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 3)
+	c.Check(queue.ReadyCount(), Equals, 0)
+
+	// connection gets removed from the set of connections without its
+	// queues being cleaned, so the cleaner won't find it anymore
+	<-queue.StopConsuming()
+	conn.StopHeartbeat()
+	c.Check(conn.Close(), Equals, true)
+
+	logger := &recordingLogger{}
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	connection, err := OpenConnectionWithConfig("verify-repair", redisClient, ConnectionConfig{Logger: logger})
+	c.Assert(err, IsNil)
+	repairConn := connection.(*redisConnection)
+	_, err = NewCleaner(repairConn).Clean()
+	c.Check(err, IsNil)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	report, err := repairConn.Verify()
+	c.Assert(err, IsNil)
+	c.Check(report.OrphanedUnacked, DeepEquals, []OrphanedUnacked{{Connection: conn.Name, Queue: "verify-q", Count: 3}})
+	c.Check(report.OrphanedConsumers, DeepEquals, []OrphanedConsumers{{Connection: conn.Name, Queue: "verify-q"}})
+
+	fixed, err := repairConn.Repair(report)
+	c.Check(err, IsNil)
+	c.Check(fixed, Equals, 4) // 3 deliveries and 1 consumers set
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.GetConsumers(), HasLen, 0)
+	c.Check(logger.Messages(), DeepEquals, []string{
+		fmt.Sprintf("rmq connection repair returned unacked deliveries [verify-q conn:%s] 3", conn.Name),
+		fmt.Sprintf("rmq connection repair deleted consumers [verify-q conn:%s]", conn.Name),
+	})
+
+	// repairing again doesn't change anything
+	fixed, err = repairConn.Repair(report)
+	c.Check(err, IsNil)
+	c.Check(fixed, Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	report, err = repairConn.Verify()
+	c.Assert(err, IsNil)
+	c.Check(report.OrphanedUnacked, HasLen, 0)
+	c.Check(report.OrphanedConsumers, HasLen, 0)
+
+	repairConn.StopHeartbeat()
+}
+
+func (suite *VerifySuite) TestParseConnectionQueueKey(c *C) {
+	connectionName, queueName, ok := parseConnectionQueueKey(connectionQueueUnackedTemplate, "rmq::connection::conn-ab12Cd::queue::[q::1]::unacked")
+	c.Check(ok, Equals, true)
+	c.Check(connectionName, Equals, "conn-ab12Cd")
+	c.Check(queueName, Equals, "q::1")
+
+	_, _, ok = parseConnectionQueueKey(connectionQueueUnackedTemplate, "rmq::connection::conn-ab12Cd::queue::[q1]::consumers")
+	c.Check(ok, Equals, false)
+
+	c.Check(keyPattern(connectionQueueUnackedTemplate), Equals, `rmq::connection::*::queue::\[*\]::unacked`)
+	c.Check(matchPattern(keyPattern(connectionQueueUnackedTemplate), "rmq::connection::conn-ab12Cd::queue::[q1]::unacked"), Equals, true)
+	c.Check(matchPattern(keyPattern(connectionQueueUnackedTemplate), "rmq::connection::conn-ab12Cd::queue::[q1]::consumers"), Equals, false)
+}